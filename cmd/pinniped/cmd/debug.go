@@ -0,0 +1,22 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+//nolint:gochecknoglobals
+var debugCmd = &cobra.Command{
+	Use:          "debug",
+	Short:        "debug",
+	Long:         "debug subcommands for troubleshooting identity provider configurations (syntax or flags are still subject to change)",
+	SilenceUsage: true, // do not print usage message when commands fail
+	Hidden:       true,
+}
+
+//nolint:gochecknoinits
+func init() {
+	rootCmd.AddCommand(debugCmd)
+}
@@ -0,0 +1,253 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/upstreamldap"
+)
+
+//nolint:gochecknoinits
+func init() {
+	debugCmd.AddCommand(debugLDAPCommand(debugLDAPRealDeps()))
+}
+
+// debugLDAPProvider is the subset of the upstreamldap.Provider which is used by the debug ldap command.
+type debugLDAPProvider interface {
+	TestConnection(ctx context.Context) error
+	DryRunAuthenticateUser(ctx context.Context, username string, grantedScopes []string) (*authenticators.Response, bool, error)
+}
+
+type debugLDAPDeps struct {
+	lookupEnv   func(string) (string, bool)
+	newProvider func(config upstreamldap.ProviderConfig) debugLDAPProvider
+}
+
+func debugLDAPRealDeps() debugLDAPDeps {
+	return debugLDAPDeps{
+		lookupEnv: os.LookupEnv,
+		newProvider: func(config upstreamldap.ProviderConfig) debugLDAPProvider {
+			return upstreamldap.New(config)
+		},
+	}
+}
+
+type debugLDAPFlags struct {
+	host                        string
+	startTLS                    bool
+	caBundlePath                string
+	bindDN                      string
+	bindPasswordEnvName         string
+	userSearchBase              string
+	userSearchFilter            string
+	userSearchUsernameAttribute string
+	userSearchUIDAttribute      string
+	groupSearchBase             string
+	groupSearchFilter           string
+	groupSearchNameAttribute    string
+	username                    string
+	timeout                     time.Duration
+	outputFormat                string
+}
+
+// debugLDAPResult is the output of the debug ldap command.
+type debugLDAPResult struct {
+	Connection debugLDAPConnectionResult `json:"connection"`
+	User       *debugLDAPUserResult      `json:"user,omitempty"`
+}
+
+type debugLDAPConnectionResult struct {
+	Succeeded bool   `json:"succeeded"`
+	ErrorKind string `json:"errorKind,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type debugLDAPUserResult struct {
+	Username       string   `json:"username"`
+	Found          bool     `json:"found"`
+	DN             string   `json:"dn,omitempty"`
+	MappedUsername string   `json:"mappedUsername,omitempty"`
+	UID            string   `json:"uid,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+func debugLDAPCommand(deps debugLDAPDeps) *cobra.Command {
+	cmd := &cobra.Command{
+		Args:  cobra.NoArgs, // do not accept positional arguments for this command
+		Use:   "ldap --host HOST --bind-dn DN [--username USERNAME]",
+		Short: "Test an LDAP identity provider configuration from this machine",
+		Long: here.Doc(`
+			Test an LDAP identity provider configuration from this machine, without creating an LDAPIdentityProvider.
+
+			Connects and binds to the LDAP server as the bind user. When --username is given, also searches for
+			that user and their groups, just like a login would, but without checking the user's password.
+		`),
+		SilenceUsage: true,
+	}
+	flags := &debugLDAPFlags{}
+
+	f := cmd.Flags()
+	f.StringVar(&flags.host, "host", "", "LDAP server host, e.g. 'ldap.example.com:636' or 'ldaps://ldap.example.com'")
+	f.BoolVar(&flags.startTLS, "start-tls", false, "Use StartTLS instead of TLS when the host is not an LDAP URL")
+	f.StringVar(&flags.caBundlePath, "ca-bundle", "", "Path to a PEM CA bundle to trust when connecting to the LDAP server (default: the system's trusted CAs)")
+	f.StringVar(&flags.bindDN, "bind-dn", "", "DN of the bind user")
+	f.StringVar(&flags.bindPasswordEnvName, "bind-password-env", "PINNIPED_LDAP_BIND_PASSWORD", "Environment variable containing the password of the bind user")
+	f.StringVar(&flags.userSearchBase, "user-search-base", "", "Base DN of the user search")
+	f.StringVar(&flags.userSearchFilter, "user-search-filter", "", "Filter of the user search, in which '{}' is replaced by the username")
+	f.StringVar(&flags.userSearchUsernameAttribute, "user-search-username-attribute", "dn", "Attribute of the user entry to use as the username")
+	f.StringVar(&flags.userSearchUIDAttribute, "user-search-uid-attribute", "dn", "Attribute of the user entry to use as the user's unique ID")
+	f.StringVar(&flags.groupSearchBase, "group-search-base", "", "Base DN of the group search (default: skip the group search)")
+	f.StringVar(&flags.groupSearchFilter, "group-search-filter", "", "Filter of the group search, in which '{}' is replaced by the user's DN (default: 'member={}')")
+	f.StringVar(&flags.groupSearchNameAttribute, "group-search-group-name-attribute", "", "Attribute of the group entries to use as the group names (default: 'dn')")
+	f.StringVar(&flags.username, "username", "", "Username of a user to search for (default: only test the connection)")
+	f.DurationVar(&flags.timeout, "timeout", time.Minute, "Timeout for all LDAP operations")
+	f.StringVarP(&flags.outputFormat, "output", "o", "text", "Output format (e.g., 'text', 'json')")
+
+	cmd.RunE = func(cmd *cobra.Command, _ []string) error {
+		return runDebugLDAP(cmd.Context(), cmd.OutOrStdout(), deps, flags)
+	}
+
+	return cmd
+}
+
+func runDebugLDAP(ctx context.Context, output io.Writer, deps debugLDAPDeps, flags *debugLDAPFlags) error {
+	if flags.host == "" {
+		return fmt.Errorf("--host must be set")
+	}
+	if flags.outputFormat != "text" && flags.outputFormat != "json" {
+		return fmt.Errorf("unknown output format: %q", flags.outputFormat)
+	}
+
+	bindPassword := ""
+	if flags.bindDN != "" {
+		var ok bool
+		bindPassword, ok = deps.lookupEnv(flags.bindPasswordEnvName)
+		if !ok {
+			return fmt.Errorf("--bind-password-env variable %q is not set", flags.bindPasswordEnvName)
+		}
+	}
+
+	connectionProtocol := upstreamldap.TLS
+	if flags.startTLS {
+		connectionProtocol = upstreamldap.StartTLS
+	}
+
+	provider := deps.newProvider(upstreamldap.ProviderConfig{
+		Name:               "pinniped-debug-ldap",
+		Host:               flags.host,
+		ConnectionProtocol: connectionProtocol,
+		CABundlePath:       flags.caBundlePath,
+		BindUsername:       flags.bindDN,
+		BindPassword:       bindPassword,
+		UserSearch: upstreamldap.UserSearchConfig{
+			Base:              flags.userSearchBase,
+			Filter:            flags.userSearchFilter,
+			UsernameAttribute: flags.userSearchUsernameAttribute,
+			UIDAttribute:      flags.userSearchUIDAttribute,
+		},
+		GroupSearch: upstreamldap.GroupSearchConfig{
+			Base:               flags.groupSearchBase,
+			Filter:             flags.groupSearchFilter,
+			GroupNameAttribute: flags.groupSearchNameAttribute,
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, flags.timeout)
+	defer cancel()
+
+	result := debugLDAP(ctx, provider, flags.username)
+
+	if err := writeDebugLDAPOutput(output, flags.outputFormat, result); err != nil {
+		return fmt.Errorf("could not write output: %w", err)
+	}
+
+	// Exit with an error after writing the output, so that scripts can check the exit code.
+	if !result.Connection.Succeeded {
+		return fmt.Errorf("could not connect to the LDAP server")
+	}
+	if result.User != nil && !result.User.Found {
+		return fmt.Errorf("could not find the LDAP user %q", flags.username)
+	}
+	return nil
+}
+
+func debugLDAP(ctx context.Context, provider debugLDAPProvider, username string) *debugLDAPResult {
+	result := &debugLDAPResult{}
+
+	if err := provider.TestConnection(ctx); err != nil {
+		result.Connection.Error = err.Error()
+		if kind, ok := upstreamldap.ConnectionErrorKindOf(err); ok {
+			result.Connection.ErrorKind = string(kind)
+		}
+		return result
+	}
+	result.Connection.Succeeded = true
+
+	if username == "" {
+		return result
+	}
+
+	result.User = &debugLDAPUserResult{Username: username}
+	response, found, err := provider.DryRunAuthenticateUser(ctx, username, []string{oidcapi.ScopeGroups})
+	switch {
+	case err != nil:
+		result.User.Error = err.Error()
+	case !found:
+		result.User.Error = "no user was found for this username"
+	default:
+		result.User.Found = true
+		result.User.DN = response.DN
+		result.User.MappedUsername = response.User.GetName()
+		result.User.UID = response.User.GetUID()
+		result.User.Groups = response.User.GetGroups()
+	}
+	return result
+}
+
+func writeDebugLDAPOutput(output io.Writer, outputFormat string, result *debugLDAPResult) error {
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	switch {
+	case result.Connection.Succeeded:
+		fmt.Fprintln(output, "Connection: succeeded")
+	case result.Connection.ErrorKind != "":
+		fmt.Fprintf(output, "Connection: failed (%s)\nError: %s\n", result.Connection.ErrorKind, result.Connection.Error)
+	default:
+		fmt.Fprintf(output, "Connection: failed\nError: %s\n", result.Connection.Error)
+	}
+
+	if result.User == nil {
+		return nil
+	}
+	fmt.Fprintln(output)
+	if !result.User.Found {
+		fmt.Fprintf(output, "User %q: not found\nError: %s\n", result.User.Username, result.User.Error)
+		return nil
+	}
+	fmt.Fprint(output, here.Docf(`
+		User %q: found
+
+		DN: %s
+		Username: %s
+		UID: %s
+		Groups: %s
+`, result.User.Username, result.User.DN, result.User.MappedUsername, result.User.UID, prettyStrings(result.User.Groups)))
+	return nil
+}
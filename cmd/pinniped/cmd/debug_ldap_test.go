@@ -0,0 +1,229 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	"go.pinniped.dev/internal/authenticators"
+	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/upstreamldap"
+)
+
+type fakeDebugLDAPProvider struct {
+	connectionErr error
+	response      *authenticators.Response
+	found         bool
+	authErr       error
+
+	gotUsername      string
+	gotGrantedScopes []string
+}
+
+func (f *fakeDebugLDAPProvider) TestConnection(_ context.Context) error {
+	return f.connectionErr
+}
+
+func (f *fakeDebugLDAPProvider) DryRunAuthenticateUser(_ context.Context, username string, grantedScopes []string) (*authenticators.Response, bool, error) {
+	f.gotUsername = username
+	f.gotGrantedScopes = grantedScopes
+	return f.response, f.found, f.authErr
+}
+
+func TestDebugLDAP(t *testing.T) {
+	foundResponse := &authenticators.Response{
+		User: &user.DefaultInfo{
+			Name:   "some-mapped-username",
+			UID:    "some-uid",
+			Groups: []string{"some-group-0", "some-group-1"},
+		},
+		DN: "cn=some-user,dc=example,dc=com",
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		provider   *fakeDebugLDAPProvider
+		wantConfig *upstreamldap.ProviderConfig
+		wantError  bool
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:       "missing host",
+			args:       []string{},
+			provider:   &fakeDebugLDAPProvider{},
+			wantError:  true,
+			wantStderr: "Error: --host must be set\n",
+		},
+		{
+			name:       "unknown output format",
+			args:       []string{"--host", "ldap.example.com", "-o", "yaml"},
+			provider:   &fakeDebugLDAPProvider{},
+			wantError:  true,
+			wantStderr: "Error: unknown output format: \"yaml\"\n",
+		},
+		{
+			name:       "bind password env var is not set",
+			args:       []string{"--host", "ldap.example.com", "--bind-dn", "cn=bind,dc=example,dc=com"},
+			provider:   &fakeDebugLDAPProvider{},
+			wantError:  true,
+			wantStderr: "Error: --bind-password-env variable \"PINNIPED_LDAP_BIND_PASSWORD\" is not set\n",
+		},
+		{
+			name: "connection succeeds",
+			args: []string{
+				"--host", "ldap.example.com",
+				"--start-tls",
+				"--ca-bundle", "some/ca.pem",
+				"--bind-dn", "cn=bind,dc=example,dc=com",
+				"--bind-password-env", "SOME_PASSWORD_ENV",
+				"--user-search-base", "ou=users,dc=example,dc=com",
+				"--user-search-filter", "uid={}",
+				"--user-search-username-attribute", "uid",
+				"--user-search-uid-attribute", "uidNumber",
+				"--group-search-base", "ou=groups,dc=example,dc=com",
+				"--group-search-filter", "memberUid={}",
+				"--group-search-group-name-attribute", "cn",
+			},
+			env:      map[string]string{"SOME_PASSWORD_ENV": "some-password"},
+			provider: &fakeDebugLDAPProvider{},
+			wantConfig: &upstreamldap.ProviderConfig{
+				Name:               "pinniped-debug-ldap",
+				Host:               "ldap.example.com",
+				ConnectionProtocol: upstreamldap.StartTLS,
+				CABundlePath:       "some/ca.pem",
+				BindUsername:       "cn=bind,dc=example,dc=com",
+				BindPassword:       "some-password",
+				UserSearch: upstreamldap.UserSearchConfig{
+					Base:              "ou=users,dc=example,dc=com",
+					Filter:            "uid={}",
+					UsernameAttribute: "uid",
+					UIDAttribute:      "uidNumber",
+				},
+				GroupSearch: upstreamldap.GroupSearchConfig{
+					Base:               "ou=groups,dc=example,dc=com",
+					Filter:             "memberUid={}",
+					GroupNameAttribute: "cn",
+				},
+			},
+			wantStdout: "Connection: succeeded\n",
+		},
+		{
+			name: "connection fails with a connection error",
+			args: []string{"--host", "ldap.example.com"},
+			provider: &fakeDebugLDAPProvider{
+				connectionErr: &upstreamldap.ConnectionError{Kind: upstreamldap.DialFailed, Err: errors.New("some dial error")},
+			},
+			wantError:  true,
+			wantStdout: "Connection: failed (DialFailed)\nError: some dial error\n",
+			wantStderr: "Error: could not connect to the LDAP server\n",
+		},
+		{
+			name:       "connection fails with another error",
+			args:       []string{"--host", "ldap.example.com"},
+			provider:   &fakeDebugLDAPProvider{connectionErr: errors.New("some other error")},
+			wantError:  true,
+			wantStdout: "Connection: failed\nError: some other error\n",
+			wantStderr: "Error: could not connect to the LDAP server\n",
+		},
+		{
+			name:     "user is found",
+			args:     []string{"--host", "ldap.example.com", "--username", "some-user"},
+			provider: &fakeDebugLDAPProvider{response: foundResponse, found: true},
+			wantStdout: here.Doc(`
+				Connection: succeeded
+
+				User "some-user": found
+
+				DN: cn=some-user,dc=example,dc=com
+				Username: some-mapped-username
+				UID: some-uid
+				Groups: some-group-0, some-group-1
+			`),
+		},
+		{
+			name:       "user is not found",
+			args:       []string{"--host", "ldap.example.com", "--username", "some-user"},
+			provider:   &fakeDebugLDAPProvider{},
+			wantError:  true,
+			wantStdout: "Connection: succeeded\n\nUser \"some-user\": not found\nError: no user was found for this username\n",
+			wantStderr: "Error: could not find the LDAP user \"some-user\"\n",
+		},
+		{
+			name:       "user search fails",
+			args:       []string{"--host", "ldap.example.com", "--username", "some-user"},
+			provider:   &fakeDebugLDAPProvider{authErr: errors.New("some search error")},
+			wantError:  true,
+			wantStdout: "Connection: succeeded\n\nUser \"some-user\": not found\nError: some search error\n",
+			wantStderr: "Error: could not find the LDAP user \"some-user\"\n",
+		},
+		{
+			name:     "json output",
+			args:     []string{"--host", "ldap.example.com", "--username", "some-user", "-o", "json"},
+			provider: &fakeDebugLDAPProvider{response: foundResponse, found: true},
+			wantStdout: here.Doc(`
+				{
+				  "connection": {
+				    "succeeded": true
+				  },
+				  "user": {
+				    "username": "some-user",
+				    "found": true,
+				    "dn": "cn=some-user,dc=example,dc=com",
+				    "mappedUsername": "some-mapped-username",
+				    "uid": "some-uid",
+				    "groups": [
+				      "some-group-0",
+				      "some-group-1"
+				    ]
+				  }
+				}
+			`),
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var gotConfig *upstreamldap.ProviderConfig
+			cmd := debugLDAPCommand(debugLDAPDeps{
+				lookupEnv: func(name string) (string, bool) {
+					value, ok := test.env[name]
+					return value, ok
+				},
+				newProvider: func(config upstreamldap.ProviderConfig) debugLDAPProvider {
+					gotConfig = &config
+					return test.provider
+				},
+			})
+
+			stdout, stderr := bytes.NewBuffer([]byte{}), bytes.NewBuffer([]byte{})
+			cmd.SetOut(stdout)
+			cmd.SetErr(stderr)
+			cmd.SetArgs(test.args)
+
+			err := cmd.Execute()
+			if test.wantError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.wantStdout, stdout.String())
+			require.Equal(t, test.wantStderr, stderr.String())
+			if test.wantConfig != nil {
+				require.Equal(t, test.wantConfig, gotConfig)
+			}
+			if test.provider.gotUsername != "" {
+				require.Equal(t, []string{"groups"}, test.provider.gotGrantedScopes)
+			}
+		})
+	}
+}
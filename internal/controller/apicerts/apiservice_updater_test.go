@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package apicerts
@@ -15,6 +15,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	coretesting "k8s.io/client-go/testing"
@@ -218,31 +219,31 @@ func TestAPIServiceUpdaterControllerSync(t *testing.T) {
 					r.Len(aggregatorAPIClient.Actions(), 2)
 					r.Equal("get", aggregatorAPIClient.Actions()[0].GetVerb())
 					expectedAPIServiceName := loginv1alpha1.SchemeGroupVersion.Version + "." + loginv1alpha1.GroupName
-					expectedUpdateAction := coretesting.NewUpdateAction(
+					expectedPatchAction := coretesting.NewRootPatchAction(
 						schema.GroupVersionResource{
 							Group:    apiregistrationv1.GroupName,
 							Version:  "v1",
 							Resource: "apiservices",
 						},
-						"",
-						&apiregistrationv1.APIService{
-							ObjectMeta: metav1.ObjectMeta{
-								Name:      expectedAPIServiceName,
-								Namespace: "",
-							},
-							Spec: apiregistrationv1.APIServiceSpec{
-								VersionPriority: 1234, // only the CABundle is updated, this other field is left unchanged
-								CABundle:        []byte("fake CA cert"),
-							},
-						},
+						expectedAPIServiceName,
+						types.MergePatchType,
+						[]byte(`{"spec":{"caBundle":"ZmFrZSBDQSBjZXJ0"}}`), // only the CABundle is patched
 					)
-					r.Equal(expectedUpdateAction, aggregatorAPIClient.Actions()[1])
+					r.Equal(expectedPatchAction, aggregatorAPIClient.Actions()[1])
+
+					// The other fields of the APIService are left unchanged.
+					apiService, err := aggregatorAPIClient.ApiregistrationV1().APIServices().Get(context.Background(), expectedAPIServiceName, metav1.GetOptions{})
+					r.NoError(err)
+					r.Equal(apiregistrationv1.APIServiceSpec{
+						VersionPriority: 1234,
+						CABundle:        []byte("fake CA cert"),
+					}, apiService.Spec)
 				})
 
 				when("updating the APIService fails", func() {
 					it.Before(func() {
 						aggregatorAPIClient.PrependReactor(
-							"update",
+							"patch",
 							"apiservices",
 							func(_ coretesting.Action) (bool, runtime.Object, error) {
 								return true, nil, errors.New("update failed")
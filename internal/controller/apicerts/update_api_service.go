@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package apicerts
@@ -6,43 +6,169 @@ package apicerts
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/util/retry"
+	"k8s.io/apimachinery/pkg/types"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
 	aggregatorclient "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+	"k8s.io/utils/pointer"
 )
 
-// UpdateAPIService updates the APIService's CA bundle.
-func UpdateAPIService(ctx context.Context, aggregatorClient aggregatorclient.Interface, apiServiceName, serviceNamespace string, aggregatedAPIServerCA []byte) error {
+const (
+	defaultAPIServiceGroupPriorityMinimum = int32(9900)
+	defaultAPIServiceVersionPriority      = int32(15)
+	defaultAPIServiceServicePort          = int32(443)
+)
+
+// APIServiceOptions are optional settings for UpdateAPIService.
+type APIServiceOptions struct {
+	// CreateWithServiceName, when not empty, causes the APIService to be created when it does not already exist,
+	// pointing at the Service with this name in the service namespace. When empty, it is an error for the
+	// APIService to not exist.
+	CreateWithServiceName string
+
+	// OwnerReference, when not nil, is set on the APIService when it is created, and is added to an existing
+	// APIService which does not already have it. This allows the APIService to be garbage collected when its
+	// owner is deleted.
+	OwnerReference *metav1.OwnerReference
+
+	// GroupPriorityMinimum, when not zero, is set on the APIService when it is created, and is updated on an existing
+	// APIService which has a different value. When zero, a default is used upon create and the existing value is
+	// left unchanged upon update.
+	GroupPriorityMinimum int32
+
+	// VersionPriority, when not zero, is set on the APIService when it is created, and is updated on an existing
+	// APIService which has a different value. When zero, a default is used upon create and the existing value is
+	// left unchanged upon update.
+	VersionPriority int32
+}
+
+// UpdateAPIService updates the APIService's CA bundle, along with the other fields requested by the options:
+//
+//   - The changes are applied using a merge patch which only contains the fields that need to change, so concurrent
+//     changes to any other fields are not clobbered. Nothing is patched when nothing needs to change.
+//   - The GroupPriorityMinimum and VersionPriority are updated when they are set in the options and differ.
+//   - The OwnerReference is appended to the existing owner references when it is missing. Since a merge patch
+//     replaces the whole list, the patch then uses the fetched resourceVersion as a precondition, so a concurrent
+//     change results in a conflict error and the caller should try again later.
+//   - When the APIService does not exist and CreateWithServiceName is set, the APIService is created instead, with
+//     the CA bundle, the OwnerReference, and the priorities from the options, or the defaults of 9900 for the
+//     GroupPriorityMinimum and 15 for the VersionPriority, pointing at port 443 of the named Service.
+//
+// An existing APIService which points at a Service in another namespace is not owned by us, so it is left unchanged.
+func UpdateAPIService(ctx context.Context, aggregatorClient aggregatorclient.Interface, apiServiceName, serviceNamespace string, aggregatedAPIServerCA []byte, opts APIServiceOptions) error {
 	apiServices := aggregatorClient.ApiregistrationV1().APIServices()
 
-	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// Retrieve the latest version of the Service.
-		fetchedAPIService, err := apiServices.Get(ctx, apiServiceName, metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("could not get existing version of API service: %w", err)
-		}
+	fetchedAPIService, err := apiServices.Get(ctx, apiServiceName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) && len(opts.CreateWithServiceName) > 0 {
+		return createAPIService(ctx, aggregatorClient, apiServiceName, serviceNamespace, aggregatedAPIServerCA, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("could not update API service: could not get existing version of API service: %w", err)
+	}
 
-		if serviceRef := fetchedAPIService.Spec.Service; serviceRef != nil {
-			if serviceRef.Namespace != serviceNamespace {
-				// we do not own this API service so do not attempt to mutate it
-				return nil
-			}
+	if serviceRef := fetchedAPIService.Spec.Service; serviceRef != nil {
+		if serviceRef.Namespace != serviceNamespace {
+			// we do not own this API service so do not attempt to mutate it
+			return nil
 		}
+	}
 
-		if bytes.Equal(fetchedAPIService.Spec.CABundle, aggregatedAPIServerCA) {
-			// Already has the same value, perhaps because another process already updated the object, so no need to update.
-			return nil
+	spec := fetchedAPIService.Spec
+	specPatch := map[string]interface{}{}
+	if !bytes.Equal(spec.CABundle, aggregatedAPIServerCA) {
+		specPatch["caBundle"] = aggregatedAPIServerCA // []byte values are base64 encoded by json.Marshal, as expected by the API
+	}
+	if opts.GroupPriorityMinimum != 0 && spec.GroupPriorityMinimum != opts.GroupPriorityMinimum {
+		specPatch["groupPriorityMinimum"] = opts.GroupPriorityMinimum
+	}
+	if opts.VersionPriority != 0 && spec.VersionPriority != opts.VersionPriority {
+		specPatch["versionPriority"] = opts.VersionPriority
+	}
+	needsOwnerReference := opts.OwnerReference != nil && !hasOwnerReference(fetchedAPIService.OwnerReferences, *opts.OwnerReference)
+
+	if len(specPatch) == 0 && !needsOwnerReference {
+		// Already has the same values, perhaps because another process already updated the object, so no need to update.
+		return nil
+	}
+
+	// Patch just the fields we care about, so we cannot clobber concurrent changes made to any other fields.
+	patch := map[string]interface{}{}
+	if len(specPatch) > 0 {
+		patch["spec"] = specPatch
+	}
+	if needsOwnerReference {
+		// A merge patch replaces the whole list, so include the resourceVersion as a precondition to avoid
+		// dropping an owner reference which was concurrently added by someone else. Any resulting conflict
+		// error will cause our caller to try again later.
+		patch["metadata"] = map[string]interface{}{
+			"resourceVersion": fetchedAPIService.ResourceVersion,
+			"ownerReferences": append(fetchedAPIService.OwnerReferences, *opts.OwnerReference),
 		}
+	}
 
-		// Update just the field we care about.
-		fetchedAPIService.Spec.CABundle = aggregatedAPIServerCA
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("could not update API service: %w", err)
+	}
 
-		_, updateErr := apiServices.Update(ctx, fetchedAPIService, metav1.UpdateOptions{})
-		return updateErr
-	}); err != nil {
+	if _, err := apiServices.Patch(ctx, apiServiceName, types.MergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
 		return fmt.Errorf("could not update API service: %w", err)
 	}
 	return nil
 }
+
+func createAPIService(ctx context.Context, aggregatorClient aggregatorclient.Interface, apiServiceName, serviceNamespace string, aggregatedAPIServerCA []byte, opts APIServiceOptions) error {
+	// APIService names are always of the form "version.group".
+	nameParts := strings.SplitN(apiServiceName, ".", 2)
+	if len(nameParts) != 2 {
+		return fmt.Errorf("could not create API service: name %q is not of the form version.group", apiServiceName)
+	}
+	version, group := nameParts[0], nameParts[1]
+
+	groupPriorityMinimum := opts.GroupPriorityMinimum
+	if groupPriorityMinimum == 0 {
+		groupPriorityMinimum = defaultAPIServiceGroupPriorityMinimum
+	}
+	versionPriority := opts.VersionPriority
+	if versionPriority == 0 {
+		versionPriority = defaultAPIServiceVersionPriority
+	}
+
+	apiService := &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Service: &apiregistrationv1.ServiceReference{
+				Namespace: serviceNamespace,
+				Name:      opts.CreateWithServiceName,
+				Port:      pointer.Int32Ptr(defaultAPIServiceServicePort),
+			},
+			Group:                group,
+			Version:              version,
+			CABundle:             aggregatedAPIServerCA,
+			GroupPriorityMinimum: groupPriorityMinimum,
+			VersionPriority:      versionPriority,
+		},
+	}
+	if opts.OwnerReference != nil {
+		apiService.OwnerReferences = []metav1.OwnerReference{*opts.OwnerReference}
+	}
+
+	if _, err := aggregatorClient.ApiregistrationV1().APIServices().Create(ctx, apiService, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("could not create API service: %w", err)
+	}
+	return nil
+}
+
+func hasOwnerReference(ownerReferences []metav1.OwnerReference, ref metav1.OwnerReference) bool {
+	for _, existing := range ownerReferences {
+		if existing.UID == ref.UID {
+			return true
+		}
+	}
+	return false
+}
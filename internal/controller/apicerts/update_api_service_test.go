@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package apicerts
@@ -9,39 +9,52 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	kubetesting "k8s.io/client-go/testing"
 	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
 	aggregatorv1fake "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/fake"
+	"k8s.io/utils/pointer"
 
 	loginv1alpha1 "go.pinniped.dev/generated/latest/apis/concierge/login/v1alpha1"
+	"go.pinniped.dev/internal/testutil"
 )
 
 func TestUpdateAPIService(t *testing.T) {
 	const apiServiceName = "v1alpha1.login.concierge.pinniped.dev"
 
+	ownerRef := metav1.OwnerReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       "some-deployment",
+		UID:        "some-deployment-uid",
+	}
+	otherOwnerRef := metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       "some-namespace",
+		UID:        "some-namespace-uid",
+	}
+
 	tests := []struct {
 		name             string
+		existing         []*apiregistrationv1.APIService
 		mocks            func(*aggregatorv1fake.Clientset)
 		caInput          []byte
 		serviceNamespace string
+		opts             APIServiceOptions
 		wantObjects      []apiregistrationv1.APIService
 		wantErr          string
 	}{
 		{
 			name: "happy path update when the pre-existing APIService did not already have a CA bundle",
-			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec: apiregistrationv1.APIServiceSpec{
-						GroupPriorityMinimum: 999,
-						CABundle:             nil,
-					},
-				})
-			},
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             nil,
+				},
+			}},
 			caInput: []byte("some-ca-bundle"),
 			wantObjects: []apiregistrationv1.APIService{{
 				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
@@ -53,15 +66,13 @@ func TestUpdateAPIService(t *testing.T) {
 		},
 		{
 			name: "happy path update when the pre-existing APIService already had a CA bundle",
-			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec: apiregistrationv1.APIServiceSpec{
-						GroupPriorityMinimum: 999,
-						CABundle:             []byte("some-other-different-ca-bundle"),
-					},
-				})
-			},
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-other-different-ca-bundle"),
+				},
+			}},
 			caInput: []byte("some-ca-bundle"),
 			wantObjects: []apiregistrationv1.APIService{{
 				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
@@ -73,17 +84,15 @@ func TestUpdateAPIService(t *testing.T) {
 		},
 		{
 			name: "happy path update when the pre-existing APIService already has the same CA bundle so there is no need to update",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
 			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec: apiregistrationv1.APIServiceSpec{
-						GroupPriorityMinimum: 999,
-						CABundle:             []byte("some-ca-bundle"),
-					},
-				})
-				c.PrependReactor("update", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
-					return true, nil, fmt.Errorf("should not encounter this error because update should be skipped in this case")
-				})
+				testutil.PrependAPIServiceErrorReactor(c, "patch", fmt.Errorf("should not encounter this error because update should be skipped in this case"))
 			},
 			caInput: []byte("some-ca-bundle"),
 			wantObjects: []apiregistrationv1.APIService{{
@@ -96,20 +105,18 @@ func TestUpdateAPIService(t *testing.T) {
 		},
 		{
 			name: "skip update when there is another pinniped instance",
-			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec: apiregistrationv1.APIServiceSpec{
-						GroupPriorityMinimum: 999,
-						CABundle:             []byte("some-other-different-ca-bundle"),
-						Service: &apiregistrationv1.ServiceReference{
-							Namespace: "namespace-2",
-						},
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-other-different-ca-bundle"),
+					Service: &apiregistrationv1.ServiceReference{
+						Namespace: "namespace-2",
 					},
-				})
-				c.PrependReactor("update", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
-					return true, nil, fmt.Errorf("should not encounter this error because update should be skipped in this case")
-				})
+				},
+			}},
+			mocks: func(c *aggregatorv1fake.Clientset) {
+				testutil.PrependAPIServiceErrorReactor(c, "patch", fmt.Errorf("should not encounter this error because update should be skipped in this case"))
 			},
 			caInput:          []byte("some-ca-bundle"),
 			serviceNamespace: "namespace-1",
@@ -125,69 +132,52 @@ func TestUpdateAPIService(t *testing.T) {
 			}},
 		},
 		{
-			name: "error on update",
+			name: "error on patch",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-other-different-ca-bundle"),
+				},
+			}},
 			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec: apiregistrationv1.APIServiceSpec{
-						GroupPriorityMinimum: 999,
-						CABundle:             []byte("some-other-different-ca-bundle"),
-					},
-				})
-				c.PrependReactor("update", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
-					return true, nil, fmt.Errorf("error on update")
-				})
+				testutil.PrependAPIServiceErrorReactor(c, "patch", fmt.Errorf("error on patch"))
 			},
 			caInput: []byte("some-ca-bundle"),
-			wantErr: "could not update API service: error on update",
+			wantErr: "could not update API service: error on patch",
 		},
 		{
 			name: "error on get",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec:       apiregistrationv1.APIServiceSpec{},
+			}},
 			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec:       apiregistrationv1.APIServiceSpec{},
-				})
-				c.PrependReactor("get", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
-					return true, nil, fmt.Errorf("error on get")
-				})
+				testutil.PrependAPIServiceErrorReactor(c, "get", fmt.Errorf("error on get"))
 			},
 			caInput: []byte("some-ca-bundle"),
 			wantErr: "could not update API service: could not get existing version of API service: error on get",
 		},
 		{
-			name: "conflict error on update, followed by successful retry",
+			name: "concurrent changes to other fields are not clobbered because only the CA bundle is patched",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 111,
+					CABundle:             nil,
+				},
+			}},
 			mocks: func(c *aggregatorv1fake.Clientset) {
-				_ = c.Tracker().Add(&apiregistrationv1.APIService{
-					ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-					Spec: apiregistrationv1.APIServiceSpec{
-						GroupPriorityMinimum: 111,
-						CABundle:             nil,
-					},
-				})
-				hit := false
-				c.PrependReactor("update", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
-					// Return an error on the first call, then fall through to the default (successful) response.
-					if !hit {
-						// Before the update fails, also change the object that will be returned by the next Get(),
-						// to make sure that the production code does a fresh Get() after detecting a conflict.
-						_ = c.Tracker().Update(schema.GroupVersionResource{
-							Group:    apiregistrationv1.GroupName,
-							Version:  apiregistrationv1.SchemeGroupVersion.Version,
-							Resource: "apiservices",
-						}, &apiregistrationv1.APIService{
-							ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
-							Spec: apiregistrationv1.APIServiceSpec{
-								GroupPriorityMinimum: 222,
-								CABundle:             nil,
-							},
-						}, "")
-						hit = true
-						return true, nil, apierrors.NewConflict(schema.GroupResource{
-							Group:    apiregistrationv1.GroupName,
-							Resource: "apiservices",
-						}, apiServiceName, fmt.Errorf("there was a conflict"))
-					}
+				c.PrependReactor("patch", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
+					// Simulate another actor changing the object after our Get() but before our Patch(),
+					// then fall through to the default (successful) response.
+					_ = c.Tracker().Update(testutil.APIServicesGVR, &apiregistrationv1.APIService{
+						ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+						Spec: apiregistrationv1.APIServiceSpec{
+							GroupPriorityMinimum: 222,
+							CABundle:             nil,
+						},
+					}, "")
 					return false, nil, nil
 				})
 			},
@@ -200,6 +190,207 @@ func TestUpdateAPIService(t *testing.T) {
 				},
 			}},
 		},
+		{
+			name:             "error when the APIService does not exist and creation was not requested",
+			caInput:          []byte("some-ca-bundle"),
+			serviceNamespace: "some-namespace",
+			wantErr:          `could not update API service: could not get existing version of API service: apiservices.apiregistration.k8s.io "` + apiServiceName + `" not found`,
+		},
+		{
+			name:             "happy path create when the APIService does not exist",
+			caInput:          []byte("some-ca-bundle"),
+			serviceNamespace: "some-namespace",
+			opts: APIServiceOptions{
+				CreateWithServiceName: "some-service",
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					Service: &apiregistrationv1.ServiceReference{
+						Namespace: "some-namespace",
+						Name:      "some-service",
+						Port:      pointer.Int32Ptr(443),
+					},
+					Group:                loginv1alpha1.GroupName,
+					Version:              loginv1alpha1.SchemeGroupVersion.Version,
+					CABundle:             []byte("some-ca-bundle"),
+					GroupPriorityMinimum: 9900,
+					VersionPriority:      15,
+				},
+			}},
+		},
+		{
+			name:             "happy path create with an owner reference when the APIService does not exist",
+			caInput:          []byte("some-ca-bundle"),
+			serviceNamespace: "some-namespace",
+			opts: APIServiceOptions{
+				CreateWithServiceName: "some-service",
+				OwnerReference:        &ownerRef,
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            apiServiceName,
+					OwnerReferences: []metav1.OwnerReference{ownerRef},
+				},
+				Spec: apiregistrationv1.APIServiceSpec{
+					Service: &apiregistrationv1.ServiceReference{
+						Namespace: "some-namespace",
+						Name:      "some-service",
+						Port:      pointer.Int32Ptr(443),
+					},
+					Group:                loginv1alpha1.GroupName,
+					Version:              loginv1alpha1.SchemeGroupVersion.Version,
+					CABundle:             []byte("some-ca-bundle"),
+					GroupPriorityMinimum: 9900,
+					VersionPriority:      15,
+				},
+			}},
+		},
+		{
+			name:             "happy path create with priorities when the APIService does not exist",
+			caInput:          []byte("some-ca-bundle"),
+			serviceNamespace: "some-namespace",
+			opts: APIServiceOptions{
+				CreateWithServiceName: "some-service",
+				GroupPriorityMinimum:  1234,
+				VersionPriority:       56,
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					Service: &apiregistrationv1.ServiceReference{
+						Namespace: "some-namespace",
+						Name:      "some-service",
+						Port:      pointer.Int32Ptr(443),
+					},
+					Group:                loginv1alpha1.GroupName,
+					Version:              loginv1alpha1.SchemeGroupVersion.Version,
+					CABundle:             []byte("some-ca-bundle"),
+					GroupPriorityMinimum: 1234,
+					VersionPriority:      56,
+				},
+			}},
+		},
+		{
+			name:             "error on create",
+			caInput:          []byte("some-ca-bundle"),
+			serviceNamespace: "some-namespace",
+			opts: APIServiceOptions{
+				CreateWithServiceName: "some-service",
+			},
+			mocks: func(c *aggregatorv1fake.Clientset) {
+				testutil.PrependAPIServiceErrorReactor(c, "create", fmt.Errorf("error on create"))
+			},
+			wantErr: "could not create API service: error on create",
+		},
+		{
+			name: "happy path update when the pre-existing APIService has different priorities than requested",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					VersionPriority:      10,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
+			caInput: []byte("some-ca-bundle"),
+			opts: APIServiceOptions{
+				GroupPriorityMinimum: 1234,
+				VersionPriority:      56,
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 1234,
+					VersionPriority:      56,
+					CABundle:             []byte("some-ca-bundle"), // unchanged
+				},
+			}},
+		},
+		{
+			name: "happy path update when the pre-existing APIService already has the requested priorities so there is no need to update",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 1234,
+					VersionPriority:      56,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
+			mocks: func(c *aggregatorv1fake.Clientset) {
+				testutil.PrependAPIServiceErrorReactor(c, "patch", fmt.Errorf("should not encounter this error because update should be skipped in this case"))
+			},
+			caInput: []byte("some-ca-bundle"),
+			opts: APIServiceOptions{
+				GroupPriorityMinimum: 1234,
+				VersionPriority:      56,
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 1234,
+					VersionPriority:      56,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
+		},
+		{
+			name: "happy path update adds a missing owner reference while preserving existing owner references",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            apiServiceName,
+					OwnerReferences: []metav1.OwnerReference{otherOwnerRef},
+				},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
+			caInput: []byte("some-ca-bundle"),
+			opts: APIServiceOptions{
+				OwnerReference: &ownerRef,
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            apiServiceName,
+					OwnerReferences: []metav1.OwnerReference{otherOwnerRef, ownerRef},
+				},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-ca-bundle"), // unchanged
+				},
+			}},
+		},
+		{
+			name: "happy path update when the pre-existing APIService already has the owner reference and CA bundle so there is no need to update",
+			existing: []*apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            apiServiceName,
+					OwnerReferences: []metav1.OwnerReference{ownerRef},
+				},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
+			mocks: func(c *aggregatorv1fake.Clientset) {
+				testutil.PrependAPIServiceErrorReactor(c, "patch", fmt.Errorf("should not encounter this error because update should be skipped in this case"))
+			},
+			caInput: []byte("some-ca-bundle"),
+			opts: APIServiceOptions{
+				OwnerReference: &ownerRef,
+			},
+			wantObjects: []apiregistrationv1.APIService{{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            apiServiceName,
+					OwnerReferences: []metav1.OwnerReference{ownerRef},
+				},
+				Spec: apiregistrationv1.APIServiceSpec{
+					GroupPriorityMinimum: 999,
+					CABundle:             []byte("some-ca-bundle"),
+				},
+			}},
+		},
 	}
 
 	for _, tt := range tests {
@@ -207,12 +398,12 @@ func TestUpdateAPIService(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
 
-			client := aggregatorv1fake.NewSimpleClientset()
+			client := testutil.NewFakeAggregatorClientset(tt.existing...)
 			if tt.mocks != nil {
 				tt.mocks(client)
 			}
 
-			err := UpdateAPIService(ctx, client, loginv1alpha1.SchemeGroupVersion.Version+"."+loginv1alpha1.GroupName, tt.serviceNamespace, tt.caInput)
+			err := UpdateAPIService(ctx, client, loginv1alpha1.SchemeGroupVersion.Version+"."+loginv1alpha1.GroupName, tt.serviceNamespace, tt.caInput, tt.opts)
 			if tt.wantErr != "" {
 				require.EqualError(t, err, tt.wantErr)
 				return
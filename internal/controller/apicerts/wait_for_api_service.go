@@ -0,0 +1,53 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apicerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	aggregatorclient "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
+)
+
+const apiServiceAvailablePollInterval = 250 * time.Millisecond
+
+// WaitForAPIServiceAvailable polls the APIService until its Available condition is True. When the APIService does
+// not become available before the timeout, or before the context is cancelled, it returns an error which describes
+// the most recently observed state of the APIService.
+func WaitForAPIServiceAvailable(ctx context.Context, aggregatorClient aggregatorclient.Interface, apiServiceName string, timeout time.Duration) error {
+	apiServices := aggregatorClient.ApiregistrationV1().APIServices()
+
+	lastObserved := "APIService was never observed"
+	err := wait.PollImmediateWithContext(ctx, apiServiceAvailablePollInterval, timeout, func(ctx context.Context) (bool, error) {
+		apiService, err := apiServices.Get(ctx, apiServiceName, metav1.GetOptions{})
+		if err != nil {
+			// This may be a transient error, so keep trying until the timeout.
+			lastObserved = fmt.Sprintf("could not get API service: %v", err)
+			return false, nil
+		}
+
+		for _, condition := range apiService.Status.Conditions {
+			if condition.Type != apiregistrationv1.Available {
+				continue
+			}
+			if condition.Status == apiregistrationv1.ConditionTrue {
+				return true, nil
+			}
+			lastObserved = fmt.Sprintf("Available condition has status %q with reason %q and message %q",
+				condition.Status, condition.Reason, condition.Message)
+			return false, nil
+		}
+
+		lastObserved = "APIService does not have an Available condition"
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("API service %q did not become available: %w: %s", apiServiceName, err, lastObserved)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package apicerts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubetesting "k8s.io/client-go/testing"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	aggregatorv1fake "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/fake"
+
+	"go.pinniped.dev/internal/testutil"
+)
+
+func TestWaitForAPIServiceAvailable(t *testing.T) {
+	const apiServiceName = "v1alpha1.login.concierge.pinniped.dev"
+
+	apiServiceWithConditions := func(conditions ...apiregistrationv1.APIServiceCondition) *apiregistrationv1.APIService {
+		return &apiregistrationv1.APIService{
+			ObjectMeta: metav1.ObjectMeta{Name: apiServiceName},
+			Status:     apiregistrationv1.APIServiceStatus{Conditions: conditions},
+		}
+	}
+	available := apiregistrationv1.APIServiceCondition{
+		Type:   apiregistrationv1.Available,
+		Status: apiregistrationv1.ConditionTrue,
+	}
+	unavailable := apiregistrationv1.APIServiceCondition{
+		Type:    apiregistrationv1.Available,
+		Status:  apiregistrationv1.ConditionFalse,
+		Reason:  "FailedDiscoveryCheck",
+		Message: "some discovery error",
+	}
+
+	tests := []struct {
+		name     string
+		existing []*apiregistrationv1.APIService
+		mocks    func(*aggregatorv1fake.Clientset)
+		timeout  time.Duration
+		wantErr  string
+	}{
+		{
+			name:     "already available",
+			existing: []*apiregistrationv1.APIService{apiServiceWithConditions(available)},
+			timeout:  time.Second,
+		},
+		{
+			name:     "becomes available after a few polls",
+			existing: []*apiregistrationv1.APIService{apiServiceWithConditions(unavailable)},
+			mocks: func(c *aggregatorv1fake.Clientset) {
+				gets := 0
+				c.PrependReactor("get", "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
+					gets++
+					if gets == 3 {
+						// Flip the condition, then fall through to the default reactor to read it.
+						_ = c.Tracker().Update(testutil.APIServicesGVR, apiServiceWithConditions(available), "")
+					}
+					return false, nil, nil
+				})
+			},
+			timeout: 10 * time.Second,
+		},
+		{
+			name:     "never becomes available",
+			existing: []*apiregistrationv1.APIService{apiServiceWithConditions(unavailable)},
+			timeout:  time.Second,
+			wantErr: `API service "` + apiServiceName + `" did not become available: timed out waiting for the condition: ` +
+				`Available condition has status "False" with reason "FailedDiscoveryCheck" and message "some discovery error"`,
+		},
+		{
+			name:     "never has an Available condition",
+			existing: []*apiregistrationv1.APIService{apiServiceWithConditions()},
+			timeout:  time.Second,
+			wantErr: `API service "` + apiServiceName + `" did not become available: timed out waiting for the condition: ` +
+				`APIService does not have an Available condition`,
+		},
+		{
+			name:    "error on get",
+			timeout: time.Second,
+			mocks: func(c *aggregatorv1fake.Clientset) {
+				testutil.PrependAPIServiceErrorReactor(c, "get", fmt.Errorf("error on get"))
+			},
+			wantErr: `API service "` + apiServiceName + `" did not become available: timed out waiting for the condition: ` +
+				`could not get API service: error on get`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := testutil.NewFakeAggregatorClientset(tt.existing...)
+			if tt.mocks != nil {
+				tt.mocks(client)
+			}
+
+			err := WaitForAPIServiceAvailable(context.Background(), client, apiServiceName, tt.timeout)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestWaitForAPIServiceAvailableContextCancelled(t *testing.T) {
+	client := testutil.NewFakeAggregatorClientset(&apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{Name: "v1alpha1.login.concierge.pinniped.dev"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := WaitForAPIServiceAvailable(ctx, client, "v1alpha1.login.concierge.pinniped.dev", time.Minute)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `API service "v1alpha1.login.concierge.pinniped.dev" did not become available`)
+}
@@ -47,6 +47,10 @@ type accessTokenStorage struct {
 type Session struct {
 	Request *fosite.Request `json:"request"`
 	Version string          `json:"version"`
+
+	// GrantTypes are the grant types of the token request which issued the access token, when they were known.
+	// Adding this optional field did not require a new version, since older sessions simply do not have it.
+	GrantTypes fosite.Arguments `json:"grantTypes,omitempty"`
 }
 
 func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
@@ -83,7 +87,7 @@ func (a *accessTokenStorage) CreateAccessTokenSession(ctx context.Context, signa
 	_, err = a.storage.Create(
 		ctx,
 		signature,
-		&Session{Request: request, Version: accessTokenStorageVersion},
+		&Session{Request: request, Version: accessTokenStorageVersion, GrantTypes: fositestorage.GrantTypesFromContext(ctx)},
 		map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()},
 		nil,
 	)
@@ -97,6 +101,10 @@ func (a *accessTokenStorage) GetAccessTokenSession(ctx context.Context, signatur
 		return nil, err
 	}
 
+	if len(session.GrantTypes) > 0 {
+		// Let the caller find out how the access token was obtained, e.g. so the token exchange can check it.
+		return &fosite.AccessRequest{GrantTypes: session.GrantTypes, Request: *session.Request}, nil
+	}
 	return session.Request, err
 }
 
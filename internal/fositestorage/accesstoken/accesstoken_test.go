@@ -21,6 +21,7 @@ import (
 	coretesting "k8s.io/client-go/testing"
 	clocktesting "k8s.io/utils/clock/testing"
 
+	"go.pinniped.dev/internal/fositestorage"
 	"go.pinniped.dev/internal/oidc/clientregistry"
 	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
@@ -107,6 +108,29 @@ func TestAccessTokenStorage(t *testing.T) {
 	require.Equal(t, wantActions, client.Actions())
 }
 
+func TestAccessTokenStorageRecordsGrantTypes(t *testing.T) {
+	ctx, client, _, storage := makeTestSubject()
+
+	request := &fosite.Request{
+		ID:      "abcd-1",
+		Client:  &clientregistry.Client{},
+		Session: testutil.NewFakePinnipedSession(),
+	}
+	err := storage.CreateAccessTokenSession(fositestorage.WithGrantTypes(ctx, fosite.Arguments{"authorization_code"}), "fancy-signature", request)
+	require.NoError(t, err)
+
+	createAction := client.Actions()[0].(coretesting.CreateActionImpl)
+	require.Contains(t, string(createAction.Object.(*corev1.Secret).Data["pinniped-storage-data"]), `"grantTypes":["authorization_code"]`)
+
+	newRequest, err := storage.GetAccessTokenSession(ctx, "fancy-signature", nil)
+	require.NoError(t, err)
+	accessRequest, ok := newRequest.(*fosite.AccessRequest)
+	require.True(t, ok)
+	require.Equal(t, fosite.Arguments{"authorization_code"}, accessRequest.GetGrantTypes())
+	require.Equal(t, request.GetID(), accessRequest.GetID())
+	require.Equal(t, request.GetSession(), accessRequest.GetSession())
+}
+
 func TestAccessTokenStorageRevocation(t *testing.T) {
 	wantActions := []coretesting.Action{
 		coretesting.NewCreateAction(secretsGVR, namespace, &corev1.Secret{
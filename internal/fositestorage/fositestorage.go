@@ -4,6 +4,8 @@
 package fositestorage
 
 import (
+	"context"
+
 	"github.com/ory/fosite"
 
 	"go.pinniped.dev/internal/constable"
@@ -18,6 +20,21 @@ const (
 	StorageRequestIDLabelName = "storage.pinniped.dev/request-id"
 )
 
+// grantTypesContextKey is the key under which WithGrantTypes stores the grant types in a context.
+type grantTypesContextKey struct{}
+
+// WithGrantTypes returns a copy of the context which holds the grant types of the token request being handled, so
+// that the storage can record how each access token was obtained.
+func WithGrantTypes(ctx context.Context, grantTypes fosite.Arguments) context.Context {
+	return context.WithValue(ctx, grantTypesContextKey{}, grantTypes)
+}
+
+// GrantTypesFromContext returns the grant types which were added to the context by WithGrantTypes, or nil.
+func GrantTypesFromContext(ctx context.Context) fosite.Arguments {
+	grantTypes, _ := ctx.Value(grantTypesContextKey{}).(fosite.Arguments)
+	return grantTypes
+}
+
 func ValidateAndExtractAuthorizeRequest(requester fosite.Requester) (*fosite.Request, error) {
 	request, ok1 := requester.(*fosite.Request)
 	if !ok1 {
@@ -137,7 +137,7 @@ func handleAuthRequestForLDAPUpstreamCLIFlow(
 	authenticateResponse, authenticated, err := ldapUpstream.AuthenticateUser(r.Context(), username, password, authorizeRequester.GetGrantedScopes())
 	if err != nil {
 		plog.WarningErr("unexpected error during upstream LDAP authentication", err, "upstreamName", ldapUpstream.GetName())
-		return httperr.New(http.StatusBadGateway, "unexpected error during upstream authentication")
+		return httperr.New(http.StatusBadGateway, upstreamUserFacingErrorMessage(ldapUpstream, err))
 	}
 	if !authenticated {
 		oidc.WriteAuthorizeError(w, oauthHelper, authorizeRequester,
@@ -156,6 +156,17 @@ func handleAuthRequestForLDAPUpstreamCLIFlow(
 	return nil
 }
 
+// upstreamUserFacingErrorMessage returns the upstream's own message for the error when the upstream has one,
+// or else the generic message.
+func upstreamUserFacingErrorMessage(upstream interface{}, err error) string {
+	if messager, ok := upstream.(provider.UpstreamUserFacingErrorMessager); ok {
+		if message := messager.UserFacingErrorMessage(err); message != "" {
+			return message
+		}
+	}
+	return "unexpected error during upstream authentication"
+}
+
 func handleAuthRequestForLDAPUpstreamBrowserFlow(
 	r *http.Request,
 	w http.ResponseWriter,
@@ -345,6 +345,21 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		},
 	}
 
+	unreachableLDAPErr := fmt.Errorf("some dial error")
+	unreachableUpstreamLDAPIdentityProvider := oidctestutil.TestUpstreamLDAPIdentityProvider{
+		Name:        ldapUpstreamName,
+		ResourceUID: ldapUpstreamResourceUID,
+		AuthenticateFunc: func(ctx context.Context, username, password string) (*authenticators.Response, bool, error) {
+			return nil, false, unreachableLDAPErr
+		},
+		UserFacingErrorMessageFunc: func(err error) string {
+			if err == unreachableLDAPErr {
+				return "the LDAP server could not be reached, please try again later"
+			}
+			return ""
+		},
+	}
+
 	happyCSRF := "test-csrf"
 	happyPKCE := "test-pkce"
 	happyNonce := "test-nonce"
@@ -1278,6 +1293,17 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantContentType:      htmlContentType,
 			wantBodyString:       "Bad Gateway: unexpected error during upstream authentication\n",
 		},
+		{
+			name:                 "upstream LDAP server cannot be reached during authentication",
+			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithLDAP(&unreachableUpstreamLDAPIdentityProvider),
+			method:               http.MethodGet,
+			path:                 happyGetRequestPath,
+			customUsernameHeader: pointer.StringPtr(happyLDAPUsername),
+			customPasswordHeader: pointer.StringPtr(happyLDAPPassword),
+			wantStatus:           http.StatusBadGateway,
+			wantContentType:      htmlContentType,
+			wantBodyString:       "Bad Gateway: the LDAP server could not be reached, please try again later\n",
+		},
 		{
 			name:                 "error during upstream Active Directory authentication",
 			idps:                 oidctestutil.NewUpstreamIDPListerBuilder().WithActiveDirectory(&erroringUpstreamLDAPIdentityProvider),
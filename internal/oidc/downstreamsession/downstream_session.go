@@ -14,6 +14,8 @@ import (
 	"github.com/ory/fosite/handler/openid"
 	"github.com/ory/fosite/token/jwt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/utils/strings/slices"
 
 	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
@@ -298,6 +300,65 @@ func ExtractStringClaimValue(claimName string, upstreamIDPName string, idTokenCl
 	return valueAsString, nil
 }
 
+// IdentityClaimNames are the names of the claims from which MapClaimsToIdentity reads an identity.
+type IdentityClaimNames struct {
+	// UsernameClaim is the name of the claim which holds the username. Empty means to use the UIDClaim.
+	UsernameClaim string
+
+	// UIDClaim is the name of the claim which holds the unique ID of the user. Empty means to use "sub".
+	UIDClaim string
+
+	// GroupsClaim is the name of the claim which holds the group names, as either a string or a list of strings.
+	// Empty means that the identity has no groups.
+	GroupsClaim string
+}
+
+// MapClaimsToIdentity maps the claims of an ID token to an identity in the same shape as the responses of the
+// LDAP and Active Directory user authenticators, so that identities from all types of IDPs can be handled alike.
+// The username and UID claims are required to be non-empty strings. The groups claim is optional, since IDPs may
+// omit it for users without groups, and empty group names are ignored. The groups are de-duplicated and sorted.
+func MapClaimsToIdentity(claims map[string]interface{}, claimNames IdentityClaimNames, upstreamIDPName string) (*authenticators.Response, error) {
+	uidClaimName := claimNames.UIDClaim
+	if uidClaimName == "" {
+		uidClaimName = oidcapi.IDTokenClaimSubject
+	}
+	usernameClaimName := claimNames.UsernameClaim
+	if usernameClaimName == "" {
+		usernameClaimName = uidClaimName
+	}
+
+	uid, err := ExtractStringClaimValue(uidClaimName, upstreamIDPName, claims)
+	if err != nil {
+		return nil, err
+	}
+	username, err := ExtractStringClaimValue(usernameClaimName, upstreamIDPName, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	if groupsAsInterface, ok := claims[claimNames.GroupsClaim]; claimNames.GroupsClaim != "" && ok {
+		groupsAsArray, okAsArray := extractGroups(groupsAsInterface)
+		if !okAsArray {
+			plog.Warning(
+				"groups claim in upstream ID token has invalid format",
+				"upstreamName", upstreamIDPName,
+				"configuredGroupsClaim", claimNames.GroupsClaim,
+			)
+			return nil, requiredClaimInvalidFormatErr
+		}
+		groups = sets.NewString(groupsAsArray...).Delete("").List()
+	}
+
+	return &authenticators.Response{
+		User: &user.DefaultInfo{
+			Name:   username,
+			UID:    uid,
+			Groups: groups,
+		},
+	}, nil
+}
+
 func DownstreamSubjectFromUpstreamLDAP(ldapUpstream provider.UpstreamLDAPIdentityProviderI, authenticateResponse *authenticators.Response) string {
 	ldapURL := *ldapUpstream.GetURL()
 	return DownstreamLDAPSubject(authenticateResponse.User.GetUID(), ldapURL)
@@ -0,0 +1,94 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package downstreamsession
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	"go.pinniped.dev/internal/authenticators"
+)
+
+func TestMapClaimsToIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     map[string]interface{}
+		claimNames IdentityClaimNames
+		wantUser   *user.DefaultInfo
+		wantErr    string
+	}{
+		{
+			name:     "uses the sub claim for the username and UID by default",
+			claims:   map[string]interface{}{"sub": "some-subject", "groups": []interface{}{"a"}},
+			wantUser: &user.DefaultInfo{Name: "some-subject", UID: "some-subject", Groups: []string{}},
+		},
+		{
+			name: "uses the configured claims",
+			claims: map[string]interface{}{
+				"sub":    "some-subject",
+				"email":  "someone@example.com",
+				"oid":    "some-object-id",
+				"groups": []interface{}{"b", "a", "", "b"},
+			},
+			claimNames: IdentityClaimNames{UsernameClaim: "email", UIDClaim: "oid", GroupsClaim: "groups"},
+			wantUser:   &user.DefaultInfo{Name: "someone@example.com", UID: "some-object-id", Groups: []string{"a", "b"}},
+		},
+		{
+			name:       "groups claim which is a single string",
+			claims:     map[string]interface{}{"sub": "some-subject", "groups": "a"},
+			claimNames: IdentityClaimNames{GroupsClaim: "groups"},
+			wantUser:   &user.DefaultInfo{Name: "some-subject", UID: "some-subject", Groups: []string{"a"}},
+		},
+		{
+			name:       "groups claim which is a single empty string",
+			claims:     map[string]interface{}{"sub": "some-subject", "groups": ""},
+			claimNames: IdentityClaimNames{GroupsClaim: "groups"},
+			wantUser:   &user.DefaultInfo{Name: "some-subject", UID: "some-subject", Groups: []string{}},
+		},
+		{
+			name:       "missing groups claim",
+			claims:     map[string]interface{}{"sub": "some-subject"},
+			claimNames: IdentityClaimNames{GroupsClaim: "groups"},
+			wantUser:   &user.DefaultInfo{Name: "some-subject", UID: "some-subject", Groups: []string{}},
+		},
+		{
+			name:       "groups claim which has an invalid format",
+			claims:     map[string]interface{}{"sub": "some-subject", "groups": []interface{}{"a", 42}},
+			claimNames: IdentityClaimNames{GroupsClaim: "groups"},
+			wantErr:    "required claim in upstream ID token has invalid format",
+		},
+		{
+			name:       "missing username claim",
+			claims:     map[string]interface{}{"sub": "some-subject"},
+			claimNames: IdentityClaimNames{UsernameClaim: "email"},
+			wantErr:    "required claim in upstream ID token missing",
+		},
+		{
+			name:       "empty UID claim",
+			claims:     map[string]interface{}{"sub": "some-subject", "oid": ""},
+			claimNames: IdentityClaimNames{UIDClaim: "oid"},
+			wantErr:    "required claim in upstream ID token is empty",
+		},
+		{
+			name:    "UID claim which is not a string",
+			claims:  map[string]interface{}{"sub": 42},
+			wantErr: "required claim in upstream ID token has invalid format",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := MapClaimsToIdentity(tt.claims, tt.claimNames, "some-upstream-idp")
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, response)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, &authenticators.Response{User: tt.wantUser}, response)
+		})
+	}
+}
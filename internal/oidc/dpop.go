@@ -0,0 +1,165 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/token/jwt"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// DPoPHeaderName is the name of the request header which holds a DPoP proof, see RFC9449 section 4.1.
+	DPoPHeaderName = "DPoP"
+
+	// dpopProofType is the required typ header of a DPoP proof.
+	dpopProofType = "dpop+jwt"
+
+	// dpopProofMaxAge is how far the iat claim of a DPoP proof may be from the current time, in either direction.
+	dpopProofMaxAge = 5 * time.Minute
+
+	// confirmationClaim is the RFC7800 claim which holds the key that the token is bound to, and
+	// jwkThumbprintConfirmationMethod is the RFC9449 section 6.1 confirmation method which holds the key's thumbprint.
+	confirmationClaim               = "cnf"
+	jwkThumbprintConfirmationMethod = "jkt"
+)
+
+// isDPoPProofAlgorithm returns true for the signature algorithms which are allowed for DPoP proofs. Symmetric
+// algorithms and "none" are never allowed, since the proof must be signed using the client's private key.
+func isDPoPProofAlgorithm(alg string) bool {
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.ES256, jose.ES384, jose.ES512,
+		jose.RS256, jose.RS384, jose.RS512,
+		jose.PS256, jose.PS384, jose.PS512,
+		jose.EdDSA:
+		return true
+	default:
+		return false
+	}
+}
+
+// errInvalidDPoPProof is the RFC9449 section 5 error for an invalid DPoP proof.
+func errInvalidDPoPProof() *fosite.RFC6749Error {
+	return &fosite.RFC6749Error{
+		ErrorField:       "invalid_dpop_proof",
+		DescriptionField: "The DPoP proof is invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+}
+
+// dpopProofsContextKey is the key under which WithDPoPProofs stores the DPoP proofs in a context.
+type dpopProofsContextKey struct{}
+
+// WithDPoPProofs returns a copy of the context which holds the values of the DPoP headers of the token request
+// being handled, so that the token exchange can bind the tokens which it mints to the client's key.
+func WithDPoPProofs(ctx context.Context, proofs []string) context.Context {
+	return context.WithValue(ctx, dpopProofsContextKey{}, proofs)
+}
+
+// DPoPProofsFromContext returns the DPoP proofs which were added to the context by WithDPoPProofs, or nil.
+func DPoPProofsFromContext(ctx context.Context) []string {
+	proofs, _ := ctx.Value(dpopProofsContextKey{}).([]string)
+	return proofs
+}
+
+// dpopProofClaims are the claims of a DPoP proof, see RFC9449 section 4.2.
+type dpopProofClaims struct {
+	JTI        string `json:"jti"`
+	HTTPMethod string `json:"htm"`
+	HTTPURI    string `json:"htu"`
+	IssuedAt   int64  `json:"iat"`
+}
+
+// validateDPoPProof validates the DPoP proof of the token request, if any, and returns the thumbprint of its key.
+// It returns an empty thumbprint when DPoP is not enabled or when the client did not send a proof.
+func (t *TokenExchangeHandler) validateDPoPProof(ctx context.Context) (string, error) {
+	if !t.config.AcceptDPoPProofs {
+		return "", nil
+	}
+	proofs := DPoPProofsFromContext(ctx)
+	switch len(proofs) {
+	case 0:
+		return "", nil
+	case 1:
+	default:
+		return "", errInvalidDPoPProof().WithHint("Only one DPoP proof may be sent.")
+	}
+
+	jkt, err := validateDPoPProof(proofs[0], http.MethodPost, t.issuer+TokenEndpointPath, time.Now())
+	if err != nil {
+		return "", errInvalidDPoPProof().WithWrap(err).WithHint(err.Error())
+	}
+	return jkt, nil
+}
+
+// validateDPoPProof checks the DPoP proof as described in RFC9449 section 4.3, except that it does not check
+// whether the jti was used before, and returns the base64url encoded SHA-256 thumbprint of its key.
+func validateDPoPProof(proof, httpMethod, httpURI string, now time.Time) (string, error) {
+	jws, err := jose.ParseSigned(proof)
+	if err != nil {
+		return "", fmt.Errorf("could not parse the DPoP proof: %w", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return "", fmt.Errorf("the DPoP proof must have exactly one signature")
+	}
+	header := jws.Signatures[0].Header
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return "", fmt.Errorf("the DPoP proof must have the typ header %q", dpopProofType)
+	}
+	if !isDPoPProofAlgorithm(header.Algorithm) {
+		return "", fmt.Errorf("the DPoP proof has the unsupported alg header %q", header.Algorithm)
+	}
+	key := header.JSONWebKey
+	if key == nil || !key.Valid() || !key.IsPublic() {
+		return "", fmt.Errorf("the DPoP proof must have a public key in its jwk header")
+	}
+
+	payload, err := jws.Verify(key)
+	if err != nil {
+		return "", fmt.Errorf("could not verify the signature of the DPoP proof: %w", err)
+	}
+	var claims dpopProofClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("could not parse the claims of the DPoP proof: %w", err)
+	}
+	if claims.JTI == "" {
+		return "", fmt.Errorf("the DPoP proof must have a jti claim")
+	}
+	if claims.HTTPMethod != httpMethod {
+		return "", fmt.Errorf("the htm claim of the DPoP proof must be %q", httpMethod)
+	}
+	if claims.HTTPURI != httpURI {
+		return "", fmt.Errorf("the htu claim of the DPoP proof must be %q", httpURI)
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if claims.IssuedAt == 0 || issuedAt.Before(now.Add(-dpopProofMaxAge)) || issuedAt.After(now.Add(dpopProofMaxAge)) {
+		return "", fmt.Errorf("the iat claim of the DPoP proof must be within %s of the current time", dpopProofMaxAge)
+	}
+
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("could not compute the thumbprint of the key of the DPoP proof: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+func setConfirmationClaim(claims *jwt.IDTokenClaims, jkt string) {
+	// Always start clean, so that this claim is only ever set by this handler.
+	delete(claims.Extra, confirmationClaim)
+	if jkt == "" {
+		return
+	}
+	if claims.Extra == nil {
+		claims.Extra = map[string]interface{}{}
+	}
+	claims.Extra[confirmationClaim] = map[string]interface{}{jwkThumbprintConfirmationMethod: jkt}
+}
@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -46,9 +46,16 @@ func (s *dynamicOpenIDConnectECDSAStrategy) GenerateIDToken(
 	ctx context.Context,
 	requester fosite.Requester,
 ) (string, error) {
-	_, activeJwk := s.jwksProvider.GetJWKS(s.fositeConfig.IDTokenIssuer)
+	issuer := s.fositeConfig.IDTokenIssuer
+	// When the TokenExchangeHandler chose another issuer for this token, sign with that issuer's key. The issuer in
+	// the session's claims is never used for this, since the sessions of authcodes and refreshes are stored.
+	if r, ok := requester.(*issuerRequester); ok {
+		issuer = r.issuer
+	}
+
+	_, activeJwk := s.jwksProvider.GetJWKS(issuer)
 	if activeJwk == nil {
-		plog.Debug("no JWK found for issuer", "issuer", s.fositeConfig.IDTokenIssuer)
+		plog.Debug("no JWK found for issuer", "issuer", issuer)
 		return "", fosite.ErrTemporarilyUnavailable.WithWrap(constable.Error("no JWK found for issuer"))
 	}
 	key, ok := activeJwk.Key.(*ecdsa.PrivateKey)
@@ -60,12 +67,52 @@ func (s *dynamicOpenIDConnectECDSAStrategy) GenerateIDToken(
 		plog.Debug(
 			"JWK must be of type ecdsa",
 			"issuer",
-			s.fositeConfig.IDTokenIssuer,
+			issuer,
 			"actualType",
 			actualType,
 		)
 		return "", fosite.ErrServerError.WithWrap(constable.Error("JWK must be of type ecdsa"))
 	}
 
-	return compose.NewOpenIDConnectECDSAStrategy(s.fositeConfig, key).GenerateIDToken(ctx, requester)
+	return compose.NewOpenIDConnectECDSAStrategy(s.fositeConfig, key).GenerateIDToken(ctx, withKeyID(requester, activeJwk.KeyID))
+}
+
+// withKeyID returns a requester whose session has the given key ID as the "kid" header of its ID tokens, so that
+// clients can pick the right key from the JWKS, even while the JWKS holds several keys during a key rotation.
+// The original session is never changed, not even when there is no key ID, since fosite fills in the headers of the
+// session that it is given, and the original's headers could otherwise hold the ID of a key which was rotated out.
+func withKeyID(requester fosite.Requester, keyID string) fosite.Requester {
+	if requester.GetSession() == nil {
+		return requester
+	}
+	session, ok := requester.GetSession().Clone().(openid.Session)
+	if !ok {
+		return requester
+	}
+	if keyID != "" {
+		session.IDTokenHeaders().Add("kid", keyID)
+	}
+	return &keyIDRequester{Requester: requester, session: session}
+}
+
+// keyIDRequester is a fosite.Requester which overrides the session of another fosite.Requester.
+type keyIDRequester struct {
+	fosite.Requester
+	session fosite.Session
+}
+
+func (r *keyIDRequester) GetSession() fosite.Session {
+	return r.session
+}
+
+// withIssuer returns a requester whose ID token is signed by the key of the given issuer instead of by the key of the
+// IDTokenIssuer. Only the TokenExchangeHandler may use this, for the issuers which it chose for exchanged tokens.
+func withIssuer(requester fosite.Requester, issuer string) fosite.Requester {
+	return &issuerRequester{Requester: requester, issuer: issuer}
+}
+
+// issuerRequester is a fosite.Requester whose ID token is signed by the key of another issuer.
+type issuerRequester struct {
+	fosite.Requester
+	issuer string
 }
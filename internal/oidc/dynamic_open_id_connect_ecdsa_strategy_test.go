@@ -1,4 +1,4 @@
-// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2022 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -27,6 +27,7 @@ import (
 func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 	const (
 		goodIssuer   = "https://some-good-issuer.com"
+		otherIssuer  = "https://some-other-issuer.com"
 		clientID     = "some-client-id"
 		goodSubject  = "some-subject"
 		goodUsername = "some-username"
@@ -36,16 +37,23 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 	ecPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 
+	otherECPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
 	rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
 
 	tests := []struct {
 		name           string
 		issuer         string
+		claimsIssuer   string
+		exchangeIssuer string
 		jwksProvider   func(jwks.DynamicJWKSProvider)
 		wantErrorType  *fosite.RFC6749Error
 		wantErrorCause string
 		wantSigningJWK *jose.JSONWebKey
+		wantIssuer     string
+		wantKeyID      string
 	}{
 		{
 			name:   "jwks provider does contain signing key for issuer",
@@ -64,6 +72,90 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 				Key: ecPrivateKey,
 			},
 		},
+		{
+			name:   "signing key's ID is the kid header of the token",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]*jose.JSONWebKey{
+						goodIssuer: {
+							Key:   ecPrivateKey,
+							KeyID: "some-key-id",
+						},
+					},
+				)
+			},
+			wantSigningJWK: &jose.JSONWebKey{
+				Key: ecPrivateKey,
+			},
+			wantKeyID: "some-key-id",
+		},
+		{
+			name:           "issuer was chosen for an exchanged token",
+			issuer:         goodIssuer,
+			claimsIssuer:   otherIssuer,
+			exchangeIssuer: otherIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]*jose.JSONWebKey{
+						goodIssuer: {
+							Key: ecPrivateKey,
+						},
+						otherIssuer: {
+							Key: otherECPrivateKey,
+						},
+					},
+				)
+			},
+			wantSigningJWK: &jose.JSONWebKey{
+				Key: otherECPrivateKey,
+			},
+			wantIssuer: otherIssuer,
+		},
+		{
+			name:         "issuer in the stored session's claims of an authcode or refresh does not choose the signing key",
+			issuer:       goodIssuer,
+			claimsIssuer: otherIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]*jose.JSONWebKey{
+						goodIssuer: {
+							Key: ecPrivateKey,
+						},
+						otherIssuer: {
+							Key: otherECPrivateKey,
+						},
+					},
+				)
+			},
+			wantSigningJWK: &jose.JSONWebKey{
+				Key: ecPrivateKey,
+			},
+			// fosite keeps the issuer claim which was stored in the session, but it is signed with the key of the
+			// IDTokenIssuer, so clients of that issuer would reject it.
+			wantIssuer: otherIssuer,
+		},
+		{
+			name:           "jwks provider does not contain signing key for the issuer chosen for an exchanged token",
+			issuer:         goodIssuer,
+			claimsIssuer:   otherIssuer,
+			exchangeIssuer: otherIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]*jose.JSONWebKey{
+						goodIssuer: {
+							Key: ecPrivateKey,
+						},
+					},
+				)
+			},
+			wantErrorType:  fosite.ErrTemporarilyUnavailable,
+			wantErrorCause: "no JWK found for issuer",
+		},
 		{
 			name:           "jwks provider does not contain signing key for issuer",
 			issuer:         goodIssuer,
@@ -106,6 +198,7 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 				Session: &openid.DefaultSession{
 					Claims: &jwt.IDTokenClaims{
 						Subject: goodSubject,
+						Issuer:  test.claimsIssuer,
 					},
 					Subject:  goodSubject,
 					Username: goodUsername,
@@ -114,7 +207,11 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 					"nonce": {goodNonce},
 				},
 			}
-			idToken, err := s.GenerateIDToken(context.Background(), requester)
+			var idTokenRequester fosite.Requester = requester
+			if test.exchangeIssuer != "" {
+				idTokenRequester = withIssuer(requester, test.exchangeIssuer)
+			}
+			idToken, err := s.GenerateIDToken(context.Background(), idTokenRequester)
 			if test.wantErrorType != nil {
 				require.True(t, errors.Is(err, test.wantErrorType))
 				require.EqualError(t, err.(*fosite.RFC6749Error).Cause(), test.wantErrorCause)
@@ -127,9 +224,19 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 				// Perform a light validation on the token to make sure 1) we passed through the correct
 				// signing key and 2) we forwarded the fosite.Requester correctly. Token generation is
 				// tested more expansively in the token endpoint.
-				token := oidctestutil.VerifyECDSAIDToken(t, goodIssuer, clientID, privateKey, idToken)
+				wantIssuer := test.wantIssuer
+				if wantIssuer == "" {
+					wantIssuer = goodIssuer
+				}
+				token := oidctestutil.VerifyECDSAIDToken(t, wantIssuer, clientID, privateKey, idToken)
 				require.Equal(t, goodSubject, token.Subject)
 				require.Equal(t, goodNonce, token.Nonce)
+
+				parsed, err := jose.ParseSigned(idToken)
+				require.NoError(t, err)
+				require.Equal(t, test.wantKeyID, parsed.Signatures[0].Header.KeyID)
+				// The kid header is never added to the requester's session.
+				require.Nil(t, requester.Session.(*openid.DefaultSession).Headers)
 			}
 		})
 	}
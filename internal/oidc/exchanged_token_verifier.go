@@ -0,0 +1,54 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/apiserver/pkg/authentication/user"
+	k8soidc "k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
+
+	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+)
+
+// VerifyExchangedToken validates a JWT minted by the TokenExchangeHandler in the same way that a Concierge
+// JWTAuthenticator with the given issuer, audience and JWKS would, and returns the user that it would authenticate.
+func VerifyExchangedToken(ctx context.Context, token, issuer, audience string, jwks *jose.JSONWebKeySet) (user.Info, error) {
+	var publicKeys []crypto.PublicKey
+	if jwks != nil {
+		for i := range jwks.Keys {
+			if publicKey := jwks.Keys[i].Public(); publicKey.Valid() {
+				publicKeys = append(publicKeys, publicKey.Key)
+			}
+		}
+	}
+
+	authenticator, err := k8soidc.New(k8soidc.Options{
+		IssuerURL:     issuer,
+		KeySet:        &coreosoidc.StaticKeySet{PublicKeys: publicKeys},
+		ClientID:      audience,
+		UsernameClaim: oidcapi.IDTokenClaimUsername,
+		GroupsClaim:   oidcapi.IDTokenClaimGroups,
+		// These are the algorithms which the Concierge's JWTAuthenticator supports by default.
+		SupportedSigningAlgs: []string{string(jose.RS256), string(jose.ES256)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize JWT authenticator: %w", err)
+	}
+	defer authenticator.Close()
+
+	response, ok, err := authenticator.AuthenticateToken(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("exchanged token would be rejected by a JWTAuthenticator: %w", err)
+	}
+	if !ok {
+		// The authenticator skips tokens from other issuers instead of rejecting them.
+		return nil, fmt.Errorf("exchanged token would not be authenticated by a JWTAuthenticator with issuer %q", issuer)
+	}
+	return response.User, nil
+}
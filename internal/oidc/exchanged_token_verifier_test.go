@@ -0,0 +1,137 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+)
+
+func TestVerifyExchangedToken(t *testing.T) {
+	const issuer = "https://issuer.example.com" // the issuer of the test harness
+
+	h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{}, &jwt.IDTokenClaims{
+		Subject: "some-subject",
+		Extra: map[string]interface{}{
+			oidcapi.IDTokenClaimUsername: "some-username",
+			oidcapi.IDTokenClaimGroups:   []interface{}{"some-group"},
+		},
+	})
+	responder, err := h.exchange(t, h.happyForm())
+	require.NoError(t, err)
+	mintedToken := responder.GetAccessToken()
+
+	jwks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &h.signingKey.PublicKey, Algorithm: string(jose.ES256), Use: "sig"},
+	}}
+
+	otherSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherJWKS := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: otherSigningKey, Algorithm: string(jose.ES256), Use: "sig"}, // private keys are reduced to their public keys
+	}}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: h.signingKey}, nil)
+	require.NoError(t, err)
+	expiredToken, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+		"iss":                        issuer,
+		"aud":                        "some-workload-cluster",
+		"sub":                        "some-subject",
+		"iat":                        time.Now().Add(-time.Hour).Unix(),
+		"exp":                        time.Now().Add(-time.Minute).Unix(),
+		oidcapi.IDTokenClaimUsername: "some-username",
+	}).CompactSerialize()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		token    string
+		issuer   string
+		audience string
+		jwks     *jose.JSONWebKeySet
+		wantUser user.Info
+		wantErr  string
+	}{
+		{
+			name:     "happy path",
+			token:    mintedToken,
+			issuer:   issuer,
+			audience: "some-workload-cluster",
+			jwks:     jwks,
+			wantUser: &user.DefaultInfo{Name: "some-username", Groups: []string{"some-group"}},
+		},
+		{
+			name:     "wrong audience",
+			token:    mintedToken,
+			issuer:   issuer,
+			audience: "other-workload-cluster",
+			jwks:     jwks,
+			wantErr:  "exchanged token would be rejected by a JWTAuthenticator: ",
+		},
+		{
+			name:     "wrong issuer",
+			token:    mintedToken,
+			issuer:   "https://other-issuer.example.com",
+			audience: "some-workload-cluster",
+			jwks:     jwks,
+			wantErr:  `exchanged token would not be authenticated by a JWTAuthenticator with issuer "https://other-issuer.example.com"`,
+		},
+		{
+			name:     "signed by a key which is not in the JWKS",
+			token:    mintedToken,
+			issuer:   issuer,
+			audience: "some-workload-cluster",
+			jwks:     otherJWKS,
+			wantErr:  "exchanged token would be rejected by a JWTAuthenticator: ",
+		},
+		{
+			name:     "no JWKS",
+			token:    mintedToken,
+			issuer:   issuer,
+			audience: "some-workload-cluster",
+			wantErr:  "exchanged token would be rejected by a JWTAuthenticator: ",
+		},
+		{
+			name:     "expired",
+			token:    expiredToken,
+			issuer:   issuer,
+			audience: "some-workload-cluster",
+			jwks:     jwks,
+			wantErr:  "exchanged token would be rejected by a JWTAuthenticator: ",
+		},
+		{
+			name:     "issuer is not https",
+			token:    mintedToken,
+			issuer:   "http://issuer.example.com",
+			audience: "some-workload-cluster",
+			jwks:     jwks,
+			wantErr:  "could not initialize JWT authenticator: ",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := VerifyExchangedToken(context.Background(), tt.token, tt.issuer, tt.audience, tt.jwks)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				require.Nil(t, u)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantUser, u)
+		})
+	}
+}
@@ -111,6 +111,14 @@ type UpstreamLDAPIdentityProviderI interface {
 	PerformRefresh(ctx context.Context, storedRefreshAttributes RefreshAttributes) (groups []string, err error)
 }
 
+// UpstreamUserFacingErrorMessager may optionally be implemented by an upstream identity provider to explain its
+// authentication errors to end users.
+type UpstreamUserFacingErrorMessager interface {
+	// UserFacingErrorMessage returns a concise message which explains the error to end users, or an empty string
+	// when the error should be reported using a generic message.
+	UserFacingErrorMessage(err error) string
+}
+
 // RefreshAttributes contains information about the user from the original login request
 // and previous refreshes.
 type RefreshAttributes struct {
@@ -18,6 +18,7 @@ import (
 	"k8s.io/utils/strings/slices"
 
 	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/fositestorage"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/downstreamsession"
@@ -65,7 +66,11 @@ func NewHandler(
 			}
 		}
 
-		accessResponse, err := oauthHelper.NewAccessResponse(r.Context(), accessRequest)
+		// Let the storage record which grant type issued the access token.
+		ctx := fositestorage.WithGrantTypes(r.Context(), accessRequest.GetGrantTypes())
+		// Let the token exchange bind its token to the client's key, when the client sent a DPoP proof.
+		ctx = oidc.WithDPoPProofs(ctx, r.Header.Values(oidc.DPoPHeaderName))
+		accessResponse, err := oauthHelper.NewAccessResponse(ctx, accessRequest)
 		if err != nil {
 			plog.Info("token response error", oidc.FositeErrorForLog(err)...)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
@@ -1468,6 +1468,7 @@ func TestTokenEndpointTokenExchange(t *testing.T) { // tests for grant_type "urn
 			require.Contains(t, parsedResponseBody, "access_token")
 			require.Equal(t, "N_A", parsedResponseBody["token_type"])
 			require.Equal(t, "urn:ietf:params:oauth:token-type:jwt", parsedResponseBody["issued_token_type"])
+			require.Equal(t, parsedAuthcodeExchangeResponseBody["scope"], parsedResponseBody["scope"])
 
 			// Parse the returned token.
 			parsedJWT, err := jose.ParseSigned(parsedResponseBody["access_token"].(string))
@@ -5,34 +5,262 @@ package oidc
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
 	"github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/utils/strings/slices"
 
 	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/psession"
 )
 
 const (
+	// actClaim is the RFC8693 section 4.1 claim which names the actor which is acting on behalf of the subject. Its value
+	// may have its own act claim, which names the prior actor, and so on, forming a delegation chain.
+	actClaim = "act"
+
+	// mayActClaim is the RFC8693 section 4.4 claim which names the actors that may act on behalf of the subject.
+	mayActClaim = "may_act"
+
+	// federationDomainClaim and idpNameClaim are the claims added by EmbedProviderClaims. They are namespaced to
+	// avoid colliding with registered claims and with claims from other issuers.
+	federationDomainClaim = "pinniped.dev/federation_domain"
+	idpNameClaim          = "pinniped.dev/idp_name"
+
+	// notBeforeClaim is the RFC7519 section 4.1.5 claim which says when a JWT starts being valid.
+	notBeforeClaim = "nbf"
+
+	// minClockSkewWarningThreshold is the smallest clock skew between supervisor pods which causes a warning.
+	// Smaller skews are common and harmless.
+	minClockSkewWarningThreshold = 5 * time.Second
+
+	// supervisorAccessTokenParam is the non-standard token exchange request parameter which asks for a supervisor
+	// access token along with the minted JWT, when its value is "true". See IssueSupervisorAccessTokens.
+	supervisorAccessTokenParam = "pinniped_supervisor_access_token" //nolint:gosec
+
+	// supervisorAccessTokenExpiresInParam is the non-standard token exchange response parameter which holds how many
+	// seconds the supervisor access token is valid for, like the standard expires_in parameter.
+	supervisorAccessTokenExpiresInParam = "pinniped_supervisor_access_token_expires_in" //nolint:gosec
+
 	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token" //nolint:gosec
 	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"          //nolint:gosec
 )
 
 type stsParams struct {
-	subjectAccessToken string
-	requestedAudience  string
+	subjectAccessToken    string
+	requestedAudience     string
+	supervisorAccessToken bool
+}
+
+// TokenExchangeConfiguration holds the optional settings of the TokenExchangeHandler.
+// The zero value is valid and results in the default behavior.
+type TokenExchangeConfiguration struct {
+	// UsernameClaim is the name of the claim in the stored session's ID token claims which holds the username.
+	// When empty, oidcapi.IDTokenClaimUsername is used.
+	UsernameClaim string
+
+	// PreserveNonce, when true, causes the nonce from the original authorize request, which is stored in the
+	// session's ID token claims, to be included in the minted JWT. When false, the minted JWT has no nonce.
+	PreserveNonce bool
+
+	// AudienceAuthorizer, when not nil, is consulted to decide whether the requested audience may be issued a
+	// token. When nil, all audiences which pass the other validations are allowed.
+	AudienceAuthorizer AudienceAuthorizer
+
+	// RecordExchangedTokens, when true, causes a record of each minted JWT to be saved in the access token storage,
+	// keyed by the JWT's jti claim, so that it can later be revoked using RevokeExchangedToken. When false, the
+	// minted JWTs are stateless and cannot be revoked before they expire.
+	RecordExchangedTokens bool
+
+	// MayActPolicy, when not nil, is consulted to decide the value of the may_act claim of each minted JWT.
+	// When nil, the minted JWTs do not have a may_act claim.
+	MayActPolicy MayActPolicy
+
+	// ExchangedTokenLifetime is how long the minted JWTs are valid for audiences which are not listed in
+	// ExchangedTokenLifetimesByAudience. When zero, the ID token lifespan of the fosite config is used.
+	ExchangedTokenLifetime time.Duration
+
+	// ExchangedTokenLifetimesByAudience optionally holds how long the minted JWTs are valid for specific audiences,
+	// e.g. to give production workload clusters shorter lived tokens than development workload clusters.
+	ExchangedTokenLifetimesByAudience map[string]time.Duration
+
+	// IssuerFunc, when not nil, returns the issuer of the JWT minted using the given original authorize request, e.g.
+	// the issuer of the FederationDomain at which the user originally logged in, when several FederationDomains with
+	// different issuers share the handler. The JWT is then signed using the signing key of that issuer. When nil, or
+	// when it returns an empty string, the issuer is decided by the ID token strategy.
+	IssuerFunc func(ctx context.Context, requester fosite.Requester) (string, error)
+
+	// EmbedProviderClaims, when true, causes each minted JWT to have a pinniped.dev/federation_domain claim, holding
+	// the issuer of the JWT, which is the issuer of the FederationDomain at which the user logged in, and a
+	// pinniped.dev/idp_name claim, holding the name of the identity provider which the user used to log in. These
+	// allow the workload cluster's authorizers to make decisions based on where the user came from. When false, the
+	// minted JWTs do not have these claims.
+	EmbedProviderClaims bool
+
+	// ClockSkewLeeway, when positive, causes each minted JWT to have an nbf claim which is this long before the time
+	// at which it was minted, so that a workload cluster whose clock is somewhat behind the supervisor's clock does not
+	// reject a freshly minted JWT as not yet valid. A few seconds is usually enough. When zero, the minted JWTs do not
+	// have an nbf claim. It is also the clock skew which causes a warning to be logged when this handler notices that
+	// the supervisor's own clocks disagree, although skews of less than a few seconds are never logged.
+	ClockSkewLeeway time.Duration
+
+	// AllowedSubjectTokenGrantTypes, when not empty, lists the grant types which may have issued the access tokens
+	// which are exchanged, e.g. only oidcapi.GrantTypeAuthorizationCode to refuse to exchange access tokens which were
+	// issued by a refresh. Access tokens whose grant type was not recorded, e.g. those issued before upgrading, are
+	// never allowed. When empty, access tokens issued by any grant type may be exchanged.
+	AllowedSubjectTokenGrantTypes []string
+
+	// GroupsFilter, when not nil, is consulted to decide which of the user's groups are in the groups claim of each
+	// minted JWT, e.g. to give each workload cluster only the groups which it cares about, which keeps the JWTs small
+	// and limits which groups each workload cluster learns about. The groups stored in the user's session are never
+	// changed, so each audience is filtered from the full list. When nil, the minted JWTs have all of the user's groups.
+	GroupsFilter GroupsFilter
+
+	// MetricsRegisterer, when not nil, is used to register a histogram of the end-to-end latency of token exchange
+	// requests and a counter of token exchange requests, both labeled by outcome, e.g. success or invalid_request,
+	// and by the type of the exchanged subject token. When nil, token exchange requests are not instrumented.
+	MetricsRegisterer prometheus.Registerer
+
+	// ReservedAudienceSubstrings optionally lists more substrings which may not appear in a requested audience, e.g.
+	// to reserve the names of internal audiences of a customized supervisor. They are in addition to the built-in
+	// reservations, which always apply. Empty strings are ignored.
+	ReservedAudienceSubstrings []string
+
+	// MaxActChainDepth, when positive, is the deepest act claim (see RFC8693 section 4.1) which a minted JWT may have,
+	// where an act claim which names one actor has a depth of one, and each nested act claim adds one. This bounds
+	// delegation chains, which also bounds the size of the minted JWTs. Since actor tokens are not supported, the act
+	// claim of a minted JWT is the one stored in the session of the exchanged access token. When zero, act claims of
+	// any depth are allowed.
+	MaxActChainDepth int
+
+	// AcceptDPoPProofs, when true, binds the minted JWT to the client's key when the token exchange request has a
+	// DPoP proof (see RFC9449), by adding a cnf claim which holds the thumbprint of the key. An invalid proof fails the
+	// request. Requests without a proof get unbound JWTs, as they do when this is false, in which case proofs are
+	// ignored.
+	AcceptDPoPProofs bool
+
+	// IssueSupervisorAccessTokens, when true, allows a client to get an opaque access token for the supervisor along
+	// with the minted JWT from a single token exchange, by adding the non-standard pinniped_supervisor_access_token=true
+	// parameter to its request. The JWT is still the access_token of the response, whose issued_token_type is still
+	// urn:ietf:params:oauth:token-type:jwt, so clients which do not know about the extension see a standard response.
+	// The response then also has these non-standard parameters:
+	//
+	//   pinniped_supervisor_access_token             the opaque access token for the supervisor
+	//   pinniped_supervisor_access_token_expires_in  how many seconds that access token is valid for
+	//
+	// The supervisor access token has the same session and scopes as the exchanged access token, and it expires when
+	// the exchanged access token expires, so it never extends the user's session. When false, the parameter is
+	// ignored and only the JWT is returned.
+	IssueSupervisorAccessTokens bool
+}
+
+// GroupsFilter returns the groups to embed into a JWT minted for the given audience, given all of the user's groups.
+// A non-nil error means that no decision could be made.
+type GroupsFilter func(ctx context.Context, audience string, groups []string) ([]string, error)
+
+// GroupsFilterByAudience returns a GroupsFilter which only keeps the groups listed for the audience in the given
+// map. Audiences which are not in the map get all of the user's groups.
+func GroupsFilterByAudience(allowedGroupsByAudience map[string][]string) GroupsFilter {
+	return func(_ context.Context, audience string, groups []string) ([]string, error) {
+		allowedGroups, ok := allowedGroupsByAudience[audience]
+		if !ok {
+			return groups, nil
+		}
+		filtered := []string{}
+		for _, group := range groups {
+			if slices.Contains(allowedGroups, group) {
+				filtered = append(filtered, group)
+			}
+		}
+		return filtered, nil
+	}
+}
+
+// MayActPolicy returns the value of the may_act claim (see RFC8693 section 4.4) to embed into a JWT minted for the
+// given subject and audience, e.g. map[string]interface{}{"sub": "some-actor"}. Returning nil means that the JWT
+// should not have a may_act claim. A non-nil error means that no decision could be made.
+type MayActPolicy func(ctx context.Context, subject, audience string) (map[string]interface{}, error)
+
+// AudienceAuthorizer decides whether a client may exchange a user's access token for a token with the requested
+// audience, e.g. by asking an external policy service. A non-nil error means that no decision could be made.
+type AudienceAuthorizer interface {
+	Allow(ctx context.Context, clientID, username, audience string) (bool, error)
+}
+
+// allowAllAudienceAuthorizer is the default AudienceAuthorizer, which allows every audience.
+type allowAllAudienceAuthorizer struct{}
+
+func (allowAllAudienceAuthorizer) Allow(_ context.Context, _, _, _ string) (bool, error) {
+	return true, nil
 }
 
+// TokenExchangeFactory creates a TokenExchangeHandler with the default configuration.
 func TokenExchangeFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
-	return &TokenExchangeHandler{
-		idTokenStrategy:     strategy.(openid.OpenIDConnectTokenStrategy),
-		accessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
-		accessTokenStorage:  storage.(oauth2.AccessTokenStorage),
+	return NewTokenExchangeFactory(TokenExchangeConfiguration{})(config, storage, strategy)
+}
+
+// NewTokenExchangeFactory returns a factory, suitable for use with compose.Compose, which creates a
+// TokenExchangeHandler with the given configuration.
+func NewTokenExchangeFactory(tokenExchangeConfig TokenExchangeConfiguration) compose.Factory {
+	return newTokenExchangeFactory(tokenExchangeConfig, nil)
+}
+
+// NewPerFederationDomainTokenExchangeFactory returns a factory, suitable for use with compose.Compose, which creates a
+// TokenExchangeHandler whose configuration depends on the FederationDomain at which the user originally logged in, so
+// that FederationDomains which share a handler can have different exchange policies. The FederationDomain is named by
+// its issuer, which is decided by the IssuerFunc of the default configuration, or is the issuer of the handler when
+// there is no IssuerFunc. Each request uses the configuration in configsByFederationDomain for its FederationDomain,
+// or the default configuration when the FederationDomain is not in the map.
+//
+// Since the FederationDomain is only known once the exchanged access token was found, the MetricsRegisterer and the
+// IssuerFunc of the default configuration always apply, so it is an error to set them in the configurations in the map.
+func NewPerFederationDomainTokenExchangeFactory(
+	defaultConfig TokenExchangeConfiguration,
+	configsByFederationDomain map[string]TokenExchangeConfiguration,
+) (compose.Factory, error) {
+	for federationDomain, config := range configsByFederationDomain {
+		if config.IssuerFunc != nil {
+			return nil, errors.Errorf("the token exchange configuration of FederationDomain %q must not set an IssuerFunc", federationDomain)
+		}
+		if config.MetricsRegisterer != nil {
+			return nil, errors.Errorf("the token exchange configuration of FederationDomain %q must not set a MetricsRegisterer", federationDomain)
+		}
+	}
+	return newTokenExchangeFactory(defaultConfig, configsByFederationDomain), nil
+}
+
+func newTokenExchangeFactory(
+	defaultConfig TokenExchangeConfiguration,
+	configsByFederationDomain map[string]TokenExchangeConfiguration,
+) compose.Factory {
+	return func(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+		metrics, err := newTokenExchangeMetrics(defaultConfig.MetricsRegisterer)
+		if err != nil {
+			// Metrics are optional, so a misconfigured registerer should not stop token exchange from working.
+			plog.Error("could not register token exchange metrics", err, "issuer", config.IDTokenIssuer)
+		}
+		return &TokenExchangeHandler{
+			idTokenStrategy:     strategy.(openid.OpenIDConnectTokenStrategy),
+			accessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
+			accessTokenStorage:  storage.(oauth2.AccessTokenStorage),
+			issuer:              config.IDTokenIssuer,
+			idTokenLifespan:     config.GetIDTokenLifespan(),
+			config:              defaultConfig,
+			metrics:             metrics,
+
+			configsByFederationDomain: configsByFederationDomain,
+		}
 	}
 }
 
@@ -40,6 +268,14 @@ type TokenExchangeHandler struct {
 	idTokenStrategy     openid.OpenIDConnectTokenStrategy
 	accessTokenStrategy oauth2.AccessTokenStrategy
 	accessTokenStorage  oauth2.AccessTokenStorage
+	issuer              string        // the default issuer of the minted JWTs
+	idTokenLifespan     time.Duration // the default lifetime of the minted JWTs
+	config              TokenExchangeConfiguration
+	metrics             *tokenExchangeMetrics // nil when metrics are not configured
+
+	// configsByFederationDomain optionally holds the configurations which replace config for the users who logged in
+	// at specific FederationDomains, keyed by the issuers of those FederationDomains.
+	configsByFederationDomain map[string]TokenExchangeConfiguration
 }
 
 var _ fosite.TokenEndpointHandler = (*TokenExchangeHandler)(nil)
@@ -57,12 +293,29 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(err)
 	}
 
+	if t.metrics == nil {
+		return t.populateTokenEndpointResponse(ctx, requester, responder)
+	}
+	start := time.Now()
+	err := t.populateTokenEndpointResponse(ctx, requester, responder)
+	t.metrics.observe(start, requester.GetRequestForm().Get("subject_token_type"), err)
+	return err
+}
+
+func (t *TokenExchangeHandler) populateTokenEndpointResponse(ctx context.Context, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
 	// Validate the basic RFC8693 parameters we support.
 	params, err := t.validateParams(requester.GetRequestForm())
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	// Check that the client is allowed to perform this grant type. This is checked before looking up
+	// the access token, since it does not require any reads from storage.
+	if !requester.GetClient().GetGrantTypes().Has(oidcapi.GrantTypeTokenExchange) {
+		// This error message is trying to be similar to the analogous one in fosite's flow_authorize_code_token.go.
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHintf(`The OAuth 2.0 Client is not allowed to use token exchange grant "%s".`, oidcapi.GrantTypeTokenExchange))
+	}
+
 	// Validate the incoming access token and lookup the information about the original authorize request.
 	originalRequester, err := t.validateAccessToken(ctx, requester, params.subjectAccessToken)
 	if err != nil {
@@ -70,15 +323,16 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 	}
 
 	// Check that the currently authenticated client and the client which was originally used to get the access token are the same.
-	if originalRequester.GetClient().GetID() != requester.GetClient().GetID() {
+	// Use a constant time comparison to avoid leaking timing information about valid client IDs.
+	if subtle.ConstantTimeCompare([]byte(originalRequester.GetClient().GetID()), []byte(requester.GetClient().GetID())) != 1 {
 		// This error message is copied from the similar check in fosite's flow_authorize_code_token.go.
 		return errors.WithStack(fosite.ErrInvalidGrant.WithHint("The OAuth 2.0 Client ID from this request does not match the one from the authorize request."))
 	}
 
-	// Check that the client is allowed to perform this grant type.
-	if !requester.GetClient().GetGrantTypes().Has(oidcapi.GrantTypeTokenExchange) {
-		// This error message is trying to be similar to the analogous one in fosite's flow_authorize_code_token.go.
-		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHintf(`The OAuth 2.0 Client is not allowed to use token exchange grant "%s".`, oidcapi.GrantTypeTokenExchange))
+	// Use the configuration of the FederationDomain at which the user logged in for the rest of the request.
+	scoped, err := t.forFederationDomain(ctx, originalRequester)
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
 	// Require that the incoming access token has the pinniped:request-audience and OpenID scopes.
@@ -89,13 +343,44 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("Missing the %q scope.", oidcapi.ScopeOpenID))
 	}
 
+	// Check that the incoming access token was issued by an allowed grant type.
+	if err := scoped.validateSubjectTokenGrantType(originalRequester); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Warn when the original request appears to have happened in the future, which can only happen when the clocks
+	// of the supervisor pods disagree. Workload clusters are likely to see similar skews.
+	scoped.warnIfClockSkewed(originalRequester)
+
 	// Check that the stored session meets the minimum requirements for token exchange.
-	if err := t.validateSession(originalRequester); err != nil {
+	username, err := scoped.validateSession(originalRequester)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Check that the delegation chain of the minted JWT would not be too long.
+	if err := scoped.validateActChainDepth(originalRequester); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Check that the requested audience is not reserved by the configuration.
+	if err := scoped.validateReservedAudienceSubstrings(params.requestedAudience); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Check that the policy allows this client to get a token for the requested audience on behalf of this user.
+	if err := scoped.authorizeAudience(ctx, requester.GetClient().GetID(), username, params.requestedAudience); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Check the DPoP proof, if any, which names the key that the minted JWT should be bound to.
+	jkt, err := scoped.validateDPoPProof(ctx)
+	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	// Use the original authorize request information, along with the requested audience, to mint a new JWT.
-	responseToken, err := t.mintJWT(ctx, originalRequester, params.requestedAudience)
+	responseToken, err := scoped.mintJWT(ctx, originalRequester, params.requestedAudience, jkt)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -104,31 +389,379 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 	responder.SetAccessToken(responseToken)
 	responder.SetTokenType("N_A")
 	responder.SetExtra("issued_token_type", tokenTypeJWT)
+	if params.supervisorAccessToken && scoped.config.IssueSupervisorAccessTokens {
+		if err := scoped.issueSupervisorAccessToken(ctx, requester, originalRequester, responder); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	// The scope parameter cannot be used to request a downscoped token, so the minted JWT has the scopes which were
+	// granted to the exchanged access token. RFC8693 section 2.2.1 asks for them to be returned when they may differ
+	// from the requested scopes, which they always do since no scopes were requested.
+	responder.SetScopes(originalRequester.GetGrantedScopes())
 	return nil
 }
 
-func (t *TokenExchangeHandler) mintJWT(ctx context.Context, requester fosite.Requester, audience string) (string, error) {
-	downscoped := fosite.NewAccessRequest(requester.GetSession())
+func (t *TokenExchangeHandler) mintJWT(ctx context.Context, requester fosite.Requester, audience, jkt string) (string, error) {
+	original, ok := requester.GetSession().(openid.Session)
+	if !ok {
+		// This shouldn't really happen.
+		return "", fosite.ErrServerError.WithHint("Invalid session storage.")
+	}
+	// Change a copy of the session, so that the claims of one minted JWT never end up in the stored session.
+	session, ok := original.Clone().(openid.Session)
+	if !ok {
+		// This shouldn't really happen.
+		return "", fosite.ErrServerError.WithHint("Invalid session storage.")
+	}
+	downscoped := fosite.NewAccessRequest(session)
+	claims := session.IDTokenClaims()
+	if !t.config.PreserveNonce {
+		// The ID token strategy will use any nonce from the stored claims, so remove it unless configured otherwise.
+		claims.Nonce = ""
+	}
+	if t.config.RecordExchangedTokens {
+		claims.JTI = uuid.New().String()
+	}
+	// Always decide the expiration here, instead of leaving it to the ID token strategy, since the strategy may set
+	// it on a copy of the claims, e.g. dynamicOpenIDConnectECDSAStrategy does, while the record of the exchanged
+	// token needs it too. This also replaces any expiration which was stored in the session.
+	claims.ExpiresAt = time.Now().UTC().Add(t.exchangedTokenLifetime(audience))
+	t.setNotBeforeClaim(claims)
+	setConfirmationClaim(claims, jkt)
+	if err := t.setMayActClaim(ctx, claims, audience); err != nil {
+		return "", err
+	}
+	issuer, err := t.setIssuer(ctx, requester, claims)
+	if err != nil {
+		return "", err
+	}
+	if err := t.setProviderClaims(requester, claims); err != nil {
+		return "", err
+	}
+	if err := t.setGroupsClaim(ctx, claims, audience); err != nil {
+		return "", err
+	}
 	downscoped.Client.(*fosite.DefaultClient).ID = audience
-	return t.idTokenStrategy.GenerateIDToken(ctx, downscoped)
+
+	var idTokenRequester fosite.Requester = downscoped
+	if issuer != "" {
+		idTokenRequester = withIssuer(downscoped, issuer)
+	}
+	token, err := t.idTokenStrategy.GenerateIDToken(ctx, idTokenRequester)
+	if err != nil {
+		return "", err
+	}
+
+	if t.config.RecordExchangedTokens {
+		if err := t.recordExchangedToken(ctx, requester, claims.JTI, audience, claims.ExpiresAt); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
 }
 
-func (t *TokenExchangeHandler) validateSession(requester fosite.Requester) error {
-	pSession, ok := requester.GetSession().(*psession.PinnipedSession)
+// issueSupervisorAccessToken stores a new access token which has the same session and scopes as the exchanged access
+// token, and adds it to the non-standard parameters of the response, see IssueSupervisorAccessTokens.
+func (t *TokenExchangeHandler) issueSupervisorAccessToken(ctx context.Context, requester fosite.AccessRequester, originalRequester fosite.Requester, responder fosite.AccessResponder) error {
+	expiresAt := originalRequester.GetSession().GetExpiresAt(fosite.AccessToken)
+	expiresIn := time.Until(expiresAt)
+	if expiresAt.IsZero() || expiresIn <= 0 {
+		// This shouldn't really happen, since the exchanged access token was just validated.
+		return fosite.ErrServerError.WithHint("Unable to determine the lifetime of the supervisor access token.")
+	}
+
+	record := fosite.NewAccessRequest(originalRequester.GetSession().Clone())
+	// Use the request ID of the original grant, so that revoking the original grant, e.g. when its refresh token is
+	// used or revoked, also revokes this access token.
+	record.ID = originalRequester.GetID()
+	record.RequestedAt = time.Now().UTC()
+	record.Client = requester.GetClient()
+	record.GrantTypes = fosite.Arguments{oidcapi.GrantTypeTokenExchange}
+	for _, scope := range originalRequester.GetGrantedScopes() {
+		record.GrantScope(scope)
+	}
+	for _, audience := range originalRequester.GetGrantedAudience() {
+		record.GrantAudience(audience)
+	}
+	record.Session.SetExpiresAt(fosite.AccessToken, expiresAt)
+
+	token, signature, err := t.accessTokenStrategy.GenerateAccessToken(ctx, record)
+	if err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithHint("Unable to generate the supervisor access token.")
+	}
+	if err := t.accessTokenStorage.CreateAccessTokenSession(ctx, signature, record); err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithHint("Unable to store the supervisor access token.")
+	}
+
+	responder.SetExtra(supervisorAccessTokenParam, token)
+	responder.SetExtra(supervisorAccessTokenExpiresInParam, int64(expiresIn.Round(time.Second).Seconds()))
+	return nil
+}
+
+func (t *TokenExchangeHandler) setNotBeforeClaim(claims *jwt.IDTokenClaims) {
+	// Always start clean, so that this claim is only ever set by this handler.
+	delete(claims.Extra, notBeforeClaim)
+	if t.config.ClockSkewLeeway <= 0 {
+		return
+	}
+	if claims.Extra == nil {
+		claims.Extra = map[string]interface{}{}
+	}
+	// The iat claim is always set to the current time by the ID token strategy, so only nbf is backdated.
+	claims.Extra[notBeforeClaim] = time.Now().UTC().Add(-t.config.ClockSkewLeeway).Unix()
+}
+
+func (t *TokenExchangeHandler) warnIfClockSkewed(originalRequester fosite.Requester) {
+	skew := clockSkew(originalRequester.GetRequestedAt(), time.Now().UTC())
+	if skew <= t.clockSkewWarningThreshold() {
+		return
+	}
+	plog.Warning("token exchange found an access token which was requested in the future, so the clocks of the supervisor pods may be skewed",
+		"clientID", originalRequester.GetClient().GetID(), "skew", skew.String(), "clockSkewLeeway", t.config.ClockSkewLeeway.String())
+}
+
+// clockSkewWarningThreshold returns the smallest clock skew which causes a warning.
+func (t *TokenExchangeHandler) clockSkewWarningThreshold() time.Duration {
+	if t.config.ClockSkewLeeway > minClockSkewWarningThreshold {
+		return t.config.ClockSkewLeeway
+	}
+	return minClockSkewWarningThreshold
+}
+
+// clockSkew returns how far in the future the requestedAt time is, or zero when it is not in the future.
+func clockSkew(requestedAt, now time.Time) time.Duration {
+	if !requestedAt.After(now) {
+		return 0
+	}
+	return requestedAt.Sub(now)
+}
+
+func (t *TokenExchangeHandler) setMayActClaim(ctx context.Context, claims *jwt.IDTokenClaims, audience string) error {
+	// Always start clean, so a value decided for one audience can never leak into a token minted for another.
+	delete(claims.Extra, mayActClaim)
+	if t.config.MayActPolicy == nil {
+		return nil
+	}
+	mayAct, err := t.config.MayActPolicy(ctx, claims.Subject, audience)
+	if err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithHint("Unable to determine the may_act claim.")
+	}
+	if mayAct != nil {
+		if claims.Extra == nil {
+			claims.Extra = map[string]interface{}{}
+		}
+		claims.Extra[mayActClaim] = mayAct
+	}
+	return nil
+}
+
+func (t *TokenExchangeHandler) setGroupsClaim(ctx context.Context, claims *jwt.IDTokenClaims, audience string) error {
+	if t.config.GroupsFilter == nil {
+		return nil
+	}
+	groupsValue, ok := claims.Extra[oidcapi.IDTokenClaimGroups]
+	if !ok {
+		// The user has no groups claim, e.g. because the groups scope was not granted, so there is nothing to filter.
+		return nil
+	}
+	groups, ok := stringSliceClaim(groupsValue)
 	if !ok {
 		// This shouldn't really happen.
 		return fosite.ErrServerError.WithHint("Invalid session storage.")
 	}
-	username, ok := pSession.IDTokenClaims().Extra[oidcapi.IDTokenClaimUsername].(string)
+	filtered, err := t.config.GroupsFilter(ctx, audience, groups)
+	if err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithHint("Unable to filter the groups.")
+	}
+	if filtered == nil {
+		filtered = []string{}
+	}
+	claims.Extra[oidcapi.IDTokenClaimGroups] = filtered
+	return nil
+}
+
+// stringSliceClaim returns the value of a claim which holds a list of strings, which is a []interface{} once the
+// session was read back from storage.
+func stringSliceClaim(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			result = append(result, s)
+		}
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+// setIssuer sets the issuer chosen by the IssuerFunc, if any, and returns it, or returns an empty string when the
+// issuer of the handler should be used.
+func (t *TokenExchangeHandler) setIssuer(ctx context.Context, requester fosite.Requester, claims *jwt.IDTokenClaims) (string, error) {
+	if t.config.IssuerFunc == nil {
+		return "", nil
+	}
+	issuer, err := t.config.IssuerFunc(ctx, requester)
+	if err != nil {
+		return "", fosite.ErrServerError.WithWrap(err).WithHint("Unable to determine the issuer.")
+	}
+	if issuer != "" {
+		claims.Issuer = issuer
+	}
+	return issuer, nil
+}
+
+func (t *TokenExchangeHandler) setProviderClaims(requester fosite.Requester, claims *jwt.IDTokenClaims) error {
+	// Always start clean, so that these claims are only ever set by this handler.
+	delete(claims.Extra, federationDomainClaim)
+	delete(claims.Extra, idpNameClaim)
+	if !t.config.EmbedProviderClaims {
+		return nil
+	}
+	pSession, ok := requester.GetSession().(*psession.PinnipedSession)
+	if !ok || pSession.Custom == nil {
+		// This shouldn't really happen.
+		return fosite.ErrServerError.WithHint("Invalid session storage.")
+	}
+	federationDomain := claims.Issuer
+	if federationDomain == "" {
+		federationDomain = t.issuer
+	}
+	if claims.Extra == nil {
+		claims.Extra = map[string]interface{}{}
+	}
+	claims.Extra[federationDomainClaim] = federationDomain
+	claims.Extra[idpNameClaim] = pSession.Custom.ProviderName
+	return nil
+}
+
+func (t *TokenExchangeHandler) recordExchangedToken(ctx context.Context, requester fosite.Requester, jti, audience string, expiresAt time.Time) error {
+	// The record holds the client and subject (in the session), the audience, and the expiration of the minted JWT.
+	record := fosite.NewRequest()
+	record.ID = jti
+	record.RequestedAt = time.Now().UTC()
+	record.Client = requester.GetClient()
+	record.Session = requester.GetSession().Clone()
+	record.Session.SetExpiresAt(fosite.AccessToken, expiresAt)
+	record.GrantAudience(audience)
+
+	if err := t.accessTokenStorage.CreateAccessTokenSession(ctx, jti, record); err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithHint("Unable to record the exchanged token.")
+	}
+	return nil
+}
+
+// RevokeExchangedToken deletes the record of the minted JWT which has the given jti claim. It only applies when
+// RecordExchangedTokens is configured. Whoever validates the minted JWTs is responsible for checking that the record
+// still exists.
+func (t *TokenExchangeHandler) RevokeExchangedToken(ctx context.Context, jti string) error {
+	return t.accessTokenStorage.DeleteAccessTokenSession(ctx, jti)
+}
+
+func (t *TokenExchangeHandler) validateSession(requester fosite.Requester) (string, error) {
+	pSession, ok := requester.GetSession().(*psession.PinnipedSession)
+	if !ok {
+		// This shouldn't really happen.
+		return "", fosite.ErrServerError.WithHint("Invalid session storage.")
+	}
+	username, ok := pSession.IDTokenClaims().Extra[t.usernameClaim()].(string)
 	if !ok || username == "" {
 		// No username was stored in the session's ID token claims (or the stored username was not a string, which
 		// shouldn't really happen). Usernames will not be stored in the session's ID token claims when the username
 		// scope was not requested/granted, but otherwise they should be stored.
-		return fosite.ErrAccessDenied.WithHintf("No username found in session. Ensure that the %q scope was requested and granted at the authorization endpoint.", oidcapi.ScopeUsername)
+		return "", fosite.ErrAccessDenied.WithHintf("No username found in session. Ensure that the %q scope was requested and granted at the authorization endpoint.", oidcapi.ScopeUsername)
+	}
+	return username, nil
+}
+
+func (t *TokenExchangeHandler) validateActChainDepth(originalRequester fosite.Requester) error {
+	if t.config.MaxActChainDepth <= 0 {
+		return nil
+	}
+	session, ok := originalRequester.GetSession().(openid.Session)
+	if !ok {
+		// This shouldn't really happen.
+		return fosite.ErrServerError.WithHint("Invalid session storage.")
+	}
+	if actChainDepth(session.IDTokenClaims().Extra) > t.config.MaxActChainDepth {
+		return fosite.ErrInvalidRequest.WithHintf("The 'subject_token' has a delegation chain which is longer than the maximum of %d actors.", t.config.MaxActChainDepth)
+	}
+	return nil
+}
+
+// actChainDepth returns how deeply the act claims are nested in the given claims, which is zero when there is no act
+// claim. An act claim whose value is not an object cannot have a nested act claim, so it ends the chain.
+func actChainDepth(claims map[string]interface{}) int {
+	depth := 0
+	for {
+		act, ok := claims[actClaim]
+		if !ok {
+			return depth
+		}
+		depth++
+		if claims, ok = act.(map[string]interface{}); !ok {
+			return depth
+		}
+	}
+}
+
+func (t *TokenExchangeHandler) validateSubjectTokenGrantType(originalRequester fosite.Requester) error {
+	if len(t.config.AllowedSubjectTokenGrantTypes) == 0 {
+		return nil
+	}
+	// The access token storage returns an AccessRequester when it knows which grant type issued the access token.
+	accessRequester, ok := originalRequester.(fosite.AccessRequester)
+	if ok {
+		for _, grantType := range t.config.AllowedSubjectTokenGrantTypes {
+			if accessRequester.GetGrantTypes().ExactOne(grantType) {
+				return nil
+			}
+		}
+	}
+	return fosite.ErrAccessDenied.WithHint("The 'subject_token' was not issued by an allowed grant type.")
+}
+
+func (t *TokenExchangeHandler) authorizeAudience(ctx context.Context, clientID, username, audience string) error {
+	authorizer := t.config.AudienceAuthorizer
+	if authorizer == nil {
+		authorizer = allowAllAudienceAuthorizer{}
+	}
+	allowed, err := authorizer.Allow(ctx, clientID, username, audience)
+	if err != nil {
+		return fosite.ErrServerError.WithWrap(err).WithHint("Unable to authorize the requested audience.")
+	}
+	if !allowed {
+		return fosite.ErrAccessDenied.WithHintf("The requested audience %q is not allowed by policy.", audience)
 	}
 	return nil
 }
 
+// exchangedTokenLifetime returns the lifetime of JWTs minted for the audience, which is the ID token lifespan unless
+// another lifetime is configured.
+func (t *TokenExchangeHandler) exchangedTokenLifetime(audience string) time.Duration {
+	lifetime, ok := t.config.ExchangedTokenLifetimesByAudience[audience]
+	if !ok {
+		lifetime = t.config.ExchangedTokenLifetime
+	}
+	if lifetime <= 0 {
+		return t.idTokenLifespan
+	}
+	return lifetime
+}
+
+func (t *TokenExchangeHandler) usernameClaim() string {
+	if t.config.UsernameClaim != "" {
+		return t.config.UsernameClaim
+	}
+	return oidcapi.IDTokenClaimUsername
+}
+
 func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, error) {
 	var result stsParams
 
@@ -150,6 +783,16 @@ func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, er
 		return nil, fosite.ErrInvalidRequest.WithHintf("Unsupported 'requested_token_type' parameter value, must be %q.", tokenTypeJWT)
 	}
 
+	// Validate the optional non-standard parameter. Only "true" asks for a supervisor access token, but "false" is also
+	// allowed, so that clients may always send it.
+	switch params.Get(supervisorAccessTokenParam) {
+	case "", "false":
+	case "true":
+		result.supervisorAccessToken = true
+	default:
+		return nil, fosite.ErrInvalidRequest.WithHintf("Unsupported '%s' parameter value, must be %q or %q.", supervisorAccessTokenParam, "true", "false")
+	}
+
 	// Validate that none of these unsupported parameters were sent. These are optional and we do not currently support them.
 	for _, param := range []string{
 		"resource",
@@ -179,10 +822,59 @@ func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, er
 	if result.requestedAudience == oidcapi.ClientIDPinnipedCLI {
 		return nil, fosite.ErrInvalidRequest.WithHintf("requested audience cannot equal '%s'", oidcapi.ClientIDPinnipedCLI)
 	}
+	// 5. Additionally, operators may reserve more strings, which are also disallowed for this token exchange. These are
+	//    checked by validateReservedAudienceSubstrings, once the configuration of the FederationDomain is known.
 
 	return &result, nil
 }
 
+func (t *TokenExchangeHandler) validateReservedAudienceSubstrings(audience string) error {
+	for _, reserved := range t.config.ReservedAudienceSubstrings {
+		if reserved != "" && strings.Contains(audience, reserved) {
+			return fosite.ErrInvalidRequest.WithHintf("requested audience cannot contain '%s'", reserved)
+		}
+	}
+	return nil
+}
+
+// forFederationDomain returns a handler which uses the configuration of the FederationDomain at which the user of the
+// original request logged in, which is this handler when there is no such configuration.
+func (t *TokenExchangeHandler) forFederationDomain(ctx context.Context, originalRequester fosite.Requester) (*TokenExchangeHandler, error) {
+	if len(t.configsByFederationDomain) == 0 {
+		return t, nil
+	}
+	federationDomain, err := t.federationDomain(ctx, originalRequester)
+	if err != nil {
+		return nil, err
+	}
+	config, ok := t.configsByFederationDomain[federationDomain]
+	if !ok {
+		return t, nil
+	}
+	scoped := *t
+	scoped.config = config
+	// The FederationDomain was found using the default IssuerFunc, so keep using it to decide the issuer of the JWT.
+	// The factory made sure that the configurations in the map do not set these.
+	scoped.config.IssuerFunc = t.config.IssuerFunc
+	scoped.config.MetricsRegisterer = t.config.MetricsRegisterer
+	return &scoped, nil
+}
+
+// federationDomain returns the issuer of the FederationDomain at which the user of the original request logged in.
+func (t *TokenExchangeHandler) federationDomain(ctx context.Context, originalRequester fosite.Requester) (string, error) {
+	if t.config.IssuerFunc == nil {
+		return t.issuer, nil
+	}
+	issuer, err := t.config.IssuerFunc(ctx, originalRequester)
+	if err != nil {
+		return "", fosite.ErrServerError.WithWrap(err).WithHint("Unable to determine the issuer.")
+	}
+	if issuer == "" {
+		return t.issuer, nil
+	}
+	return issuer, nil
+}
+
 func (t *TokenExchangeHandler) validateAccessToken(ctx context.Context, requester fosite.AccessRequester, accessToken string) (fosite.Requester, error) {
 	// Look up the access token's stored session data.
 	signature := t.accessTokenStrategy.AccessTokenSignature(accessToken)
@@ -0,0 +1,127 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	tokenExchangeMetricsNamespace = "pinniped"
+	tokenExchangeMetricsSubsystem = "supervisor_token_exchange"
+
+	tokenExchangeOutcomeLabel          = "outcome"
+	tokenExchangeSubjectTokenTypeLabel = "subject_token_type"
+
+	tokenExchangeOutcomeSuccess = "success"
+
+	// These are the values of the subject_token_type label. Unsupported token types share a single value to keep
+	// the cardinality of the metrics bounded, since the parameter is chosen by the client.
+	tokenExchangeSubjectTokenTypeAccessToken = "access_token"
+	tokenExchangeSubjectTokenTypeJWT         = "jwt"
+	tokenExchangeSubjectTokenTypeOther       = "other"
+)
+
+// tokenExchangeMetrics holds the collectors which instrument the TokenExchangeHandler. A nil *tokenExchangeMetrics
+// is valid and records nothing.
+type tokenExchangeMetrics struct {
+	duration *prometheus.HistogramVec
+	total    *prometheus.CounterVec
+}
+
+// newTokenExchangeMetrics creates the collectors and registers them with the given registerer. Collectors which were
+// already registered, e.g. by the handler of another FederationDomain, are shared. It returns nil when the registerer
+// is nil.
+func newTokenExchangeMetrics(registerer prometheus.Registerer) (*tokenExchangeMetrics, error) {
+	if registerer == nil {
+		return nil, nil
+	}
+
+	labels := []string{tokenExchangeOutcomeLabel, tokenExchangeSubjectTokenTypeLabel}
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: tokenExchangeMetricsNamespace,
+		Subsystem: tokenExchangeMetricsSubsystem,
+		Name:      "duration_seconds",
+		Help:      "The end-to-end latency of token exchange requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels)
+	total := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: tokenExchangeMetricsNamespace,
+		Subsystem: tokenExchangeMetricsSubsystem,
+		Name:      "requests_total",
+		Help:      "The number of token exchange requests.",
+	}, labels)
+
+	var err error
+	if duration, err = registerHistogramVec(registerer, duration); err != nil {
+		return nil, err
+	}
+	if total, err = registerCounterVec(registerer, total); err != nil {
+		return nil, err
+	}
+	return &tokenExchangeMetrics{duration: duration, total: total}, nil
+}
+
+func registerHistogramVec(registerer prometheus.Registerer, collector *prometheus.HistogramVec) (*prometheus.HistogramVec, error) {
+	if err := registerer.Register(collector); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(*prometheus.HistogramVec); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return collector, nil
+}
+
+func registerCounterVec(registerer prometheus.Registerer, collector *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	if err := registerer.Register(collector); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(*prometheus.CounterVec); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return collector, nil
+}
+
+// observe records a token exchange request which started at the given time and ended with the given error.
+func (m *tokenExchangeMetrics) observe(start time.Time, subjectTokenType string, err error) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{
+		tokenExchangeOutcomeLabel:          tokenExchangeOutcome(err),
+		tokenExchangeSubjectTokenTypeLabel: tokenExchangeSubjectTokenType(subjectTokenType),
+	}
+	m.duration.With(labels).Observe(time.Since(start).Seconds())
+	m.total.With(labels).Inc()
+}
+
+// tokenExchangeOutcome returns the OAuth2 error code of the error, e.g. invalid_request, or success when there was no
+// error. The error codes are a small fixed set, so they are safe to use as label values.
+func tokenExchangeOutcome(err error) string {
+	if err == nil {
+		return tokenExchangeOutcomeSuccess
+	}
+	return fosite.ErrorToRFC6749Error(err).ErrorField
+}
+
+func tokenExchangeSubjectTokenType(subjectTokenType string) string {
+	switch subjectTokenType {
+	case tokenTypeAccessToken:
+		return tokenExchangeSubjectTokenTypeAccessToken
+	case tokenTypeJWT:
+		return tokenExchangeSubjectTokenTypeJWT
+	default:
+		return tokenExchangeSubjectTokenTypeOther
+	}
+}
@@ -0,0 +1,1590 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/storage"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+
+	oidcapi "go.pinniped.dev/generated/latest/apis/supervisor/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/psession"
+)
+
+type tokenExchangeTestHarness struct {
+	handler         *TokenExchangeHandler
+	store           *storage.MemoryStore
+	hmac            *oauth2.HMACSHAStrategy
+	signingKey      *ecdsa.PrivateKey
+	client          *fosite.DefaultClient
+	originalRequest *fosite.AccessRequest // the stored request of the access token
+	accessToken     string
+}
+
+// newTokenExchangeTestHarness creates a TokenExchangeHandler with the given configuration, and stores an access token
+// whose session has the given ID token claims. The access token is available as the accessToken field.
+func newTokenExchangeTestHarness(t *testing.T, cfg TokenExchangeConfiguration, idTokenClaims *jwt.IDTokenClaims) *tokenExchangeTestHarness {
+	t.Helper()
+
+	fositeConfig := &compose.Config{
+		IDTokenIssuer:       "https://issuer.example.com",
+		AccessTokenLifespan: time.Hour,
+		IDTokenLifespan:     time.Hour,
+	}
+	hmacStrategy := compose.NewOAuth2HMACStrategy(fositeConfig, []byte("some-secret-that-is-at-least-32-bytes-long"), nil)
+	jwtSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	idTokenStrategy := compose.NewOpenIDConnectECDSAStrategy(fositeConfig, jwtSigningKey)
+	store := storage.NewMemoryStore()
+
+	handler := NewTokenExchangeFactory(cfg)(fositeConfig, store, &compose.CommonStrategy{
+		CoreStrategy:               hmacStrategy,
+		OpenIDConnectTokenStrategy: idTokenStrategy,
+	}).(*TokenExchangeHandler)
+
+	client := &fosite.DefaultClient{
+		ID:         oidcapi.ClientIDPinnipedCLI,
+		GrantTypes: fosite.Arguments{oidcapi.GrantTypeAuthorizationCode, oidcapi.GrantTypeTokenExchange},
+	}
+
+	session := &psession.PinnipedSession{
+		Fosite: &openid.DefaultSession{
+			Claims:  idTokenClaims,
+			Headers: &jwt.Headers{},
+			Subject: idTokenClaims.Subject,
+		},
+		Custom: &psession.CustomSessionData{ProviderName: "some-idp-name"},
+	}
+	session.SetExpiresAt(fosite.AccessToken, time.Now().Add(time.Hour))
+
+	originalRequest := fosite.NewAccessRequest(session)
+	originalRequest.Client = client
+	originalRequest.GrantScope(oidcapi.ScopeOpenID)
+	originalRequest.GrantScope(oidcapi.ScopeRequestAudience)
+
+	accessToken, signature, err := hmacStrategy.GenerateAccessToken(context.Background(), originalRequest)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccessTokenSession(context.Background(), signature, originalRequest))
+
+	return &tokenExchangeTestHarness{
+		handler:         handler,
+		store:           store,
+		hmac:            hmacStrategy,
+		signingKey:      jwtSigningKey,
+		client:          client,
+		originalRequest: originalRequest,
+		accessToken:     accessToken,
+	}
+}
+
+// exchange performs a token exchange of the harness's access token for the given audience.
+func (h *tokenExchangeTestHarness) exchange(t *testing.T, form url.Values) (fosite.AccessResponder, error) {
+	t.Helper()
+	return h.exchangeWithContext(t, context.Background(), form)
+}
+
+func (h *tokenExchangeTestHarness) exchangeWithContext(t *testing.T, ctx context.Context, form url.Values) (fosite.AccessResponder, error) {
+	t.Helper()
+
+	request := fosite.NewAccessRequest(psession.NewPinnipedSession())
+	request.Client = h.client
+	request.GrantTypes = fosite.Arguments{oidcapi.GrantTypeTokenExchange}
+	request.Form = form
+
+	responder := fosite.NewAccessResponse()
+	err := h.handler.PopulateTokenEndpointResponse(ctx, request, responder)
+	return responder, err
+}
+
+func (h *tokenExchangeTestHarness) happyForm() url.Values {
+	return url.Values{
+		"audience":             {"some-workload-cluster"},
+		"subject_token":        {h.accessToken},
+		"subject_token_type":   {tokenTypeAccessToken},
+		"requested_token_type": {tokenTypeJWT},
+	}
+}
+
+// mintedClaims returns the claims of the given minted JWT, without verifying its signature.
+func mintedClaims(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+
+	parsed, err := josejwt.ParseSigned(token)
+	require.NoError(t, err)
+	var claims map[string]interface{}
+	require.NoError(t, parsed.UnsafeClaimsWithoutVerification(&claims))
+	return claims
+}
+
+func TestTokenExchangeUsernameClaim(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         TokenExchangeConfiguration
+		claimsExtra map[string]interface{}
+		wantErr     string
+	}{
+		{
+			name:        "default username claim",
+			claimsExtra: map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+		},
+		{
+			name:        "default username claim is missing",
+			claimsExtra: map[string]interface{}{"other": "some-username"},
+			wantErr:     `No username found in session. Ensure that the "username" scope was requested and granted at the authorization endpoint.`,
+		},
+		{
+			name:        "custom username claim",
+			cfg:         TokenExchangeConfiguration{UsernameClaim: "custom_username"},
+			claimsExtra: map[string]interface{}{"custom_username": "some-username"},
+		},
+		{
+			name:        "custom username claim is missing even though the default claim is present",
+			cfg:         TokenExchangeConfiguration{UsernameClaim: "custom_username"},
+			claimsExtra: map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			wantErr:     `No username found in session. Ensure that the "username" scope was requested and granted at the authorization endpoint.`,
+		},
+		{
+			name:        "custom username claim is not a string",
+			cfg:         TokenExchangeConfiguration{UsernameClaim: "custom_username"},
+			claimsExtra: map[string]interface{}{"custom_username": 42},
+			wantErr:     `No username found in session. Ensure that the "username" scope was requested and granted at the authorization endpoint.`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   tt.claimsExtra,
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, fosite.ErrAccessDenied)
+				require.Equal(t, tt.wantErr, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, responder.GetAccessToken())
+			require.Equal(t, "N_A", responder.GetTokenType())
+			require.Equal(t, tokenTypeJWT, responder.GetExtra("issued_token_type"))
+		})
+	}
+}
+
+func TestTokenExchangeNonce(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           TokenExchangeConfiguration
+		originalNonce string
+		wantNonce     string
+	}{
+		{
+			name:          "nonce is not preserved by default",
+			originalNonce: "some-nonce-value-with-enough-entropy",
+		},
+		{
+			name:          "nonce is preserved when configured",
+			cfg:           TokenExchangeConfiguration{PreserveNonce: true},
+			originalNonce: "some-nonce-value-with-enough-entropy",
+			wantNonce:     "some-nonce-value-with-enough-entropy",
+		},
+		{
+			name: "no nonce when configured but the original had none",
+			cfg:  TokenExchangeConfiguration{PreserveNonce: true},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Nonce:   tt.originalNonce,
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			require.Equal(t, []interface{}{"some-workload-cluster"}, claims["aud"])
+			if tt.wantNonce == "" {
+				require.NotContains(t, claims, "nonce")
+				return
+			}
+			require.Equal(t, tt.wantNonce, claims["nonce"])
+		})
+	}
+}
+
+func TestTokenExchangeLifetime(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          TokenExchangeConfiguration
+		wantLifetime time.Duration
+	}{
+		{
+			name:         "lifetime is the ID token lifespan by default",
+			wantLifetime: time.Hour, // the IDTokenLifespan of the test harness
+		},
+		{
+			name: "lifetime for a listed audience",
+			cfg: TokenExchangeConfiguration{
+				ExchangedTokenLifetime:            30 * time.Minute,
+				ExchangedTokenLifetimesByAudience: map[string]time.Duration{"some-workload-cluster": 2 * time.Minute},
+			},
+			wantLifetime: 2 * time.Minute,
+		},
+		{
+			name: "default lifetime for an audience which is not listed",
+			cfg: TokenExchangeConfiguration{
+				ExchangedTokenLifetime:            30 * time.Minute,
+				ExchangedTokenLifetimesByAudience: map[string]time.Duration{"other-workload-cluster": 2 * time.Minute},
+			},
+			wantLifetime: 30 * time.Minute,
+		},
+		{
+			name: "lifetime for a listed audience without a default lifetime",
+			cfg: TokenExchangeConfiguration{
+				ExchangedTokenLifetimesByAudience: map[string]time.Duration{"some-workload-cluster": 5 * time.Minute},
+			},
+			wantLifetime: 5 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			require.InDelta(t, float64(time.Now().Add(tt.wantLifetime).Unix()), claims["exp"], 5)
+		})
+	}
+}
+
+func TestTokenExchangeClockSkewLeeway(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           TokenExchangeConfiguration
+		wantNotBefore time.Duration
+	}{
+		{
+			name: "no nbf claim by default",
+		},
+		{
+			name:          "nbf claim is backdated by the leeway",
+			cfg:           TokenExchangeConfiguration{ClockSkewLeeway: 30 * time.Second},
+			wantNotBefore: -30 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra: map[string]interface{}{
+					oidcapi.IDTokenClaimUsername: "some-username",
+					"nbf":                        time.Now().Add(time.Hour).Unix(), // never copied from the session
+				},
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			require.InDelta(t, float64(time.Now().Unix()), claims["iat"], 5)
+			if tt.wantNotBefore == 0 {
+				require.NotContains(t, claims, "nbf")
+				return
+			}
+			require.InDelta(t, float64(time.Now().Add(tt.wantNotBefore).Unix()), claims["nbf"], 5)
+		})
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, time.Duration(0), clockSkew(now.Add(-time.Minute), now))
+	require.Equal(t, time.Duration(0), clockSkew(now, now))
+	require.Equal(t, time.Minute, clockSkew(now.Add(time.Minute), now))
+
+	require.Equal(t, minClockSkewWarningThreshold, (&TokenExchangeHandler{}).clockSkewWarningThreshold())
+	require.Equal(t, minClockSkewWarningThreshold, (&TokenExchangeHandler{config: TokenExchangeConfiguration{ClockSkewLeeway: time.Second}}).clockSkewWarningThreshold())
+	require.Equal(t, time.Minute, (&TokenExchangeHandler{config: TokenExchangeConfiguration{ClockSkewLeeway: time.Minute}}).clockSkewWarningThreshold())
+}
+
+func TestTokenExchangeAllowedSubjectTokenGrantTypes(t *testing.T) {
+	tests := []struct {
+		name               string
+		cfg                TokenExchangeConfiguration
+		originalGrantTypes fosite.Arguments
+		wantErr            bool
+	}{
+		{
+			name:               "any grant type is allowed by default",
+			originalGrantTypes: fosite.Arguments{oidcapi.GrantTypeRefreshToken},
+		},
+		{
+			name:               "unknown grant type is allowed by default",
+			originalGrantTypes: nil,
+		},
+		{
+			name:               "allowed grant type",
+			cfg:                TokenExchangeConfiguration{AllowedSubjectTokenGrantTypes: []string{oidcapi.GrantTypeAuthorizationCode}},
+			originalGrantTypes: fosite.Arguments{oidcapi.GrantTypeAuthorizationCode},
+		},
+		{
+			name:               "disallowed grant type",
+			cfg:                TokenExchangeConfiguration{AllowedSubjectTokenGrantTypes: []string{oidcapi.GrantTypeAuthorizationCode}},
+			originalGrantTypes: fosite.Arguments{oidcapi.GrantTypeRefreshToken},
+			wantErr:            true,
+		},
+		{
+			name:               "unknown grant type when only some are allowed",
+			cfg:                TokenExchangeConfiguration{AllowedSubjectTokenGrantTypes: []string{oidcapi.GrantTypeAuthorizationCode}},
+			originalGrantTypes: nil,
+			wantErr:            true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+			h.originalRequest.GrantTypes = tt.originalGrantTypes
+
+			responder, err := h.exchange(t, h.happyForm())
+			if tt.wantErr {
+				require.ErrorIs(t, err, fosite.ErrAccessDenied)
+				require.Equal(t, "The 'subject_token' was not issued by an allowed grant type.", fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, responder.GetAccessToken())
+		})
+	}
+}
+
+type audienceAuthorizerFunc func(ctx context.Context, clientID, username, audience string) (bool, error)
+
+func (f audienceAuthorizerFunc) Allow(ctx context.Context, clientID, username, audience string) (bool, error) {
+	return f(ctx, clientID, username, audience)
+}
+
+func TestTokenExchangeAudienceAuthorizer(t *testing.T) {
+	tests := []struct {
+		name         string
+		authorizer   AudienceAuthorizer
+		wantErr      error
+		wantErrHint  string
+		wantErrCause string
+	}{
+		{
+			name: "no authorizer allows everything",
+		},
+		{
+			name: "authorizer allows",
+			authorizer: audienceAuthorizerFunc(func(_ context.Context, clientID, username, audience string) (bool, error) {
+				return clientID == oidcapi.ClientIDPinnipedCLI && username == "some-username" && audience == "some-workload-cluster", nil
+			}),
+		},
+		{
+			name: "authorizer denies",
+			authorizer: audienceAuthorizerFunc(func(_ context.Context, _, _, _ string) (bool, error) {
+				return false, nil
+			}),
+			wantErr:     fosite.ErrAccessDenied,
+			wantErrHint: `The requested audience "some-workload-cluster" is not allowed by policy.`,
+		},
+		{
+			name: "authorizer errors",
+			authorizer: audienceAuthorizerFunc(func(_ context.Context, _, _, _ string) (bool, error) {
+				return true, errors.New("policy service unavailable")
+			}),
+			wantErr:      fosite.ErrServerError,
+			wantErrHint:  "Unable to authorize the requested audience.",
+			wantErrCause: "policy service unavailable",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{AudienceAuthorizer: tt.authorizer}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				rfcErr := fosite.ErrorToRFC6749Error(err)
+				require.Equal(t, tt.wantErrHint, rfcErr.HintField)
+				if tt.wantErrCause != "" {
+					require.EqualError(t, rfcErr.Cause(), tt.wantErrCause)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, responder.GetAccessToken())
+		})
+	}
+}
+
+func TestTokenExchangeRecordExchangedTokens(t *testing.T) {
+	newHarness := func(t *testing.T, cfg TokenExchangeConfiguration) *tokenExchangeTestHarness {
+		return newTokenExchangeTestHarness(t, cfg, &jwt.IDTokenClaims{
+			Subject: "some-subject",
+			Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+		})
+	}
+
+	t.Run("stateless by default", func(t *testing.T) {
+		h := newHarness(t, TokenExchangeConfiguration{})
+
+		_, err := h.exchange(t, h.happyForm())
+		require.NoError(t, err)
+
+		// Only the original access token is in storage.
+		require.Len(t, h.store.AccessTokens, 1)
+	})
+
+	t.Run("records and revokes exchanged tokens when configured", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, TokenExchangeConfiguration{RecordExchangedTokens: true})
+
+		responder, err := h.exchange(t, h.happyForm())
+		require.NoError(t, err)
+
+		claims := mintedClaims(t, responder.GetAccessToken())
+		jti, ok := claims["jti"].(string)
+		require.True(t, ok)
+		require.NotEmpty(t, jti)
+
+		record, err := h.store.GetAccessTokenSession(ctx, jti, nil)
+		require.NoError(t, err)
+		require.Equal(t, jti, record.GetID())
+		require.Equal(t, oidcapi.ClientIDPinnipedCLI, record.GetClient().GetID())
+		require.Equal(t, fosite.Arguments{"some-workload-cluster"}, record.GetGrantedAudience())
+		require.Equal(t, "some-subject", record.GetSession().GetSubject())
+		require.Equal(t, int64(claims["exp"].(float64)), record.GetSession().GetExpiresAt(fosite.AccessToken).Unix())
+
+		// A second exchange gets a different jti.
+		secondResponder, err := h.exchange(t, h.happyForm())
+		require.NoError(t, err)
+		require.NotEqual(t, jti, mintedClaims(t, secondResponder.GetAccessToken())["jti"])
+
+		require.NoError(t, h.handler.RevokeExchangedToken(ctx, jti))
+		_, err = h.store.GetAccessTokenSession(ctx, jti, nil)
+		require.ErrorIs(t, err, fosite.ErrNotFound)
+	})
+	t.Run("records the expiration when the ID token strategy changes a copy of the claims", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, TokenExchangeConfiguration{RecordExchangedTokens: true})
+
+		// Like in production, the dynamic strategy generates the JWT from a copy of the session, see withKeyID.
+		jwksProvider := jwks.NewDynamicJWKSProvider()
+		jwksProvider.SetIssuerToJWKSMap(nil, map[string]*jose.JSONWebKey{
+			"https://issuer.example.com": {Key: h.signingKey, KeyID: "some-key-id"},
+		})
+		h.handler.idTokenStrategy = newDynamicOpenIDConnectECDSAStrategy(
+			&compose.Config{IDTokenIssuer: "https://issuer.example.com", IDTokenLifespan: time.Hour},
+			jwksProvider,
+		)
+
+		responder, err := h.exchange(t, h.happyForm())
+		require.NoError(t, err)
+
+		claims := mintedClaims(t, responder.GetAccessToken())
+		record, err := h.store.GetAccessTokenSession(ctx, claims["jti"].(string), nil)
+		require.NoError(t, err)
+		expiresAt := record.GetSession().GetExpiresAt(fosite.AccessToken)
+		require.Equal(t, int64(claims["exp"].(float64)), expiresAt.Unix())
+		require.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, 5*time.Second)
+	})
+}
+
+func TestTokenExchangeMayActPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     MayActPolicy
+		wantMayAct interface{}
+		wantErr    string
+	}{
+		{
+			name: "no policy",
+		},
+		{
+			name: "policy returns a value",
+			policy: func(_ context.Context, subject, audience string) (map[string]interface{}, error) {
+				require.Equal(t, "some-subject", subject)
+				require.Equal(t, "some-workload-cluster", audience)
+				return map[string]interface{}{"sub": "some-actor"}, nil
+			},
+			wantMayAct: map[string]interface{}{"sub": "some-actor"},
+		},
+		{
+			name: "policy returns nil",
+			policy: func(_ context.Context, _, _ string) (map[string]interface{}, error) {
+				return nil, nil
+			},
+		},
+		{
+			name: "policy errors",
+			policy: func(_ context.Context, _, _ string) (map[string]interface{}, error) {
+				return nil, errors.New("some policy error")
+			},
+			wantErr: "Unable to determine the may_act claim.",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{MayActPolicy: tt.policy}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, fosite.ErrServerError)
+				require.Equal(t, tt.wantErr, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			if tt.wantMayAct == nil {
+				require.NotContains(t, claims, "may_act")
+				return
+			}
+			require.Equal(t, tt.wantMayAct, claims["may_act"])
+		})
+	}
+}
+
+func TestTokenExchangeIssuer(t *testing.T) {
+	tests := []struct {
+		name       string
+		issuerFunc func(ctx context.Context, requester fosite.Requester) (string, error)
+		wantIssuer string
+		wantErr    string
+	}{
+		{
+			name:       "issuer is decided by the ID token strategy by default",
+			wantIssuer: "https://issuer.example.com", // the IDTokenIssuer of the test harness
+		},
+		{
+			name: "issuer of the original authorize request's FederationDomain",
+			issuerFunc: func(_ context.Context, requester fosite.Requester) (string, error) {
+				require.Equal(t, "some-subject", requester.GetSession().(*psession.PinnipedSession).Fosite.Subject)
+				return "https://other-issuer.example.com/some/path", nil
+			},
+			wantIssuer: "https://other-issuer.example.com/some/path",
+		},
+		{
+			name: "issuer func returns an empty string",
+			issuerFunc: func(_ context.Context, _ fosite.Requester) (string, error) {
+				return "", nil
+			},
+			wantIssuer: "https://issuer.example.com",
+		},
+		{
+			name: "issuer func errors",
+			issuerFunc: func(_ context.Context, _ fosite.Requester) (string, error) {
+				return "", errors.New("some issuer error")
+			},
+			wantErr: "Unable to determine the issuer.",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{IssuerFunc: tt.issuerFunc}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, fosite.ErrServerError)
+				require.Equal(t, tt.wantErr, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			require.Equal(t, tt.wantIssuer, claims["iss"])
+		})
+	}
+}
+
+func TestTokenExchangeEmbedProviderClaims(t *testing.T) {
+	tests := []struct {
+		name                 string
+		config               TokenExchangeConfiguration
+		storedExtra          map[string]interface{}
+		wantFederationDomain interface{}
+		wantIDPName          interface{}
+	}{
+		{
+			name: "not embedded by default",
+		},
+		{
+			name: "not embedded by default, even when the stored claims happen to have them",
+			storedExtra: map[string]interface{}{
+				"pinniped.dev/federation_domain": "https://some-stored-value.example.com",
+				"pinniped.dev/idp_name":          "some-stored-value",
+			},
+		},
+		{
+			name:                 "embedded",
+			config:               TokenExchangeConfiguration{EmbedProviderClaims: true},
+			wantFederationDomain: "https://issuer.example.com", // the IDTokenIssuer of the test harness
+			wantIDPName:          "some-idp-name",
+		},
+		{
+			name: "embedded with the issuer of the original authorize request's FederationDomain",
+			config: TokenExchangeConfiguration{
+				EmbedProviderClaims: true,
+				IssuerFunc: func(_ context.Context, _ fosite.Requester) (string, error) {
+					return "https://other-issuer.example.com/some/path", nil
+				},
+			},
+			wantFederationDomain: "https://other-issuer.example.com/some/path",
+			wantIDPName:          "some-idp-name",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			extra := map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"}
+			for k, v := range tt.storedExtra {
+				extra[k] = v
+			}
+			h := newTokenExchangeTestHarness(t, tt.config, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   extra,
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			if tt.wantFederationDomain == nil {
+				require.NotContains(t, claims, "pinniped.dev/federation_domain")
+				require.NotContains(t, claims, "pinniped.dev/idp_name")
+				return
+			}
+			require.Equal(t, tt.wantFederationDomain, claims["pinniped.dev/federation_domain"])
+			require.Equal(t, tt.wantIDPName, claims["pinniped.dev/idp_name"])
+		})
+	}
+}
+
+func TestTokenExchangeClientChecks(t *testing.T) {
+	tests := []struct {
+		name        string
+		client      *fosite.DefaultClient
+		form        func(h *tokenExchangeTestHarness) url.Values
+		wantErr     error
+		wantErrHint string
+	}{
+		{
+			name: "client ID does not match the client of the original access token",
+			client: &fosite.DefaultClient{
+				ID:         "some-other-client",
+				GrantTypes: fosite.Arguments{oidcapi.GrantTypeTokenExchange},
+			},
+			wantErr:     fosite.ErrInvalidGrant,
+			wantErrHint: "The OAuth 2.0 Client ID from this request does not match the one from the authorize request.",
+		},
+		{
+			name: "client ID is a prefix of the client of the original access token",
+			client: &fosite.DefaultClient{
+				ID:         oidcapi.ClientIDPinnipedCLI[:len(oidcapi.ClientIDPinnipedCLI)-1],
+				GrantTypes: fosite.Arguments{oidcapi.GrantTypeTokenExchange},
+			},
+			wantErr:     fosite.ErrInvalidGrant,
+			wantErrHint: "The OAuth 2.0 Client ID from this request does not match the one from the authorize request.",
+		},
+		{
+			name: "client is not allowed to use token exchange, which is checked before the access token is looked up",
+			client: &fosite.DefaultClient{
+				ID:         oidcapi.ClientIDPinnipedCLI,
+				GrantTypes: fosite.Arguments{oidcapi.GrantTypeAuthorizationCode},
+			},
+			form: func(h *tokenExchangeTestHarness) url.Values {
+				form := h.happyForm()
+				form.Set("subject_token", "some-access-token-which-does-not-exist")
+				return form
+			},
+			wantErr:     fosite.ErrUnauthorizedClient,
+			wantErrHint: `The OAuth 2.0 Client is not allowed to use token exchange grant "urn:ietf:params:oauth:grant-type:token-exchange".`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+			h.client = tt.client
+
+			form := h.happyForm()
+			if tt.form != nil {
+				form = tt.form(h)
+			}
+
+			_, err := h.exchange(t, form)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.wantErrHint, fosite.ErrorToRFC6749Error(err).HintField)
+		})
+	}
+}
+
+func TestTokenExchangeSigningKeyRotation(t *testing.T) {
+	const issuer = "https://issuer.example.com"
+
+	h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{}, &jwt.IDTokenClaims{
+		Subject: "some-subject",
+		Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+	})
+
+	oldKey := &jose.JSONWebKey{Key: h.signingKey, KeyID: "old-key", Algorithm: "ES256", Use: "sig"}
+	newSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	newKey := &jose.JSONWebKey{Key: newSigningKey, KeyID: "new-key", Algorithm: "ES256", Use: "sig"}
+
+	// The subject token was issued while the old key was active. Since then, the key was rotated: the new key is
+	// active, and the old key is still published so that the tokens which it signed can still be validated.
+	jwksProvider := jwks.NewDynamicJWKSProvider()
+	jwksProvider.SetIssuerToJWKSMap(
+		map[string]*jose.JSONWebKeySet{issuer: {Keys: []jose.JSONWebKey{newKey.Public(), oldKey.Public()}}},
+		map[string]*jose.JSONWebKey{issuer: newKey},
+	)
+	h.handler.idTokenStrategy = newDynamicOpenIDConnectECDSAStrategy(
+		&compose.Config{IDTokenIssuer: issuer, IDTokenLifespan: time.Hour},
+		jwksProvider,
+	)
+
+	responder, err := h.exchange(t, h.happyForm())
+	require.NoError(t, err)
+
+	parsed, err := josejwt.ParseSigned(responder.GetAccessToken())
+	require.NoError(t, err)
+	require.Len(t, parsed.Headers, 1)
+	require.Equal(t, "new-key", parsed.Headers[0].KeyID)
+
+	// The kid header points at a published key, which validates the token.
+	publishedJWKS, _ := jwksProvider.GetJWKS(issuer)
+	publishedKeys := publishedJWKS.Key(parsed.Headers[0].KeyID)
+	require.Len(t, publishedKeys, 1)
+	var claims map[string]interface{}
+	require.NoError(t, parsed.Claims(publishedKeys[0].Key, &claims))
+	require.Equal(t, issuer, claims["iss"])
+	require.Equal(t, []interface{}{"some-workload-cluster"}, claims["aud"])
+
+	// The token was not signed by the rotated out key.
+	require.Error(t, parsed.Claims(oldKey.Public().Key, &claims))
+}
+
+func TestTokenExchangeGroupsFilter(t *testing.T) {
+	allGroups := []string{"group1", "group2", "group3"}
+
+	tests := []struct {
+		name       string
+		cfg        TokenExchangeConfiguration
+		groups     interface{}
+		audience   string
+		wantGroups interface{}
+		wantErr    string
+	}{
+		{
+			name:       "all groups by default",
+			groups:     allGroups,
+			audience:   "some-workload-cluster",
+			wantGroups: []interface{}{"group1", "group2", "group3"},
+		},
+		{
+			name: "groups are filtered for a listed audience",
+			cfg: TokenExchangeConfiguration{GroupsFilter: GroupsFilterByAudience(map[string][]string{
+				"some-workload-cluster": {"group3", "group1", "some-other-group"},
+			})},
+			groups:     allGroups,
+			audience:   "some-workload-cluster",
+			wantGroups: []interface{}{"group1", "group3"},
+		},
+		{
+			name: "groups are filtered when read back from storage",
+			cfg: TokenExchangeConfiguration{GroupsFilter: GroupsFilterByAudience(map[string][]string{
+				"some-workload-cluster": {"group2"},
+			})},
+			groups:     []interface{}{"group1", "group2", "group3"},
+			audience:   "some-workload-cluster",
+			wantGroups: []interface{}{"group2"},
+		},
+		{
+			name: "no groups are left for a listed audience",
+			cfg: TokenExchangeConfiguration{GroupsFilter: GroupsFilterByAudience(map[string][]string{
+				"some-workload-cluster": {},
+			})},
+			groups:     allGroups,
+			audience:   "some-workload-cluster",
+			wantGroups: []interface{}{},
+		},
+		{
+			name: "all groups for an audience which is not listed",
+			cfg: TokenExchangeConfiguration{GroupsFilter: GroupsFilterByAudience(map[string][]string{
+				"some-other-workload-cluster": {"group2"},
+			})},
+			groups:     allGroups,
+			audience:   "some-workload-cluster",
+			wantGroups: []interface{}{"group1", "group2", "group3"},
+		},
+		{
+			name: "no groups claim when the user has no groups claim",
+			cfg: TokenExchangeConfiguration{GroupsFilter: func(_ context.Context, _ string, _ []string) ([]string, error) {
+				t.Fatal("the filter should not be called without a groups claim")
+				return nil, nil
+			}},
+			audience: "some-workload-cluster",
+		},
+		{
+			name: "filter error",
+			cfg: TokenExchangeConfiguration{GroupsFilter: func(_ context.Context, _ string, _ []string) ([]string, error) {
+				return nil, errors.New("some filter error")
+			}},
+			groups:   allGroups,
+			audience: "some-workload-cluster",
+			wantErr:  "Unable to filter the groups.",
+		},
+		{
+			name:     "invalid groups claim",
+			cfg:      TokenExchangeConfiguration{GroupsFilter: GroupsFilterByAudience(nil)},
+			groups:   []interface{}{"group1", 42},
+			audience: "some-workload-cluster",
+			wantErr:  "Invalid session storage.",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			extra := map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"}
+			if tt.groups != nil {
+				extra[oidcapi.IDTokenClaimGroups] = tt.groups
+			}
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{Subject: "some-subject", Extra: extra})
+
+			form := h.happyForm()
+			form.Set("audience", tt.audience)
+			responder, err := h.exchange(t, form)
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, fosite.ErrServerError)
+				require.Equal(t, tt.wantErr, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			if tt.wantGroups == nil {
+				require.NotContains(t, claims, oidcapi.IDTokenClaimGroups)
+			} else {
+				require.Equal(t, tt.wantGroups, claims[oidcapi.IDTokenClaimGroups])
+			}
+
+			// The stored session still has all of the user's groups.
+			storedClaims := h.originalRequest.GetSession().(*psession.PinnipedSession).Fosite.Claims
+			require.Equal(t, tt.groups, storedClaims.Extra[oidcapi.IDTokenClaimGroups])
+		})
+	}
+}
+
+func TestTokenExchangeMetrics(t *testing.T) {
+	tests := []struct {
+		name                 string
+		cfg                  TokenExchangeConfiguration
+		client               *fosite.DefaultClient
+		form                 func(form url.Values)
+		wantOutcome          string
+		wantSubjectTokenType string
+	}{
+		{
+			name:                 "success",
+			wantOutcome:          "success",
+			wantSubjectTokenType: "access_token",
+		},
+		{
+			name:                 "invalid request",
+			form:                 func(form url.Values) { form.Del("audience") },
+			wantOutcome:          "invalid_request",
+			wantSubjectTokenType: "access_token",
+		},
+		{
+			name:                 "jwt subject token",
+			form:                 func(form url.Values) { form.Set("subject_token_type", tokenTypeJWT) },
+			wantOutcome:          "invalid_request",
+			wantSubjectTokenType: "jwt",
+		},
+		{
+			name:                 "unsupported subject token type",
+			form:                 func(form url.Values) { form.Set("subject_token_type", "some-other-token-type") },
+			wantOutcome:          "invalid_request",
+			wantSubjectTokenType: "other",
+		},
+		{
+			name: "access denied",
+			cfg: TokenExchangeConfiguration{AudienceAuthorizer: audienceAuthorizerFunc(func(_ context.Context, _, _, _ string) (bool, error) {
+				return false, nil
+			})},
+			wantOutcome:          "access_denied",
+			wantSubjectTokenType: "access_token",
+		},
+		{
+			name: "unauthorized client",
+			client: &fosite.DefaultClient{
+				ID:         oidcapi.ClientIDPinnipedCLI,
+				GrantTypes: fosite.Arguments{oidcapi.GrantTypeAuthorizationCode},
+			},
+			wantOutcome:          "unauthorized_client",
+			wantSubjectTokenType: "access_token",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			tt.cfg.MetricsRegisterer = registry
+			h := newTokenExchangeTestHarness(t, tt.cfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+			if tt.client != nil {
+				h.client = tt.client
+			}
+
+			form := h.happyForm()
+			if tt.form != nil {
+				tt.form(form)
+			}
+			_, err := h.exchange(t, form)
+			if tt.wantOutcome == "success" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			require.Equal(t, 1, testutil.CollectAndCount(h.handler.metrics.total))
+			require.Equal(t, float64(1), testutil.ToFloat64(h.handler.metrics.total.WithLabelValues(tt.wantOutcome, tt.wantSubjectTokenType)))
+			require.Equal(t, 1, testutil.CollectAndCount(h.handler.metrics.duration))
+		})
+	}
+}
+
+func TestTokenExchangeMetricsRegistration(t *testing.T) {
+	claims := &jwt.IDTokenClaims{
+		Subject: "some-subject",
+		Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+	}
+
+	// Without a registerer, nothing is instrumented.
+	h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{}, claims)
+	require.Nil(t, h.handler.metrics)
+	_, err := h.exchange(t, h.happyForm())
+	require.NoError(t, err)
+
+	// Handlers which share a registerer, e.g. those of several FederationDomains, share the collectors.
+	registry := prometheus.NewRegistry()
+	h1 := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{MetricsRegisterer: registry}, claims)
+	h2 := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{MetricsRegisterer: registry}, claims)
+	require.Same(t, h1.handler.metrics.total, h2.handler.metrics.total)
+	require.Same(t, h1.handler.metrics.duration, h2.handler.metrics.duration)
+
+	_, err = h1.exchange(t, h1.happyForm())
+	require.NoError(t, err)
+	_, err = h2.exchange(t, h2.happyForm())
+	require.NoError(t, err)
+	require.Equal(t, float64(2), testutil.ToFloat64(h1.handler.metrics.total.WithLabelValues("success", "access_token")))
+
+	count, err := testutil.GatherAndCount(registry,
+		"pinniped_supervisor_token_exchange_requests_total",
+		"pinniped_supervisor_token_exchange_duration_seconds",
+	)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestTokenExchangeReservedAudienceSubstrings(t *testing.T) {
+	tests := []struct {
+		name        string
+		reserved    []string
+		audience    string
+		wantErrHint string
+	}{
+		{
+			name:     "no reserved substrings",
+			audience: "internal.example.com",
+		},
+		{
+			name:     "audience which does not contain a reserved substring",
+			reserved: []string{"internal.example.com", "some-prefix-"},
+			audience: "some-workload-cluster",
+		},
+		{
+			name:        "audience which contains a reserved substring",
+			reserved:    []string{"internal.example.com", "some-prefix-"},
+			audience:    "cluster.internal.example.com",
+			wantErrHint: "requested audience cannot contain 'internal.example.com'",
+		},
+		{
+			name:        "audience which equals a reserved substring",
+			reserved:    []string{"internal.example.com", "some-prefix-"},
+			audience:    "some-prefix-",
+			wantErrHint: "requested audience cannot contain 'some-prefix-'",
+		},
+		{
+			name:     "empty reserved substrings are ignored",
+			reserved: []string{""},
+			audience: "some-workload-cluster",
+		},
+		{
+			name:        "built-in reservations still apply",
+			reserved:    []string{"internal.example.com"},
+			audience:    "something.pinniped.dev",
+			wantErrHint: "requested audience cannot contain '.pinniped.dev'",
+		},
+		{
+			name:        "built-in reservation of the CLI client still applies",
+			reserved:    []string{"internal.example.com"},
+			audience:    oidcapi.ClientIDPinnipedCLI,
+			wantErrHint: "requested audience cannot equal 'pinniped-cli'",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{ReservedAudienceSubstrings: tt.reserved}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+
+			form := h.happyForm()
+			form.Set("audience", tt.audience)
+			responder, err := h.exchange(t, form)
+			if tt.wantErrHint != "" {
+				require.ErrorIs(t, err, fosite.ErrInvalidRequest)
+				require.Equal(t, tt.wantErrHint, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{tt.audience}, mintedClaims(t, responder.GetAccessToken())["aud"])
+		})
+	}
+}
+
+func TestTokenExchangeMaxActChainDepth(t *testing.T) {
+	// actChain returns an act claim value which names the given number of nested actors.
+	actChain := func(depth int) map[string]interface{} {
+		act := map[string]interface{}{"sub": "actor-1"}
+		for i := 2; i <= depth; i++ {
+			act = map[string]interface{}{"sub": fmt.Sprintf("actor-%d", i), "act": act}
+		}
+		return act
+	}
+
+	tests := []struct {
+		name        string
+		maxDepth    int
+		act         interface{}
+		wantErrHint string
+	}{
+		{
+			name: "any depth is allowed by default",
+			act:  actChain(20),
+		},
+		{
+			name:     "no act claim",
+			maxDepth: 1,
+		},
+		{
+			name:     "chain shorter than the limit",
+			maxDepth: 3,
+			act:      actChain(2),
+		},
+		{
+			name:     "chain at the limit",
+			maxDepth: 3,
+			act:      actChain(3),
+		},
+		{
+			name:        "chain longer than the limit",
+			maxDepth:    3,
+			act:         actChain(4),
+			wantErrHint: "The 'subject_token' has a delegation chain which is longer than the maximum of 3 actors.",
+		},
+		{
+			name:     "act claim which is not an object ends the chain",
+			maxDepth: 1,
+			act:      "some-actor",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			extra := map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"}
+			if tt.act != nil {
+				extra["act"] = tt.act
+			}
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{MaxActChainDepth: tt.maxDepth}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   extra,
+			})
+
+			responder, err := h.exchange(t, h.happyForm())
+			if tt.wantErrHint != "" {
+				require.ErrorIs(t, err, fosite.ErrInvalidRequest)
+				require.Equal(t, tt.wantErrHint, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+			claims := mintedClaims(t, responder.GetAccessToken())
+			if tt.act == nil {
+				require.NotContains(t, claims, "act")
+			} else {
+				require.Equal(t, actChainDepth(extra), actChainDepth(claims))
+			}
+		})
+	}
+}
+
+func TestActChainDepth(t *testing.T) {
+	require.Equal(t, 0, actChainDepth(nil))
+	require.Equal(t, 0, actChainDepth(map[string]interface{}{"sub": "some-subject"}))
+	require.Equal(t, 1, actChainDepth(map[string]interface{}{"act": map[string]interface{}{"sub": "actor-1"}}))
+	require.Equal(t, 1, actChainDepth(map[string]interface{}{"act": "actor-1"}))
+	require.Equal(t, 2, actChainDepth(map[string]interface{}{"act": map[string]interface{}{"sub": "actor-2", "act": map[string]interface{}{"sub": "actor-1"}}}))
+}
+
+func TestTokenExchangeResponseScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		grantedScopes []string
+		wantScope     string
+	}{
+		{
+			name:          "only the required scopes",
+			grantedScopes: []string{oidcapi.ScopeOpenID, oidcapi.ScopeRequestAudience},
+			wantScope:     "openid pinniped:request-audience",
+		},
+		{
+			name:          "more scopes",
+			grantedScopes: []string{oidcapi.ScopeOpenID, oidcapi.ScopeRequestAudience, oidcapi.ScopeUsername, oidcapi.ScopeGroups},
+			wantScope:     "openid pinniped:request-audience username groups",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+			h.originalRequest.GrantedScope = fosite.Arguments(tt.grantedScopes)
+
+			responder, err := h.exchange(t, h.happyForm())
+			require.NoError(t, err)
+			require.Equal(t, tt.wantScope, responder.GetExtra("scope"))
+		})
+	}
+}
+
+func TestTokenExchangeDPoP(t *testing.T) {
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientJWK := jose.JSONWebKey{Key: clientKey.Public()}
+	thumbprint, err := clientJWK.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	wantJKT := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	happyClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"jti": "some-jti",
+			"htm": "POST",
+			"htu": "https://issuer.example.com/oauth2/token",
+			"iat": time.Now().Unix(),
+		}
+	}
+	newProof := func(t *testing.T, typ string, claims map[string]interface{}) string {
+		t.Helper()
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: clientKey},
+			(&jose.SignerOptions{EmbedJWK: true}).WithType(jose.ContentType(typ)),
+		)
+		require.NoError(t, err)
+		proof, err := josejwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return proof
+	}
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := happyClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name          string
+		disabled      bool
+		proofs        func(t *testing.T) []string
+		storedCnf     interface{}
+		wantJKT       string
+		wantErrorHint string
+	}{
+		{
+			name:    "a valid proof binds the minted JWT to the client's key",
+			proofs:  func(t *testing.T) []string { return []string{newProof(t, "dpop+jwt", happyClaims())} },
+			wantJKT: wantJKT,
+		},
+		{
+			name:   "no proof mints an unbound JWT",
+			proofs: func(t *testing.T) []string { return nil },
+		},
+		{
+			name:      "no proof never copies a cnf claim from the stored session",
+			proofs:    func(t *testing.T) []string { return nil },
+			storedCnf: map[string]interface{}{"jkt": "some-other-jkt"},
+		},
+		{
+			name:     "proofs are ignored when not enabled",
+			disabled: true,
+			proofs:   func(t *testing.T) []string { return []string{"not-a-proof"} },
+		},
+		{
+			name: "more than one proof",
+			proofs: func(t *testing.T) []string {
+				return []string{newProof(t, "dpop+jwt", happyClaims()), newProof(t, "dpop+jwt", happyClaims())}
+			},
+			wantErrorHint: "Only one DPoP proof may be sent.",
+		},
+		{
+			name:          "a proof which is not a JWS",
+			proofs:        func(t *testing.T) []string { return []string{"not-a-proof"} },
+			wantErrorHint: "could not parse the DPoP proof: square/go-jose: compact JWS format must have three parts",
+		},
+		{
+			name:          "a proof with the wrong typ header",
+			proofs:        func(t *testing.T) []string { return []string{newProof(t, "JWT", happyClaims())} },
+			wantErrorHint: `the DPoP proof must have the typ header "dpop+jwt"`,
+		},
+		{
+			name:          "a proof without a jti claim",
+			proofs:        func(t *testing.T) []string { return []string{newProof(t, "dpop+jwt", withClaim("jti", nil))} },
+			wantErrorHint: "the DPoP proof must have a jti claim",
+		},
+		{
+			name:          "a proof for another HTTP method",
+			proofs:        func(t *testing.T) []string { return []string{newProof(t, "dpop+jwt", withClaim("htm", "GET"))} },
+			wantErrorHint: `the htm claim of the DPoP proof must be "POST"`,
+		},
+		{
+			name: "a proof for another URI",
+			proofs: func(t *testing.T) []string {
+				return []string{newProof(t, "dpop+jwt", withClaim("htu", "https://other-issuer.example.com/oauth2/token"))}
+			},
+			wantErrorHint: `the htu claim of the DPoP proof must be "https://issuer.example.com/oauth2/token"`,
+		},
+		{
+			name: "a proof which is too old",
+			proofs: func(t *testing.T) []string {
+				return []string{newProof(t, "dpop+jwt", withClaim("iat", time.Now().Add(-10*time.Minute).Unix()))}
+			},
+			wantErrorHint: "the iat claim of the DPoP proof must be within 5m0s of the current time",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			extra := map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"}
+			if tt.storedCnf != nil {
+				extra["cnf"] = tt.storedCnf
+			}
+			h := newTokenExchangeTestHarness(t, TokenExchangeConfiguration{AcceptDPoPProofs: !tt.disabled}, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   extra,
+			})
+
+			ctx := WithDPoPProofs(context.Background(), tt.proofs(t))
+			responder, err := h.exchangeWithContext(t, ctx, h.happyForm())
+			if tt.wantErrorHint != "" {
+				require.Error(t, err)
+				rfc6749Error := fosite.ErrorToRFC6749Error(err)
+				require.Equal(t, "invalid_dpop_proof", rfc6749Error.ErrorField)
+				require.Equal(t, tt.wantErrorHint, rfc6749Error.HintField)
+				return
+			}
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			if tt.wantJKT == "" {
+				require.NotContains(t, claims, "cnf")
+				return
+			}
+			require.Equal(t, map[string]interface{}{"jkt": tt.wantJKT}, claims["cnf"])
+		})
+	}
+}
+
+func TestTokenExchangeIssueSupervisorAccessTokens(t *testing.T) {
+	newHarness := func(t *testing.T, cfg TokenExchangeConfiguration) *tokenExchangeTestHarness {
+		return newTokenExchangeTestHarness(t, cfg, &jwt.IDTokenClaims{
+			Subject: "some-subject",
+			Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+		})
+	}
+	formWithParam := func(h *tokenExchangeTestHarness, value string) url.Values {
+		form := h.happyForm()
+		form.Set("pinniped_supervisor_access_token", value)
+		return form
+	}
+
+	t.Run("returns a supervisor access token along with the JWT when configured and requested", func(t *testing.T) {
+		ctx := context.Background()
+		h := newHarness(t, TokenExchangeConfiguration{IssueSupervisorAccessTokens: true})
+
+		responder, err := h.exchange(t, formWithParam(h, "true"))
+		require.NoError(t, err)
+
+		// The JWT is still the primary token of the response.
+		require.Equal(t, "some-subject", mintedClaims(t, responder.GetAccessToken())["sub"])
+		require.Equal(t, tokenTypeJWT, responder.GetExtra("issued_token_type"))
+		require.Equal(t, "N_A", responder.GetTokenType())
+
+		supervisorAccessToken, ok := responder.GetExtra("pinniped_supervisor_access_token").(string)
+		require.True(t, ok)
+		require.NotEmpty(t, supervisorAccessToken)
+		require.NotEqual(t, h.accessToken, supervisorAccessToken)
+		expiresIn, ok := responder.GetExtra("pinniped_supervisor_access_token_expires_in").(int64)
+		require.True(t, ok)
+		require.InDelta(t, time.Hour.Seconds(), expiresIn, 5)
+
+		// The supervisor access token is stored with the same session and scopes, and expires with the exchanged one.
+		record, err := h.store.GetAccessTokenSession(ctx, h.hmac.AccessTokenSignature(supervisorAccessToken), nil)
+		require.NoError(t, err)
+		require.NoError(t, h.hmac.ValidateAccessToken(ctx, record, supervisorAccessToken))
+		require.Equal(t, oidcapi.ClientIDPinnipedCLI, record.GetClient().GetID())
+		require.Equal(t, h.originalRequest.GetGrantedScopes(), record.GetGrantedScopes())
+		require.Equal(t, "some-subject", record.GetSession().GetSubject())
+		require.Equal(t, h.originalRequest.GetSession().GetExpiresAt(fosite.AccessToken), record.GetSession().GetExpiresAt(fosite.AccessToken))
+		require.Equal(t, fosite.Arguments{oidcapi.GrantTypeTokenExchange}, record.(fosite.AccessRequester).GetGrantTypes())
+		require.NotEmpty(t, h.originalRequest.GetID())
+		require.Equal(t, h.originalRequest.GetID(), record.GetID())
+
+		// The supervisor access token may itself be exchanged.
+		secondForm := h.happyForm()
+		secondForm.Set("subject_token", supervisorAccessToken)
+		_, err = h.exchange(t, secondForm)
+		require.NoError(t, err)
+
+		// Revoking the original grant also revokes the supervisor access token.
+		require.NoError(t, h.store.RevokeAccessToken(ctx, h.originalRequest.GetID()))
+		_, err = h.store.GetAccessTokenSession(ctx, h.hmac.AccessTokenSignature(supervisorAccessToken), nil)
+		require.ErrorIs(t, err, fosite.ErrNotFound)
+	})
+
+	t.Run("only returns the JWT when not requested", func(t *testing.T) {
+		h := newHarness(t, TokenExchangeConfiguration{IssueSupervisorAccessTokens: true})
+
+		for _, form := range []url.Values{h.happyForm(), formWithParam(h, "false")} {
+			responder, err := h.exchange(t, form)
+			require.NoError(t, err)
+			require.Nil(t, responder.GetExtra("pinniped_supervisor_access_token"))
+			require.Nil(t, responder.GetExtra("pinniped_supervisor_access_token_expires_in"))
+		}
+		require.Len(t, h.store.AccessTokens, 1)
+	})
+
+	t.Run("ignores the request when not configured", func(t *testing.T) {
+		h := newHarness(t, TokenExchangeConfiguration{})
+
+		responder, err := h.exchange(t, formWithParam(h, "true"))
+		require.NoError(t, err)
+		require.NotEmpty(t, responder.GetAccessToken())
+		require.Nil(t, responder.GetExtra("pinniped_supervisor_access_token"))
+		require.Len(t, h.store.AccessTokens, 1)
+	})
+
+	t.Run("rejects an invalid parameter value", func(t *testing.T) {
+		h := newHarness(t, TokenExchangeConfiguration{IssueSupervisorAccessTokens: true})
+
+		_, err := h.exchange(t, formWithParam(h, "yes"))
+		require.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		require.Equal(t, `Unsupported 'pinniped_supervisor_access_token' parameter value, must be "true" or "false".`, fosite.ErrorToRFC6749Error(err).HintField)
+	})
+}
+
+func TestTokenExchangePerFederationDomainConfiguration(t *testing.T) {
+	// The users of this IssuerFunc logged in at one of two FederationDomains, depending on their identity provider.
+	issuerFunc := func(_ context.Context, requester fosite.Requester) (string, error) {
+		if requester.GetSession().(*psession.PinnipedSession).Custom.ProviderName == "some-idp-name" {
+			return "https://tenant-a.example.com", nil
+		}
+		return "https://tenant-b.example.com", nil
+	}
+	configsByFederationDomain := map[string]TokenExchangeConfiguration{
+		"https://tenant-a.example.com": {
+			ExchangedTokenLifetime:     5 * time.Minute,
+			ReservedAudienceSubstrings: []string{"tenant-b-"},
+		},
+		"https://issuer.example.com": { // the IDTokenIssuer of the test harness
+			ExchangedTokenLifetime: 10 * time.Minute,
+		},
+	}
+
+	tests := []struct {
+		name         string
+		defaultCfg   TokenExchangeConfiguration
+		providerName string
+		audience     string
+		wantIssuer   string
+		wantLifetime time.Duration
+		wantErrHint  string
+	}{
+		{
+			name:         "uses the configuration of the FederationDomain decided by the IssuerFunc",
+			defaultCfg:   TokenExchangeConfiguration{IssuerFunc: issuerFunc, ExchangedTokenLifetime: 20 * time.Minute},
+			providerName: "some-idp-name",
+			audience:     "some-workload-cluster",
+			wantIssuer:   "https://tenant-a.example.com",
+			wantLifetime: 5 * time.Minute,
+		},
+		{
+			name:         "applies the reserved audience substrings of the FederationDomain",
+			defaultCfg:   TokenExchangeConfiguration{IssuerFunc: issuerFunc},
+			providerName: "some-idp-name",
+			audience:     "tenant-b-cluster",
+			wantErrHint:  "requested audience cannot contain 'tenant-b-'",
+		},
+		{
+			name:         "uses the default configuration for other FederationDomains",
+			defaultCfg:   TokenExchangeConfiguration{IssuerFunc: issuerFunc, ExchangedTokenLifetime: 20 * time.Minute},
+			providerName: "some-other-idp-name",
+			audience:     "tenant-b-cluster",
+			wantIssuer:   "https://tenant-b.example.com",
+			wantLifetime: 20 * time.Minute,
+		},
+		{
+			name:         "uses the issuer of the handler without an IssuerFunc",
+			defaultCfg:   TokenExchangeConfiguration{ExchangedTokenLifetime: 20 * time.Minute},
+			providerName: "some-idp-name",
+			audience:     "some-workload-cluster",
+			wantIssuer:   "https://issuer.example.com",
+			wantLifetime: 10 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTokenExchangeTestHarness(t, tt.defaultCfg, &jwt.IDTokenClaims{
+				Subject: "some-subject",
+				Extra:   map[string]interface{}{oidcapi.IDTokenClaimUsername: "some-username"},
+			})
+			h.handler.configsByFederationDomain = configsByFederationDomain
+			h.originalRequest.GetSession().(*psession.PinnipedSession).Custom.ProviderName = tt.providerName
+
+			form := h.happyForm()
+			form.Set("audience", tt.audience)
+			responder, err := h.exchange(t, form)
+			if tt.wantErrHint != "" {
+				require.ErrorIs(t, err, fosite.ErrInvalidRequest)
+				require.Equal(t, tt.wantErrHint, fosite.ErrorToRFC6749Error(err).HintField)
+				return
+			}
+			require.NoError(t, err)
+
+			claims := mintedClaims(t, responder.GetAccessToken())
+			require.Equal(t, tt.wantIssuer, claims["iss"])
+			require.InDelta(t, time.Now().Add(tt.wantLifetime).Unix(), claims["exp"], 5)
+		})
+	}
+}
+
+func TestNewPerFederationDomainTokenExchangeFactory(t *testing.T) {
+	issuerFunc := func(_ context.Context, _ fosite.Requester) (string, error) { return "", nil }
+
+	tests := []struct {
+		name    string
+		configs map[string]TokenExchangeConfiguration
+		wantErr string
+	}{
+		{
+			name:    "no configurations",
+			configs: nil,
+		},
+		{
+			name: "configurations without an IssuerFunc or MetricsRegisterer",
+			configs: map[string]TokenExchangeConfiguration{
+				"https://tenant-a.example.com": {ExchangedTokenLifetime: 5 * time.Minute},
+			},
+		},
+		{
+			name: "a configuration with an IssuerFunc",
+			configs: map[string]TokenExchangeConfiguration{
+				"https://tenant-a.example.com": {IssuerFunc: issuerFunc},
+			},
+			wantErr: `the token exchange configuration of FederationDomain "https://tenant-a.example.com" must not set an IssuerFunc`,
+		},
+		{
+			name: "a configuration with a MetricsRegisterer",
+			configs: map[string]TokenExchangeConfiguration{
+				"https://tenant-a.example.com": {MetricsRegisterer: prometheus.NewRegistry()},
+			},
+			wantErr: `the token exchange configuration of FederationDomain "https://tenant-a.example.com" must not set a MetricsRegisterer`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			factory, err := NewPerFederationDomainTokenExchangeFactory(TokenExchangeConfiguration{IssuerFunc: issuerFunc}, tt.configs)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, factory)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, factory)
+		})
+	}
+}
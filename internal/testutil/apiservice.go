@@ -0,0 +1,31 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package testutil
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	kubetesting "k8s.io/client-go/testing"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	aggregatorv1fake "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/fake"
+)
+
+// APIServicesGVR is the resource of APIServices, for use with the fake clientset's object tracker.
+var APIServicesGVR = apiregistrationv1.SchemeGroupVersion.WithResource("apiservices")
+
+// NewFakeAggregatorClientset returns a fake aggregation clientset which is pre-seeded with the given APIServices.
+func NewFakeAggregatorClientset(apiServices ...*apiregistrationv1.APIService) *aggregatorv1fake.Clientset {
+	objects := make([]runtime.Object, 0, len(apiServices))
+	for _, apiService := range apiServices {
+		objects = append(objects, apiService)
+	}
+	return aggregatorv1fake.NewSimpleClientset(objects...)
+}
+
+// PrependAPIServiceErrorReactor causes every request of the given verb (e.g. "get" or "update") on APIServices
+// to fail with the given error.
+func PrependAPIServiceErrorReactor(client *aggregatorv1fake.Clientset, verb string, err error) {
+	client.PrependReactor(verb, "apiservices", func(_ kubetesting.Action) (bool, runtime.Object, error) {
+		return true, nil, err
+	})
+}
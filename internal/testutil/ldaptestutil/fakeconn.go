@@ -0,0 +1,113 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ldaptestutil contains fakes for testing code which talks to LDAP servers.
+package ldaptestutil
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// FakeStartTLSConn is a fake unencrypted LDAP connection which can be upgraded using StartTLS, for testing how
+// connections are upgraded without a real LDAP server. Like a server which requires TLS, it refuses all operations
+// until StartTLS has succeeded. Its zero value succeeds at StartTLS, accepts every bind, and finds nothing.
+type FakeStartTLSConn struct {
+	// StartTLSErr, when not nil, is returned by StartTLS, which then leaves the connection unencrypted.
+	StartTLSErr error
+
+	// BindFunc, when not nil, is called by Bind once the connection is encrypted.
+	BindFunc func(username, password string) error
+
+	// SearchFunc, when not nil, is called by Search and SearchWithPaging once the connection is encrypted.
+	SearchFunc func(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+
+	// Calls holds the names of the called methods, in the order in which they were called.
+	Calls []string
+
+	// TLSConfig is the config which was passed to StartTLS.
+	TLSConfig *tls.Config
+
+	encrypted bool
+	closed    bool
+}
+
+func (c *FakeStartTLSConn) StartTLS(config *tls.Config) error {
+	c.Calls = append(c.Calls, "StartTLS")
+	if c.encrypted {
+		// This is the same error as the one from ldap.Conn.
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: already encrypted"))
+	}
+	c.TLSConfig = config
+	if c.StartTLSErr != nil {
+		return c.StartTLSErr
+	}
+	c.encrypted = true
+	return nil
+}
+
+func (c *FakeStartTLSConn) Bind(username, password string) error {
+	c.Calls = append(c.Calls, "Bind")
+	if err := c.requireEncrypted(); err != nil {
+		return err
+	}
+	if c.BindFunc == nil {
+		return nil
+	}
+	return c.BindFunc(username, password)
+}
+
+func (c *FakeStartTLSConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.Calls = append(c.Calls, "Search")
+	return c.search(searchRequest)
+}
+
+func (c *FakeStartTLSConn) SearchWithPaging(searchRequest *ldap.SearchRequest, _ uint32) (*ldap.SearchResult, error) {
+	c.Calls = append(c.Calls, "SearchWithPaging")
+	return c.search(searchRequest)
+}
+
+func (c *FakeStartTLSConn) WhoAmI(_ []ldap.Control) (*ldap.WhoAmIResult, error) {
+	c.Calls = append(c.Calls, "WhoAmI")
+	if err := c.requireEncrypted(); err != nil {
+		return nil, err
+	}
+	return &ldap.WhoAmIResult{}, nil
+}
+
+func (c *FakeStartTLSConn) Close() {
+	c.Calls = append(c.Calls, "Close")
+	c.closed = true
+}
+
+// IsEncrypted returns whether StartTLS has succeeded.
+func (c *FakeStartTLSConn) IsEncrypted() bool {
+	return c.encrypted
+}
+
+// IsClosed returns whether Close was called.
+func (c *FakeStartTLSConn) IsClosed() bool {
+	return c.closed
+}
+
+func (c *FakeStartTLSConn) search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if err := c.requireEncrypted(); err != nil {
+		return nil, err
+	}
+	if c.SearchFunc == nil {
+		return &ldap.SearchResult{}, nil
+	}
+	return c.SearchFunc(searchRequest)
+}
+
+func (c *FakeStartTLSConn) requireEncrypted() error {
+	if c.closed {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+	}
+	if !c.encrypted {
+		return ldap.NewError(ldap.LDAPResultConfidentialityRequired, errors.New("confidentiality required"))
+	}
+	return nil
+}
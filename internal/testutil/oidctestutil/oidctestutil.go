@@ -97,17 +97,19 @@ type ValidateRefreshArgs struct {
 }
 
 type TestUpstreamLDAPIdentityProvider struct {
-	Name                    string
-	ResourceUID             types.UID
-	URL                     *url.URL
-	AuthenticateFunc        func(ctx context.Context, username, password string) (*authenticators.Response, bool, error)
-	performRefreshCallCount int
-	performRefreshArgs      []*PerformRefreshArgs
-	PerformRefreshErr       error
-	PerformRefreshGroups    []string
+	Name                       string
+	ResourceUID                types.UID
+	URL                        *url.URL
+	AuthenticateFunc           func(ctx context.Context, username, password string) (*authenticators.Response, bool, error)
+	performRefreshCallCount    int
+	performRefreshArgs         []*PerformRefreshArgs
+	PerformRefreshErr          error
+	PerformRefreshGroups       []string
+	UserFacingErrorMessageFunc func(err error) string
 }
 
 var _ provider.UpstreamLDAPIdentityProviderI = &TestUpstreamLDAPIdentityProvider{}
+var _ provider.UpstreamUserFacingErrorMessager = &TestUpstreamLDAPIdentityProvider{}
 
 func (u *TestUpstreamLDAPIdentityProvider) GetResourceUID() types.UID {
 	return u.ResourceUID
@@ -142,6 +144,13 @@ func (u *TestUpstreamLDAPIdentityProvider) PerformRefresh(ctx context.Context, s
 	return u.PerformRefreshGroups, nil
 }
 
+func (u *TestUpstreamLDAPIdentityProvider) UserFacingErrorMessage(err error) string {
+	if u.UserFacingErrorMessageFunc == nil {
+		return ""
+	}
+	return u.UserFacingErrorMessageFunc(err)
+}
+
 func (u *TestUpstreamLDAPIdentityProvider) PerformRefreshCallCount() int {
 	return u.performRefreshCallCount
 }
@@ -0,0 +1,114 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// AccountStatusExtraKey is the key of the user's extra info which holds the status of the user's Active Directory
+// account when ProviderConfig.DryRunAccountStatus is enabled. It is only ever added by DryRunAuthenticateUser.
+const AccountStatusExtraKey = "ldap.pinniped.dev/account-status"
+
+// The account statuses which may be found under the AccountStatusExtraKey. An account is either enabled, or it has
+// any combination of the other statuses.
+const (
+	AccountStatusEnabled         = "enabled"
+	AccountStatusDisabled        = "disabled"
+	AccountStatusLocked          = "locked"
+	AccountStatusPasswordExpired = "password-expired"
+)
+
+const (
+	// userAccountControlAttribute is a bitmap of the properties of an Active Directory account.
+	// https://docs.microsoft.com/en-us/troubleshoot/windows-server/identity/useraccountcontrol-manipulate-account-properties
+	userAccountControlAttribute = "userAccountControl"
+
+	// userAccountControlComputedAttribute is a bitmap of the properties of an Active Directory account which are
+	// computed by the server, including the lockout and password expiration, which are not kept up to date in the
+	// userAccountControlAttribute. https://docs.microsoft.com/en-us/windows/win32/adschema/a-msds-user-account-control-computed
+	userAccountControlComputedAttribute = "msDS-User-Account-Control-Computed"
+
+	accountControlDisabled        = 0x0002   // ACCOUNTDISABLE
+	accountControlLocked          = 0x0010   // UF_LOCKOUT
+	accountControlPasswordExpired = 0x800000 // UF_PASSWORD_EXPIRED
+)
+
+// searchAccountStatus reads the account control attributes of the user, and returns the statuses of their account.
+func (p *Provider) searchAccountStatus(conn Conn, userDN string) ([]string, error) {
+	searchResult, err := conn.Search(p.accountStatusSearchRequest(userDN))
+	if err != nil {
+		return nil, fmt.Errorf(`error searching for account status of user with DN %q: %w`, userDN, err)
+	}
+	if len(searchResult.Entries) != 1 {
+		return nil, fmt.Errorf(`searching for account status of user with DN %q resulted in %d search results, but expected 1 result`,
+			userDN, len(searchResult.Entries),
+		)
+	}
+	statuses, err := accountStatuses(searchResult.Entries[0])
+	if err != nil {
+		return nil, fmt.Errorf(`error reading account status of user with DN %q: %w`, userDN, err)
+	}
+	return statuses, nil
+}
+
+func (p *Provider) accountStatusSearchRequest(userDN string) *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       userDN,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)", // we already have the dn, so the filter doesn't matter
+		Attributes:   []string{userAccountControlAttribute, userAccountControlComputedAttribute},
+		Controls:     nil, // don't need paging because we set the SizeLimit so small
+	}
+}
+
+// accountStatuses decodes the account control attributes of the entry. The computed attribute is preferred for the
+// lockout and password expiration, but older servers which do not have it may set them in userAccountControl.
+func accountStatuses(entry *ldap.Entry) ([]string, error) {
+	userAccountControl, err := accountControlBitmap(entry, userAccountControlAttribute)
+	if err != nil {
+		return nil, err
+	}
+	computedFlags := userAccountControl
+	if len(entry.GetAttributeValues(userAccountControlComputedAttribute)) > 0 {
+		computedFlags, err = accountControlBitmap(entry, userAccountControlComputedAttribute)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := []string{}
+	if userAccountControl&accountControlDisabled != 0 {
+		statuses = append(statuses, AccountStatusDisabled)
+	}
+	if computedFlags&accountControlLocked != 0 {
+		statuses = append(statuses, AccountStatusLocked)
+	}
+	if computedFlags&accountControlPasswordExpired != 0 {
+		statuses = append(statuses, AccountStatusPasswordExpired)
+	}
+	if len(statuses) == 0 {
+		statuses = append(statuses, AccountStatusEnabled)
+	}
+	return statuses, nil
+}
+
+func accountControlBitmap(entry *ldap.Entry, attributeName string) (int64, error) {
+	values := entry.GetAttributeValues(attributeName)
+	if len(values) != 1 {
+		return 0, fmt.Errorf(`found %d values for attribute %q, but expected 1 result`, len(values), attributeName)
+	}
+	bitmap, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf(`could not parse attribute %q as a number: %w`, attributeName, err)
+	}
+	return bitmap, nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestAccountStatuses(t *testing.T) {
+	tests := []struct {
+		name         string
+		attributes   map[string]string
+		wantStatuses []string
+		wantError    string
+	}{
+		{
+			name:         "enabled",
+			attributes:   map[string]string{userAccountControlAttribute: "512", userAccountControlComputedAttribute: "0"},
+			wantStatuses: []string{AccountStatusEnabled},
+		},
+		{
+			name:         "disabled",
+			attributes:   map[string]string{userAccountControlAttribute: "514", userAccountControlComputedAttribute: "0"},
+			wantStatuses: []string{AccountStatusDisabled},
+		},
+		{
+			name:         "locked and password expired according to the computed attribute",
+			attributes:   map[string]string{userAccountControlAttribute: "512", userAccountControlComputedAttribute: "8388624"},
+			wantStatuses: []string{AccountStatusLocked, AccountStatusPasswordExpired},
+		},
+		{
+			name:         "computed attribute is preferred over userAccountControl",
+			attributes:   map[string]string{userAccountControlAttribute: "8389136", userAccountControlComputedAttribute: "0"},
+			wantStatuses: []string{AccountStatusEnabled},
+		},
+		{
+			name:         "userAccountControl is used when the computed attribute is missing",
+			attributes:   map[string]string{userAccountControlAttribute: "8389122"},
+			wantStatuses: []string{AccountStatusDisabled, AccountStatusPasswordExpired},
+		},
+		{
+			name:       "userAccountControl is missing",
+			attributes: map[string]string{userAccountControlComputedAttribute: "0"},
+			wantError:  `found 0 values for attribute "userAccountControl", but expected 1 result`,
+		},
+		{
+			name:       "userAccountControl is not a number",
+			attributes: map[string]string{userAccountControlAttribute: "not-a-number"},
+			wantError:  `could not parse attribute "userAccountControl" as a number: strconv.ParseInt: parsing "not-a-number": invalid syntax`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &ldap.Entry{DN: testUserSearchResultDNValue}
+			for name, value := range tt.attributes {
+				entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(name, []string{value}))
+			}
+
+			statuses, err := accountStatuses(entry)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatuses, statuses)
+		})
+	}
+}
+
+func TestDryRunAuthenticateUserAccountStatus(t *testing.T) {
+	userSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+				},
+			},
+		},
+	}
+
+	expectedAccountStatusSearch := &ldap.SearchRequest{
+		BaseDN:       testUserSearchResultDNValue,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{"userAccountControl", "msDS-User-Account-Control-Computed"},
+		Controls:     nil,
+	}
+
+	tests := []struct {
+		name                string
+		dryRunAccountStatus bool
+		setupMocks          func(conn *mockldapconn.MockConn)
+		wantExtra           map[string][]string
+		wantError           string
+	}{
+		{
+			name: "account status is not read by default",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:                "account status is added to the extra info",
+			dryRunAccountStatus: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				gomock.InOrder(
+					conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1),
+					conn.EXPECT().Search(expectedAccountStatusSearch).Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{
+							{
+								DN: testUserSearchResultDNValue,
+								Attributes: []*ldap.EntryAttribute{
+									ldap.NewEntryAttribute("userAccountControl", []string{"514"}),
+									ldap.NewEntryAttribute("msDS-User-Account-Control-Computed", []string{"16"}),
+								},
+							},
+						},
+					}, nil).Times(1),
+				)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantExtra: map[string][]string{AccountStatusExtraKey: {AccountStatusDisabled, AccountStatusLocked}},
+		},
+		{
+			name:                "error reading the account status",
+			dryRunAccountStatus: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				gomock.InOrder(
+					conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1),
+					conn.EXPECT().Search(expectedAccountStatusSearch).Return(nil, errors.New("some search error")).Times(1),
+				)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for account status of user with DN "%s": some search error`, testUserSearchResultDNValue),
+		},
+		{
+			name:                "account status is not an Active Directory account status",
+			dryRunAccountStatus: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				gomock.InOrder(
+					conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1),
+					conn.EXPECT().Search(expectedAccountStatusSearch).Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue}},
+					}, nil).Times(1),
+				)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error reading account status of user with DN "%s": found 0 values for attribute "userAccountControl", but expected 1 result`, testUserSearchResultDNValue),
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			tt.setupMocks(conn)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+				DryRunAccountStatus: tt.dryRunAccountStatus,
+			})
+
+			authResponse, authenticated, err := ldapProvider.DryRunAuthenticateUser(context.Background(), testUpstreamUsername, []string{})
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.False(t, authenticated)
+				require.Nil(t, authResponse)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, authenticated)
+			if tt.wantExtra == nil {
+				require.Empty(t, authResponse.User.GetExtra())
+				return
+			}
+			require.Equal(t, tt.wantExtra, authResponse.User.GetExtra())
+		})
+	}
+}
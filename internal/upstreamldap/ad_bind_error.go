@@ -0,0 +1,86 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ADBindFailureReason is the reason why Active Directory refused a bind, as encoded in the sub-code of its
+// invalid credentials error.
+type ADBindFailureReason string
+
+// The reasons of the Active Directory sub-codes, which are the hexadecimal Windows error codes of the failed logon.
+const (
+	ADBindFailureUserNotFound       = ADBindFailureReason("user-not-found")       // 525
+	ADBindFailureBadPassword        = ADBindFailureReason("bad-password")         // 52e
+	ADBindFailureLogonRestricted    = ADBindFailureReason("logon-restricted")     // 530 and 531
+	ADBindFailurePasswordExpired    = ADBindFailureReason("password-expired")     // 532
+	ADBindFailureAccountDisabled    = ADBindFailureReason("account-disabled")     // 533
+	ADBindFailureAccountExpired     = ADBindFailureReason("account-expired")      // 701
+	ADBindFailurePasswordMustChange = ADBindFailureReason("password-must-change") // 773
+	ADBindFailureAccountLocked      = ADBindFailureReason("account-locked")       // 775
+)
+
+// adBindFailureReasons maps the Active Directory sub-codes to their reasons.
+var adBindFailureReasons = map[string]ADBindFailureReason{
+	"525": ADBindFailureUserNotFound,
+	"52e": ADBindFailureBadPassword,
+	"530": ADBindFailureLogonRestricted,
+	"531": ADBindFailureLogonRestricted,
+	"532": ADBindFailurePasswordExpired,
+	"533": ADBindFailureAccountDisabled,
+	"701": ADBindFailureAccountExpired,
+	"773": ADBindFailurePasswordMustChange,
+	"775": ADBindFailureAccountLocked,
+}
+
+// adBindFailureSubCode finds the sub-code in the diagnostic message of an Active Directory bind error, e.g.
+// "80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e, v4563".
+var adBindFailureSubCode = regexp.MustCompile(`\bdata ([0-9a-fA-F]+)\b`)
+
+// ADBindFailureReasonOf returns the reason of an Active Directory invalid credentials error. It returns false for
+// other errors, including the invalid credentials errors of other LDAP servers.
+func ADBindFailureReasonOf(err error) (ADBindFailureReason, bool) {
+	ldapErr := &ldap.Error{}
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode != ldap.LDAPResultInvalidCredentials || ldapErr.Err == nil {
+		return "", false
+	}
+	match := adBindFailureSubCode.FindStringSubmatch(ldapErr.Err.Error())
+	if match == nil {
+		return "", false
+	}
+	reason, ok := adBindFailureReasons[strings.ToLower(match[1])]
+	return reason, ok
+}
+
+// isAccountProblem returns true when the user's password may be correct, but their account cannot be used to log in.
+func (r ADBindFailureReason) isAccountProblem() bool {
+	switch r {
+	case ADBindFailureUserNotFound, ADBindFailureBadPassword:
+		return false
+	default:
+		return true
+	}
+}
+
+// ADBindError is returned when an end user's bind fails because Active Directory refused to let their account log
+// in, e.g. because it is locked, as opposed to because of a bad username or password, which is not an error.
+type ADBindError struct {
+	Reason ADBindFailureReason
+	Err    error
+}
+
+func (e *ADBindError) Error() string {
+	return fmt.Sprintf("Active Directory refused the bind (%s): %s", e.Reason, e.Err.Error())
+}
+
+func (e *ADBindError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+// adBindError returns an invalid credentials error like the ones which Active Directory returns for the sub-code.
+func adBindError(subCode string) error {
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials,
+		fmt.Errorf("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data %s, v4563\x00", subCode))
+}
+
+func TestADBindFailureReasonOf(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantReason ADBindFailureReason
+		wantOK     bool
+	}{
+		{name: "user not found", err: adBindError("525"), wantReason: ADBindFailureUserNotFound, wantOK: true},
+		{name: "bad password", err: adBindError("52e"), wantReason: ADBindFailureBadPassword, wantOK: true},
+		{name: "upper case sub-code", err: adBindError("52E"), wantReason: ADBindFailureBadPassword, wantOK: true},
+		{name: "not permitted at this time", err: adBindError("530"), wantReason: ADBindFailureLogonRestricted, wantOK: true},
+		{name: "not permitted at this workstation", err: adBindError("531"), wantReason: ADBindFailureLogonRestricted, wantOK: true},
+		{name: "password expired", err: adBindError("532"), wantReason: ADBindFailurePasswordExpired, wantOK: true},
+		{name: "account disabled", err: adBindError("533"), wantReason: ADBindFailureAccountDisabled, wantOK: true},
+		{name: "account expired", err: adBindError("701"), wantReason: ADBindFailureAccountExpired, wantOK: true},
+		{name: "password must change", err: adBindError("773"), wantReason: ADBindFailurePasswordMustChange, wantOK: true},
+		{name: "account locked", err: adBindError("775"), wantReason: ADBindFailureAccountLocked, wantOK: true},
+		{name: "wrapped", err: fmt.Errorf("some context: %w", adBindError("775")), wantReason: ADBindFailureAccountLocked, wantOK: true},
+		{name: "unknown sub-code", err: adBindError("568")},
+		{name: "invalid credentials of another LDAP server", err: ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))},
+		{name: "other result code", err: ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("data 775"))},
+		{name: "not an LDAP error", err: errors.New("data 775")},
+		{name: "no error"},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			reason, ok := ADBindFailureReasonOf(tt.err)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func TestEndUserAuthenticationADBindFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		bindErr    error
+		wantReason ADBindFailureReason
+		wantError  string
+	}{
+		{
+			name:    "bad password is not an error",
+			bindErr: adBindError("52e"),
+		},
+		{
+			name:    "invalid credentials of another LDAP server are not an error",
+			bindErr: ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error")),
+		},
+		{
+			name:       "locked account",
+			bindErr:    adBindError("775"),
+			wantReason: ADBindFailureAccountLocked,
+			wantError: fmt.Sprintf(`Active Directory refused the bind (account-locked): error binding for user %q using provided password against DN %q: `+
+				`LDAP Result Code 49 "Invalid Credentials": 80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 775, v4563`+"\x00",
+				testUpstreamUsername, testUserSearchResultDNValue),
+		},
+		{
+			name:       "disabled account",
+			bindErr:    adBindError("533"),
+			wantReason: ADBindFailureAccountDisabled,
+			wantError: fmt.Sprintf(`Active Directory refused the bind (account-disabled): error binding for user %q using provided password against DN %q: `+
+				`LDAP Result Code 49 "Invalid Credentials": 80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 533, v4563`+"\x00",
+				testUpstreamUsername, testUserSearchResultDNValue),
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).Return(&ldap.SearchResult{Entries: []*ldap.Entry{{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+				},
+			}}}, nil).Times(1)
+			conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Return(tt.bindErr).Times(1)
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+			require.False(t, authenticated)
+			require.Nil(t, authResponse)
+			if tt.wantError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantError)
+			adBindErr := &ADBindError{}
+			require.ErrorAs(t, err, &adBindErr)
+			require.Equal(t, tt.wantReason, adBindErr.Reason)
+		})
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"time"
+)
+
+// timeoutSetter is implemented by connections whose requests can time out, e.g. ldap.Conn.
+type timeoutSetter interface {
+	SetTimeout(timeout time.Duration)
+}
+
+// withBindTimeout returns the connection wrapped to enforce the BindTimeout, or returns the connection itself when
+// the BindTimeout is not configured or the connection cannot time out its requests, e.g. one from a test Dialer.
+func (p *Provider) withBindTimeout(conn Conn) Conn {
+	if p.c.BindTimeout <= 0 {
+		return conn
+	}
+	setter, ok := conn.(timeoutSetter)
+	if !ok {
+		return conn
+	}
+	return &bindTimeoutConn{Conn: conn, setter: setter, bindTimeout: p.c.BindTimeout}
+}
+
+// bindTimeoutConn is a Conn whose binds time out after the bind timeout, while its other requests do not time out.
+// It must wrap the connection which was dialed, below every other wrapper, so that every bind goes through it.
+type bindTimeoutConn struct {
+	Conn
+	setter      timeoutSetter
+	bindTimeout time.Duration
+}
+
+func (c *bindTimeoutConn) Bind(username, password string) error {
+	// The timeout applies to the requests which are sent while it is set, so only the bind request gets it.
+	c.setter.SetTimeout(c.bindTimeout)
+	defer c.setter.SetTimeout(0)
+	return c.Conn.Bind(username, password)
+}
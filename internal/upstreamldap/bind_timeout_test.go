@@ -0,0 +1,75 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+// timeoutRecordingConn is a Conn which records the request timeout that each of its operations ran with.
+type timeoutRecordingConn struct {
+	*mockldapconn.MockConn
+	timeout  time.Duration
+	timeouts []time.Duration
+}
+
+func (c *timeoutRecordingConn) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+func (c *timeoutRecordingConn) Bind(username, password string) error {
+	c.timeouts = append(c.timeouts, c.timeout)
+	return c.MockConn.Bind(username, password)
+}
+
+func (c *timeoutRecordingConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.timeouts = append(c.timeouts, c.timeout)
+	return c.MockConn.Search(searchRequest)
+}
+
+func TestWithBindTimeout(t *testing.T) {
+	t.Run("not configured", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn := &timeoutRecordingConn{MockConn: mockldapconn.NewMockConn(ctrl)}
+
+		require.Same(t, conn, New(ProviderConfig{}).withBindTimeout(conn))
+	})
+
+	t.Run("connections which cannot time out their requests", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn := mockldapconn.NewMockConn(ctrl)
+
+		require.Same(t, conn, New(ProviderConfig{BindTimeout: time.Second}).withBindTimeout(conn))
+	})
+
+	t.Run("only binds time out", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn := &timeoutRecordingConn{MockConn: mockldapconn.NewMockConn(ctrl)}
+		searchRequest := &ldap.SearchRequest{BaseDN: testUserSearchBase}
+		gomock.InOrder(
+			conn.MockConn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+			conn.MockConn.EXPECT().Search(searchRequest).Return(&ldap.SearchResult{}, nil).Times(1),
+			conn.MockConn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1),
+		)
+
+		c := New(ProviderConfig{BindTimeout: time.Second}).withBindTimeout(conn)
+		require.NoError(t, c.Bind(testBindUsername, testBindPassword))
+		_, err := c.Search(searchRequest)
+		require.NoError(t, err)
+		require.NoError(t, c.Bind(testUserSearchResultDNValue, testUpstreamPassword))
+
+		require.Equal(t, []time.Duration{time.Second, 0, time.Second}, conn.timeouts)
+		require.Zero(t, conn.timeout)
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitBreakerWindow   = time.Minute
+	defaultCircuitBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of dialing the LDAP server while the Provider's circuit breaker is open, i.e.
+// after too many consecutive failures to dial and bind to the LDAP server.
+var ErrCircuitOpen = errors.New("not connecting to the LDAP server after repeated connection failures, will try again later")
+
+// CircuitBreakerConfig contains information about when to stop trying to connect to an LDAP server which is
+// failing, so that logins fail fast instead of each waiting for the dial timeout.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive dial or bind failures within the Window after which the circuit
+	// opens. Zero or less disables the circuit breaker.
+	FailureThreshold int
+
+	// Window is the duration in which the FailureThreshold failures must happen. Zero means one minute.
+	Window time.Duration
+
+	// Cooldown is how long the circuit stays open before a single attempt is allowed to probe whether the LDAP
+	// server has recovered. Zero means 30 seconds.
+	Cooldown time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the dial and bind failures of a Provider. Its zero value is a closed circuit.
+type circuitBreaker struct {
+	// clock exists to enable testing. When nil, time.Now will be used.
+	clock func() time.Time
+
+	lock          sync.Mutex
+	state         circuitState
+	failures      int
+	firstFailure  time.Time
+	openedAt      time.Time
+	probeInFlight bool
+}
+
+func (b *circuitBreaker) now() time.Time {
+	if b.clock == nil {
+		return time.Now()
+	}
+	return b.clock()
+}
+
+// allow returns ErrCircuitOpen when an attempt to connect should not be made. Every allowed attempt must be
+// followed by a call to record.
+func (b *circuitBreaker) allow(c CircuitBreakerConfig) error {
+	if c.FailureThreshold <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		cooldown := c.Cooldown
+		if cooldown <= 0 {
+			cooldown = defaultCircuitBreakerCooldown
+		}
+		if b.now().Before(b.openedAt.Add(cooldown)) {
+			return ErrCircuitOpen
+		}
+		// The cooldown is over, so let this attempt probe whether the LDAP server has recovered.
+		b.state = circuitHalfOpen
+		b.probeInFlight = true
+		return nil
+	case circuitHalfOpen:
+		if b.probeInFlight {
+			return ErrCircuitOpen
+		}
+		b.probeInFlight = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// record updates the circuit using the result of an attempt to dial and bind. A nil error closes the circuit.
+func (b *circuitBreaker) record(c CircuitBreakerConfig, err error) {
+	if c.FailureThreshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+
+	if err == nil {
+		b.state = circuitClosed
+		b.failures = 0
+		b.probeInFlight = false
+		return
+	}
+
+	switch b.state {
+	case circuitHalfOpen:
+		// The probe failed, so start another cooldown.
+		b.state = circuitOpen
+		b.openedAt = now
+		b.probeInFlight = false
+	case circuitOpen:
+		// An attempt which was allowed before the circuit opened has also failed, which changes nothing.
+	default:
+		window := c.Window
+		if window <= 0 {
+			window = defaultCircuitBreakerWindow
+		}
+		if b.failures == 0 || now.Sub(b.firstFailure) > window {
+			b.failures = 0
+			b.firstFailure = now
+		}
+		b.failures++
+		if b.failures >= c.FailureThreshold {
+			b.state = circuitOpen
+			b.openedAt = now
+			b.failures = 0
+		}
+	}
+}
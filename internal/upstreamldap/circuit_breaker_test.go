@@ -0,0 +1,191 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const (
+		threshold = 3
+		window    = time.Minute
+		cooldown  = 30 * time.Second
+	)
+
+	// A result is the outcome of one connection attempt: a dial error, a bind error, or success.
+	type result struct {
+		dialErr error
+		bindErr error
+	}
+	type step struct {
+		advance       time.Duration
+		result        result
+		wantDial      bool
+		wantOpenError bool
+	}
+
+	dialFailure := result{dialErr: errors.New("some dial error")}
+	bindFailure := result{bindErr: errors.New("some bind error")}
+	success := result{}
+
+	tests := []struct {
+		name   string
+		config CircuitBreakerConfig
+		steps  []step
+	}{
+		{
+			name:   "disabled by default",
+			config: CircuitBreakerConfig{},
+			steps: []step{
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: success, wantDial: true},
+			},
+		},
+		{
+			name:   "opens after consecutive dial and bind failures, then closes after a successful probe",
+			config: CircuitBreakerConfig{FailureThreshold: threshold, Window: window, Cooldown: cooldown},
+			steps: []step{
+				{result: dialFailure, wantDial: true},
+				{result: bindFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{wantOpenError: true},
+				{advance: cooldown - time.Second, wantOpenError: true},
+				{advance: time.Second, result: success, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: success, wantDial: true},
+			},
+		},
+		{
+			name:   "reopens when the probe fails",
+			config: CircuitBreakerConfig{FailureThreshold: threshold, Window: window, Cooldown: cooldown},
+			steps: []step{
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{advance: cooldown, result: bindFailure, wantDial: true},
+				{wantOpenError: true},
+				{advance: cooldown, result: success, wantDial: true},
+				{result: success, wantDial: true},
+			},
+		},
+		{
+			name:   "a success resets the count of failures",
+			config: CircuitBreakerConfig{FailureThreshold: threshold, Window: window, Cooldown: cooldown},
+			steps: []step{
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: success, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: success, wantDial: true},
+			},
+		},
+		{
+			name:   "failures which are spread out over more than the window do not open the circuit",
+			config: CircuitBreakerConfig{FailureThreshold: threshold, Window: window, Cooldown: cooldown},
+			steps: []step{
+				{result: dialFailure, wantDial: true},
+				{advance: window / 2, result: dialFailure, wantDial: true},
+				{advance: window, result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{result: dialFailure, wantDial: true},
+				{wantOpenError: true},
+			},
+		},
+		{
+			name:   "uses the default window and cooldown",
+			config: CircuitBreakerConfig{FailureThreshold: 1},
+			steps: []step{
+				{result: dialFailure, wantDial: true},
+				{advance: defaultCircuitBreakerCooldown - time.Second, wantOpenError: true},
+				{advance: time.Second, result: success, wantDial: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+			var current result
+			dialCount := 0
+
+			p := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				CircuitBreaker:     tt.config,
+				Dialer: LDAPDialerFunc(func(ctx context.Context, _ endpointaddr.HostPort) (Conn, error) {
+					dialCount++
+					if current.dialErr != nil {
+						return nil, current.dialErr
+					}
+					conn := mockldapconn.NewMockConn(ctrl)
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(current.bindErr).Times(1)
+					conn.EXPECT().Close().Times(1)
+					return conn, nil
+				}),
+			})
+			p.breaker.clock = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				current = s.result
+				dialCountBefore := dialCount
+
+				err := p.TestConnection(context.Background())
+
+				if s.wantDial {
+					require.Equal(t, dialCountBefore+1, dialCount, "step %d", i)
+				} else {
+					require.Equal(t, dialCountBefore, dialCount, "step %d", i)
+				}
+				switch {
+				case s.wantOpenError:
+					require.ErrorIs(t, err, ErrCircuitOpen, "step %d", i)
+				case s.result.dialErr != nil:
+					require.ErrorIs(t, err, s.result.dialErr, "step %d", i)
+				case s.result.bindErr != nil:
+					require.ErrorIs(t, err, s.result.bindErr, "step %d", i)
+				default:
+					require.NoError(t, err, "step %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerAllowsOnlyOneProbe(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := &circuitBreaker{clock: func() time.Time { return now }}
+	c := CircuitBreakerConfig{FailureThreshold: 1}
+
+	require.NoError(t, b.allow(c))
+	b.record(c, errors.New("some error"))
+	require.ErrorIs(t, b.allow(c), ErrCircuitOpen)
+
+	now = now.Add(defaultCircuitBreakerCooldown)
+	require.NoError(t, b.allow(c))                 // the probe
+	require.ErrorIs(t, b.allow(c), ErrCircuitOpen) // concurrent attempts while the probe is in flight
+	b.record(c, nil)
+	require.NoError(t, b.allow(c))
+}
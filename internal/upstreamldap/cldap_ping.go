@@ -0,0 +1,130 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"go.pinniped.dev/internal/endpointaddr"
+)
+
+const (
+	// cldapPingTimeout is how long a CLDAP ping waits for an answer before HealthCheck falls back to dialing.
+	cldapPingTimeout = 2 * time.Second
+
+	// cldapPingMessageID is the message ID of every CLDAP ping. Each ping uses its own UDP socket, so the ID does
+	// not need to be unique.
+	cldapPingMessageID = int64(1)
+
+	// cldapMaxResponseBytes is the largest UDP datagram which can be received.
+	cldapMaxResponseBytes = 65535
+)
+
+// cldapPingAddress returns the UDP address of the CLDAP ping, which uses the same port number as StartTLS.
+func (p *Provider) cldapPingAddress() (string, error) {
+	host, connectionProtocol, err := p.hostAndConnectionProtocol()
+	if err != nil {
+		return "", err
+	}
+	addr, err := endpointaddr.Parse(host, defaultLDAPPort)
+	if err != nil {
+		return "", err
+	}
+	if connectionProtocol != StartTLS {
+		// The configured port, if any, is a TLS port, which is never used for CLDAP.
+		addr.Port = defaultLDAPPort
+	}
+	return addr.Endpoint(), nil
+}
+
+// cldapPing sends a connectionless LDAP (CLDAP, see RFC 3352) search of the root DSE to the LDAP server over UDP,
+// and waits for the server to answer it. Active Directory domain controllers answer these "LDAP pings". No
+// credentials are sent, so it only shows that the server is up, not that the Provider's config is correct.
+func (p *Provider) cldapPing(ctx context.Context) error {
+	address, err := p.cldapPingAddress()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(cldapPingTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", address)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	request, err := cldapPingRequest()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return err
+	}
+
+	buf := make([]byte, cldapMaxResponseBytes)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	return checkCLDAPPingResponse(buf[:n])
+}
+
+// cldapPingRequest returns an LDAPMessage holding a search of the root DSE for its supported LDAP versions.
+func cldapPingRequest() (*ber.Packet, error) {
+	filter, err := ldap.CompileFilter("(objectClass=*)")
+	if err != nil {
+		return nil, err
+	}
+
+	searchRequest := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	searchRequest.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Base DN"))
+	searchRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.ScopeBaseObject), "Scope"))
+	searchRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.NeverDerefAliases), "Deref Aliases"))
+	searchRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, uint64(1), "Size Limit"))
+	searchRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, uint64(cldapPingTimeout.Seconds()), "Time Limit"))
+	searchRequest.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	searchRequest.AppendChild(filter)
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	attributes.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "supportedLDAPVersion", "Attribute"))
+	searchRequest.AppendChild(attributes)
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, cldapPingMessageID, "MessageID"))
+	packet.AppendChild(searchRequest)
+	return packet, nil
+}
+
+// checkCLDAPPingResponse returns an error unless the response is an LDAPMessage which answers the ping with a
+// search result entry or with the end of the search results.
+func checkCLDAPPingResponse(response []byte) error {
+	packet, err := ber.DecodePacketErr(response)
+	if err != nil {
+		return fmt.Errorf("could not decode CLDAP ping response: %w", err)
+	}
+	if len(packet.Children) < 2 {
+		return fmt.Errorf("CLDAP ping response is not an LDAP message")
+	}
+	if messageID, ok := packet.Children[0].Value.(int64); !ok || messageID != cldapPingMessageID {
+		return fmt.Errorf("CLDAP ping response has the wrong message ID")
+	}
+	protocolOp := packet.Children[1]
+	if protocolOp.ClassType != ber.ClassApplication ||
+		(protocolOp.Tag != ldap.ApplicationSearchResultEntry && protocolOp.Tag != ldap.ApplicationSearchResultDone) {
+		return fmt.Errorf("CLDAP ping response is not a search result")
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+// startCLDAPServer starts a UDP server which answers each CLDAP ping with the response built by the given func,
+// and returns its address.
+func startCLDAPServer(t *testing.T, respond func(messageID int64) *ber.Packet) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, cldapMaxResponseBytes)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request, err := ber.DecodePacketErr(buf[:n])
+			if err != nil || len(request.Children) != 2 || request.Children[1].Tag != ldap.ApplicationSearchRequest {
+				continue // not a CLDAP ping, so do not answer
+			}
+			_, _ = conn.WriteTo(respond(request.Children[0].Value.(int64)).Bytes(), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func cldapResponse(messageID int64, tag ber.Tag) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(0), "Result Code"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	packet.AppendChild(response)
+	return packet
+}
+
+// unusedUDPAddress returns the address of a UDP port on which nothing is listening.
+func unusedUDPAddress(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+	return addr
+}
+
+func TestHealthCheck(t *testing.T) {
+	answeringServer := startCLDAPServer(t, func(messageID int64) *ber.Packet {
+		return cldapResponse(messageID, ldap.ApplicationSearchResultDone)
+	})
+	wrongMessageIDServer := startCLDAPServer(t, func(messageID int64) *ber.Packet {
+		return cldapResponse(messageID+1, ldap.ApplicationSearchResultDone)
+	})
+	wrongOperationServer := startCLDAPServer(t, func(messageID int64) *ber.Packet {
+		return cldapResponse(messageID, ldap.ApplicationBindResponse)
+	})
+
+	tests := []struct {
+		name           string
+		host           string
+		cldapPing      bool
+		setupMocks     func(conn *mockldapconn.MockConn)
+		wantToSkipDial bool
+		wantError      string
+	}{
+		{
+			name:           "answered CLDAP ping does not dial",
+			host:           "ldap://" + answeringServer,
+			cldapPing:      true,
+			wantToSkipDial: true,
+		},
+		{
+			name:      "unanswered CLDAP ping falls back to dialing and binding",
+			host:      "ldap://" + unusedUDPAddress(t),
+			cldapPing: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:      "CLDAP ping answered with the wrong message ID falls back to dialing and binding",
+			host:      "ldap://" + wrongMessageIDServer,
+			cldapPing: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:      "CLDAP ping answered with something other than a search result falls back to dialing and binding",
+			host:      "ldap://" + wrongOperationServer,
+			cldapPing: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name: "without CLDAP ping, dials and binds",
+			host: "ldap://" + answeringServer,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:      "bind error after the fallback",
+			host:      "ldap://" + unusedUDPAddress(t),
+			cldapPing: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error binding as "%s": some bind error`, testBindUsername),
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			dialWasAttempted := false
+			provider := New(ProviderConfig{
+				Name:         "some-provider-name",
+				Host:         tt.host,
+				CLDAPPing:    tt.cldapPing,
+				BindUsername: testBindUsername,
+				BindPassword: testBindPassword,
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					dialWasAttempted = true
+					return conn, nil
+				}),
+			})
+
+			err := provider.HealthCheck(context.Background())
+
+			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCLDAPPingAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		protocol LDAPConnectionProtocol
+		want     string
+	}{
+		{name: "StartTLS with default port", host: "ldap.example.com", protocol: StartTLS, want: "ldap.example.com:389"},
+		{name: "StartTLS with other port", host: "ldap.example.com:1389", protocol: StartTLS, want: "ldap.example.com:1389"},
+		{name: "TLS with default port", host: "ldap.example.com", protocol: TLS, want: "ldap.example.com:389"},
+		{name: "TLS with other port", host: "ldap.example.com:1636", protocol: TLS, want: "ldap.example.com:389"},
+		{name: "ldap URL", host: "ldap://ldap.example.com:1389/", protocol: TLS, want: "ldap.example.com:1389"},
+		{name: "ldaps URL", host: "ldaps://ldap.example.com:1636/", protocol: StartTLS, want: "ldap.example.com:389"},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			address, err := New(ProviderConfig{Host: tt.host, ConnectionProtocol: tt.protocol}).cldapPingAddress()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, address)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ConnectionErrorKind classifies why connecting to the LDAP server failed, so that callers, e.g. controllers which
+// set status conditions, can react to each kind of failure without matching error messages.
+type ConnectionErrorKind string
+
+const (
+	// ConfigInvalid means that the ProviderConfig is invalid, so no connection was attempted.
+	ConfigInvalid ConnectionErrorKind = "ConfigInvalid"
+
+	// DialFailed means that the LDAP server could not be reached.
+	DialFailed ConnectionErrorKind = "DialFailed"
+
+	// TLSFailed means that the LDAP server was reached, but the TLS connection could not be established, e.g.
+	// because the server's certificate is not trusted by the CA bundle.
+	TLSFailed ConnectionErrorKind = "TLSFailed"
+
+	// BindFailed means that the bind user's credentials could not be found or were rejected by the LDAP server.
+	BindFailed ConnectionErrorKind = "BindFailed"
+
+	// SearchBaseNotFound means that the UserSearch Base could not be read by the bind user.
+	SearchBaseNotFound ConnectionErrorKind = "SearchBaseNotFound"
+
+	// SearchBaseNotReadable means that the UserSearch Base exists, but the bind user cannot read the user entries
+	// under it, which would otherwise look like users who are not found during logins.
+	SearchBaseNotReadable ConnectionErrorKind = "SearchBaseNotReadable"
+)
+
+// ConnectionError is returned by TestConnection and by the other operations of a Provider when they could not
+// connect to the LDAP server. Its message is the message of the wrapped error.
+type ConnectionError struct {
+	Kind ConnectionErrorKind
+	Err  error
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectionErrorKindOf returns the kind of the ConnectionError in the error's chain, and false when there is none.
+func ConnectionErrorKindOf(err error) (ConnectionErrorKind, bool) {
+	var connectionErr *ConnectionError
+	if !errors.As(err, &connectionErr) {
+		return "", false
+	}
+	return connectionErr.Kind, true
+}
+
+// dialErrorKind returns TLSFailed for errors from the dial which happened while establishing TLS, and otherwise
+// returns DialFailed.
+func dialErrorKind(err error) ConnectionErrorKind {
+	// The go-ldap library's Error might not unwrap, so look inside of it explicitly.
+	ldapErr := &ldap.Error{}
+	if errors.As(err, &ldapErr) && ldapErr.Err != nil {
+		err = ldapErr.Err
+	}
+
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	var notTLSErr *NotTLSError
+	switch {
+	case errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &certificateInvalidErr),
+		errors.As(err, &recordHeaderErr),
+		errors.As(err, &notTLSErr):
+		return TLSFailed
+	default:
+		return DialFailed
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialErrorKind(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantKind ConnectionErrorKind
+	}{
+		{
+			name:     "a plain error",
+			err:      errors.New("some dial error"),
+			wantKind: DialFailed,
+		},
+		{
+			name:     "a network error",
+			err:      ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused")),
+			wantKind: DialFailed,
+		},
+		{
+			name:     "an untrusted certificate",
+			err:      ldap.NewError(ldap.ErrorNetwork, x509.UnknownAuthorityError{}),
+			wantKind: TLSFailed,
+		},
+		{
+			name:     "a certificate for another host",
+			err:      ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("handshake failed: %w", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "ldap.example.com"})),
+			wantKind: TLSFailed,
+		},
+		{
+			name:     "a server which does not speak TLS",
+			err:      ldap.NewError(ldap.ErrorNetwork, &NotTLSError{Err: errors.New("some handshake error")}),
+			wantKind: TLSFailed,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.wantKind, dialErrorKind(tt.err))
+		})
+	}
+}
+
+func TestConnectionErrorKindOf(t *testing.T) {
+	kind, ok := ConnectionErrorKindOf(errors.New("some error"))
+	require.False(t, ok)
+	require.Empty(t, kind)
+
+	err := fmt.Errorf("some context: %w", &ConnectionError{Kind: BindFailed, Err: errors.New("some bind error")})
+	require.EqualError(t, err, "some context: some bind error")
+	kind, ok = ConnectionErrorKindOf(err)
+	require.True(t, ok)
+	require.Equal(t, BindFailed, kind)
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"net"
+	"time"
+)
+
+// withDeadlines returns the connection wrapped to enforce the ReadDeadline and WriteDeadline, or returns the
+// connection itself when neither is configured.
+func (p *Provider) withDeadlines(c net.Conn) net.Conn {
+	if p.c.ReadDeadline <= 0 && p.c.WriteDeadline <= 0 {
+		return c
+	}
+	return &deadlineConn{Conn: c, readDeadline: p.c.ReadDeadline, writeDeadline: p.c.WriteDeadline}
+}
+
+// deadlineConn is a net.Conn which sets a new deadline before each read and write, so that each read and write
+// fails when it takes longer than its deadline, regardless of how long the connection has been open.
+type deadlineConn struct {
+	net.Conn
+	readDeadline  time.Duration
+	writeDeadline time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.readDeadline > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readDeadline)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeDeadline > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeDeadline)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
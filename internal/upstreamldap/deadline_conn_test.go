@@ -0,0 +1,52 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithDeadlines(t *testing.T) {
+	t.Run("no deadlines are configured", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		require.Same(t, client, New(ProviderConfig{}).withDeadlines(client))
+	})
+
+	t.Run("reads which stall fail after the read deadline", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		c := New(ProviderConfig{ReadDeadline: 50 * time.Millisecond}).withDeadlines(client)
+
+		// The deadline is renewed for each read, so reads keep working while the server keeps sending.
+		for i := 0; i < 3; i++ {
+			go func() { _, _ = server.Write([]byte("x")) }()
+			time.Sleep(30 * time.Millisecond)
+			n, err := c.Read(make([]byte, 1))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+		}
+
+		_, err := c.Read(make([]byte, 1))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("writes which stall fail after the write deadline", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		c := New(ProviderConfig{WriteDeadline: 50 * time.Millisecond}).withDeadlines(client)
+
+		// Nothing reads from the server side of the pipe, so the write stalls.
+		_, err := c.Write([]byte("x"))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"go.pinniped.dev/internal/authenticators"
+)
+
+// RawEntryBinaryValuePrefix prefixes the values of the entries returned by DryRunAuthenticateUserWithEntry which are
+// not valid UTF-8, e.g. the values of objectGUID, which are base64 URL encoded without padding after the prefix.
+const RawEntryBinaryValuePrefix = "base64url:"
+
+// DryRunAuthenticateUserWithEntry is like DryRunAuthenticateUser, but it also returns the user's entry with all of
+// its user attributes, exactly as the LDAP server returned them, so that admins can see which attributes to
+// configure. The entry is read first, using the same user search with all attributes requested, so that it is also
+// returned when the dry run fails, e.g. because the configured UIDAttribute is missing. The entry is nil when the
+// user was not found. Values which are not valid UTF-8 are encoded, see RawEntryBinaryValuePrefix.
+//
+// This is only meant for debugging a config, since it reads every attribute which the bind user may read. Nothing
+// else calls it, so it never runs during an authentication.
+func (p *Provider) DryRunAuthenticateUserWithEntry(ctx context.Context, username string, grantedScopes []string) (*authenticators.Response, bool, *ldap.Entry, error) {
+	entry, err := p.readRawUserEntry(ctx, username)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	response, authenticated, err := p.DryRunAuthenticateUser(ctx, username, grantedScopes)
+	return response, authenticated, entry, err
+}
+
+// readRawUserEntry searches for the user with all of their user attributes, and returns their entry with encoded
+// binary values, or nil when the user was not found.
+func (p *Provider) readRawUserEntry(ctx context.Context, username string) (*ldap.Entry, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
+	if len(username) == 0 {
+		return nil, nil
+	}
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	searchRequest := p.userSearchRequest(username)
+	searchRequest.Attributes = []string{"*"} // the special attribute name which requests all user attributes
+	searchResult, err := conn.Search(searchRequest)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf(`error searching for user: %w`, classifySearchError(err))
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
+		return nil, fmt.Errorf(`error searching for user: %w`, err)
+	}
+	if err != nil || len(searchResult.Entries) != 1 {
+		// Let the dry run report a missing or ambiguous user the same way that an authentication would.
+		return nil, nil
+	}
+	return encodeRawEntry(searchResult.Entries[0]), nil
+}
+
+// encodeRawEntry returns a copy of the entry whose values are all printable, see RawEntryBinaryValuePrefix.
+func encodeRawEntry(entry *ldap.Entry) *ldap.Entry {
+	encoded := &ldap.Entry{DN: entry.DN, Attributes: make([]*ldap.EntryAttribute, 0, len(entry.Attributes))}
+	for _, attribute := range entry.Attributes {
+		values := make([]string, 0, len(attribute.ByteValues))
+		for _, value := range attribute.ByteValues {
+			if utf8.Valid(value) {
+				values = append(values, string(value))
+			} else {
+				values = append(values, RawEntryBinaryValuePrefix+base64.RawURLEncoding.EncodeToString(value))
+			}
+		}
+		encoded.Attributes = append(encoded.Attributes, ldap.NewEntryAttribute(attribute.Name, values))
+	}
+	return encoded
+}
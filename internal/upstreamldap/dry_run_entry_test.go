@@ -0,0 +1,163 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestDryRunAuthenticateUserWithEntry(t *testing.T) {
+	binaryGUID := []byte{0x00, 0xff, 0xfe, 0x01}
+
+	rawUserSearch := &ldap.SearchRequest{
+		BaseDN:       testUserSearchBase,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       testUserSearchFilterInterpolated,
+		Attributes:   []string{"*"},
+	}
+	userSearch := &ldap.SearchRequest{
+		BaseDN:       testUserSearchBase,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       testUserSearchFilterInterpolated,
+		Attributes:   []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute},
+	}
+	rawUserEntry := &ldap.Entry{
+		DN: testUserSearchResultDNValue,
+		Attributes: []*ldap.EntryAttribute{
+			ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+			ldap.NewEntryAttribute("mail", []string{"some-user@example.com", "other-user@example.com"}),
+			{Name: "objectGUID", Values: []string{string(binaryGUID)}, ByteValues: [][]byte{binaryGUID}},
+		},
+	}
+	wantEntry := &ldap.Entry{
+		DN: testUserSearchResultDNValue,
+		Attributes: []*ldap.EntryAttribute{
+			ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+			ldap.NewEntryAttribute("mail", []string{"some-user@example.com", "other-user@example.com"}),
+			ldap.NewEntryAttribute("objectGUID", []string{"base64url:AP_-AQ"}),
+		},
+	}
+
+	tests := []struct {
+		name              string
+		setupMocks        func(conn *mockldapconn.MockConn)
+		wantAuthenticated bool
+		wantEntry         *ldap.Entry
+		wantError         string
+	}{
+		{
+			name: "returns the entry with all attributes along with the dry run result",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				gomock.InOrder(
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+					conn.EXPECT().Search(rawUserSearch).Return(&ldap.SearchResult{Entries: []*ldap.Entry{rawUserEntry}}, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+					conn.EXPECT().Search(userSearch).Return(&ldap.SearchResult{Entries: []*ldap.Entry{{
+						DN: testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{
+							ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+							ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+						},
+					}}}, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+				)
+			},
+			wantAuthenticated: true,
+			wantEntry:         wantEntry,
+		},
+		{
+			name: "returns the entry when the dry run fails, so that the entry can show why",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				gomock.InOrder(
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+					conn.EXPECT().Search(rawUserSearch).Return(&ldap.SearchResult{Entries: []*ldap.Entry{rawUserEntry}}, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+					conn.EXPECT().Search(userSearch).Return(&ldap.SearchResult{Entries: []*ldap.Entry{{
+						DN: testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{
+							ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+						},
+					}}}, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+				)
+			},
+			wantEntry: wantEntry,
+			wantError: fmt.Sprintf(`found 0 values for attribute %q while searching for user %q, but expected 1 result`,
+				testUserSearchUIDAttribute, testUpstreamUsername),
+		},
+		{
+			name: "returns no entry when the user is not found",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				gomock.InOrder(
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+					conn.EXPECT().Search(rawUserSearch).Return(&ldap.SearchResult{}, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+					conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+					conn.EXPECT().Search(userSearch).Return(&ldap.SearchResult{}, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+				)
+			},
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			tt.setupMocks(conn)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			authResponse, authenticated, entry, err := ldapProvider.DryRunAuthenticateUserWithEntry(context.Background(), testUpstreamUsername, []string{})
+			require.Equal(t, tt.wantEntry, entry)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.False(t, authenticated)
+				require.Nil(t, authResponse)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAuthenticated, authenticated)
+			if tt.wantAuthenticated {
+				require.Equal(t, testUserSearchResultDNValue, authResponse.DN)
+			}
+		})
+	}
+}
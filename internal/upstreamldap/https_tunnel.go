@@ -0,0 +1,137 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"go.pinniped.dev/internal/crypto/ptls"
+	"go.pinniped.dev/internal/endpointaddr"
+)
+
+const defaultHTTPSPort = uint16(443)
+
+// HTTPSTunnelConfig contains information about how to reach the LDAP server through an HTTPS CONNECT tunnel, for
+// environments in which only outbound HTTPS is allowed. The LDAP connection inside the tunnel is still encrypted
+// and verified using the ProviderConfig's ConnectionProtocol and CABundle.
+type HTTPSTunnelConfig struct {
+	// URL is the https URL of the tunnel endpoint, e.g. "https://tunnel.example.com:8443". Empty means to connect
+	// to the LDAP server directly.
+	URL string
+
+	// PEM-encoded CA cert bundle to trust when connecting to the tunnel endpoint. When nil, the system's trusted
+	// CAs will be used.
+	CABundle []byte
+}
+
+// dialTCP returns a connection to the address, either directly or through the HTTPS tunnel when it is configured.
+func (p *Provider) dialTCP(ctx context.Context, addr endpointaddr.HostPort) (net.Conn, error) {
+	if len(p.c.HTTPSTunnel.URL) == 0 {
+		netDialer, err := p.netDialer()
+		if err != nil {
+			return nil, err
+		}
+		return netDialer.DialContext(ctx, "tcp", addr.Endpoint())
+	}
+	return p.dialHTTPSTunnel(ctx, addr)
+}
+
+// dialHTTPSTunnel connects to the tunnel endpoint using TLS and asks it to open a tunnel to the address using
+// the HTTP CONNECT method. The returned connection is the tunnel to the address.
+func (p *Provider) dialHTTPSTunnel(ctx context.Context, addr endpointaddr.HostPort) (net.Conn, error) {
+	tunnelURL, err := url.Parse(p.c.HTTPSTunnel.URL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse HTTPS tunnel URL: %w", err)
+	}
+	if tunnelURL.Scheme != "https" || len(tunnelURL.Host) == 0 {
+		return nil, fmt.Errorf("HTTPS tunnel URL %q must be an https URL with a host", p.c.HTTPSTunnel.URL)
+	}
+	tunnelAddr, err := endpointaddr.Parse(tunnelURL.Host, defaultHTTPSPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTPS tunnel URL host: %w", err)
+	}
+
+	var rootCAs *x509.CertPool
+	if p.c.HTTPSTunnel.CABundle != nil {
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(p.c.HTTPSTunnel.CABundle) {
+			return nil, fmt.Errorf("could not parse HTTPS tunnel CA bundle")
+		}
+	}
+
+	tlsConfig := ptls.Default(rootCAs)
+	tlsConfig.NextProtos = []string{"http/1.1"} // the CONNECT request below is written using HTTP/1.1
+	netDialer, err := p.netDialer()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", tunnelAddr.Endpoint())
+	if err != nil {
+		return nil, fmt.Errorf("error dialing HTTPS tunnel %q: %w", tunnelAddr.Endpoint(), err)
+	}
+
+	// Give up on the CONNECT request when the context is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	connectRequest := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr.Endpoint()},
+		Host:   addr.Endpoint(),
+		Header: http.Header{},
+	}
+	if err := connectRequest.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error writing CONNECT request to HTTPS tunnel %q: %w", tunnelAddr.Endpoint(), err)
+	}
+
+	reader := bufio.NewReader(conn)
+	connectResponse, err := http.ReadResponse(reader, connectRequest)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response from HTTPS tunnel %q: %w", tunnelAddr.Endpoint(), err)
+	}
+	_ = connectResponse.Body.Close()
+	if connectResponse.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("HTTPS tunnel %q refused to connect to %q: %s", tunnelAddr.Endpoint(), addr.Endpoint(), connectResponse.Status)
+	}
+
+	if ctx.Err() != nil {
+		// The context was done while the goroutine above may have already closed the connection.
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+
+	// The LDAP client speaks first, so the tunnel should not have sent any more bytes yet, but do not lose them if it did.
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads are first served from a reader which may have buffered some of its data.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/crypto/ptls"
+	"go.pinniped.dev/internal/testutil/tlsserver"
+)
+
+func TestRealTLSDialingThroughHTTPSTunnel(t *testing.T) {
+	ldapServer := tlsserver.TLSTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+	parsedURL, err := url.Parse(ldapServer.URL)
+	require.NoError(t, err)
+	ldapServerHostAndPort := parsedURL.Host
+	ldapServerCABundle := tlsserver.TLSTestServerCA(ldapServer)
+
+	tunnelServer := tlsserver.TLSTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != ldapServerHostAndPort {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		targetConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		clientConn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = targetConn.Close()
+			return
+		}
+		_, _ = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(targetConn, clientConn)
+			_ = targetConn.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(clientConn, targetConn)
+			_ = clientConn.Close()
+		}()
+	}), nil)
+	tunnelServerCABundle := tlsserver.TLSTestServerCA(tunnelServer)
+	parsedTunnelURL, err := url.Parse(tunnelServer.URL)
+	require.NoError(t, err)
+	tunnelServerHostAndPort := parsedTunnelURL.Host
+
+	tests := []struct {
+		name      string
+		host      string
+		connProto LDAPConnectionProtocol
+		tunnel    HTTPSTunnelConfig
+		wantError string
+	}{
+		{
+			name:      "happy path",
+			host:      ldapServerHostAndPort,
+			connProto: TLS,
+			tunnel:    HTTPSTunnelConfig{URL: tunnelServer.URL, CABundle: tunnelServerCABundle},
+		},
+		{
+			name:      "tunnel refuses to connect to the host",
+			host:      "127.0.0.1:1234",
+			connProto: TLS,
+			tunnel:    HTTPSTunnelConfig{URL: tunnelServer.URL, CABundle: tunnelServerCABundle},
+			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": HTTPS tunnel %q refused to connect to "127.0.0.1:1234": 403 Forbidden`, tunnelServerHostAndPort),
+		},
+		{
+			name:      "tunnel URL is not https",
+			host:      ldapServerHostAndPort,
+			connProto: StartTLS,
+			tunnel:    HTTPSTunnelConfig{URL: "http://" + tunnelServerHostAndPort, CABundle: tunnelServerCABundle},
+			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": HTTPS tunnel URL "http://%s" must be an https URL with a host`, tunnelServerHostAndPort),
+		},
+		{
+			name:      "invalid tunnel CA bundle",
+			host:      ldapServerHostAndPort,
+			connProto: TLS,
+			tunnel:    HTTPSTunnelConfig{URL: tunnelServer.URL, CABundle: []byte("not a ca bundle")},
+			wantError: `LDAP Result Code 200 "Network Error": could not parse HTTPS tunnel CA bundle`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			provider := New(ProviderConfig{
+				Host:               tt.host,
+				CABundle:           ldapServerCABundle,
+				ConnectionProtocol: tt.connProto,
+				HTTPSTunnel:        tt.tunnel,
+			})
+			conn, err := provider.dial(context.Background())
+			if conn != nil {
+				defer conn.Close()
+			}
+			if tt.wantError != "" {
+				require.Nil(t, conn)
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+				require.IsType(t, &maxMessageSizeLDAPConn{}, conn)
+
+				// The TLS handshake with the LDAP server happened inside the tunnel.
+				err := conn.(*maxMessageSizeLDAPConn).StartTLS(ptls.DefaultLDAP(nil))
+				require.EqualError(t, err, `LDAP Result Code 200 "Network Error": ldap: already encrypted`)
+			}
+		})
+	}
+}
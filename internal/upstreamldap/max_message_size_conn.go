@@ -0,0 +1,186 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// maxEntryMessageOverheadBytes is how much larger than the MaxEntrySizeBytes an LDAP message from the server may be,
+// to allow for the DN of the entry, the encoding of its attributes, and the controls of the message.
+const maxEntryMessageOverheadBytes = 64 * 1024
+
+// MessageTooLargeError is returned when the LDAP server started to send a message, e.g. a search result entry, which
+// is larger than the configured ProviderConfig.MaxEntrySizeBytes allows. The connection is closed without reading the
+// message.
+type MessageTooLargeError struct {
+	SizeBytes int64
+	MaxBytes  int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("the LDAP server started to send a message of %d bytes, which exceeds the maximum of %d bytes",
+		e.SizeBytes, e.MaxBytes)
+}
+
+// maxEntrySizeBytes returns the configured MaxEntrySizeBytes, or the default.
+func (p *Provider) maxEntrySizeBytes() int {
+	if p.c.MaxEntrySizeBytes <= 0 {
+		return defaultMaxEntrySizeBytes
+	}
+	return p.c.MaxEntrySizeBytes
+}
+
+// withMaxMessageSize returns a net.Conn which fails to read any LDAP message from the server which is larger than the
+// MaxEntrySizeBytes allows, as soon as the message's length was read, so that the message is never buffered.
+// It must wrap the connection which carries the unencrypted LDAP messages, i.e. the TLS connection.
+func (p *Provider) withMaxMessageSize(c net.Conn) *maxMessageSizeConn {
+	return &maxMessageSizeConn{Conn: c, maxBytes: int64(p.maxEntrySizeBytes()) + maxEntryMessageOverheadBytes}
+}
+
+// maxMessageSizeConn is a net.Conn which reads the BER header of each LDAP message from the server before it passes
+// the message on, and fails instead when the length in the header is too large. It never reads past the end of the
+// current message, so it can also be used to read a single message.
+type maxMessageSizeConn struct {
+	net.Conn
+	maxBytes int64
+
+	// header holds the header of the current message which was read, but not yet passed on.
+	header []byte
+	// remaining is the number of bytes of the current message which were not read yet.
+	remaining int64
+
+	mutex   sync.Mutex
+	tooLong *MessageTooLargeError
+}
+
+func (c *maxMessageSizeConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(c.header) == 0 && c.remaining == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.header) > 0 {
+		n := copy(b, c.header)
+		c.header = c.header[n:]
+		return n, nil
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// readHeader reads the tag and the length of the next message, see RFC 4511 section 5.1.
+func (c *maxMessageSizeConn) readHeader() error {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	length := int64(header[1])
+	if length&0x80 != 0 {
+		// The long form of the length, in which the low bits are the number of bytes of the length. The indefinite
+		// form, which has zero bytes, is not allowed for LDAP messages.
+		lengthBytes := int(length & 0x7f)
+		if lengthBytes == 0 || lengthBytes > 4 {
+			return ldap.NewError(ldap.ErrorNetwork, errors.New("invalid length of LDAP message"))
+		}
+		header = header[:2+lengthBytes]
+		if _, err := io.ReadFull(c.Conn, header[2:]); err != nil {
+			return err
+		}
+		length = 0
+		for _, lengthByte := range header[2:] {
+			length = length<<8 | int64(lengthByte)
+		}
+	}
+	if size := int64(len(header)) + length; size > c.maxBytes {
+		tooLong := &MessageTooLargeError{SizeBytes: size, MaxBytes: c.maxBytes}
+		c.mutex.Lock()
+		c.tooLong = tooLong
+		c.mutex.Unlock()
+		return tooLong
+	}
+	c.header = header
+	c.remaining = length
+	return nil
+}
+
+// messageTooLargeError returns the MessageTooLargeError which stopped the connection from being read, if any.
+func (c *maxMessageSizeConn) messageTooLargeError() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.tooLong == nil {
+		return nil
+	}
+	return c.tooLong
+}
+
+// maxMessageSizeLDAPConn is an ldap.Conn whose operations return the MessageTooLargeError of its maxMessageSizeConn
+// instead of the less helpful error of the connection being closed. It embeds the ldap.Conn, so that its other
+// methods, e.g. SetTimeout, are still available.
+type maxMessageSizeLDAPConn struct {
+	*ldap.Conn
+	netConn *maxMessageSizeConn
+}
+
+var _ Conn = &maxMessageSizeLDAPConn{}
+
+// newMaxMessageSizeLDAPConn starts a new ldap.Conn which reads its messages through the given maxMessageSizeConn.
+func newMaxMessageSizeLDAPConn(netConn *maxMessageSizeConn, isTLS bool) *maxMessageSizeLDAPConn {
+	conn := ldap.NewConn(netConn, isTLS)
+	conn.Start()
+	return &maxMessageSizeLDAPConn{Conn: conn, netConn: netConn}
+}
+
+func (c *maxMessageSizeLDAPConn) Bind(username, password string) error {
+	err := c.Conn.Bind(username, password)
+	if tooLong := c.messageTooLargeError(err); tooLong != nil {
+		return tooLong
+	}
+	return err
+}
+
+func (c *maxMessageSizeLDAPConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result, err := c.Conn.Search(searchRequest)
+	if tooLong := c.messageTooLargeError(err); tooLong != nil {
+		return nil, tooLong
+	}
+	return result, err
+}
+
+func (c *maxMessageSizeLDAPConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	result, err := c.Conn.SearchWithPaging(searchRequest, pagingSize)
+	if tooLong := c.messageTooLargeError(err); tooLong != nil {
+		return nil, tooLong
+	}
+	return result, err
+}
+
+func (c *maxMessageSizeLDAPConn) WhoAmI(controls []ldap.Control) (*ldap.WhoAmIResult, error) {
+	result, err := c.Conn.WhoAmI(controls)
+	if tooLong := c.messageTooLargeError(err); tooLong != nil {
+		return nil, tooLong
+	}
+	return result, err
+}
+
+// messageTooLargeError returns the MessageTooLargeError which caused the error of an operation, if any.
+func (c *maxMessageSizeLDAPConn) messageTooLargeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return c.netConn.messageTooLargeError()
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// testLDAPMessage returns an LDAP message with the given message ID and a protocol op which holds the given value.
+func testLDAPMessage(messageID int64, tag ber.Tag, value string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Op")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+	packet.AppendChild(op)
+	return packet
+}
+
+// testLDAPResult returns an LDAP result message with the given message ID and result code.
+func testLDAPResult(messageID int64, tag ber.Tag, resultCode uint16) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func TestMaxMessageSizeConn(t *testing.T) {
+	const maxEntrySizeBytes = 1000
+	p := New(ProviderConfig{MaxEntrySizeBytes: maxEntrySizeBytes})
+	maxMessageBytes := int64(maxEntrySizeBytes + maxEntryMessageOverheadBytes)
+
+	t.Run("messages which are not too large are read unchanged", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		messages := []*ber.Packet{
+			testLDAPMessage(1, ldap.ApplicationSearchResultEntry, "small"),                                // short form length
+			testLDAPMessage(2, ldap.ApplicationSearchResultEntry, strings.Repeat("x", 300)),               // long form length
+			testLDAPMessage(3, ldap.ApplicationSearchResultEntry, strings.Repeat("x", maxEntrySizeBytes)), // at the maximum entry size
+		}
+		go func() {
+			for _, message := range messages {
+				_, _ = server.Write(message.Bytes())
+			}
+		}()
+
+		c := p.withMaxMessageSize(client)
+		for _, message := range messages {
+			read, err := ber.ReadPacket(c)
+			require.NoError(t, err)
+			require.Equal(t, message.Bytes(), read.Bytes())
+		}
+		require.NoError(t, c.messageTooLargeError())
+	})
+
+	t.Run("a message which is too large fails as soon as its length was read", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		// Only send the header of a huge message, since the rest of it must never be read.
+		go func() { _, _ = server.Write([]byte{0x30, 0x84, 0x40, 0x00, 0x00, 0x00}) }()
+
+		c := p.withMaxMessageSize(client)
+		_, err := ber.ReadPacket(c)
+		wantErr := &MessageTooLargeError{SizeBytes: 6 + 0x40000000, MaxBytes: maxMessageBytes}
+		require.Equal(t, wantErr, err)
+		require.Equal(t, wantErr, c.messageTooLargeError())
+	})
+
+	t.Run("the indefinite length form fails", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		go func() { _, _ = server.Write([]byte{0x30, 0x80}) }()
+
+		_, err := ber.ReadPacket(p.withMaxMessageSize(client))
+		require.EqualError(t, err, `LDAP Result Code 200 "Network Error": invalid length of LDAP message`)
+	})
+
+	t.Run("a search fails with the MessageTooLargeError when an entry is too large", func(t *testing.T) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+		go func() {
+			if _, err := ber.ReadPacket(server); err != nil {
+				return
+			}
+			// Answer the search with a huge entry, of which only the start is ever sent.
+			header := testLDAPMessage(1, ldap.ApplicationSearchResultEntry, strings.Repeat("x", int(maxMessageBytes))).Bytes()
+			_, _ = server.Write(header[:100])
+		}()
+
+		conn := newMaxMessageSizeLDAPConn(p.withMaxMessageSize(client), true)
+		t.Cleanup(conn.Close)
+
+		result, err := conn.Search(ldap.NewSearchRequest("dc=pinniped,dc=dev", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, 0, false, "(objectClass=*)", nil, nil))
+		require.Nil(t, result)
+		errTooLarge := &MessageTooLargeError{}
+		require.ErrorAs(t, err, &errTooLarge)
+		require.Equal(t, maxMessageBytes, errTooLarge.MaxBytes)
+	})
+}
+
+func TestRequestStartTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		resultCode uint16
+		wantError  string
+	}{
+		{
+			name:       "success",
+			resultCode: ldap.LDAPResultSuccess,
+		},
+		{
+			name:       "the server refuses StartTLS",
+			resultCode: ldap.LDAPResultProtocolError,
+			wantError:  `LDAP Result Code 2 "Protocol Error": `,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+
+			requests := make(chan *ber.Packet, 1)
+			go func() {
+				request, err := ber.ReadPacket(server)
+				if err != nil {
+					close(requests)
+					return
+				}
+				requests <- request
+				_, _ = server.Write(testLDAPResult(1, ldap.ApplicationExtendedResponse, tt.resultCode).Bytes())
+			}()
+
+			err := New(ProviderConfig{}).requestStartTLS(client)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+			}
+
+			request := <-requests
+			require.NotNil(t, request)
+			require.Len(t, request.Children, 2)
+			require.Equal(t, int64(1), request.Children[0].Value)
+			require.Equal(t, ber.Tag(ldap.ApplicationExtendedRequest), request.Children[1].Tag)
+			require.True(t, bytes.Equal([]byte(startTLSOID), request.Children[1].Children[0].Data.Bytes()))
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+// withMaxOperations returns the connection wrapped to enforce the MaxOperationsPerConnection, or returns the
+// connection itself when it is not configured. The context is used to dial the replacement connections.
+func (p *Provider) withMaxOperations(ctx context.Context, conn Conn) Conn {
+	if p.c.MaxOperationsPerConnection <= 0 {
+		return conn
+	}
+	return &maxOperationsConn{
+		conn:          conn,
+		maxOperations: p.c.MaxOperationsPerConnection,
+		upstreamName:  p.GetName(),
+		redial: func() (Conn, error) {
+			return p.dialConn(ctx)
+		},
+	}
+}
+
+// maxOperationsConn is a Conn which counts the operations on the underlying connection, and replaces the underlying
+// connection with a new one before an operation which would exceed the maximum. The new connection is bound again
+// using the most recent successful bind, so that the replacement does not change which permissions the following
+// operations have. It is safe for concurrent use, although an operation which is still running on a connection when
+// it gets replaced fails.
+type maxOperationsConn struct {
+	maxOperations int
+	upstreamName  string
+	redial        func() (Conn, error)
+
+	mu         sync.Mutex
+	conn       Conn
+	operations int
+	// rebind repeats the most recent successful bind on a new connection, or is nil when the connection was not bound.
+	rebind func(conn Conn) error
+}
+
+var _ Conn = &maxOperationsConn{}
+
+func (c *maxOperationsConn) Bind(username, password string) error {
+	// A bind decides the identity of the connection by itself, so there is no need to rebind a new connection first.
+	conn, err := c.nextOperation(false)
+	if err != nil {
+		return err
+	}
+	err = conn.Bind(username, password)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn == c.conn {
+		c.rebind = nil // a failed bind leaves the connection unbound
+		if err == nil {
+			c.rebind = func(conn Conn) error {
+				return conn.Bind(username, password)
+			}
+		}
+	}
+	return err
+}
+
+func (c *maxOperationsConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	conn, err := c.nextOperation(true)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Search(searchRequest)
+}
+
+func (c *maxOperationsConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	conn, err := c.nextOperation(true)
+	if err != nil {
+		return nil, err
+	}
+	return conn.SearchWithPaging(searchRequest, pagingSize)
+}
+
+func (c *maxOperationsConn) WhoAmI(controls []ldap.Control) (*ldap.WhoAmIResult, error) {
+	conn, err := c.nextOperation(true)
+	if err != nil {
+		return nil, err
+	}
+	return conn.WhoAmI(controls)
+}
+
+func (c *maxOperationsConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Close()
+}
+
+// nextOperation counts an operation and returns the connection on which it must run, which is a new connection when
+// the current one already ran the maximum number of operations. When rebind is true, the new connection is bound
+// the same way that the current one was bound.
+func (c *maxOperationsConn) nextOperation(rebind bool) (Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.operations >= c.maxOperations {
+		if err := c.replace(rebind); err != nil {
+			return nil, err
+		}
+	}
+	c.operations++
+	return c.conn, nil
+}
+
+// replace closes the current connection and dials a new one. It must be called while holding the mutex.
+func (c *maxOperationsConn) replace(rebind bool) error {
+	plog.Debug("replacing the connection to the LDAP server which reached its maximum number of operations",
+		"upstreamName", c.upstreamName, "maxOperations", c.maxOperations)
+
+	newConn, err := c.redial()
+	if err != nil {
+		return fmt.Errorf("error replacing the connection which reached its maximum of %d operations: %w", c.maxOperations, err)
+	}
+	if rebind && c.rebind != nil {
+		if err := c.rebind(newConn); err != nil {
+			newConn.Close()
+			return fmt.Errorf("error binding the connection which replaced the one which reached its maximum of %d operations: %w", c.maxOperations, err)
+		}
+	}
+
+	c.conn.Close()
+	c.conn = newConn
+	c.operations = 0
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestWithMaxOperations(t *testing.T) {
+	searchRequest := &ldap.SearchRequest{BaseDN: testUserSearchBase, Filter: "(objectClass=*)"}
+
+	// newConn dials the first of the given connections, and returns a Conn which dials the others as replacements.
+	newConn := func(t *testing.T, maxOperations int, conns ...Conn) Conn {
+		t.Helper()
+		dials := 0
+		provider := New(ProviderConfig{
+			Name:                       "some-provider-name",
+			Host:                       testHost,
+			ConnectionProtocol:         TLS,
+			MaxOperationsPerConnection: maxOperations,
+			Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				if dials >= len(conns) {
+					return nil, errors.New("some dial error")
+				}
+				dials++
+				return conns[dials-1], nil
+			}),
+		})
+		conn, err := provider.dial(context.Background())
+		require.NoError(t, err)
+		return conn
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn := mockldapconn.NewMockConn(ctrl)
+
+		require.Same(t, conn, newConn(t, 0, conn))
+	})
+
+	t.Run("replaces the connection and binds it again after the maximum number of operations", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn1 := mockldapconn.NewMockConn(ctrl)
+		conn2 := mockldapconn.NewMockConn(ctrl)
+		gomock.InOrder(
+			conn1.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+			conn1.EXPECT().Search(searchRequest).Return(&ldap.SearchResult{}, nil).Times(1),
+			conn2.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+			conn1.EXPECT().Close().Times(1),
+			conn2.EXPECT().SearchWithPaging(searchRequest, uint32(10)).Return(&ldap.SearchResult{}, nil).Times(1),
+			conn2.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{}, nil).Times(1),
+			conn2.EXPECT().Close().Times(1),
+		)
+
+		conn := newConn(t, 2, conn1, conn2)
+		require.NoError(t, conn.Bind(testBindUsername, testBindPassword))
+		_, err := conn.Search(searchRequest)
+		require.NoError(t, err)
+		_, err = conn.SearchWithPaging(searchRequest, 10)
+		require.NoError(t, err)
+		_, err = conn.WhoAmI(nil)
+		require.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("does not bind the replacement of an unbound connection", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn1 := mockldapconn.NewMockConn(ctrl)
+		conn2 := mockldapconn.NewMockConn(ctrl)
+		gomock.InOrder(
+			conn1.EXPECT().Bind(testBindUsername, "wrong-password").Return(errors.New("some bind error")).Times(1),
+			conn1.EXPECT().Close().Times(1),
+			conn2.EXPECT().Search(searchRequest).Return(&ldap.SearchResult{}, nil).Times(1),
+		)
+
+		conn := newConn(t, 1, conn1, conn2)
+		require.EqualError(t, conn.Bind(testBindUsername, "wrong-password"), "some bind error")
+		_, err := conn.Search(searchRequest)
+		require.NoError(t, err)
+	})
+
+	t.Run("a bind on the replacement decides its identity by itself", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn1 := mockldapconn.NewMockConn(ctrl)
+		conn2 := mockldapconn.NewMockConn(ctrl)
+		conn3 := mockldapconn.NewMockConn(ctrl)
+		gomock.InOrder(
+			conn1.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+			conn1.EXPECT().Close().Times(1),
+			conn2.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1),
+			conn3.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1),
+			conn2.EXPECT().Close().Times(1),
+			conn3.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{}, nil).Times(1),
+		)
+
+		conn := newConn(t, 1, conn1, conn2, conn3)
+		require.NoError(t, conn.Bind(testBindUsername, testBindPassword))
+		require.NoError(t, conn.Bind(testUserSearchResultDNValue, testUpstreamPassword))
+		_, err := conn.WhoAmI(nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("the replacement cannot be dialed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn1 := mockldapconn.NewMockConn(ctrl)
+		gomock.InOrder(
+			conn1.EXPECT().Search(searchRequest).Return(&ldap.SearchResult{}, nil).Times(1),
+			conn1.EXPECT().Close().Times(1),
+		)
+
+		conn := newConn(t, 1, conn1)
+		_, err := conn.Search(searchRequest)
+		require.NoError(t, err)
+		_, err = conn.Search(searchRequest)
+		require.EqualError(t, err, "error replacing the connection which reached its maximum of 1 operations: some dial error")
+		conn.Close()
+	})
+
+	t.Run("the replacement cannot be bound", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		conn1 := mockldapconn.NewMockConn(ctrl)
+		conn2 := mockldapconn.NewMockConn(ctrl)
+		gomock.InOrder(
+			conn1.EXPECT().Bind(testBindUsername, testBindPassword).Times(1),
+			conn2.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1),
+			conn2.EXPECT().Close().Times(1),
+			conn1.EXPECT().Close().Times(1),
+		)
+
+		conn := newConn(t, 1, conn1, conn2)
+		require.NoError(t, conn.Bind(testBindUsername, testBindPassword))
+		_, err := conn.Search(searchRequest)
+		require.EqualError(t, err, "error binding the connection which replaced the one which reached its maximum of 1 operations: some bind error")
+		conn.Close()
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// undiscoveredMaxPageSize is the maximum page size to assume when DiscoverMaxPageSize is enabled, but the
+	// LDAP server's maximum page size could not be discovered. It is lower than the defaults of common servers,
+	// e.g. 1000 for Active Directory.
+	undiscoveredMaxPageSize = uint32(500)
+
+	// activeDirectoryQueryPolicyRDNs are the RDNs of Active Directory's default query policy, relative to the
+	// configuration naming context.
+	activeDirectoryQueryPolicyRDNs = "CN=Default Query Policy,CN=Query-Policies,CN=Directory Service,CN=Windows NT,CN=Services"
+
+	ldapAdminLimitsAttributeName = "lDAPAdminLimits"
+	maxPageSizeAdminLimitPrefix  = "MaxPageSize="
+)
+
+// pageSize returns the page size to use for paged searches. When DiscoverMaxPageSize is enabled, the configured
+// page size is clamped to the LDAP server's maximum page size, which is discovered using the given connection the
+// first time that this is called. The connection must be bound as the bind user.
+func (p *Provider) pageSize(conn Conn) uint32 {
+	pageSize := p.c.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if !p.c.DiscoverMaxPageSize {
+		return pageSize
+	}
+
+	p.maxPageSize.Do(func() {
+		maxPageSize, err := discoverMaxPageSize(conn)
+		if err != nil {
+			plog.DebugErr("could not discover the maximum page size of the LDAP server, using a conservative maximum instead", err,
+				"upstreamName", p.GetName(), "maxPageSize", undiscoveredMaxPageSize)
+			maxPageSize = undiscoveredMaxPageSize
+		} else {
+			plog.Debug("discovered the maximum page size of the LDAP server", "upstreamName", p.GetName(), "maxPageSize", maxPageSize)
+		}
+		p.maxPageSizeValue = maxPageSize
+	})
+
+	if pageSize > p.maxPageSizeValue {
+		return p.maxPageSizeValue
+	}
+	return pageSize
+}
+
+// discoverMaxPageSize returns the MaxPageSize which the LDAP server advertises. Only Active Directory advertises it,
+// in the lDAPAdminLimits of its default query policy, which is found using the configurationNamingContext of the
+// Root DSE. It does not take into account any other query policy which applies to some domain controllers.
+func discoverMaxPageSize(conn Conn) (uint32, error) {
+	rootDSE, err := searchForSingleEntry(conn, rootDSERequest("configurationNamingContext"))
+	if err != nil {
+		return 0, fmt.Errorf("error querying RootDSE for configurationNamingContext: %w", err)
+	}
+	configurationNamingContext := rootDSE.GetAttributeValue("configurationNamingContext")
+	if configurationNamingContext == "" {
+		return 0, fmt.Errorf("the RootDSE does not have a configurationNamingContext")
+	}
+
+	queryPolicy, err := searchForSingleEntry(conn, &ldap.SearchRequest{
+		BaseDN:       activeDirectoryQueryPolicyRDNs + "," + configurationNamingContext,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{ldapAdminLimitsAttributeName},
+		Controls:     nil, // don't need paging because we set the SizeLimit so small
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error querying the default query policy: %w", err)
+	}
+
+	for _, limit := range queryPolicy.GetAttributeValues(ldapAdminLimitsAttributeName) {
+		if !strings.HasPrefix(limit, maxPageSizeAdminLimitPrefix) {
+			continue
+		}
+		maxPageSize, err := strconv.ParseUint(strings.TrimPrefix(limit, maxPageSizeAdminLimitPrefix), 10, 32)
+		if err != nil || maxPageSize == 0 {
+			return 0, fmt.Errorf("the default query policy has an invalid admin limit %q", limit)
+		}
+		return uint32(maxPageSize), nil
+	}
+	return 0, fmt.Errorf("the default query policy does not have a MaxPageSize admin limit")
+}
+
+func rootDSERequest(attributes ...string) *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       "",
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   attributes,
+		Controls:     nil, // don't need paging because we set the SizeLimit so small
+	}
+}
+
+func searchForSingleEntry(conn Conn, searchRequest *ldap.SearchRequest) (*ldap.Entry, error) {
+	searchResult, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchResult.Entries) != 1 {
+		return nil, fmt.Errorf("expected to find 1 entry but found %d", len(searchResult.Entries))
+	}
+	return searchResult.Entries[0], nil
+}
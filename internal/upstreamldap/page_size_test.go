@@ -0,0 +1,144 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestPageSize(t *testing.T) {
+	const configurationNamingContext = "CN=Configuration,DC=pinniped,DC=dev"
+
+	expectedRootDSESearch := &ldap.SearchRequest{
+		BaseDN:       "",
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{"configurationNamingContext"},
+	}
+	rootDSEResult := &ldap.SearchResult{Entries: []*ldap.Entry{
+		ldap.NewEntry("", map[string][]string{"configurationNamingContext": {configurationNamingContext}}),
+	}}
+	expectedQueryPolicySearch := &ldap.SearchRequest{
+		BaseDN:       "CN=Default Query Policy,CN=Query-Policies,CN=Directory Service,CN=Windows NT,CN=Services," + configurationNamingContext,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{"lDAPAdminLimits"},
+	}
+	queryPolicyResult := func(adminLimits ...string) *ldap.SearchResult {
+		return &ldap.SearchResult{Entries: []*ldap.Entry{
+			ldap.NewEntry(expectedQueryPolicySearch.BaseDN, map[string][]string{"lDAPAdminLimits": adminLimits}),
+		}}
+	}
+
+	tests := []struct {
+		name                string
+		pageSize            uint32
+		discoverMaxPageSize bool
+		setupMocks          func(conn *mockldapconn.MockConn)
+		wantPageSize        uint32
+	}{
+		{
+			name:         "default page size",
+			wantPageSize: 250,
+		},
+		{
+			name:         "configured page size",
+			pageSize:     2000,
+			wantPageSize: 2000,
+		},
+		{
+			name:                "discovered maximum page size which is larger than the page size",
+			discoverMaxPageSize: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedRootDSESearch).Return(rootDSEResult, nil).Times(1)
+				conn.EXPECT().Search(expectedQueryPolicySearch).
+					Return(queryPolicyResult("MaxQueryDuration=120", "MaxPageSize=1000"), nil).Times(1)
+			},
+			wantPageSize: 250,
+		},
+		{
+			name:                "discovered maximum page size which is smaller than the configured page size",
+			pageSize:            2000,
+			discoverMaxPageSize: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedRootDSESearch).Return(rootDSEResult, nil).Times(1)
+				conn.EXPECT().Search(expectedQueryPolicySearch).
+					Return(queryPolicyResult("MaxQueryDuration=120", "MaxPageSize=1000"), nil).Times(1)
+			},
+			wantPageSize: 1000,
+		},
+		{
+			name:                "the RootDSE has no configuration naming context",
+			pageSize:            2000,
+			discoverMaxPageSize: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedRootDSESearch).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("", nil)}}, nil).Times(1)
+			},
+			wantPageSize: 500,
+		},
+		{
+			name:                "querying the RootDSE fails",
+			pageSize:            2000,
+			discoverMaxPageSize: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedRootDSESearch).Return(nil, errors.New("some search error")).Times(1)
+			},
+			wantPageSize: 500,
+		},
+		{
+			name:                "the default query policy has no MaxPageSize",
+			pageSize:            2000,
+			discoverMaxPageSize: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedRootDSESearch).Return(rootDSEResult, nil).Times(1)
+				conn.EXPECT().Search(expectedQueryPolicySearch).Return(queryPolicyResult("MaxQueryDuration=120"), nil).Times(1)
+			},
+			wantPageSize: 500,
+		},
+		{
+			name:                "the default query policy has an invalid MaxPageSize",
+			pageSize:            2000,
+			discoverMaxPageSize: true,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedRootDSESearch).Return(rootDSEResult, nil).Times(1)
+				conn.EXPECT().Search(expectedQueryPolicySearch).Return(queryPolicyResult("MaxPageSize=0"), nil).Times(1)
+			},
+			wantPageSize: 500,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			provider := New(ProviderConfig{PageSize: tt.pageSize, DiscoverMaxPageSize: tt.discoverMaxPageSize})
+
+			// The maximum page size is only discovered once per Provider.
+			require.Equal(t, tt.wantPageSize, provider.pageSize(conn))
+			require.Equal(t, tt.wantPageSize, provider.pageSize(conn))
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.pinniped.dev/internal/endpointaddr"
+)
+
+// Option customizes a ProviderConfig built by NewProviderConfigFromURL.
+type Option func(*ProviderConfig)
+
+// WithName sets the ProviderConfig's Name.
+func WithName(name string) Option {
+	return func(c *ProviderConfig) { c.Name = name }
+}
+
+// WithBindCredentials sets the ProviderConfig's BindUsername and BindPassword.
+func WithBindCredentials(username, password string) Option {
+	return func(c *ProviderConfig) {
+		c.BindUsername = username
+		c.BindPassword = password
+	}
+}
+
+// WithCABundle sets the ProviderConfig's CABundle, a PEM-encoded bundle of CA certificates.
+func WithCABundle(caBundle []byte) Option {
+	return func(c *ProviderConfig) { c.CABundle = caBundle }
+}
+
+// WithUserSearch sets the ProviderConfig's UserSearch.
+func WithUserSearch(userSearch UserSearchConfig) Option {
+	return func(c *ProviderConfig) { c.UserSearch = userSearch }
+}
+
+// WithGroupSearch sets the ProviderConfig's GroupSearch.
+func WithGroupSearch(groupSearch GroupSearchConfig) Option {
+	return func(c *ProviderConfig) { c.GroupSearch = groupSearch }
+}
+
+// NewProviderConfigFromURL builds a ProviderConfig from an LDAP URL, e.g. "ldaps://hostname:636/" or
+// "ldap://hostname/", and the given options. The URL's scheme determines the ConnectionProtocol: TLS for "ldaps"
+// and StartTLS for "ldap". The returned ProviderConfig has its Host set to the URL's "hostname:port" and is ready
+// to be passed to New.
+func NewProviderConfigFromURL(rawURL string, opts ...Option) (ProviderConfig, error) {
+	if !strings.Contains(rawURL, "://") {
+		return ProviderConfig{}, fmt.Errorf("%q is not an LDAP URL, must start with %q or %q", rawURL, ldapsScheme+"://", ldapScheme+"://")
+	}
+
+	host, connectionProtocol, err := parseLDAPURL(rawURL)
+	if err != nil {
+		return ProviderConfig{}, err
+	}
+	defaultPort := defaultLDAPPort
+	if connectionProtocol == TLS {
+		defaultPort = defaultLDAPSPort
+	}
+	if _, err := endpointaddr.Parse(host, defaultPort); err != nil {
+		return ProviderConfig{}, fmt.Errorf("LDAP URL host %q is not valid: %w", host, err)
+	}
+
+	config := ProviderConfig{
+		Host:               host,
+		ConnectionProtocol: connectionProtocol,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config, nil
+}
+
+// parseLDAPURL returns the "hostname:port" and the LDAPConnectionProtocol described by an LDAP URL.
+func parseLDAPURL(rawURL string) (string, LDAPConnectionProtocol, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse host as an LDAP URL: %w", err)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", "", fmt.Errorf("LDAP URL host must not have a user, path, query, or fragment")
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("LDAP URL host must have a hostname")
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case ldapsScheme:
+		return u.Host, TLS, nil
+	case ldapScheme:
+		return u.Host, StartTLS, nil
+	default:
+		return "", "", fmt.Errorf("LDAP URL host has unsupported scheme %q, must be %q or %q", u.Scheme, ldapsScheme, ldapScheme)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProviderConfigFromURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		rawURL     string
+		opts       []Option
+		wantConfig ProviderConfig
+		wantError  string
+	}{
+		{
+			name:   "ldaps URL without options",
+			rawURL: "ldaps://ldap.example.com:636/",
+			wantConfig: ProviderConfig{
+				Host:               "ldap.example.com:636",
+				ConnectionProtocol: TLS,
+			},
+		},
+		{
+			name:   "ldap URL without port",
+			rawURL: "LDAP://ldap.example.com",
+			wantConfig: ProviderConfig{
+				Host:               "ldap.example.com",
+				ConnectionProtocol: StartTLS,
+			},
+		},
+		{
+			name:   "all options",
+			rawURL: "ldaps://[::1]:1234",
+			opts: []Option{
+				WithName("some-ldap-idp"),
+				WithBindCredentials("cn=bind-user,dc=example,dc=com", "some-password"),
+				WithCABundle([]byte("some-ca-bundle")),
+				WithUserSearch(UserSearchConfig{Base: "ou=users,dc=example,dc=com", Filter: "uid={}"}),
+				WithGroupSearch(GroupSearchConfig{Base: "ou=groups,dc=example,dc=com", GroupNameAttribute: "cn"}),
+			},
+			wantConfig: ProviderConfig{
+				Name:               "some-ldap-idp",
+				Host:               "[::1]:1234",
+				ConnectionProtocol: TLS,
+				BindUsername:       "cn=bind-user,dc=example,dc=com",
+				BindPassword:       "some-password",
+				CABundle:           []byte("some-ca-bundle"),
+				UserSearch:         UserSearchConfig{Base: "ou=users,dc=example,dc=com", Filter: "uid={}"},
+				GroupSearch:        GroupSearchConfig{Base: "ou=groups,dc=example,dc=com", GroupNameAttribute: "cn"},
+			},
+		},
+		{
+			name:   "later options override earlier options",
+			rawURL: "ldaps://ldap.example.com",
+			opts:   []Option{WithName("first"), WithName("second")},
+			wantConfig: ProviderConfig{
+				Name:               "second",
+				Host:               "ldap.example.com",
+				ConnectionProtocol: TLS,
+			},
+		},
+		{
+			name:      "not a URL",
+			rawURL:    "ldap.example.com:636",
+			wantError: `"ldap.example.com:636" is not an LDAP URL, must start with "ldaps://" or "ldap://"`,
+		},
+		{
+			name:      "unsupported scheme",
+			rawURL:    "ldapi://ldap.example.com",
+			wantError: `LDAP URL host has unsupported scheme "ldapi", must be "ldaps" or "ldap"`,
+		},
+		{
+			name:      "URL with a path",
+			rawURL:    "ldaps://ldap.example.com/dc=example,dc=com",
+			wantError: `LDAP URL host must not have a user, path, query, or fragment`,
+		},
+		{
+			name:      "URL with a user",
+			rawURL:    "ldaps://someone@ldap.example.com",
+			wantError: `LDAP URL host must not have a user, path, query, or fragment`,
+		},
+		{
+			name:      "URL without a host",
+			rawURL:    "ldap:///",
+			wantError: `LDAP URL host must have a hostname`,
+		},
+		{
+			name:      "invalid hostname",
+			rawURL:    "ldaps://ldap_server.example.com",
+			wantError: `LDAP URL host "ldap_server.example.com" is not valid: host "ldap_server.example.com" is not a valid hostname or IP address`,
+		},
+		{
+			name:      "invalid port",
+			rawURL:    "ldaps://ldap.example.com:99999",
+			wantError: `LDAP URL host "ldap.example.com:99999" is not valid: invalid port "99999"`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewProviderConfigFromURL(tt.rawURL, tt.opts...)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.Equal(t, ProviderConfig{}, config)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantConfig, config)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+// DialAttempt is one call to the Dial method of a RecordingDialer.
+type DialAttempt struct {
+	Addr endpointaddr.HostPort
+	Time time.Time
+}
+
+// RecordingDialer is a deterministic LDAPDialer for tests, which records every dial and which can be programmed to
+// fail the first dials or every dial of specific hosts. Dials which do not fail return the result of NewConn.
+type RecordingDialer struct {
+	// NewConn returns the Conn for each successful dial.
+	NewConn func() Conn
+
+	// FailFirst is the number of dials which fail before any dial may succeed.
+	FailFirst int
+
+	// FailHosts are the hostnames for which every dial fails.
+	FailHosts []string
+
+	// Err is the error returned by failing dials. When nil, a network error is returned.
+	Err error
+
+	// Clock exists to control the recorded times. When nil, time.Now will be used.
+	Clock func() time.Time
+
+	lock     sync.Mutex
+	attempts []DialAttempt
+}
+
+var _ LDAPDialer = (*RecordingDialer)(nil)
+
+func (d *RecordingDialer) Dial(_ context.Context, addr endpointaddr.HostPort) (Conn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now
+	if d.Clock != nil {
+		now = d.Clock
+	}
+	d.attempts = append(d.attempts, DialAttempt{Addr: addr, Time: now()})
+
+	if len(d.attempts) <= d.FailFirst || d.failsHost(addr.Host) {
+		if d.Err != nil {
+			return nil, d.Err
+		}
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("programmed dial failure"))
+	}
+	return d.NewConn(), nil
+}
+
+func (d *RecordingDialer) failsHost(host string) bool {
+	for _, failHost := range d.FailHosts {
+		if failHost == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Attempts returns a copy of the dials which have been recorded so far.
+func (d *RecordingDialer) Attempts() []DialAttempt {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]DialAttempt{}, d.attempts...)
+}
+
+// AttemptedHosts returns the endpoints of the dials which have been recorded so far, in order.
+func (d *RecordingDialer) AttemptedHosts() []string {
+	var hosts []string
+	for _, attempt := range d.Attempts() {
+		hosts = append(hosts, attempt.Addr.Endpoint())
+	}
+	return hosts
+}
+
+func TestRecordingDialer(t *testing.T) {
+	newConn := func(t *testing.T) func() Conn {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		return func() Conn {
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Close().Times(1)
+			return conn
+		}
+	}
+	newProvider := func(host string, dialer LDAPDialer, circuitBreaker CircuitBreakerConfig) *Provider {
+		return New(ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               host,
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			Dialer:             dialer,
+			CircuitBreaker:     circuitBreaker,
+		})
+	}
+
+	t.Run("records each dial and fails the first dials", func(t *testing.T) {
+		now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		dialer := &RecordingDialer{NewConn: newConn(t), FailFirst: 2, Clock: func() time.Time { return now }}
+		p := newProvider(testHost, dialer, CircuitBreakerConfig{})
+
+		require.EqualError(t, p.TestConnection(context.Background()),
+			`error dialing host "ldap.example.com:8443": LDAP Result Code 200 "Network Error": programmed dial failure`)
+		now = now.Add(time.Second)
+		require.Error(t, p.TestConnection(context.Background()))
+		now = now.Add(time.Second)
+		require.NoError(t, p.TestConnection(context.Background()))
+
+		attempts := dialer.Attempts()
+		require.Len(t, attempts, 3)
+		for i, attempt := range attempts {
+			require.Equal(t, testHost, attempt.Addr.Endpoint())
+			require.Equal(t, time.Date(2022, 1, 1, 0, 0, i, 0, time.UTC), attempt.Time)
+		}
+	})
+
+	t.Run("the circuit breaker stops dialing after repeated failures", func(t *testing.T) {
+		dialer := &RecordingDialer{NewConn: newConn(t), FailFirst: 100}
+		p := newProvider(testHost, dialer, CircuitBreakerConfig{FailureThreshold: 2})
+
+		require.Error(t, p.TestConnection(context.Background()))
+		require.Error(t, p.TestConnection(context.Background()))
+		require.ErrorIs(t, p.TestConnection(context.Background()), ErrCircuitOpen)
+
+		require.Equal(t, []string{testHost, testHost}, dialer.AttemptedHosts())
+	})
+
+	// The Provider has a single Host, so trying another host is up to the caller, e.g. by using another Provider.
+	t.Run("fails the dials of specific hosts, such that a caller can fail over from host A to host B", func(t *testing.T) {
+		dialer := &RecordingDialer{NewConn: newConn(t), FailHosts: []string{"host-a.example.com"}}
+
+		var err error
+		for _, host := range []string{"host-a.example.com", "host-b.example.com"} {
+			if err = newProvider(host, dialer, CircuitBreakerConfig{}).TestConnection(context.Background()); err == nil {
+				break
+			}
+		}
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"host-a.example.com:636", "host-b.example.com:636"}, dialer.AttemptedHosts())
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"k8s.io/utils/trace"
+)
+
+// UserEntryStatus is the result of RefreshUser.
+type UserEntryStatus struct {
+	// Exists is false when the user's entry no longer exists, or can no longer be read by the bind user.
+	Exists bool
+
+	// MatchesFilter is false when the user's entry no longer matches the UserSearch Filter, e.g. because the user's
+	// account was disabled and the Filter only matches enabled accounts. Always false when the entry does not exist.
+	MatchesFilter bool
+}
+
+// RefreshUser reads the user's entry with the given DN again, e.g. from a background job which revokes the sessions
+// of users whose accounts were deleted or disabled since they logged in, and reports whether the entry still exists
+// and still matches the UserSearch Filter. The part of the Filter which matches the username is treated as matching
+// any value, since the username which was used to log in is not known here. Unlike the refresh of a session, it does
+// not check any attributes of the entry, and it is never used while authenticating users.
+//
+// The go-ldap library used here has no support for the persistent search and entry change notification controls, so
+// the entry is polled by each call instead of being watched for changes.
+func (p *Provider) RefreshUser(ctx context.Context, userDN string) (*UserEntryStatus, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
+	t := trace.FromContext(ctx).Nest("slow ldap refresh user attempt", trace.Field{Key: "providerName", Value: p.GetName()})
+	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Interpolating an unescaped "*" turns the username part of the filter into a presence or substring match.
+	found, err := userEntryFound(conn, userEntryRequest(userDN, p.userSearchFilterForSafeValue("*")))
+	if err != nil {
+		return nil, fmt.Errorf(`error searching for user with DN %q: %w`, userDN, err)
+	}
+	if found {
+		return &UserEntryStatus{Exists: true, MatchesFilter: true}, nil
+	}
+
+	found, err = userEntryFound(conn, userEntryRequest(userDN, "(objectClass=*)"))
+	if err != nil {
+		return nil, fmt.Errorf(`error searching for user with DN %q: %w`, userDN, err)
+	}
+	return &UserEntryStatus{Exists: found}, nil
+}
+
+// userEntryFound returns whether the base search found the entry, treating an entry which does not exist as not
+// found instead of as an error.
+func userEntryFound(conn Conn, searchRequest *ldap.SearchRequest) (bool, error) {
+	searchResult, err := conn.Search(searchRequest)
+	if err != nil {
+		ldapErr := &ldap.Error{}
+		if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultNoSuchObject {
+			return false, nil
+		}
+		return false, classifySearchError(err)
+	}
+	return len(searchResult.Entries) == 1, nil
+}
+
+func userEntryRequest(userDN, filter string) *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       userDN,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       filter,
+		Attributes:   []string{"1.1"}, // the special attribute name which requests that no attributes are returned
+		Controls:     nil,             // don't need paging because we set the SizeLimit so small
+	}
+}
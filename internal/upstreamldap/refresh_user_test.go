@@ -0,0 +1,130 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestRefreshUser(t *testing.T) {
+	expectedSearch := func(filter string) *ldap.SearchRequest {
+		return &ldap.SearchRequest{
+			BaseDN:       testUserSearchResultDNValue,
+			Scope:        ldap.ScopeBaseObject,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    2,
+			TimeLimit:    90,
+			TypesOnly:    false,
+			Filter:       filter,
+			Attributes:   []string{"1.1"},
+			Controls:     nil,
+		}
+	}
+	filterSearch := expectedSearch("(some-user-filter=*-and-more-filter=*)")
+	existsSearch := expectedSearch("(objectClass=*)")
+	foundEntry := &ldap.SearchResult{Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue}}}
+	noSuchObject := ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("some search error"))
+
+	tests := []struct {
+		name       string
+		setupMocks func(conn *mockldapconn.MockConn)
+		wantStatus *UserEntryStatus
+		wantError  string
+	}{
+		{
+			name: "the entry exists and matches the filter",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(filterSearch).Return(foundEntry, nil).Times(1)
+			},
+			wantStatus: &UserEntryStatus{Exists: true, MatchesFilter: true},
+		},
+		{
+			name: "the entry exists but no longer matches the filter",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(filterSearch).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Search(existsSearch).Return(foundEntry, nil).Times(1)
+			},
+			wantStatus: &UserEntryStatus{Exists: true, MatchesFilter: false},
+		},
+		{
+			name: "the entry no longer exists",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(filterSearch).Return(nil, noSuchObject).Times(1)
+				conn.EXPECT().Search(existsSearch).Return(nil, noSuchObject).Times(1)
+			},
+			wantStatus: &UserEntryStatus{Exists: false, MatchesFilter: false},
+		},
+		{
+			name: "the entry can no longer be read",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(filterSearch).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Search(existsSearch).Return(&ldap.SearchResult{}, nil).Times(1)
+			},
+			wantStatus: &UserEntryStatus{Exists: false, MatchesFilter: false},
+		},
+		{
+			name: "the search fails",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(filterSearch).Return(nil, errors.New("some search error")).Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for user with DN %q: some search error`, testUserSearchResultDNValue),
+		},
+		{
+			name: "the second search fails",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(filterSearch).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Search(existsSearch).Return(nil, errors.New("some search error")).Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for user with DN %q: some search error`, testUserSearchResultDNValue),
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			tt.setupMocks(conn)
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			status, err := ldapProvider.RefreshUser(context.Background(), testUserSearchResultDNValue)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.Nil(t, status)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, status)
+		})
+	}
+}
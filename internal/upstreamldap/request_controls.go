@@ -0,0 +1,73 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// requestControlsContextKey is the key under which WithRequestControls stores the controls in a context.
+type requestControlsContextKey struct{}
+
+// WithRequestControls returns a copy of the context which holds LDAP controls to attach to the user and group
+// searches of an authentication which uses the context, e.g. a proxied authorization control
+// (OID 2.16.840.1.113730.3.4.18, see RFC 4370) or a session tracking control (OID 1.3.6.1.4.1.21008.108.63.1).
+// These controls are safe to inject because they only change who the server considers to be performing a search
+// or how it audits the search.
+//
+// The controls are never attached to binds or to the "Who am I?" extended operation, because the server's answer
+// to those decides which user is authenticated. A paging control (OID 1.2.840.113556.1.4.319) is ignored, because
+// the Provider pages its searches itself, and so is any control whose type is already on a search request.
+func WithRequestControls(ctx context.Context, controls []ldap.Control) context.Context {
+	return context.WithValue(ctx, requestControlsContextKey{}, controls)
+}
+
+// RequestControlsFromContext returns the controls which were added to the context by WithRequestControls, or nil.
+func RequestControlsFromContext(ctx context.Context) []ldap.Control {
+	controls, _ := ctx.Value(requestControlsContextKey{}).([]ldap.Control)
+	return controls
+}
+
+// withRequestControls returns the connection wrapped to attach the context's request controls to each search, or
+// returns the connection itself when the context has no request controls.
+func withRequestControls(ctx context.Context, conn Conn) Conn {
+	controls := RequestControlsFromContext(ctx)
+	if len(controls) == 0 {
+		return conn
+	}
+	return &requestControlsConn{Conn: conn, controls: controls}
+}
+
+// requestControlsConn is a Conn which attaches extra controls to each search.
+type requestControlsConn struct {
+	Conn
+	controls []ldap.Control
+}
+
+func (c *requestControlsConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return c.Conn.Search(c.withControls(searchRequest))
+}
+
+func (c *requestControlsConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	return c.Conn.SearchWithPaging(c.withControls(searchRequest), pagingSize)
+}
+
+// withControls returns a shallow copy of the search request with the extra controls appended, leaving the caller's
+// request untouched so that it can be reused, e.g. for the next page of a paged search.
+func (c *requestControlsConn) withControls(searchRequest *ldap.SearchRequest) *ldap.SearchRequest {
+	request := *searchRequest
+	request.Controls = append([]ldap.Control{}, searchRequest.Controls...)
+	for _, control := range c.controls {
+		if control == nil || control.GetControlType() == ldap.ControlTypePaging {
+			continue
+		}
+		if ldap.FindControl(request.Controls, control.GetControlType()) != nil {
+			continue
+		}
+		request.Controls = append(request.Controls, control)
+	}
+	return &request
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+const proxiedAuthorizationControlType = "2.16.840.1.113730.3.4.18"
+
+func TestRequestControlsFromContext(t *testing.T) {
+	require.Nil(t, RequestControlsFromContext(context.Background()))
+
+	controls := []ldap.Control{ldap.NewControlString(proxiedAuthorizationControlType, true, "dn:cn=someone")}
+	require.Equal(t, controls, RequestControlsFromContext(WithRequestControls(context.Background(), controls)))
+}
+
+func TestWithRequestControls(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+	conn := mockldapconn.NewMockConn(ctrl)
+
+	t.Run("returns the connection itself when there are no controls", func(t *testing.T) {
+		require.Same(t, conn, withRequestControls(context.Background(), conn))
+		require.Same(t, conn, withRequestControls(WithRequestControls(context.Background(), []ldap.Control{}), conn))
+	})
+
+	t.Run("attaches the controls to a copy of each search request", func(t *testing.T) {
+		proxiedAuthorization := ldap.NewControlString(proxiedAuthorizationControlType, true, "dn:cn=someone")
+		existingManageDsaIT := ldap.NewControlManageDsaIT(false)
+		ctx := WithRequestControls(context.Background(), []ldap.Control{
+			proxiedAuthorization,
+			nil,
+			ldap.NewControlPaging(10),        // ignored because the Provider pages its own searches
+			ldap.NewControlManageDsaIT(true), // ignored because the request already has this type of control
+		})
+
+		request := &ldap.SearchRequest{BaseDN: "some-base", Controls: []ldap.Control{existingManageDsaIT}}
+		wantRequest := &ldap.SearchRequest{BaseDN: "some-base", Controls: []ldap.Control{existingManageDsaIT, proxiedAuthorization}}
+		conn.EXPECT().Search(wantRequest).Return(&ldap.SearchResult{}, nil).Times(2)
+		conn.EXPECT().SearchWithPaging(wantRequest, uint32(42)).Return(&ldap.SearchResult{}, nil).Times(1)
+
+		wrapped := withRequestControls(ctx, conn)
+		_, err := wrapped.Search(request)
+		require.NoError(t, err)
+		_, err = wrapped.Search(request) // reusing the request does not attach the controls twice
+		require.NoError(t, err)
+		_, err = wrapped.SearchWithPaging(request, 42)
+		require.NoError(t, err)
+
+		require.Equal(t, []ldap.Control{existingManageDsaIT}, request.Controls)
+	})
+}
+
+func TestEndUserAuthenticationRequestControls(t *testing.T) {
+	proxiedAuthorization := ldap.NewControlString(proxiedAuthorizationControlType, true, "dn:cn=someone")
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	conn := mockldapconn.NewMockConn(ctrl)
+	conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+	conn.EXPECT().Search(gomock.Any()).DoAndReturn(func(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+		require.Equal(t, testUserSearchBase, searchRequest.BaseDN)
+		require.Equal(t, []ldap.Control{proxiedAuthorization}, searchRequest.Controls)
+		return &ldap.SearchResult{
+			Entries: []*ldap.Entry{
+				{
+					DN: testUserSearchResultDNValue,
+					Attributes: []*ldap.EntryAttribute{
+						ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+						ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+					},
+				},
+			},
+		}, nil
+	}).Times(1)
+	conn.EXPECT().SearchWithPaging(gomock.Any(), defaultPageSize).DoAndReturn(func(searchRequest *ldap.SearchRequest, _ uint32) (*ldap.SearchResult, error) {
+		require.Equal(t, testGroupSearchBase, searchRequest.BaseDN)
+		require.Equal(t, []ldap.Control{proxiedAuthorization}, searchRequest.Controls)
+		return &ldap.SearchResult{
+			Entries: []*ldap.Entry{{DN: testGroupSearchResultDNValue1}},
+		}, nil
+	}).Times(1)
+	conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+	conn.EXPECT().Close().Times(1)
+
+	ldapProvider := New(ProviderConfig{
+		Name:               "some-provider-name",
+		Host:               testHost,
+		ConnectionProtocol: TLS,
+		BindUsername:       testBindUsername,
+		BindPassword:       testBindPassword,
+		UserSearch: UserSearchConfig{
+			Base:              testUserSearchBase,
+			Filter:            testUserSearchFilter,
+			UsernameAttribute: testUserSearchUsernameAttribute,
+			UIDAttribute:      testUserSearchUIDAttribute,
+		},
+		GroupSearch: GroupSearchConfig{
+			Base:               testGroupSearchBase,
+			Filter:             testGroupSearchFilter,
+			GroupNameAttribute: "dn",
+		},
+		Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			return conn, nil
+		}),
+	})
+
+	ctx := WithRequestControls(context.Background(), []ldap.Control{proxiedAuthorization})
+	authResponse, authenticated, err := ldapProvider.AuthenticateUser(ctx, testUpstreamUsername, testUpstreamPassword, []string{"groups"})
+	require.NoError(t, err)
+	require.True(t, authenticated)
+	require.Equal(t, []string{testGroupSearchResultDNValue1}, authResponse.User.GetGroups())
+}
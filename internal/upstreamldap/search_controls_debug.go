@@ -0,0 +1,58 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"github.com/go-ldap/ldap/v3"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+// searchControlsDebugConn is a Conn which logs the types of the controls of each search request and of its result,
+// to help debug whether the LDAP server honored controls such as paging. The values of the controls are not logged.
+type searchControlsDebugConn struct {
+	Conn
+	upstreamName string
+}
+
+func (c *searchControlsDebugConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	searchResult, err := c.Conn.Search(searchRequest)
+	c.log(searchRequest, searchResult)
+	return searchResult, err
+}
+
+func (c *searchControlsDebugConn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	searchResult, err := c.Conn.SearchWithPaging(searchRequest, pagingSize)
+	// ldap.Conn's SearchWithPaging adds its paging control to the request's controls.
+	c.log(searchRequest, searchResult)
+	return searchResult, err
+}
+
+func (c *searchControlsDebugConn) log(searchRequest *ldap.SearchRequest, searchResult *ldap.SearchResult) {
+	var resultControls []ldap.Control
+	if searchResult != nil {
+		resultControls = searchResult.Controls
+	}
+	plog.Debug("LDAP search controls",
+		"upstreamName", c.upstreamName,
+		"baseDN", searchRequest.BaseDN,
+		"requestControls", describeControls(searchRequest.Controls),
+		"resultControls", describeControls(resultControls),
+	)
+}
+
+// describeControls returns the name and OID of each control, e.g. "Paging (1.2.840.113556.1.4.319)", or only the
+// OID when the name of the control is not known.
+func describeControls(controls []ldap.Control) []string {
+	descriptions := []string{}
+	for _, control := range controls {
+		controlType := control.GetControlType()
+		if name, ok := ldap.ControlTypeMap[controlType]; ok {
+			descriptions = append(descriptions, name+" ("+controlType+")")
+		} else {
+			descriptions = append(descriptions, controlType)
+		}
+	}
+	return descriptions
+}
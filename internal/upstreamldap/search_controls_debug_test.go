@@ -0,0 +1,75 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestDescribeControls(t *testing.T) {
+	require.Equal(t, []string{}, describeControls(nil))
+	require.Equal(t,
+		[]string{"Paging (1.2.840.113556.1.4.319)", "1.2.3.4"},
+		describeControls([]ldap.Control{
+			ldap.NewControlPaging(42),
+			ldap.NewControlString("1.2.3.4", true, "some-value-which-should-not-be-described"),
+		}),
+	)
+}
+
+func TestSearchControlsDebugConn(t *testing.T) {
+	for _, debugSearchControls := range []bool{false, true} {
+		debugSearchControls := debugSearchControls
+		t.Run(fmt.Sprintf("DebugSearchControls=%t", debugSearchControls), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockConn := mockldapconn.NewMockConn(ctrl)
+			p := New(ProviderConfig{
+				Name:                "some-provider-name",
+				Host:                testHost,
+				ConnectionProtocol:  TLS,
+				DebugSearchControls: debugSearchControls,
+				Dialer: LDAPDialerFunc(func(ctx context.Context, _ endpointaddr.HostPort) (Conn, error) {
+					return mockConn, nil
+				}),
+			})
+
+			conn, err := p.dial(context.Background())
+			require.NoError(t, err)
+			if !debugSearchControls {
+				require.Same(t, mockConn, conn)
+				return
+			}
+			require.IsType(t, &searchControlsDebugConn{}, conn)
+
+			// The wrapped Conn's results are returned unchanged.
+			searchRequest := &ldap.SearchRequest{BaseDN: "some-base-dn", Controls: []ldap.Control{ldap.NewControlPaging(42)}}
+			searchResult := &ldap.SearchResult{Controls: []ldap.Control{ldap.NewControlPaging(0)}}
+			mockConn.EXPECT().Search(searchRequest).Return(searchResult, nil).Times(1)
+			mockConn.EXPECT().SearchWithPaging(searchRequest, uint32(42)).Return(nil, errors.New("some search error")).Times(1)
+			mockConn.EXPECT().Close().Times(1)
+
+			gotResult, err := conn.Search(searchRequest)
+			require.NoError(t, err)
+			require.Same(t, searchResult, gotResult)
+
+			gotResult, err = conn.SearchWithPaging(searchRequest, 42)
+			require.EqualError(t, err, "some search error")
+			require.Nil(t, gotResult)
+
+			conn.Close()
+		})
+	}
+}
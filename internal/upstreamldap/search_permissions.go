@@ -0,0 +1,95 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrUserSearchBaseNotReadable is returned by TestConnection when it is configured to validate the bind user's
+// permissions and the bind user cannot read the user entries under the user search base.
+var ErrUserSearchBaseNotReadable = errors.New("service account cannot read under base DN (check permissions)")
+
+// checkUserSearchPermissions checks that the bind user can read the UsernameAttribute of at least one entry under
+// the UserSearch Base, telling apart a Base which does not exist from a Base whose entries cannot be read.
+func (p *Provider) checkUserSearchPermissions(conn Conn) error {
+	base := p.c.UserSearch.Base
+	attribute := p.userSearchPermissionsAttribute()
+
+	searchResult, err := conn.Search(p.userSearchPermissionsRequest(attribute))
+	if err != nil {
+		ldapErr := &ldap.Error{}
+		isLDAPErr := errors.As(err, &ldapErr)
+		switch {
+		case isLDAPErr && ldapErr.ResultCode == ldap.LDAPResultSizeLimitExceeded && searchResult != nil:
+			// Finding more than one entry is fine, since the first entry is enough.
+		case isLDAPErr && ldapErr.ResultCode == ldap.LDAPResultNoSuchObject:
+			err = fmt.Errorf(`%w: %q: %s`, ErrUserSearchBaseNotAccessible, base, err)
+			return &ConnectionError{Kind: SearchBaseNotFound, Err: err}
+		case isLDAPErr && ldapErr.ResultCode == ldap.LDAPResultInsufficientAccessRights:
+			err = fmt.Errorf(`%w: %q: %s`, ErrUserSearchBaseNotReadable, base, err)
+			return &ConnectionError{Kind: SearchBaseNotReadable, Err: err}
+		default:
+			return fmt.Errorf(`error searching for entries under user search base %q: %w`, base, classifySearchError(err))
+		}
+	}
+
+	// Servers commonly hide the entries which cannot be read instead of returning an error, so finding no entries
+	// which have the attribute most likely means that the bind user may not read them.
+	if len(searchResult.Entries) == 0 {
+		err = fmt.Errorf(`%w: %q: found no entries with a readable %q attribute`, ErrUserSearchBaseNotReadable, base, attribute)
+		return &ConnectionError{Kind: SearchBaseNotReadable, Err: err}
+	}
+	entry := searchResult.Entries[0]
+	if !p.hasReadableAttribute(entry, attribute) {
+		err = fmt.Errorf(`%w: %q: the %q attribute of entry %q could not be read`, ErrUserSearchBaseNotReadable, base, attribute, entry.DN)
+		return &ConnectionError{Kind: SearchBaseNotReadable, Err: err}
+	}
+	return nil
+}
+
+// userSearchPermissionsAttribute returns the attribute which the bind user must be able to read, which is the
+// UsernameAttribute, the UIDAttribute, or objectClass when both of those are the DN.
+func (p *Provider) userSearchPermissionsAttribute() string {
+	switch {
+	case p.c.UserSearch.UsernameAttribute != "" && p.c.UserSearch.UsernameAttribute != distinguishedNameAttributeName:
+		return p.c.UserSearch.UsernameAttribute
+	case p.c.UserSearch.UIDAttribute != "" && p.c.UserSearch.UIDAttribute != distinguishedNameAttributeName:
+		return p.c.UserSearch.UIDAttribute
+	default:
+		return "objectClass"
+	}
+}
+
+// hasReadableAttribute returns true when the entry has the attribute, which only means that it has values when the
+// search was not a DiagnosticSearchesTypesOnly search.
+func (p *Provider) hasReadableAttribute(entry *ldap.Entry, attribute string) bool {
+	if !p.c.DiagnosticSearchesTypesOnly {
+		return len(entry.GetAttributeValues(attribute)) > 0
+	}
+	for _, entryAttribute := range entry.Attributes {
+		if strings.EqualFold(entryAttribute.Name, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) userSearchPermissionsRequest(attribute string) *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       p.c.UserSearch.Base,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    1,
+		TimeLimit:    90,
+		TypesOnly:    p.c.DiagnosticSearchesTypesOnly,
+		Filter:       fmt.Sprintf("(%s=*)", ldap.EscapeFilter(attribute)),
+		Attributes:   []string{attribute},
+		Controls:     nil, // don't need paging because we set the SizeLimit so small
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestTestConnectionValidatesUserSearchPermissions(t *testing.T) {
+	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
+		config := &ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch: UserSearchConfig{
+				Base:              testUserSearchBase,
+				UsernameAttribute: testUserSearchUsernameAttribute,
+				UIDAttribute:      testUserSearchUIDAttribute,
+			},
+			TestConnectionValidatesUserSearchPermissions: true,
+		}
+		if editFunc != nil {
+			editFunc(config)
+		}
+		return config
+	}
+
+	expectedPermissionsSearch := func(attribute string) *ldap.SearchRequest {
+		return &ldap.SearchRequest{
+			BaseDN:       testUserSearchBase,
+			Scope:        ldap.ScopeWholeSubtree,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    1,
+			TimeLimit:    90,
+			TypesOnly:    false,
+			Filter:       fmt.Sprintf("(%s=*)", attribute),
+			Attributes:   []string{attribute},
+			Controls:     nil,
+		}
+	}
+
+	readableEntry := &ldap.SearchResult{
+		Entries: []*ldap.Entry{{
+			DN: testUserSearchResultDNValue,
+			Attributes: []*ldap.EntryAttribute{
+				ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+			},
+		}},
+	}
+
+	tests := []struct {
+		name           string
+		providerConfig *ProviderConfig
+		setupMocks     func(conn *mockldapconn.MockConn)
+		wantError      string
+		wantErrorIs    error
+		wantKind       ConnectionErrorKind
+	}{
+		{
+			name:           "happy path",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).Return(readableEntry, nil).Times(1)
+			},
+		},
+		{
+			name:           "more entries than the size limit",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).
+					Return(readableEntry, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("some size limit error"))).Times(1)
+			},
+		},
+		{
+			name: "uses the UID attribute when the username attribute is the DN",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameAttribute = "dn"
+				p.UserSearch.Filter = testUserSearchFilter
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUIDAttribute)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{
+						DN: testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{
+							ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+						},
+					}},
+				}, nil).Times(1)
+			},
+		},
+		{
+			name: "uses objectClass when both the username and UID attributes are the DN",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameAttribute = "dn"
+				p.UserSearch.UIDAttribute = "dn"
+				p.UserSearch.Filter = testUserSearchFilter
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch("objectClass")).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{
+						DN:         testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{ldap.NewEntryAttribute("objectClass", []string{"person"})},
+					}},
+				}, nil).Times(1)
+			},
+		},
+		{
+			name: "only requests the attribute types when configured to",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.DiagnosticSearchesTypesOnly = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				search := expectedPermissionsSearch(testUserSearchUsernameAttribute)
+				search.TypesOnly = true
+				conn.EXPECT().Search(search).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{
+						DN:         testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{{Name: testUserSearchUsernameAttribute}},
+					}},
+				}, nil).Times(1)
+			},
+		},
+		{
+			name: "when only requesting the attribute types finds an entry without the attribute",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.DiagnosticSearchesTypesOnly = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				search := expectedPermissionsSearch(testUserSearchUsernameAttribute)
+				search.TypesOnly = true
+				conn.EXPECT().Search(search).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue}},
+				}, nil).Times(1)
+			},
+			wantError: fmt.Sprintf(`service account cannot read under base DN (check permissions): "%s": the "%s" attribute of entry "%s" could not be read`,
+				testUserSearchBase, testUserSearchUsernameAttribute, testUserSearchResultDNValue),
+			wantErrorIs: ErrUserSearchBaseNotReadable,
+			wantKind:    SearchBaseNotReadable,
+		},
+		{
+			name: "when not configured to validate the permissions",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.TestConnectionValidatesUserSearchPermissions = false
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {},
+		},
+		{
+			name: "when the user search base is empty",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Base = ""
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {},
+		},
+		{
+			name:           "when the user search base does not exist",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).
+					Return(nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("some search error"))).Times(1)
+			},
+			wantError:   fmt.Sprintf(`user search base not found or not accessible: "%s": LDAP Result Code 32 "No Such Object": some search error`, testUserSearchBase),
+			wantErrorIs: ErrUserSearchBaseNotAccessible,
+			wantKind:    SearchBaseNotFound,
+		},
+		{
+			name:           "when the server refuses the search",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).
+					Return(nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("some search error"))).Times(1)
+			},
+			wantError:   fmt.Sprintf(`service account cannot read under base DN (check permissions): "%s": LDAP Result Code 50 "Insufficient Access Rights": some search error`, testUserSearchBase),
+			wantErrorIs: ErrUserSearchBaseNotReadable,
+			wantKind:    SearchBaseNotReadable,
+		},
+		{
+			name:           "when the search finds no entries",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).Return(&ldap.SearchResult{}, nil).Times(1)
+			},
+			wantError: fmt.Sprintf(`service account cannot read under base DN (check permissions): "%s": found no entries with a readable "%s" attribute`,
+				testUserSearchBase, testUserSearchUsernameAttribute),
+			wantErrorIs: ErrUserSearchBaseNotReadable,
+			wantKind:    SearchBaseNotReadable,
+		},
+		{
+			name:           "when the search finds an entry without the attribute",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue}},
+				}, nil).Times(1)
+			},
+			wantError: fmt.Sprintf(`service account cannot read under base DN (check permissions): "%s": the "%s" attribute of entry "%s" could not be read`,
+				testUserSearchBase, testUserSearchUsernameAttribute, testUserSearchResultDNValue),
+			wantErrorIs: ErrUserSearchBaseNotReadable,
+			wantKind:    SearchBaseNotReadable,
+		},
+		{
+			name:           "when the search fails for another reason",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedPermissionsSearch(testUserSearchUsernameAttribute)).
+					Return(nil, ldap.NewError(ldap.LDAPResultOperationsError, errors.New("some search error"))).Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for entries under user search base "%s": LDAP Result Code 1 "Operations Error": some search error`, testUserSearchBase),
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			tt.setupMocks(conn)
+			conn.EXPECT().Close().Times(1)
+
+			providerConfig := *tt.providerConfig
+			providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				return conn, nil
+			})
+
+			err := New(providerConfig).TestConnection(context.Background())
+			if tt.wantError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantError)
+			kind, ok := ConnectionErrorKindOf(err)
+			if tt.wantKind == "" {
+				require.False(t, ok)
+				return
+			}
+			require.ErrorIs(t, err, tt.wantErrorIs)
+			require.True(t, ok)
+			require.Equal(t, tt.wantKind, kind)
+		})
+	}
+}
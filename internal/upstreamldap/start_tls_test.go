@@ -0,0 +1,117 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/testutil/ldaptestutil"
+)
+
+func TestStartTLSUpgrade(t *testing.T) {
+	tests := []struct {
+		name              string
+		startTLSErr       error
+		plainDialer       bool
+		wantCalls         []string
+		wantAuthenticated bool
+		wantError         string
+	}{
+		{
+			name: "StartTLS is called before the bind as the bind user",
+			wantCalls: []string{
+				"StartTLS",
+				"Bind",   // as the bind user
+				"Search", // for the user
+				"Bind",   // as the user
+				"Close",
+			},
+			wantAuthenticated: true,
+		},
+		{
+			name:        "StartTLS fails",
+			startTLSErr: ldap.NewError(ldap.LDAPResultProtocolError, errors.New("some StartTLS error")),
+			wantCalls:   []string{"StartTLS", "Close"},
+			wantError:   `error dialing host "ldap.example.com:8443": LDAP Result Code 2 "Protocol Error": some StartTLS error`,
+		},
+		{
+			name:        "a dialer which is not a StartTLSDialer is responsible for the upgrade itself",
+			plainDialer: true,
+			wantCalls:   []string{"Bind", "Close"},
+			wantError:   `error binding as "cn=some-bind-username,dc=pinniped,dc=dev" before user search: LDAP Result Code 13 "Confidentiality Required": confidentiality required`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &ldaptestutil.FakeStartTLSConn{
+				StartTLSErr: tt.startTLSErr,
+				BindFunc: func(username, password string) error {
+					if username == testBindUsername && password == testBindPassword ||
+						username == testUserSearchResultDNValue && password == testUpstreamPassword {
+						return nil
+					}
+					return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))
+				},
+				SearchFunc: func(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+					require.Equal(t, testUserSearchBase, searchRequest.BaseDN)
+					return &ldap.SearchResult{Entries: []*ldap.Entry{{
+						DN: testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{
+							ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+							ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+						},
+					}}}, nil
+				},
+			}
+
+			var dialer LDAPDialer = StartTLSDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (StartTLSConn, error) {
+				return conn, nil
+			})
+			if tt.plainDialer {
+				dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				})
+			}
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: StartTLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: dialer,
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+			require.Equal(t, tt.wantCalls, conn.Calls)
+			require.True(t, conn.IsClosed())
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.False(t, authenticated)
+				require.False(t, tt.startTLSErr != nil && conn.IsEncrypted())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAuthenticated, authenticated)
+			require.Equal(t, testUserSearchResultDNValue, authResponse.DN)
+
+			// The TLS config is the same one which the default dialer would have used.
+			require.True(t, conn.IsEncrypted())
+			require.Equal(t, "ldap.example.com", conn.TLSConfig.ServerName)
+		})
+	}
+}
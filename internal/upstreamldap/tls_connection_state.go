@@ -0,0 +1,59 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/plog"
+)
+
+// tlsConnectionStater is implemented by connections which know their TLS connection state, e.g. ldap.Conn.
+type tlsConnectionStater interface {
+	TLSConnectionState() (tls.ConnectionState, bool)
+}
+
+// reportTLSConnectionState logs the TLS version and cipher suite which were negotiated with the LDAP server, and
+// passes the connection state to the TLSConnectionStateFunc, if any. It only reads the state of a finished
+// handshake, so it never affects the connection.
+func (p *Provider) reportTLSConnectionState(addr endpointaddr.HostPort, tlsConfig *tls.Config, state tls.ConnectionState) {
+	version := tlsVersionName(state.Version)
+	cipherSuite := tls.CipherSuiteName(state.CipherSuite)
+	plog.Debug("negotiated TLS with the LDAP server",
+		"upstreamName", p.GetName(), "host", addr.Endpoint(), "tlsVersion", version, "cipherSuite", cipherSuite)
+
+	if state.Version < tls.VersionTLS13 && offersTLS13(tlsConfig) {
+		// Only note this once per Provider, since every connection would otherwise repeat it.
+		p.olderTLSVersionNote.Do(func() {
+			plog.Info("the LDAP server negotiated an older TLS version although TLS 1.3 was offered, consider enabling TLS 1.3 on the LDAP server",
+				"upstreamName", p.GetName(), "host", addr.Endpoint(), "tlsVersion", version, "cipherSuite", cipherSuite)
+		})
+	}
+
+	if p.c.TLSConnectionStateFunc != nil {
+		p.c.TLSConnectionStateFunc(addr, state)
+	}
+}
+
+// offersTLS13 returns true when a client using the config offers TLS 1.3 during the handshake.
+func offersTLS13(tlsConfig *tls.Config) bool {
+	return tlsConfig.MaxVersion == 0 || tlsConfig.MaxVersion >= tls.VersionTLS13
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+)
+
+func TestTLSConnectionStateFunc(t *testing.T) {
+	tests := []struct {
+		name             string
+		serverMaxVersion uint16
+		wantVersion      uint16
+	}{
+		{
+			name:             "TLS 1.2",
+			serverMaxVersion: tls.VersionTLS12,
+			wantVersion:      tls.VersionTLS12,
+		},
+		{
+			name:             "TLS 1.3",
+			serverMaxVersion: tls.VersionTLS13,
+			wantVersion:      tls.VersionTLS13,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.TLS = &tls.Config{MaxVersion: tt.serverMaxVersion} //nolint:gosec // the test needs to choose the version
+			server.StartTLS()
+			t.Cleanup(server.Close)
+			serverURL, err := url.Parse(server.URL)
+			require.NoError(t, err)
+			caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+			var states []tls.ConnectionState
+			provider := New(ProviderConfig{
+				Host:               serverURL.Host,
+				ConnectionProtocol: TLS,
+				CABundle:           caBundle,
+				TLSConnectionStateFunc: func(addr endpointaddr.HostPort, state tls.ConnectionState) {
+					require.Equal(t, serverURL.Host, addr.Endpoint())
+					states = append(states, state)
+				},
+			})
+
+			conn, err := provider.dial(context.Background())
+			require.NoError(t, err)
+			conn.Close()
+
+			require.Len(t, states, 1)
+			require.True(t, states[0].HandshakeComplete)
+			require.Equal(t, tt.wantVersion, states[0].Version)
+			require.NotZero(t, states[0].CipherSuite)
+		})
+	}
+}
+
+func TestOffersTLS13(t *testing.T) {
+	require.True(t, offersTLS13(&tls.Config{}))                              //nolint:gosec // only the max version matters
+	require.True(t, offersTLS13(&tls.Config{MaxVersion: tls.VersionTLS13}))  //nolint:gosec // only the max version matters
+	require.False(t, offersTLS13(&tls.Config{MaxVersion: tls.VersionTLS12})) //nolint:gosec // only the max version matters
+	require.Equal(t, "TLS 1.2", tlsVersionName(tls.VersionTLS12))
+	require.Equal(t, "TLS 1.3", tlsVersionName(tls.VersionTLS13))
+	require.Equal(t, "0x0305", tlsVersionName(0x0305))
+}
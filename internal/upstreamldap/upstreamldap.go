@@ -5,6 +5,7 @@
 package upstreamldap
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -13,9 +14,13 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/go-ldap/ldap/v3"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -34,13 +39,29 @@ import (
 
 const (
 	ldapsScheme                             = "ldaps"
+	ldapScheme                              = "ldap"
 	distinguishedNameAttributeName          = "dn"
 	searchFilterInterpolationLocationMarker = "{}"
-	groupSearchPageSize                     = uint32(250)
+	startTLSOID                             = "1.3.6.1.4.1.1466.20037"
+	defaultPageSize                         = uint32(250)
 	defaultLDAPPort                         = uint16(389)
 	defaultLDAPSPort                        = uint16(636)
+	defaultMaxEntrySizeBytes                = 1024 * 1024
+	defaultMaxEntryAttributes               = 100
+	defaultDialTimeout                      = time.Minute
 )
 
+// DebugTimingsExtraKey is the key of the user's extra info which holds the timings of the authentication steps
+// when ProviderConfig.DebugTimings is enabled.
+const DebugTimingsExtraKey = "ldap.pinniped.dev/timing"
+
+// AuditBindDNExtraKey is the key of the user's extra info which holds the DN of the LDAP entry which was bound as
+// the user when ProviderConfig.AuditBindDN is enabled.
+const AuditBindDNExtraKey = "ldap.pinniped.dev/bind-dn"
+
+// uidAttributeTemplatePlaceholder matches the "{attributeName}" placeholders of a UIDAttributeTemplate.
+var uidAttributeTemplatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
 // Conn abstracts the upstream LDAP communication protocol (mostly for testing).
 type Conn interface {
 	Bind(username, password string) error
@@ -49,6 +70,8 @@ type Conn interface {
 
 	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
 
+	WhoAmI(controls []ldap.Control) (*ldap.WhoAmIResult, error)
+
 	Close()
 }
 
@@ -69,6 +92,38 @@ func (f LDAPDialerFunc) Dial(ctx context.Context, addr endpointaddr.HostPort) (C
 	return f(ctx, addr)
 }
 
+// StartTLSConn is an unencrypted Conn which can be upgraded to TLS using StartTLS.
+type StartTLSConn interface {
+	Conn
+
+	StartTLS(config *tls.Config) error
+}
+
+// Our StartTLSConn type is also a subset of the ldap.Client interface.
+var _ StartTLSConn = &ldap.Conn{}
+
+// StartTLSDialer is an optional interface of an LDAPDialer. When the Dialer implements it and the ConnectionProtocol
+// is StartTLS, the Dialer only makes the unencrypted connection, which is then upgraded using StartTLS just like the
+// default dialer does. This makes the StartTLS upgrade testable without a real LDAP server.
+type StartTLSDialer interface {
+	DialStartTLS(ctx context.Context, addr endpointaddr.HostPort) (StartTLSConn, error)
+}
+
+// StartTLSDialerFunc makes it easy to use a func as an LDAPDialer which is also a StartTLSDialer. When the
+// ConnectionProtocol is TLS, the connection returned by the func is used as if it was already encrypted.
+type StartTLSDialerFunc func(ctx context.Context, addr endpointaddr.HostPort) (StartTLSConn, error)
+
+var _ LDAPDialer = StartTLSDialerFunc(nil)
+var _ StartTLSDialer = StartTLSDialerFunc(nil)
+
+func (f StartTLSDialerFunc) Dial(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+	return f(ctx, addr)
+}
+
+func (f StartTLSDialerFunc) DialStartTLS(ctx context.Context, addr endpointaddr.HostPort) (StartTLSConn, error) {
+	return f(ctx, addr)
+}
+
 type LDAPConnectionProtocol string
 
 const (
@@ -76,6 +131,27 @@ const (
 	TLS      = LDAPConnectionProtocol("TLS")
 )
 
+// TLSVerificationMode decides how the LDAP server's certificate is verified. Connections are always encrypted,
+// regardless of the mode.
+type TLSVerificationMode string
+
+const (
+	// TLSVerificationFull verifies that the server's certificate chain is trusted and that the certificate is
+	// valid for the hostname or IP address being dialed. This is the default.
+	TLSVerificationFull = TLSVerificationMode("Full")
+
+	// TLSVerificationCAOnly verifies that the server's certificate chain is trusted, but does not check that the
+	// certificate is valid for the hostname or IP address being dialed. Any server which holds a certificate issued
+	// by a trusted CA can impersonate the LDAP server, so only use this when that CA issues certificates to no one else.
+	TLSVerificationCAOnly = TLSVerificationMode("CAOnly")
+
+	// TLSVerificationInsecureSkipVerify does not verify the server's certificate at all. This makes connections
+	// trivially open to man-in-the-middle attacks, which can steal the bind user's password and the password of
+	// every end user who logs in. It is intended only for staging environments with self-signed certificates,
+	// must always be chosen explicitly, and causes a warning to be logged for every connection.
+	TLSVerificationInsecureSkipVerify = TLSVerificationMode("InsecureSkipVerify")
+)
+
 // ProviderConfig includes all of the settings for connection and searching for users and groups in
 // the upstream LDAP IDP. It also provides methods for testing the connection and performing logins.
 // The nested structs are not pointer fields to enable deep copy on function params and return values.
@@ -87,21 +163,56 @@ type ProviderConfig struct {
 	ResourceUID types.UID
 
 	// Host is the hostname or "hostname:port" of the LDAP server. When the port is not specified,
-	// the default LDAP port will be used.
+	// the default LDAP port will be used. Host may also be an LDAP URL, e.g. "ldaps://hostname:636/" or
+	// "ldap://hostname/", in which case the URL's scheme determines the ConnectionProtocol: TLS for "ldaps" and
+	// StartTLS for "ldap". Unencrypted connections are never used.
 	Host string
 
 	// ConnectionProtocol determines how to establish the connection to the server. Either StartTLS or TLS.
+	// Ignored when Host is an LDAP URL.
 	ConnectionProtocol LDAPConnectionProtocol
 
 	// PEM-encoded CA cert bundle to trust when connecting to the LDAP server. Can be nil.
 	CABundle []byte
 
+	// CABundlePath, when non-empty, is the path of a file containing the PEM-encoded CA cert bundle, e.g. from a
+	// mounted ConfigMap or Secret. It is read for each new connection, so that the CA bundle can be rotated without
+	// recreating the Provider. At most one of CABundle, CABundlePath, and CABundleFunc may be set.
+	CABundlePath string
+
+	// CABundleFunc, when non-nil, is called for each new connection to get the PEM-encoded CA cert bundle.
+	// At most one of CABundle, CABundlePath, and CABundleFunc may be set.
+	CABundleFunc func(ctx context.Context) ([]byte, error)
+
+	// TLSVerificationMode decides how the server's certificate is verified. When empty, TLSVerificationFull is used.
+	// SECURITY: TLSVerificationCAOnly and TLSVerificationInsecureSkipVerify weaken the protection of the bind user's
+	// and the end users' passwords, so see their docs before using either of them.
+	TLSVerificationMode TLSVerificationMode
+
+	// CLDAPPing, when true, causes HealthCheck to first send a connectionless LDAP (CLDAP) "ping" to the server over
+	// UDP, which is much cheaper than dialing and binding, so that liveness probes can run very frequently without
+	// churning connections. This is meant for Active Directory, whose domain controllers answer CLDAP pings, and
+	// other servers usually do not. The ping is sent to the UDP port of the same number as the StartTLS port, which
+	// is 389 unless the Host names another port while using StartTLS. When the ping is not answered, HealthCheck falls
+	// back to dialing and binding. The ping is not encrypted, but it does not contain any credentials.
+	CLDAPPing bool
+
 	// BindUsername is the username to use when performing a bind with the upstream LDAP IDP.
 	BindUsername string
 
 	// BindPassword is the password to use when performing a bind with the upstream LDAP IDP.
 	BindPassword string
 
+	// BindCredentialsFunc, when non-nil, is called before each bind as the bind user to get the username and
+	// password to use instead of BindUsername and BindPassword, e.g. to use the current contents of a Secret whose
+	// credentials are rotated without recreating the Provider. Its results must not be logged.
+	BindCredentialsFunc func(ctx context.Context) (username, password string, err error)
+
+	// BindUserSearch optionally contains information about how to search for the DN of the bind user, so that
+	// BindUsername can be e.g. the account name of a service account instead of its DN. When not configured,
+	// BindUsername is the DN of the bind user.
+	BindUserSearch BindUserSearchConfig
+
 	// UserSearch contains information about how to search for users in the upstream LDAP IDP.
 	UserSearch UserSearchConfig
 
@@ -111,6 +222,13 @@ type ProviderConfig struct {
 	// Dialer exists to enable testing. When nil, will use a default appropriate for production use.
 	Dialer LDAPDialer
 
+	// CircuitBreaker optionally configures failing fast when the LDAP server cannot be dialed or bound to.
+	CircuitBreaker CircuitBreakerConfig
+
+	// HTTPSTunnel optionally configures connecting to the LDAP server through an HTTPS CONNECT tunnel.
+	// Only used by the default Dialer.
+	HTTPSTunnel HTTPSTunnelConfig
+
 	// UIDAttributeParsingOverrides are mappings between an attribute name and a way to parse it as a UID when
 	// it comes out of LDAP.
 	UIDAttributeParsingOverrides map[string]func(*ldap.Entry) (string, error)
@@ -119,8 +237,168 @@ type ProviderConfig struct {
 	// name when it comes out of LDAP.
 	GroupAttributeParsingOverrides map[string]func(*ldap.Entry) (string, error)
 
+	// TrimAttributeWhitespace, when true, removes leading and trailing whitespace, including newlines, from the values
+	// of the attributes which are mapped to usernames and group names, e.g. for servers or proxies which return values
+	// with a trailing CRLF. A value which is empty after trimming is treated like an empty value. The UID is never
+	// trimmed by this setting. The values returned by the attribute parsing overrides are never trimmed.
+	TrimAttributeWhitespace bool
+
+	// TrimUIDAttributeWhitespace, when true, also removes leading and trailing whitespace from the values of the
+	// attributes which are mapped to UIDs. Beware that this changes the UIDs of users whose values had whitespace,
+	// and that it also trims the raw bytes of binary attributes which are not handled by UIDAttributeParsingOverrides.
+	TrimUIDAttributeWhitespace bool
+
 	// RefreshAttributeChecks are extra checks that attributes in a refresh response are as expected.
 	RefreshAttributeChecks map[string]func(*ldap.Entry, provider.RefreshAttributes) error
+
+	// UserSearchRequestMutator is an optional hook for advanced use cases, such as attaching LDAP controls which
+	// are not otherwise modeled by this config. When non-nil, it is called with the fully constructed user search
+	// request just before the search is issued. The mutator must not remove the SizeLimit or otherwise weaken the
+	// filter, since the user search relies on finding at most one matching entry for the given username.
+	UserSearchRequestMutator func(*ldap.SearchRequest)
+
+	// DebugTimings, when true, causes the durations of the steps of each successful authentication to be added to the
+	// authenticated user's extra info under the DebugTimingsExtraKey, in order, e.g. "dial", "bind", "search" (the
+	// user search), "group-search", and "user-bind". The steps of a retry due to RetryOnStaleConnection are prefixed
+	// with "retry-". This is only meant for debugging performance in development environments and should never be
+	// enabled in production, since it changes the user's identity.
+	DebugTimings bool
+
+	// AuditBindDN, when true, causes the DN of the LDAP entry which was bound as the user during each successful
+	// authentication to be added to the authenticated user's extra info under the AuditBindDNExtraKey, so that audit
+	// logs can show exactly which entry the user search matched. The DN is only for auditing. It is not the username
+	// or the UID of the user, and it should not be used in RBAC rules.
+	AuditBindDN bool
+
+	// DryRunAccountStatus, when true, causes DryRunAuthenticateUser to also read the Active Directory account control
+	// attributes of the user, and to add the status of their account to the user's extra info under the
+	// AccountStatusExtraKey, e.g. to help admins understand why a user who exists cannot log in. The status is either
+	// AccountStatusEnabled, or any of AccountStatusDisabled, AccountStatusLocked, and AccountStatusPasswordExpired.
+	// This only works with Active Directory, and it does not affect AuthenticateUser.
+	DryRunAccountStatus bool
+
+	// UserFacingAccountStatus, when true, causes UserFacingErrorMessage to tell end users when Active Directory refused
+	// their login because of their account, e.g. because it is locked, disabled, or expired, or because their password
+	// expired. Anyone who can reach the login endpoint could then learn the state of any account, so when false, the
+	// default, these errors get the generic message instead.
+	UserFacingAccountStatus bool
+
+	// DebugSearchControls, when true, causes the types of the controls of every search request and of its result to
+	// be logged at the debug level, e.g. to check whether the LDAP server honored the paging control. The values of
+	// the controls are never logged. This adds overhead to every search, so it is only meant for debugging.
+	DebugSearchControls bool
+
+	// RetryOnStaleConnection, when true, causes an authentication or refresh to dial, bind, and search for the user
+	// once more using a new connection when the search for the user fails with a network error, e.g. because the LDAP
+	// server quickly closes idle connections. Errors from dialing or binding are never retried. When false, the
+	// default, the error is returned without retrying.
+	RetryOnStaleConnection bool
+
+	// TestConnectionValidatesUserSearchBase, when true, causes TestConnection to also check that the UserSearch Base
+	// exists and is readable by the bind user, so that a wrong Base is found before the first login. When false,
+	// TestConnection only dials and binds. Ignored when the UserSearch Base is empty.
+	TestConnectionValidatesUserSearchBase bool
+
+	// TestConnectionValidatesUserSearchPermissions, when true, causes TestConnection to also check that the bind user
+	// can read the UsernameAttribute of at least one entry under the UserSearch Base. A bind user without permission
+	// to read the user entries is a common mistake, which otherwise only shows up as users who are not found during
+	// logins. The failure is reported as SearchBaseNotReadable, unlike a Base which does not exist, which is reported
+	// as SearchBaseNotFound. Ignored when the UserSearch Base is empty.
+	TestConnectionValidatesUserSearchPermissions bool
+
+	// DiagnosticSearchesTypesOnly, when true, causes the diagnostic searches which only check whether an attribute
+	// exists, e.g. the one of TestConnectionValidatesUserSearchPermissions, to request only the attribute types and
+	// not their values, which is cheaper for large values. The searches of authentications and refreshes always
+	// request the values, since they need them.
+	DiagnosticSearchesTypesOnly bool
+
+	// IdentityTransform is an optional hook which can change the authenticated user's identity, e.g. to prefix the
+	// username or to add or remove groups. When non-nil, it is called with the response of every successful
+	// authentication, including dry runs, just before the response is returned. When it returns an error,
+	// the authentication fails.
+	IdentityTransform func(*authenticators.Response) error
+
+	// MaxEntrySizeBytes is the maximum total size of the attribute names and values of any single entry returned
+	// by a search. Searches which return a larger entry fail with an EntryTooLargeError, so that unexpectedly huge
+	// attribute values from the LDAP server, e.g. binary attributes, are not used. The connections of the default
+	// Dialer also stop reading as soon as the server starts to send any message which is more than 64 KiB larger than
+	// this, which leaves room for the DN and the encoding, and fail with a MessageTooLargeError, so that such messages
+	// are never read into memory. Zero or less means to use the default of 1 MiB.
+	MaxEntrySizeBytes int
+
+	// MaxEntryAttributes is the maximum number of attributes of any single entry returned by a search. Searches which
+	// return an entry with more attributes fail with an EntryTooManyAttributesError. Searches only request the
+	// attributes which are needed, so this only matters for LDAP servers which ignore that request, e.g. by returning
+	// all of the operational attributes of the entry. It should be at least the number of attributes requested by any
+	// search, including the RefreshAttributeChecks and the GroupSearch GroupNameAttributes. Zero or less means to use
+	// the default of 100.
+	MaxEntryAttributes int
+
+	// MaxConcurrentConnections, when greater than zero, is the maximum number of operations, e.g. authentications,
+	// refreshes, and connection tests, which may be connected to the LDAP server at the same time. Each operation uses
+	// at most one connection at a time. Further operations wait until another operation finishes, or until their
+	// context is done. This protects both the LDAP server and this process from being overwhelmed by a burst of
+	// logins. Zero or less means unlimited.
+	MaxConcurrentConnections int
+
+	// PageSize is the number of entries to request per page of the paged searches, e.g. the group search. Zero means
+	// to use the default of 250.
+	PageSize uint32
+
+	// DiscoverMaxPageSize, when true, causes the PageSize to be clamped to the maximum page size which the LDAP
+	// server advertises, e.g. Active Directory's MaxPageSize, so that paged searches do not fail because of the
+	// server's administrative limits. It is discovered once per Provider, as the bind user, before the first paged
+	// search. When it cannot be discovered, e.g. because the server is not Active Directory, a conservative maximum
+	// of 500 is used instead.
+	DiscoverMaxPageSize bool
+
+	// DefaultDialTimeout is the longest time to wait while connecting to the LDAP server, including the TLS handshake
+	// and any HTTPS tunnel, when the context of the operation has no earlier deadline. This keeps a black-holed server
+	// from blocking authentication forever when the caller did not set a deadline. Zero means one minute.
+	DefaultDialTimeout time.Duration
+
+	// BindTimeout, when greater than zero, is the longest time to wait for the LDAP server to respond to each bind,
+	// both as the bind user and as an end user, after which the bind fails. Some LDAP servers accept connections
+	// quickly but are slow to process binds, e.g. because of a password policy overlay, so this allows failing fast
+	// on slow binds without shortening the DefaultDialTimeout or the TimeLimit of searches. Zero means no timeout
+	// other than the context's deadline. Only used by the production dialer.
+	BindTimeout time.Duration
+
+	// TLSConnectionStateFunc, when not nil, is called with the state of each TLS connection to the LDAP server after
+	// its handshake, e.g. to report which TLS versions and cipher suites are used. It must be cheap and must not
+	// modify the state. It is not called when the Dialer is overridden, unless the connection is upgraded by StartTLS.
+	TLSConnectionStateFunc func(addr endpointaddr.HostPort, state tls.ConnectionState)
+
+	// LocalAddr optionally is the local IP address from which connections to the LDAP server originate, e.g. on a host
+	// with several network interfaces when the LDAP server only allows connections from some source IP addresses.
+	// It also applies to connections to the HTTPS tunnel. Empty means that the operating system chooses.
+	LocalAddr string
+
+	// ReadDeadline, when greater than zero, is the longest time to wait for each read from the connection to the LDAP
+	// server, e.g. for the next entry of a search result, after which the connection is closed and the operation fails.
+	// Unlike the search TimeLimit, which is enforced by the LDAP server, this protects against an LDAP server which
+	// accepts a search but then stalls while sending its results. It must be longer than the slowest expected search.
+	// Zero means no deadline. Only used by the production dialer.
+	ReadDeadline time.Duration
+
+	// WriteDeadline, when greater than zero, is the longest time to wait for each write to the connection to the LDAP
+	// server, after which the connection is closed and the operation fails. Zero means no deadline. Only used by the
+	// production dialer.
+	WriteDeadline time.Duration
+
+	// MaxOperationsPerConnection, when greater than zero, is the most operations which may run on one connection to the
+	// LDAP server, e.g. for an LDAP server which leaks resources per connection. When an operation would exceed it, the
+	// connection is closed and replaced by a new connection, which is bound again as whoever the old connection was
+	// bound as, before the operation runs on the new connection. A paged search counts as one operation, and the bind
+	// which restores the identity on the new connection does not count. Zero means no maximum.
+	MaxOperationsPerConnection int
+
+	// UserNotFoundDelay, when greater than zero, is how long to wait before reporting that no user was found for a
+	// username, so that a failed login of a username which does not exist takes about as long as a failed bind of a
+	// user who does exist. It should be about the typical latency of a bind. This is only a mitigation against
+	// discovering which usernames exist by timing failed logins, not a complete defense, since other differences in
+	// latency remain. The wait ends early when the context is done. Zero means no delay.
+	UserNotFoundDelay time.Duration
 }
 
 // UserSearchConfig contains information about how to search for users in the upstream LDAP IDP.
@@ -131,13 +409,114 @@ type UserSearchConfig struct {
 	// Filter is the filter to use for the user search in the upstream LDAP IDP.
 	Filter string
 
+	// RawFilter, when true, causes the Filter to be used verbatim after the username is interpolated into it, instead
+	// of being wrapped in parens when it does not already start and end with parens. This gives full control over
+	// the filter, e.g. for filters with surrounding whitespace. The username is still escaped. When true, the Filter
+	// must contain the "{}" placeholder.
+	RawFilter bool
+
 	// UsernameAttribute is the attribute in the LDAP entry from which the username should be
 	// retrieved.
 	UsernameAttribute string
 
+	// UsernameSearchAttributes is an ordered list of attributes to match against the username when Filter is empty,
+	// e.g. to allow users to log in with either their sAMAccountName or their userPrincipalName. The default filter
+	// then becomes "(|(attr1=username)(attr2=username))". The username is still retrieved from UsernameAttribute.
+	// When empty, the default filter matches the username against UsernameAttribute. Ignored when Filter is not empty.
+	UsernameSearchAttributes []string
+
+	// UsernameStripDomainSuffix, when true, causes everything from the last "@" of the value of the UsernameAttribute
+	// to be removed from the username, e.g. "pinny@example.com" becomes "pinny", for directories such as Active
+	// Directory whose userPrincipalName includes the domain. Values without an "@" are used as is. Only the username is
+	// changed, never the UID. Note that users of different domains who share a local part then share a username,
+	// which RBAC bindings cannot tell apart.
+	UsernameStripDomainSuffix bool
+
+	// UsernameFromWhoAmI, when true, causes the username to be taken from the authorization identity returned by the
+	// RFC 4532 "Who am I?" operation after binding as the user, for LDAP servers which only reveal the canonical form
+	// of the user's login after the bind. Both "u:username" and "dn:DN" identities are supported, and the
+	// UsernameStripDomainSuffix still applies. When the LDAP server does not support the operation, or returns an
+	// empty identity, the UsernameAttribute is used instead, so it must still be configured. Since DryRunAuthenticateUser
+	// and refreshes do not bind as the user, they cannot use this operation: dry runs always use the UsernameAttribute,
+	// and refreshes do not check that the username is unchanged, only that the UID is unchanged.
+	UsernameFromWhoAmI bool
+
+	// ReadUserEntryAfterBind, when true, causes the user's entry to be read again after binding as the user, with the
+	// user's own permissions, and the username, UID, and RefreshAttributeChecks attributes to be mapped from that
+	// entry instead of from the user search result. This is for LDAP servers on which the bind user may find users,
+	// but may not read all of their attributes. Since DryRunAuthenticateUser and refreshes do not bind as the user,
+	// they read the entry as the bind user.
+	ReadUserEntryAfterBind bool
+
+	// AmbiguousDNlessResultsAsNotFound, when true, causes a user search which returns more than one entry, none of
+	// which has a DN, to be treated like a search which found no user, so the authentication fails without an error.
+	// Some virtual directories and LDAP proxies return such results instead of no results, and the default of
+	// failing with an error would otherwise break the login for those usernames.
+	AmbiguousDNlessResultsAsNotFound bool
+
+	// BindDNAttribute, when not empty, is the attribute of the user's LDAP entry whose value is used as the name for
+	// the user's bind instead of the user's DN, e.g. "userPrincipalName" for Active Directory setups which prefer UPN
+	// binds. The attribute is requested by the user search, and the entry must have exactly one non-empty value for
+	// it. Empty, or "dn", means to bind using the user's DN.
+	BindDNAttribute string
+
 	// UIDAttribute is the attribute in the LDAP entry from which the user's unique ID should be
 	// retrieved.
 	UIDAttribute string
+
+	// UIDAttributeTemplate, when not empty, is used instead of UIDAttribute to build the user's unique ID from the
+	// values of several attributes of the LDAP entry, for directories which do not have a single stable unique ID
+	// attribute. Each "{attributeName}" in the template is replaced by the single value of that attribute, e.g.
+	// "{sAMAccountName}@example.com". The template must reference at least one attribute.
+	UIDAttributeTemplate string
+
+	// UIDFallbackToDN, when true, causes the user's DN to be used as the user's unique ID when the LDAP entry has no
+	// value, or an empty value, for the UIDAttribute. This is meant for directories in which only some entries have the
+	// UIDAttribute. Ignored when UIDAttributeTemplate is used.
+	UIDFallbackToDN bool
+
+	// EmptyValuePolicy decides what happens when the LDAP entry has a single, empty value for the UsernameAttribute
+	// or the UIDAttribute. Entries which have no value, or several values, for these attributes are always an error.
+	// Empty means EmptyValueError.
+	EmptyValuePolicy EmptyValuePolicy
+
+	// RequireNonDNAttribute, when true, causes the config to be invalid when both the username and the UID are
+	// taken from the DN, i.e. when the UsernameAttribute is "dn" and the UIDAttribute is "dn" or the
+	// UIDAttributeTemplate only references "dn". The user search then reads none of the user's attributes, which is
+	// valid, but is usually a mistake when attribute based mapping was intended. When false, such configs are allowed.
+	RequireNonDNAttribute bool
+}
+
+// EmptyValuePolicy decides how a single, empty value of the UsernameAttribute or UIDAttribute of an LDAP entry
+// is handled.
+type EmptyValuePolicy string
+
+const (
+	// EmptyValueError causes empty values to be an error, which fails the authentication or refresh.
+	EmptyValueError = EmptyValuePolicy("Error")
+
+	// EmptyValueSkipToFallback causes the user's DN to be used instead of an empty value, like UIDFallbackToDN
+	// does for the UIDAttribute. The DN is used as is, e.g. UsernameStripDomainSuffix does not apply to it.
+	// Ignored for the UIDAttributeTemplate.
+	EmptyValueSkipToFallback = EmptyValuePolicy("SkipToFallback")
+)
+
+// BindUserSearchConfig contains information about how to search for the DN of the bind user in the upstream LDAP IDP.
+// It is independent of the UserSearchConfig, since service accounts often live in a different subtree than end users.
+// The search happens before the bind as the bind user, so it is an anonymous search, which the LDAP server must allow
+// for the Base.
+type BindUserSearchConfig struct {
+	// Base is the base DN to use for the bind user search, e.g. the DN of an OU which holds service accounts.
+	Base string
+
+	// Filter is the filter to use for the bind user search, e.g. `uid={}`, where "{}" is replaced by the escaped
+	// bind username. It must contain "{}". Empty means that there is no bind user search.
+	Filter string
+}
+
+// configured returns true when the bind user's DN should be found using a search.
+func (c BindUserSearchConfig) configured() bool {
+	return len(c.Base) > 0 || len(c.Filter) > 0
 }
 
 // GroupSearchConfig contains information about how to search for group membership for users in the upstream LDAP IDP.
@@ -153,23 +532,230 @@ type GroupSearchConfig struct {
 	// retrieved. Empty means to use 'cn'.
 	GroupNameAttribute string
 
+	// GroupNameAttributes, when non-empty, lists the attributes in the LDAP group entry from which the group name may
+	// be retrieved, in order of preference. Each group's name is retrieved from the first of these attributes which
+	// the group entry has, e.g. ["cn", "name"] for directories in which different group object classes name their
+	// groups differently. The group names are de-duplicated before the GroupAllowlist is applied. At most one of
+	// GroupNameAttribute and GroupNameAttributes may be set.
+	GroupNameAttributes []string
+
 	// SkipGroupRefresh skips the group refresh operation that occurs with each refresh
 	// (every 5 minutes). This can be done if group search is very slow or resource intensive for the LDAP
 	// server.
 	SkipGroupRefresh bool
+
+	// MaxGroups is the maximum number of group entries to read for a user, reading as many pages of search results
+	// as needed. Users who are members of more groups only get the first MaxGroups groups returned by the LDAP server,
+	// and a warning is logged. Zero means unlimited.
+	MaxGroups int
+
+	// GroupAllowlist, when non-empty, is the list of group names which may be included in the user's groups. Any
+	// other groups found by the group search are left out, e.g. to avoid revealing the organization's structure
+	// through group names which are not used for authorization. It is compared to the group names after they have
+	// been read from the GroupNameAttribute or GroupNameAttributes, for both logins and refreshes. Empty means to include all groups.
+	GroupAllowlist []string
+
+	// FailOpen, when true, causes errors from the group search to be logged and otherwise ignored, choosing
+	// availability over complete group memberships during LDAP server problems. A login then results in no groups,
+	// and a refresh keeps the groups from the previous login or refresh. Errors from finding and binding as the user
+	// still fail the login. When false, the default, any group search error fails the login or refresh.
+	FailOpen bool
+
+	// SearchAfterUserBind, when true, causes the group search of a login to happen after the user's bind succeeded,
+	// so that no groups are searched for logins with a wrong password. The connection is first bound as the bind
+	// user again, since the group search must not run as the user. When false, the default, the groups are searched
+	// before the user's bind, which saves that extra bind.
+	SearchAfterUserBind bool
+}
+
+// ReferralError is returned when an LDAP search resulted in a referral (result code 10), which the Provider does
+// not follow. This commonly happens when an Active Directory search base DN belongs to a different domain than the
+// domain controller which was searched.
+type ReferralError struct {
+	Err error
+}
+
+func (e *ReferralError) Error() string {
+	return fmt.Sprintf("the LDAP server returned a referral, which is not followed; "+
+		"please check that the search base DN belongs to the naming context of the configured host "+
+		"(e.g. use a Global Catalog host for cross-domain Active Directory searches): %s", e.Err)
+}
+
+func (e *ReferralError) Unwrap() error {
+	return e.Err
+}
+
+// classifySearchError returns a more specific error for search errors which are commonly caused by configuration
+// mistakes, and otherwise returns the original error.
+func classifySearchError(err error) error {
+	ldapErr := &ldap.Error{}
+	if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultReferral {
+		return &ReferralError{Err: err}
+	}
+	return err
+}
+
+// NotTLSError is returned when dialing with the TLS ConnectionProtocol reached a server which did not respond with
+// TLS. This commonly happens when the Host uses the plaintext LDAP port, e.g. 389, instead of the ldaps port.
+type NotTLSError struct {
+	Err error
 }
 
+func (e *NotTLSError) Error() string {
+	return fmt.Sprintf("the LDAP server did not respond with TLS; "+
+		"please check that the port of the configured host is correct for the connection protocol "+
+		"(e.g. use ldaps with port 636, or use StartTLS with port 389): %s", e.Err)
+}
+
+func (e *NotTLSError) Unwrap() error {
+	return e.Err
+}
+
+// classifyTLSHandshakeError returns a more specific error for TLS handshake errors which are commonly caused by
+// configuration mistakes, and otherwise returns the original error.
+func classifyTLSHandshakeError(err error) error {
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &recordHeaderErr) {
+		return &NotTLSError{Err: err}
+	}
+	return err
+}
+
+// EntryTooLargeError is returned when an LDAP search returned an entry which is larger than the configured
+// ProviderConfig.MaxEntrySizeBytes.
+type EntryTooLargeError struct {
+	DN        string
+	SizeBytes int
+	MaxBytes  int
+}
+
+func (e *EntryTooLargeError) Error() string {
+	return fmt.Sprintf("the LDAP server returned an entry with DN %q whose attributes are %d bytes, which exceeds the maximum of %d bytes",
+		e.DN, e.SizeBytes, e.MaxBytes)
+}
+
+// EntryTooManyAttributesError is returned when an LDAP search returned an entry which has more attributes than the
+// configured ProviderConfig.MaxEntryAttributes.
+type EntryTooManyAttributesError struct {
+	DN            string
+	Attributes    int
+	MaxAttributes int
+}
+
+func (e *EntryTooManyAttributesError) Error() string {
+	return fmt.Sprintf("the LDAP server returned an entry with DN %q which has %d attributes, which exceeds the maximum of %d attributes",
+		e.DN, e.Attributes, e.MaxAttributes)
+}
+
+// checkSearchResultEntrySizes returns an EntryTooManyAttributesError or an EntryTooLargeError for the first entry of
+// the search result which has more attributes than the configured maximum, or which is larger than the configured
+// maximum entry size. The connections of the default Dialer already refuse to read much larger entries, see
+// withMaxMessageSize, so this applies the exact maximum, and it applies it to the connections of other Dialers.
+// The search result may be nil.
+func (p *Provider) checkSearchResultEntrySizes(searchResult *ldap.SearchResult) error {
+	if searchResult == nil {
+		return nil
+	}
+	maxBytes := p.maxEntrySizeBytes()
+	maxAttributes := p.c.MaxEntryAttributes
+	if maxAttributes <= 0 {
+		maxAttributes = defaultMaxEntryAttributes
+	}
+	for _, entry := range searchResult.Entries {
+		if len(entry.Attributes) > maxAttributes {
+			return &EntryTooManyAttributesError{DN: entry.DN, Attributes: len(entry.Attributes), MaxAttributes: maxAttributes}
+		}
+		size := 0
+		for _, attribute := range entry.Attributes {
+			size += len(attribute.Name)
+			for _, value := range attribute.ByteValues {
+				size += len(value)
+			}
+		}
+		if size > maxBytes {
+			return &EntryTooLargeError{DN: entry.DN, SizeBytes: size, MaxBytes: maxBytes}
+		}
+	}
+	return nil
+}
+
+// ErrUserSearchBaseNotAccessible is returned by TestConnection when it is configured to validate the user search
+// base and the base DN cannot be read by the bind user.
+var ErrUserSearchBaseNotAccessible = errors.New("user search base not found or not accessible")
+
+// ErrProviderClosed is returned by the operations of a Provider after its Shutdown method was called.
+var ErrProviderClosed = errors.New("LDAP provider closed")
+
+// ErrUserNotFound is returned by DryRunResolveGroups when the user search does not find the user.
+var ErrUserNotFound = errors.New("user not found")
+
 type Provider struct {
 	c ProviderConfig
+
+	// These track the in-flight operations, so that Shutdown can reject new operations and wait for the others.
+	lock     sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+
+	// connectionSlots holds one value for each operation which is in progress when MaxConcurrentConnections is
+	// configured, and is otherwise nil.
+	connectionSlots chan struct{}
+
+	// breaker tracks whether the LDAP server has been failing to dial or bind.
+	breaker circuitBreaker
+
+	// The TLS config built from the CABundle, which is read-only after New. It is nil when the CA bundle is loaded
+	// for each new connection instead.
+	tlsConfigTemplate *tls.Config
+	tlsConfigErr      error
+
+	// bindUserDN remembers the DN which was found by the latest bind user search, so that binding as the bind user
+	// again after binding as an end user does not need to search as the end user.
+	bindUserDN struct {
+		sync.Mutex
+		username, dn string
+	}
+
+	// maxPageSize makes sure that the LDAP server's maximum page size is only discovered once, and maxPageSizeValue
+	// holds the result. See pageSize.
+	maxPageSize      sync.Once
+	maxPageSizeValue uint32
+
+	// olderTLSVersionNote makes sure that the note about the LDAP server not negotiating TLS 1.3 is only logged once.
+	olderTLSVersionNote sync.Once
 }
 
 var _ provider.UpstreamLDAPIdentityProviderI = &Provider{}
 var _ authenticators.UserAuthenticator = &Provider{}
+var _ provider.UpstreamUserFacingErrorMessager = &Provider{}
 
 // Create a Provider. The config is not a pointer to ensure that a copy of the config is created,
 // making the resulting Provider use an effectively read-only configuration.
 func New(config ProviderConfig) *Provider {
-	return &Provider{c: config}
+	p := &Provider{c: config}
+	if config.MaxConcurrentConnections > 0 {
+		p.connectionSlots = make(chan struct{}, config.MaxConcurrentConnections)
+	}
+	// Parse a static CA bundle once, instead of for every dial. Errors are returned by validateConfig and by dial.
+	p.tlsConfigErr = config.validateTLSSettings()
+	if p.tlsConfigErr == nil && config.hasStaticCABundle() {
+		p.tlsConfigTemplate, p.tlsConfigErr = buildTLSConfig(config.CABundle, config.TLSVerificationMode)
+	}
+	return p
+}
+
+func countCABundleSources(config ProviderConfig) int {
+	count := 0
+	if config.CABundle != nil {
+		count++
+	}
+	if len(config.CABundlePath) > 0 {
+		count++
+	}
+	if config.CABundleFunc != nil {
+		count++
+	}
+	return count
 }
 
 // A reader for the config. Returns a copy of the config to keep the underlying config read-only.
@@ -177,27 +763,83 @@ func (p *Provider) GetConfig() ProviderConfig {
 	return p.c
 }
 
+// Shutdown causes all future operations of the Provider to fail with ErrProviderClosed, e.g. when the Provider's
+// IDP config was deleted. It then waits for the in-flight operations to finish, or returns an error when the context
+// is done first. Shutdown may be called more than once.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for in-flight operations of LDAP provider %q to finish: %w", p.GetName(), ctx.Err())
+	}
+}
+
+// beginOperation must be called at the start of each operation which talks to the LDAP server. It waits until
+// fewer than MaxConcurrentConnections operations are in progress. When it does not return an error, the caller must
+// call endOperation when the operation is finished.
+func (p *Provider) beginOperation(ctx context.Context) error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrProviderClosed
+	}
+	p.inFlight.Add(1)
+	p.lock.Unlock()
+
+	if p.connectionSlots == nil {
+		return nil
+	}
+	select {
+	case p.connectionSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		p.inFlight.Done()
+		return fmt.Errorf("error waiting for one of the %d concurrent connections of LDAP provider %q: %w",
+			p.c.MaxConcurrentConnections, p.GetName(), ctx.Err())
+	}
+}
+
+func (p *Provider) endOperation() {
+	if p.connectionSlots != nil {
+		<-p.connectionSlots
+	}
+	p.inFlight.Done()
+}
+
 func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes provider.RefreshAttributes) ([]string, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
 	t := trace.FromContext(ctx).Nest("slow ldap refresh attempt", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
 	userDN := storedRefreshAttributes.DN
 
-	conn, err := p.dial(ctx)
-	if err != nil {
-		return nil, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
-	}
-	defer conn.Close()
-
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	bindUsername, bindPassword, err := p.bindCredentials(ctx)
 	if err != nil {
-		return nil, fmt.Errorf(`error binding as %q before user search: %w`, p.c.BindUsername, err)
+		return nil, err
 	}
 
-	searchResult, err := p.performUserRefreshSearch(conn, userDN)
+	conn, searchResult, err := p.dialBindAndSearch(ctx, newDebugTimer(false), bindUsername, bindPassword, func(conn Conn) (*ldap.SearchResult, error) {
+		return p.performUserRefreshSearch(conn, userDN)
+	})
 	if err != nil {
 		p.traceRefreshFailure(t, err)
 		return nil, err
 	}
+	defer conn.Close()
 
 	// if any more or less than one entry, error.
 	// we don't need to worry about logging this because we know it's a dn.
@@ -209,24 +851,28 @@ func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes p
 
 	userEntry := searchResult.Entries[0]
 	if len(userEntry.DN) == 0 {
-		return nil, fmt.Errorf(`searching for user with original DN %q resulted in search result without DN`, userDN)
+		return nil, p.userEntryWithoutDNError(userDN,
+			fmt.Errorf(`searching for user with original DN %q resulted in search result without DN`, userDN))
 	}
 
-	newUsername, err := p.getSearchResultAttributeValue(p.c.UserSearch.UsernameAttribute, userEntry, userDN)
-	if err != nil {
-		return nil, err
-	}
-	if newUsername != storedRefreshAttributes.Username {
-		return nil, fmt.Errorf(`searching for user %q returned a different username than the previous value. expected: %q, actual: %q`,
-			userDN, storedRefreshAttributes.Username, newUsername,
-		)
+	// The username from the "Who am I?" operation can only be found when bound as the user, which a refresh is not.
+	if !p.c.UserSearch.UsernameFromWhoAmI {
+		newUsername, err := p.getMappedUsername(userEntry, userDN)
+		if err != nil {
+			return nil, err
+		}
+		if newUsername != storedRefreshAttributes.Username {
+			return nil, fmt.Errorf(`searching for user %q returned a different username than the previous value. expected: %q, actual: %q`,
+				userDN, storedRefreshAttributes.Username, newUsername,
+			)
+		}
 	}
 
-	newUID, err := p.getSearchResultAttributeRawValueEncoded(p.c.UserSearch.UIDAttribute, userEntry, userDN)
+	newUID, err := p.getMappedUID(userEntry, userDN)
 	if err != nil {
 		return nil, err
 	}
-	newSubject := downstreamsession.DownstreamLDAPSubject(newUID, *p.GetURL())
+	newSubject := p.UserIdentifier(newUID)
 	if newSubject != storedRefreshAttributes.Subject {
 		return nil, fmt.Errorf(`searching for user %q produced a different subject than the previous value. expected: %q, actual: %q`, userDN, storedRefreshAttributes.Subject, newSubject)
 	}
@@ -247,29 +893,101 @@ func (p *Provider) PerformRefresh(ctx context.Context, storedRefreshAttributes p
 
 	mappedGroupNames, err := p.searchGroupsForUserDN(conn, userDN)
 	if err != nil {
+		if p.c.GroupSearch.FailOpen {
+			plog.WarningErr("error searching for groups during refresh, keeping the previous groups because group search is configured to fail open",
+				err, "upstreamName", p.GetName(), "dn", userDN)
+			return storedRefreshAttributes.Groups, nil
+		}
 		return nil, err
 	}
 	return mappedGroupNames, nil
 }
 
+// dialBindAndSearch dials, binds as the bind user, and then calls search using the new connection. The connection
+// is returned for further use when there was no error, and the caller must close it. When RetryOnStaleConnection is
+// enabled and search fails with a network error, it does all of that once more using another new connection, since
+// the LDAP server may have closed the first connection after the bind. Errors from dialing and binding, including
+// authentication errors, are never retried.
+func (p *Provider) dialBindAndSearch(
+	ctx context.Context,
+	timer *debugTimer,
+	bindUsername, bindPassword string,
+	search func(conn Conn) (*ldap.SearchResult, error),
+) (Conn, *ldap.SearchResult, error) {
+	for attempt := 1; ; attempt++ {
+		// Label the steps of the retry separately, so that they can be told apart from those of the first attempt.
+		stepPrefix := ""
+		if attempt > 1 {
+			stepPrefix = "retry-"
+		}
+
+		conn, err := p.dial(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		}
+		timer.record(stepPrefix + "dial")
+
+		err = p.bindAsBindUser(conn, bindUsername, bindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf(`error binding as %q before user search: %w`, bindUsername, err)
+		}
+		timer.record(stepPrefix + "bind")
+
+		searchResult, err := search(conn)
+		timer.record(stepPrefix + "search")
+		if err == nil {
+			return conn, searchResult, nil
+		}
+		conn.Close()
+		if attempt > 1 || !p.c.RetryOnStaleConnection || !isNetworkError(err) {
+			return nil, nil, err
+		}
+		plog.DebugErr("retrying search with a new connection after a network error", err, "upstreamName", p.GetName())
+	}
+}
+
+// isNetworkError returns true when the error means that the connection to the LDAP server failed, as opposed to
+// an error result returned by the LDAP server.
+func isNetworkError(err error) bool {
+	ldapErr := &ldap.Error{}
+	return errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.ErrorNetwork
+}
+
 func (p *Provider) performUserRefreshSearch(conn Conn, userDN string) (*ldap.SearchResult, error) {
 	search := p.refreshUserSearchRequest(userDN)
 
 	searchResult, err := conn.Search(search)
 
 	if err != nil {
+		return nil, fmt.Errorf(`error searching for user %q: %w`, userDN, classifySearchError(err))
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
 		return nil, fmt.Errorf(`error searching for user %q: %w`, userDN, err)
 	}
 	return searchResult, nil
 }
 
 func (p *Provider) dial(ctx context.Context) (Conn, error) {
-	tlsAddr, err := endpointaddr.Parse(p.c.Host, defaultLDAPSPort)
+	conn, err := p.dialConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.withMaxOperations(ctx, conn), nil
+}
+
+func (p *Provider) dialConn(ctx context.Context) (Conn, error) {
+	host, connectionProtocol, err := p.hostAndConnectionProtocol()
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
 
-	startTLSAddr, err := endpointaddr.Parse(p.c.Host, defaultLDAPPort)
+	tlsAddr, err := endpointaddr.Parse(host, defaultLDAPSPort)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	startTLSAddr, err := endpointaddr.Parse(host, defaultLDAPPort)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
@@ -278,10 +996,10 @@ func (p *Provider) dial(ctx context.Context) (Conn, error) {
 	var dialFunc LDAPDialerFunc
 	var addr endpointaddr.HostPort
 	switch {
-	case p.c.ConnectionProtocol == TLS:
+	case connectionProtocol == TLS:
 		dialFunc = p.dialTLS
 		addr = tlsAddr
-	case p.c.ConnectionProtocol == StartTLS:
+	case connectionProtocol == StartTLS:
 		dialFunc = p.dialStartTLS
 		addr = startTLSAddr
 	default:
@@ -291,36 +1009,179 @@ func (p *Provider) dial(ctx context.Context) (Conn, error) {
 	// Override the real dialer for testing purposes sometimes.
 	if p.c.Dialer != nil {
 		dialFunc = p.c.Dialer.Dial
+		if startTLSDialer, ok := p.c.Dialer.(StartTLSDialer); ok && connectionProtocol == StartTLS {
+			dialFunc = func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				return p.startTLS(ctx, addr, startTLSDialer.DialStartTLS)
+			}
+		}
+	}
+
+	// Fail fast without dialing while the LDAP server has been failing.
+	if err := p.breaker.allow(p.c.CircuitBreaker); err != nil {
+		return nil, err
+	}
+
+	// The effective timeout is the earlier of the context's deadline, if any, and the default dial timeout.
+	dialCtx, cancel := context.WithTimeout(ctx, p.dialTimeout())
+	defer cancel()
+
+	conn, err := dialFunc(dialCtx, addr)
+	if err != nil {
+		p.breaker.record(p.c.CircuitBreaker, err)
+		return nil, err
+	}
+	conn = p.withBindTimeout(conn)
+	if p.c.TLSVerificationMode == TLSVerificationInsecureSkipVerify {
+		plog.Warning("connected to the LDAP server without verifying its certificate, which is insecure and must not be used in production",
+			"upstreamName", p.GetName(), "host", addr.Endpoint(), "tlsVerificationMode", p.c.TLSVerificationMode)
+	}
+	if p.c.DebugSearchControls {
+		conn = &searchControlsDebugConn{Conn: conn, upstreamName: p.GetName()}
+	}
+	return conn, nil
+}
+
+// bindCredentials returns the username and password of the bind user, from the BindCredentialsFunc when there
+// is one. The returned values must never be logged.
+func (p *Provider) bindCredentials(ctx context.Context) (string, string, error) {
+	if p.c.BindCredentialsFunc == nil {
+		return p.c.BindUsername, p.c.BindPassword, nil
+	}
+	username, password, err := p.c.BindCredentialsFunc(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf(`error getting bind credentials: %w`, err)
+	}
+	return username, password, nil
+}
+
+// bindAsBindUser binds as the bind user. Its result, along with the result of the preceding dial,
+// is what the circuit breaker uses to decide whether the LDAP server is healthy.
+func (p *Provider) bindAsBindUser(conn Conn, bindUsername, bindPassword string) error {
+	bindDN, err := p.searchBindUserDN(conn, bindUsername)
+	if err == nil {
+		err = conn.Bind(bindDN, bindPassword)
+	}
+	p.breaker.record(p.c.CircuitBreaker, err)
+	return err
+}
+
+// rebindAsBindUser binds the connection as the bind user again, e.g. after it was bound as an end user, so that
+// the following operations on the connection run as the bind user instead of as the end user.
+func (p *Provider) rebindAsBindUser(conn Conn, bindUsername, bindPassword string) error {
+	var err error
+	if bindDN, ok := p.rememberedBindUserDN(bindUsername); ok {
+		err = conn.Bind(bindDN, bindPassword)
+	} else {
+		err = p.bindAsBindUser(conn, bindUsername, bindPassword)
+	}
+	if err != nil {
+		return fmt.Errorf(`error binding as %q again after binding as the user: %w`, bindUsername, err)
+	}
+	return nil
+}
+
+// searchBindUserDN returns the DN of the bind user, which is the bindUsername itself unless the BindUserSearch is
+// configured. The connection must not be bound yet, since the search is meant to be anonymous.
+func (p *Provider) searchBindUserDN(conn Conn, bindUsername string) (string, error) {
+	if !p.c.BindUserSearch.configured() {
+		return bindUsername, nil
+	}
+	searchResult, err := conn.Search(p.bindUserSearchRequest(bindUsername))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", fmt.Errorf(`searching for the bind user resulted in more search results than the size limit, but expected 1 result`)
+	}
+	if err != nil {
+		return "", fmt.Errorf(`error searching for the bind user: %w`, classifySearchError(err))
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
+		return "", fmt.Errorf(`error searching for the bind user: %w`, err)
+	}
+	if len(searchResult.Entries) != 1 {
+		return "", fmt.Errorf(`searching for the bind user resulted in %d search results, but expected 1 result`, len(searchResult.Entries))
+	}
+	bindDN := searchResult.Entries[0].DN
+	if len(bindDN) == 0 {
+		return "", fmt.Errorf(`searching for the bind user resulted in a search result without a DN`)
 	}
 
-	return dialFunc(ctx, addr)
+	p.bindUserDN.Lock()
+	defer p.bindUserDN.Unlock()
+	p.bindUserDN.username, p.bindUserDN.dn = bindUsername, bindDN
+	return bindDN, nil
+}
+
+// rememberedBindUserDN returns the DN of the bind user without searching, when it does not need a search or when
+// it was found by an earlier search for the same bind username.
+func (p *Provider) rememberedBindUserDN(bindUsername string) (string, bool) {
+	if !p.c.BindUserSearch.configured() {
+		return bindUsername, true
+	}
+	p.bindUserDN.Lock()
+	defer p.bindUserDN.Unlock()
+	if p.bindUserDN.username != bindUsername || len(p.bindUserDN.dn) == 0 {
+		return "", false
+	}
+	return p.bindUserDN.dn, true
+}
+
+// hostAndConnectionProtocol returns the "hostname[:port]" and the connection protocol, taken from the Host when it
+// is an LDAP URL, or else from the Host and ConnectionProtocol as they were configured.
+func (p *Provider) hostAndConnectionProtocol() (string, LDAPConnectionProtocol, error) {
+	if !strings.Contains(p.c.Host, "://") {
+		return p.c.Host, p.c.ConnectionProtocol, nil
+	}
+
+	return parseLDAPURL(p.c.Host)
 }
 
 // dialTLS is a default implementation of the Dialer, used when Dialer is nil and ConnectionProtocol is TLS.
 // Unfortunately, the go-ldap library does not seem to support dialing with a context.Context,
 // so we implement it ourselves, heavily inspired by ldap.DialURL.
 func (p *Provider) dialTLS(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
-	tlsConfig, err := p.tlsConfig()
+	tlsConfig, err := p.tlsConfig(ctx)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
 
-	dialer := &tls.Dialer{NetDialer: netDialer(), Config: tlsConfig}
-	c, err := dialer.DialContext(ctx, "tcp", addr.Endpoint())
-	if err != nil {
-		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	var c net.Conn
+	if len(p.c.HTTPSTunnel.URL) == 0 {
+		netDialer, err := p.netDialer()
+		if err != nil {
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		dialer := &tls.Dialer{NetDialer: netDialer, Config: tlsConfig}
+		c, err = dialer.DialContext(ctx, "tcp", addr.Endpoint())
+		if err != nil {
+			return nil, ldap.NewError(ldap.ErrorNetwork, classifyTLSHandshakeError(err))
+		}
+	} else {
+		tunnelConn, err := p.dialHTTPSTunnel(ctx, addr)
+		if err != nil {
+			return nil, ldap.NewError(ldap.ErrorNetwork, err)
+		}
+		// Layer TLS to the LDAP server inside the tunnel, just like tls.Dialer would have done.
+		tlsConfig.ServerName = addr.Host
+		tlsConn := tls.Client(tunnelConn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = tunnelConn.Close()
+			return nil, ldap.NewError(ldap.ErrorNetwork, classifyTLSHandshakeError(err))
+		}
+		c = tlsConn
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		p.reportTLSConnectionState(addr, tlsConfig, tlsConn.ConnectionState())
 	}
 
-	conn := ldap.NewConn(c, true)
-	conn.Start()
-	return conn, nil
+	return newMaxMessageSizeLDAPConn(p.withMaxMessageSize(p.withDeadlines(c)), true), nil
 }
 
-// dialTLS is a default implementation of the Dialer, used when Dialer is nil and ConnectionProtocol is StartTLS.
+// dialStartTLS is a default implementation of the Dialer, used when Dialer is nil and ConnectionProtocol is StartTLS.
 // Unfortunately, the go-ldap library does not seem to support dialing with a context.Context,
-// so we implement it ourselves, heavily inspired by ldap.DialURL.
+// so we implement it ourselves, heavily inspired by ldap.DialURL. The StartTLS request is also sent by this method
+// instead of by ldap.Conn, since the ldap.Conn must read its messages through the withMaxMessageSize wrapper of the
+// TLS connection, which only exists after StartTLS.
 func (p *Provider) dialStartTLS(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
-	tlsConfig, err := p.tlsConfig()
+	tlsConfig, err := p.tlsConfig(ctx)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
@@ -328,34 +1189,189 @@ func (p *Provider) dialStartTLS(ctx context.Context, addr endpointaddr.HostPort)
 	// Unfortunately, this seems to be required for StartTLS, even though it is not needed for regular TLS.
 	tlsConfig.ServerName = addr.Host
 
-	c, err := netDialer().DialContext(ctx, "tcp", addr.Endpoint())
+	tcpConn, err := p.dialTCP(ctx, addr)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	c := p.withDeadlines(tcpConn)
+
+	if err := p.requestStartTLS(c); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	tlsConn := tls.Client(c, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = c.Close()
+		return nil, ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("TLS handshake failed (%w)", classifyTLSHandshakeError(err)))
+	}
+	p.reportTLSConnectionState(addr, tlsConfig, tlsConn.ConnectionState())
+
+	return newMaxMessageSizeLDAPConn(p.withMaxMessageSize(tlsConn), true), nil
+}
+
+// requestStartTLS sends the StartTLS extended request over the unencrypted connection and reads its response,
+// see RFC 4511 section 4.14. This is the only request of the connection before it is upgraded to TLS.
+func (p *Provider) requestStartTLS(c net.Conn) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(1), "MessageID"))
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, startTLSOID, "TLS Extended Command"))
+	packet.AppendChild(request)
+
+	if _, err := c.Write(packet.Bytes()); err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	response, err := ber.ReadPacket(p.withMaxMessageSize(c))
+	if err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return ldap.GetLDAPError(response)
+}
+
+// startTLS makes an unencrypted connection using the given func, and then upgrades it to TLS.
+func (p *Provider) startTLS(
+	ctx context.Context,
+	addr endpointaddr.HostPort,
+	dialUnencrypted func(ctx context.Context, addr endpointaddr.HostPort) (StartTLSConn, error),
+) (Conn, error) {
+	tlsConfig, err := p.tlsConfig(ctx)
 	if err != nil {
 		return nil, ldap.NewError(ldap.ErrorNetwork, err)
 	}
 
-	conn := ldap.NewConn(c, false)
-	conn.Start()
+	// Unfortunately, this seems to be required for StartTLS, even though it is not needed for regular TLS.
+	tlsConfig.ServerName = addr.Host
+
+	conn, err := dialUnencrypted(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
 	err = conn.StartTLS(tlsConfig)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if stater, ok := conn.(tlsConnectionStater); ok {
+		if state, ok := stater.TLSConnectionState(); ok {
+			p.reportTLSConnectionState(addr, tlsConfig, state)
+		}
+	}
 
 	return conn, nil
 }
 
-func netDialer() *net.Dialer {
-	return &net.Dialer{Timeout: time.Minute}
+func (p *Provider) netDialer() (*net.Dialer, error) {
+	localAddr, err := p.c.localTCPAddr()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{} // the timeout comes from the context, see dialTimeout
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	return dialer, nil
+}
+
+// localTCPAddr returns the parsed LocalAddr, or nil when it is empty.
+func (c ProviderConfig) localTCPAddr() (*net.TCPAddr, error) {
+	if len(c.LocalAddr) == 0 {
+		return nil, nil
+	}
+	ip := net.ParseIP(c.LocalAddr)
+	if ip == nil {
+		return nil, fmt.Errorf("LocalAddr %q must be an IP address", c.LocalAddr)
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+// dialTimeout returns the longest time to wait for dialing when the context has no earlier deadline.
+func (p *Provider) dialTimeout() time.Duration {
+	if p.c.DefaultDialTimeout > 0 {
+		return p.c.DefaultDialTimeout
+	}
+	return defaultDialTimeout
+}
+
+// tlsConfig returns a TLS config which the caller may modify. It is either a copy of the TLS config which was built
+// from the CABundle when the Provider was created, or it is built from the current contents of the CABundlePath
+// or the result of the CABundleFunc.
+func (p *Provider) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	if p.tlsConfigErr != nil {
+		return nil, p.tlsConfigErr
+	}
+	if p.tlsConfigTemplate != nil {
+		return p.tlsConfigTemplate.Clone(), nil
+	}
+
+	var caBundle []byte
+	var err error
+	if len(p.c.CABundlePath) > 0 {
+		caBundle, err = os.ReadFile(p.c.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle file %q: %w", p.c.CABundlePath, err)
+		}
+	} else {
+		caBundle, err = p.c.CABundleFunc(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not load CA bundle: %w", err)
+		}
+	}
+	return buildTLSConfig(caBundle, p.c.TLSVerificationMode)
+}
+
+func validateTLSVerificationMode(mode TLSVerificationMode) error {
+	switch mode {
+	case "", TLSVerificationFull, TLSVerificationCAOnly, TLSVerificationInsecureSkipVerify:
+		return nil
+	default:
+		return fmt.Errorf("TLSVerificationMode must be %q, %q, or %q, but was %q",
+			TLSVerificationFull, TLSVerificationCAOnly, TLSVerificationInsecureSkipVerify, mode)
+	}
 }
 
-func (p *Provider) tlsConfig() (*tls.Config, error) {
+func buildTLSConfig(caBundle []byte, mode TLSVerificationMode) (*tls.Config, error) {
 	var rootCAs *x509.CertPool
-	if p.c.CABundle != nil {
+	if caBundle != nil {
 		rootCAs = x509.NewCertPool()
-		if !rootCAs.AppendCertsFromPEM(p.c.CABundle) {
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
 			return nil, fmt.Errorf("could not parse CA bundle")
 		}
 	}
-	return ptls.DefaultLDAP(rootCAs), nil
+	tlsConfig := ptls.DefaultLDAP(rootCAs)
+	switch mode {
+	case "", TLSVerificationFull:
+	case TLSVerificationCAOnly:
+		// Skip the default verification, which includes the hostname check, and verify only the chain instead.
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec // the certificate chain is verified by VerifyConnection
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyCertificateChain(state, rootCAs)
+		}
+	case TLSVerificationInsecureSkipVerify:
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec // explicitly requested, and logged for every connection
+	default:
+		return nil, validateTLSVerificationMode(mode)
+	}
+	return tlsConfig, nil
+}
+
+// verifyCertificateChain verifies that the server's certificate chains up to one of the rootCAs, or to one of the
+// system's trusted CAs when rootCAs is nil, without checking the names for which the certificate is valid.
+func verifyCertificateChain(state tls.ConnectionState, rootCAs *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("the LDAP server did not present a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         rootCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
 }
 
 // A name for this upstream provider.
@@ -370,34 +1386,273 @@ func (p *Provider) GetResourceUID() types.UID {
 // Return a URL which uniquely identifies this LDAP provider, e.g. "ldaps://host.example.com:1234?base=user-search-base".
 // This URL is not used for connecting to the provider, but rather is used for creating a globally unique user
 // identifier by being combined with the user's UID, since user UIDs are only unique within one provider.
+// When the Host is an LDAP URL, only its "hostname[:port]" is used, so e.g. "ldaps://host.example.com:1234/" and
+// "host.example.com:1234" result in the same URL.
 func (p *Provider) GetURL() *url.URL {
-	u := &url.URL{Scheme: ldapsScheme, Host: p.c.Host}
+	host, _, err := p.hostAndConnectionProtocol()
+	if err != nil {
+		// An invalid LDAP URL cannot be dialed anyway, so fall back to using it as it was configured.
+		host = p.c.Host
+	}
+	u := &url.URL{Scheme: ldapsScheme, Host: host}
 	q := u.Query()
 	q.Set("base", p.c.UserSearch.Base)
 	u.RawQuery = q.Encode()
 	return u
 }
 
+// UserIdentifier returns the globally unique identifier of the user with the given UID from this LDAP server, which
+// is the URL returned by GetURL with the UID added as the "sub" query parameter. It is the same for a given
+// Host and UserSearch Base regardless of how the Host was written or of which ConnectionProtocol is used, so all
+// callers should use it instead of combining the URL and UID themselves.
+func (p *Provider) UserIdentifier(uid string) string {
+	return downstreamsession.DownstreamLDAPSubject(uid, *p.GetURL())
+}
+
 // TestConnection provides a method for testing the connection and bind settings. It performs a dial and bind
-// and returns any errors that we encountered.
+// and returns any errors that we encountered. When TestConnectionValidatesUserSearchBase is configured, it also
+// checks that the UserSearch Base can be read, returning an error which wraps ErrUserSearchBaseNotAccessible.
+// When TestConnectionValidatesUserSearchPermissions is configured, it also checks that the user entries under the
+// UserSearch Base can be read, returning an error which wraps ErrUserSearchBaseNotReadable.
+// Errors from connecting are a *ConnectionError, whose kind can be found using ConnectionErrorKindOf.
 func (p *Provider) TestConnection(ctx context.Context) error {
-	err := p.validateConfig()
+	if err := p.beginOperation(ctx); err != nil {
+		return err
+	}
+	defer p.endOperation()
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if p.c.TestConnectionValidatesUserSearchBase && len(p.c.UserSearch.Base) > 0 {
+		searchResult, err := conn.Search(p.userSearchBaseRequest())
+		if err != nil {
+			err = fmt.Errorf(`%w: %q: %s`, ErrUserSearchBaseNotAccessible, p.c.UserSearch.Base, classifySearchError(err))
+			return &ConnectionError{Kind: SearchBaseNotFound, Err: err}
+		}
+		if len(searchResult.Entries) != 1 {
+			err = fmt.Errorf(`%w: %q: expected to find 1 entry but found %d`, ErrUserSearchBaseNotAccessible, p.c.UserSearch.Base, len(searchResult.Entries))
+			return &ConnectionError{Kind: SearchBaseNotFound, Err: err}
+		}
+	}
+	if p.c.TestConnectionValidatesUserSearchPermissions && len(p.c.UserSearch.Base) > 0 {
+		if err := p.checkUserSearchPermissions(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HealthCheck returns an error when the LDAP server does not seem to be up. When CLDAPPing is enabled, it first
+// sends a CLDAP ping, which needs no connection. Otherwise, or when the ping is not answered, it dials and binds as
+// the bind user, in the same way as TestConnection, and returns the same errors.
+func (p *Provider) HealthCheck(ctx context.Context) error {
+	if p.c.CLDAPPing {
+		err := p.cldapPing(ctx)
+		if err == nil {
+			return nil
+		}
+		plog.DebugErr("CLDAP ping failed, falling back to dialing the LDAP server", err, "upstreamName", p.GetName())
+	}
+
+	if err := p.beginOperation(ctx); err != nil {
+		return err
+	}
+	defer p.endOperation()
+
+	conn, err := p.dialAndBind(ctx)
 	if err != nil {
 		return err
 	}
+	conn.Close()
+	return nil
+}
+
+// dialAndBind validates the config, dials, and binds as the bind user. The caller must close the returned Conn.
+// Errors are a *ConnectionError.
+func (p *Provider) dialAndBind(ctx context.Context) (Conn, error) {
+	err := p.validateConfig()
+	if err != nil {
+		return nil, &ConnectionError{Kind: ConfigInvalid, Err: err}
+	}
+
+	bindUsername, bindPassword, err := p.bindCredentials(ctx)
+	if err != nil {
+		return nil, &ConnectionError{Kind: BindFailed, Err: err}
+	}
 
 	conn, err := p.dial(ctx)
 	if err != nil {
-		return fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		return nil, &ConnectionError{Kind: dialErrorKind(err), Err: fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)}
+	}
+
+	err = p.bindAsBindUser(conn, bindUsername, bindPassword)
+	if err != nil {
+		conn.Close()
+		return nil, &ConnectionError{Kind: BindFailed, Err: fmt.Errorf(`error binding as %q: %w`, bindUsername, err)}
+	}
+
+	return conn, nil
+}
+
+// UserSummary describes a user found by ListUsers.
+type UserSummary struct {
+	Username string
+	UID      string
+	DN       string
+}
+
+// ListUsers is an admin-only operation which previews which users the UserSearch config would match, e.g. for an
+// admin UI. It searches for users whose username matches the given value, in the same way that a username is
+// matched during authentication, and returns the mapped username, UID, and DN of at most limit users. An empty value
+// matches all users. It only binds as the bind user, and never as any end user.
+func (p *Provider) ListUsers(ctx context.Context, username string, limit int) ([]UserSummary, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
+	t := trace.FromContext(ctx).Nest("slow ldap list users attempt", trace.Field{Key: "providerName", Value: p.GetName()})
+	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, but was %d", limit)
+	}
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return nil, err
 	}
 	defer conn.Close()
 
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	entries, err := p.pagedSearchForUsers(conn, p.listUsersSafeValue(username), limit)
 	if err != nil {
-		return fmt.Errorf(`error binding as %q: %w`, p.c.BindUsername, err)
+		return nil, err
 	}
+	return p.userSummaries(entries)
+}
 
-	return nil
+// listUsersSafeValue returns the escaped username to search for, or a wildcard to match all users when it is empty.
+func (p *Provider) listUsersSafeValue(username string) string {
+	if len(username) == 0 {
+		return "*" // matches any value, but only when not escaped
+	}
+	return p.escapeForSearchFilter(username)
+}
+
+// pagedSearchForUsers returns at most limit entries of the users whose username matches the safe value.
+func (p *Provider) pagedSearchForUsers(conn Conn, safeValue string, limit int) ([]*ldap.Entry, error) {
+	pageSize := p.pageSize(conn)
+	if uint32(limit) < pageSize {
+		pageSize = uint32(limit)
+	}
+	searchResult, err := conn.SearchWithPaging(p.listUsersRequest(safeValue, limit), pageSize)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf(`error searching for users: %w`, err)
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
+		return nil, fmt.Errorf(`error searching for users: %w`, err)
+	}
+	var entries []*ldap.Entry
+	if searchResult != nil {
+		// The search result holds the partial results when the size limit was exceeded.
+		entries = searchResult.Entries
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// userSummaries maps the entries found by a search for users.
+func (p *Provider) userSummaries(entries []*ldap.Entry) ([]UserSummary, error) {
+	users := make([]UserSummary, 0, len(entries))
+	for _, entry := range entries {
+		summary, err := p.userSummary(entry)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, summary)
+	}
+
+	return users, nil
+}
+
+// userSummary maps an entry found by a search for users.
+func (p *Provider) userSummary(entry *ldap.Entry) (UserSummary, error) {
+	if len(entry.DN) == 0 {
+		return UserSummary{}, fmt.Errorf(`searching for users resulted in search result without DN`)
+	}
+	mappedUsername, err := p.getMappedUsername(entry, entry.DN)
+	if err != nil {
+		return UserSummary{}, err
+	}
+	mappedUID, err := p.getMappedUID(entry, entry.DN)
+	if err != nil {
+		return UserSummary{}, err
+	}
+	return UserSummary{Username: mappedUsername, UID: mappedUID, DN: entry.DN}, nil
+}
+
+// StreamUsers is like ListUsers, except that it has no limit, and instead of returning the users it calls
+// userFunc for each user as each page of search results arrives. Only one page of entries is held in memory at a
+// time, so it can be used for large directories. When userFunc returns an error, no more pages are requested and
+// that error is returned as-is, so callers may stop early by returning an error of their own.
+func (p *Provider) StreamUsers(ctx context.Context, username string, userFunc func(UserSummary) error) error {
+	if err := p.beginOperation(ctx); err != nil {
+		return err
+	}
+	defer p.endOperation()
+
+	t := trace.FromContext(ctx).Nest("slow ldap stream users attempt", trace.Field{Key: "providerName", Value: p.GetName()})
+	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	searchRequest := p.listUsersRequest(p.listUsersSafeValue(username), 0)
+	pagingControl := ldap.NewControlPaging(p.pageSize(conn))
+	searchRequest.Controls = append(searchRequest.Controls, pagingControl)
+
+	var previousCookie []byte
+	for {
+		page, err := conn.Search(searchRequest)
+		if err != nil {
+			return fmt.Errorf(`error searching for users: %w`, err)
+		}
+		if err := p.checkSearchResultEntrySizes(page); err != nil {
+			return fmt.Errorf(`error searching for users: %w`, err)
+		}
+		for _, entry := range page.Entries {
+			summary, err := p.userSummary(entry)
+			if err != nil {
+				return err
+			}
+			if err := userFunc(summary); err != nil {
+				return err
+			}
+		}
+		if !hasMorePages(page) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf(`error searching for users: %w`, err)
+		}
+
+		cookie := ldap.FindControl(page.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging).Cookie
+		if previousCookie != nil && bytes.Equal(cookie, previousCookie) {
+			// Asking for the same page again would never end.
+			return fmt.Errorf("error searching for users: the LDAP server returned the same paging cookie twice")
+		}
+		previousCookie = cookie
+		pagingControl.SetCookie(cookie)
+	}
 }
 
 // DryRunAuthenticateUser provides a method for testing all of the Provider settings in a kind of dry run of
@@ -405,22 +1660,129 @@ func (p *Provider) TestConnection(ctx context.Context) error {
 // not bind as that user, so it does not test their password. It returns the same values that a real call to
 // AuthenticateUser with the correct password would return.
 func (p *Provider) DryRunAuthenticateUser(ctx context.Context, username string, grantedScopes []string) (*authenticators.Response, bool, error) {
-	endUserBindFunc := func(conn Conn, foundUserDN string) error {
+	var accountStatus []string
+	var accountStatusErr error
+	endUserBindFunc := func(conn Conn, foundUserDN, _ string) error {
+		if p.c.DryRunAccountStatus {
+			// This runs as the bind user, where the end user bind would have happened.
+			accountStatus, accountStatusErr = p.searchAccountStatus(conn, foundUserDN)
+		}
 		// Act as if the end user bind always succeeds.
 		return nil
 	}
-	return p.authenticateUserImpl(ctx, username, grantedScopes, endUserBindFunc)
+	// Since the end user bind does not really happen, the "Who am I?" operation would only find the bind user.
+	response, authenticated, err := p.authenticateUserImpl(ctx, username, grantedScopes, endUserBindFunc, false)
+	if err != nil || !authenticated {
+		return response, authenticated, err
+	}
+	if accountStatusErr != nil {
+		return nil, false, accountStatusErr
+	}
+	if info, ok := response.User.(*user.DefaultInfo); ok && accountStatus != nil {
+		if info.Extra == nil {
+			info.Extra = map[string][]string{}
+		}
+		info.Extra[AccountStatusExtraKey] = accountStatus
+	}
+	return response, true, nil
+}
+
+// DryRunResolveGroups returns the groups which the user would have after logging in, as found by the group search,
+// without the user's password. Like DryRunAuthenticateUser, it searches for the user and their groups as the bind
+// user, but it does not map the user's username or UID, so it only fails when the user or their groups cannot be found.
+// The groups are returned before any IdentityTransform, and even when the GroupSearch is configured to fail open.
+// It returns an error which wraps ErrUserNotFound when no user was found for the username.
+func (p *Provider) DryRunResolveGroups(ctx context.Context, username string) ([]string, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
+	t := trace.FromContext(ctx).Nest("slow ldap resolve groups attempt", trace.Field{Key: "providerName", Value: p.GetName()})
+	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
+
+	if err := p.validateConfig(); err != nil {
+		return nil, err
+	}
+
+	if len(username) == 0 {
+		return nil, fmt.Errorf("%w: empty username", ErrUserNotFound)
+	}
+
+	bindUsername, bindPassword, err := p.bindCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, searchResult, err := p.dialBindAndSearch(ctx, newDebugTimer(false), bindUsername, bindPassword, func(conn Conn) (*ldap.SearchResult, error) {
+		return p.searchUser(conn, username)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	switch len(searchResult.Entries) {
+	case 0:
+		return nil, fmt.Errorf("%w: %q", ErrUserNotFound, username)
+	case 1:
+	default:
+		return nil, fmt.Errorf(`searching for user %q resulted in %d search results, but expected 1 result`,
+			username, len(searchResult.Entries),
+		)
+	}
+	userDN := searchResult.Entries[0].DN
+	if len(userDN) == 0 {
+		return nil, fmt.Errorf(`searching for user %q resulted in search result without DN`, username)
+	}
+
+	return p.searchGroupsForUserDN(conn, userDN)
+}
+
+// TestGroupSearch returns the groups which the group search finds for the given user DN, e.g. to try out changes to
+// the GroupSearch config using the DN of a known user. Unlike DryRunResolveGroups, it skips the user search, so the
+// DN does not need to be found by the UserSearch. It binds as the bind user, and errors from dialing and binding are
+// a *ConnectionError. The groups are returned before any IdentityTransform, and even when the GroupSearch is
+// configured to fail open.
+func (p *Provider) TestGroupSearch(ctx context.Context, userDN string) ([]string, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
+	if len(p.c.GroupSearch.Base) == 0 {
+		return nil, fmt.Errorf("cannot test the group search because the GroupSearch Base is not configured")
+	}
+	if len(userDN) == 0 {
+		return nil, fmt.Errorf("cannot test the group search because the user DN is empty")
+	}
+	if _, err := ldap.ParseDN(userDN); err != nil {
+		return nil, fmt.Errorf("cannot test the group search because %q is not a valid DN: %w", userDN, err)
+	}
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return p.searchGroupsForUserDN(conn, userDN)
 }
 
 // Authenticate an end user and return their mapped username, groups, and UID. Implements authenticators.UserAuthenticator.
 func (p *Provider) AuthenticateUser(ctx context.Context, username, password string, grantedScopes []string) (*authenticators.Response, bool, error) {
-	endUserBindFunc := func(conn Conn, foundUserDN string) error {
-		return conn.Bind(foundUserDN, password)
+	endUserBindFunc := func(conn Conn, _, bindName string) error {
+		return conn.Bind(bindName, password)
 	}
-	return p.authenticateUserImpl(ctx, username, grantedScopes, endUserBindFunc)
+	return p.authenticateUserImpl(ctx, username, grantedScopes, endUserBindFunc, p.c.UserSearch.UsernameFromWhoAmI)
 }
 
-func (p *Provider) authenticateUserImpl(ctx context.Context, username string, grantedScopes []string, bindFunc func(conn Conn, foundUserDN string) error) (*authenticators.Response, bool, error) {
+func (p *Provider) authenticateUserImpl(ctx context.Context, username string, grantedScopes []string, bindFunc func(conn Conn, foundUserDN, bindName string) error, usernameFromWhoAmI bool) (*authenticators.Response, bool, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, false, err
+	}
+	defer p.endOperation()
+
 	t := trace.FromContext(ctx).Nest("slow ldap authenticate user attempt", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
 
@@ -436,20 +1798,31 @@ func (p *Provider) authenticateUserImpl(ctx context.Context, username string, gr
 		return nil, false, nil
 	}
 
-	conn, err := p.dial(ctx)
+	bindUsername, bindPassword, err := p.bindCredentials(ctx)
 	if err != nil {
 		p.traceAuthFailure(t, err)
-		return nil, false, fmt.Errorf(`error dialing host %q: %w`, p.c.Host, err)
+		return nil, false, err
 	}
-	defer conn.Close()
 
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	timer := newDebugTimer(p.c.DebugTimings)
+
+	conn, searchResult, err := p.dialBindAndSearch(ctx, timer, bindUsername, bindPassword, func(conn Conn) (*ldap.SearchResult, error) {
+		return p.searchUser(withRequestControls(ctx, conn), username)
+	})
 	if err != nil {
 		p.traceAuthFailure(t, err)
-		return nil, false, fmt.Errorf(`error binding as %q before user search: %w`, p.c.BindUsername, err)
+		return nil, false, err
 	}
+	defer conn.Close()
 
-	response, err := p.searchAndBindUser(conn, username, grantedScopes, bindFunc)
+	if len(searchResult.Entries) == 0 {
+		p.delayUserNotFound(ctx)
+	}
+
+	rebindAsBindUser := func(conn Conn) error {
+		return p.rebindAsBindUser(conn, bindUsername, bindPassword)
+	}
+	response, err := p.searchAndBindUser(withRequestControls(ctx, conn), timer, username, searchResult, grantedScopes, bindFunc, rebindAsBindUser, usernameFromWhoAmI)
 	if err != nil {
 		p.traceAuthFailure(t, err)
 		return nil, false, err
@@ -458,9 +1831,92 @@ func (p *Provider) authenticateUserImpl(ctx context.Context, username string, gr
 		p.traceAuthFailure(t, fmt.Errorf("bad username or password"))
 		return nil, false, nil
 	}
-
-	p.traceAuthSuccess(t)
-	return response, true, nil
+
+	if p.c.IdentityTransform != nil {
+		if err := p.c.IdentityTransform(response); err != nil {
+			p.traceAuthFailure(t, err)
+			return nil, false, fmt.Errorf(`error transforming identity of user %q: %w`, username, err)
+		}
+	}
+	timer.addToUser(response.User)
+	p.addAuditBindDN(response)
+
+	p.traceAuthSuccess(t)
+	return response, true, nil
+}
+
+// debugTimer records the durations of consecutive steps when enabled, and does nothing otherwise.
+type debugTimer struct {
+	enabled bool
+	last    time.Time
+	timings []string
+}
+
+func newDebugTimer(enabled bool) *debugTimer {
+	return &debugTimer{enabled: enabled, last: time.Now()}
+}
+
+// record saves the duration of the named step, which is the time since the previous step ended.
+func (d *debugTimer) record(step string) {
+	if !d.enabled {
+		return
+	}
+	now := time.Now()
+	d.timings = append(d.timings, fmt.Sprintf("%s=%s", step, now.Sub(d.last)))
+	d.last = now
+}
+
+// addToUser adds the recorded timings to the user's extra info under the DebugTimingsExtraKey.
+func (d *debugTimer) addToUser(u user.Info) {
+	info, ok := u.(*user.DefaultInfo)
+	if !d.enabled || !ok {
+		return
+	}
+	if info.Extra == nil {
+		info.Extra = map[string][]string{}
+	}
+	info.Extra[DebugTimingsExtraKey] = d.timings
+}
+
+// delayUserNotFound waits for the UserNotFoundDelay, or until the context is done.
+func (p *Provider) delayUserNotFound(ctx context.Context) {
+	if p.c.UserNotFoundDelay <= 0 {
+		return
+	}
+	timer := time.NewTimer(p.c.UserNotFoundDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// addAuditBindDN adds the DN which was bound as the user to the user's extra info under the AuditBindDNExtraKey
+// when the AuditBindDN option is enabled.
+func (p *Provider) addAuditBindDN(response *authenticators.Response) {
+	info, ok := response.User.(*user.DefaultInfo)
+	if !p.c.AuditBindDN || !ok {
+		return
+	}
+	if info.Extra == nil {
+		info.Extra = map[string][]string{}
+	}
+	info.Extra[AuditBindDNExtraKey] = []string{response.DN}
+}
+
+// searchGroupsForUser returns the user's groups, or no groups when the group search failed and is configured to
+// fail open.
+func (p *Provider) searchGroupsForUser(conn Conn, username, userDN string) ([]string, error) {
+	groups, err := p.searchGroupsForUserDN(conn, userDN)
+	if err != nil {
+		if !p.c.GroupSearch.FailOpen {
+			return nil, err
+		}
+		plog.WarningErr("error searching for groups, continuing without groups because group search is configured to fail open",
+			err, "upstreamName", p.GetName(), "username", username, "dn", userDN)
+		return []string{}, nil
+	}
+	return groups, nil
 }
 
 func (p *Provider) searchGroupsForUserDN(conn Conn, userDN string) ([]string, error) {
@@ -469,15 +1925,26 @@ func (p *Provider) searchGroupsForUserDN(conn Conn, userDN string) ([]string, er
 		return []string{}, nil
 	}
 
-	searchResult, err := conn.SearchWithPaging(p.groupSearchRequest(userDN), groupSearchPageSize)
+	var searchResult *ldap.SearchResult
+	var err error
+	if p.c.GroupSearch.MaxGroups > 0 {
+		var truncated bool
+		searchResult, truncated, err = searchWithPagingUpTo(conn, p.groupSearchRequest(userDN), p.pageSize(conn), p.c.GroupSearch.MaxGroups)
+		if truncated {
+			plog.Warning("user has more groups than the configured maximum, ignoring the rest of the groups",
+				"upstreamName", p.GetName(), "dn", userDN, "maxGroups", p.c.GroupSearch.MaxGroups)
+		}
+	} else {
+		searchResult, err = conn.SearchWithPaging(p.groupSearchRequest(userDN), p.pageSize(conn))
+	}
 	if err != nil {
+		return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, classifySearchError(err))
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
 		return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, err)
 	}
 
-	groupAttributeName := p.c.GroupSearch.GroupNameAttribute
-	if len(groupAttributeName) == 0 {
-		groupAttributeName = distinguishedNameAttributeName
-	}
+	groupAttributeNames := p.groupNameAttributes()
 
 	groups := []string{}
 entries:
@@ -485,6 +1952,7 @@ entries:
 		if len(groupEntry.DN) == 0 {
 			return nil, fmt.Errorf(`searching for group memberships for user with DN %q resulted in search result without DN`, userDN)
 		}
+		groupAttributeName := firstPresentAttributeName(groupAttributeNames, groupEntry)
 		if overrideFunc := p.c.GroupAttributeParsingOverrides[groupAttributeName]; overrideFunc != nil {
 			overrideGroupName, err := overrideFunc(groupEntry)
 			if err != nil {
@@ -494,7 +1962,7 @@ entries:
 			continue entries
 		}
 		// if none of the overrides matched, use the default behavior (no mapping)
-		mappedGroupName, err := p.getSearchResultAttributeValue(groupAttributeName, groupEntry, userDN)
+		mappedGroupName, err := p.getSearchResultAttributeValue(groupAttributeName, groupEntry, userDN, p.c.TrimAttributeWhitespace)
 		if err != nil {
 			return nil, fmt.Errorf(`error searching for group memberships for user with DN %q: %w`, userDN, err)
 		}
@@ -502,21 +1970,174 @@ entries:
 	}
 	// de-duplicate the list of groups by turning it into a set,
 	// then turn it back into a sorted list.
-	return sets.NewString(groups...).List(), nil
+	groupSet := sets.NewString(groups...)
+	if len(p.c.GroupSearch.GroupAllowlist) > 0 {
+		groupSet = groupSet.Intersection(sets.NewString(p.c.GroupSearch.GroupAllowlist...))
+	}
+	return groupSet.List(), nil
+}
+
+// searchWithPagingUpTo is like Conn.SearchWithPaging, except that it stops asking for more pages once it has found
+// maxEntries entries, in which case it returns true. Any more entries are discarded.
+func searchWithPagingUpTo(conn Conn, searchRequest *ldap.SearchRequest, pagingSize uint32, maxEntries int) (*ldap.SearchResult, bool, error) {
+	pagingControl := ldap.NewControlPaging(pagingSize)
+	searchRequest.Controls = append(searchRequest.Controls, pagingControl)
+
+	searchResult := &ldap.SearchResult{Entries: []*ldap.Entry{}, Referrals: []string{}, Controls: []ldap.Control{}}
+	var previousCookie []byte
+	for {
+		page, err := conn.Search(searchRequest)
+		if err != nil {
+			return nil, false, err
+		}
+		searchResult.Entries = append(searchResult.Entries, page.Entries...)
+		searchResult.Referrals = append(searchResult.Referrals, page.Referrals...)
+
+		if len(searchResult.Entries) >= maxEntries {
+			truncated := len(searchResult.Entries) > maxEntries || hasMorePages(page)
+			searchResult.Entries = searchResult.Entries[:maxEntries]
+			return searchResult, truncated, nil
+		}
+		if !hasMorePages(page) {
+			return searchResult, false, nil
+		}
+
+		cookie := ldap.FindControl(page.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging).Cookie
+		if previousCookie != nil && bytes.Equal(cookie, previousCookie) {
+			// Asking for the same page again would never end.
+			return nil, false, fmt.Errorf("the LDAP server returned the same paging cookie twice")
+		}
+		previousCookie = cookie
+		pagingControl.SetCookie(cookie)
+	}
+}
+
+// hasMorePages returns true when the page of a paged search says that there are more pages. A server which does
+// not support paging, and therefore returns no paging control, returned all results in the first page.
+func hasMorePages(page *ldap.SearchResult) bool {
+	pagingControl, ok := ldap.FindControl(page.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	return ok && len(pagingControl.Cookie) > 0
 }
 
+// validateConfig returns the same errors as the Validate method of the config, except that the TLS settings were
+// already validated once by New.
 func (p *Provider) validateConfig() error {
-	if p.c.UserSearch.UsernameAttribute == distinguishedNameAttributeName && len(p.c.UserSearch.Filter) == 0 {
+	if p.tlsConfigErr != nil {
+		return p.tlsConfigErr
+	}
+	if _, err := p.c.localTCPAddr(); err != nil {
+		return err
+	}
+	return p.c.validateSearch()
+}
+
+// Validate returns an error when the config is invalid, using the same rules which every operation of a Provider
+// created from the config uses. It does not connect to the LDAP server, so it can be used to validate a config,
+// e.g. by an admission webhook, before creating a Provider.
+func (c ProviderConfig) Validate() error {
+	if err := c.validateTLSSettings(); err != nil {
+		return err
+	}
+	if c.hasStaticCABundle() {
+		if _, err := buildTLSConfig(c.CABundle, c.TLSVerificationMode); err != nil {
+			return err
+		}
+	}
+	if _, err := c.localTCPAddr(); err != nil {
+		return err
+	}
+	return c.validateSearch()
+}
+
+// validateTLSSettings validates the TLS settings, except for the contents of the CA bundle.
+func (c ProviderConfig) validateTLSSettings() error {
+	if err := validateTLSVerificationMode(c.TLSVerificationMode); err != nil {
+		return err
+	}
+	if countCABundleSources(c) > 1 {
+		return fmt.Errorf("at most one of CABundle, CABundlePath, and CABundleFunc may be set")
+	}
+	return nil
+}
+
+// hasStaticCABundle returns true when the CA bundle is not read for each new connection, i.e. when it is the
+// CABundle, or when it is nil, which means using the system's trusted CAs.
+func (c ProviderConfig) hasStaticCABundle() bool {
+	return len(c.CABundlePath) == 0 && c.CABundleFunc == nil
+}
+
+// validateSearch validates the BindUserSearch, UserSearch, and GroupSearch settings.
+func (c ProviderConfig) validateSearch() error {
+	if c.UserSearch.UsernameAttribute == distinguishedNameAttributeName && len(c.UserSearch.Filter) == 0 && len(c.UserSearch.UsernameSearchAttributes) == 0 {
 		// LDAP search filters do not allow searching by DN, so we would have no reasonable default for Filter.
 		return fmt.Errorf(`must specify UserSearch Filter when UserSearch UsernameAttribute is "dn"`)
 	}
+	if c.UserSearch.RawFilter && !strings.Contains(c.UserSearch.Filter, searchFilterInterpolationLocationMarker) {
+		// A raw filter which does not include the username would match the same user for every username.
+		return fmt.Errorf(`UserSearch Filter must contain "{}" when UserSearch RawFilter is true`)
+	}
+	if c.BindUserSearch.configured() {
+		if len(c.BindUserSearch.Base) == 0 {
+			return fmt.Errorf(`must specify BindUserSearch Base when BindUserSearch Filter is set`)
+		}
+		if !strings.Contains(c.BindUserSearch.Filter, searchFilterInterpolationLocationMarker) {
+			// A filter which does not include the bind username would find the same entry for every bind username.
+			return fmt.Errorf(`BindUserSearch Filter must contain "{}"`)
+		}
+	}
+	if slices.Contains(c.UserSearch.UsernameSearchAttributes, distinguishedNameAttributeName) {
+		// LDAP search filters do not allow searching by DN.
+		return fmt.Errorf(`UserSearch UsernameSearchAttributes must not contain "dn"`)
+	}
+	if len(c.GroupSearch.GroupNameAttribute) > 0 && len(c.GroupSearch.GroupNameAttributes) > 0 {
+		return fmt.Errorf(`at most one of GroupSearch GroupNameAttribute and GroupNameAttributes may be set`)
+	}
+	switch c.UserSearch.EmptyValuePolicy {
+	case "", EmptyValueError, EmptyValueSkipToFallback:
+	default:
+		return fmt.Errorf(`UserSearch EmptyValuePolicy must be %q or %q, but was %q`, EmptyValueError, EmptyValueSkipToFallback, c.UserSearch.EmptyValuePolicy)
+	}
+	if len(c.UserSearch.UIDAttributeTemplate) > 0 && len(c.UserSearch.uidAttributeTemplateAttributes()) == 0 {
+		return fmt.Errorf(`UserSearch UIDAttributeTemplate %q must reference at least one attribute using "{attributeName}"`, c.UserSearch.UIDAttributeTemplate)
+	}
+	if c.UserSearch.RequireNonDNAttribute && c.UserSearch.mapsOnlyDN() {
+		return fmt.Errorf(`UserSearch RequireNonDNAttribute is true, but both the username and the UID are taken from "dn"`)
+	}
 	return nil
 }
 
+// mapsOnlyDN returns true when both the username and the UID are taken from the DN, so that the user search does not
+// need to read any of the user's attributes to map them.
+func (s UserSearchConfig) mapsOnlyDN() bool {
+	if s.UsernameAttribute != distinguishedNameAttributeName {
+		return false
+	}
+	if len(s.UIDAttributeTemplate) > 0 {
+		for _, attributeName := range s.uidAttributeTemplateAttributes() {
+			if attributeName != distinguishedNameAttributeName {
+				return false
+			}
+		}
+		return true
+	}
+	return s.UIDAttribute == distinguishedNameAttributeName
+}
+
 func (p *Provider) SearchForDefaultNamingContext(ctx context.Context) (string, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return "", err
+	}
+	defer p.endOperation()
+
 	t := trace.FromContext(ctx).Nest("slow ldap attempt when searching for default naming context", trace.Field{Key: "providerName", Value: p.GetName()})
 	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
 
+	bindUsername, bindPassword, err := p.bindCredentials(ctx)
+	if err != nil {
+		p.traceSearchBaseDiscoveryFailure(t, err)
+		return "", err
+	}
+
 	conn, err := p.dial(ctx)
 	if err != nil {
 		p.traceSearchBaseDiscoveryFailure(t, err)
@@ -524,16 +2145,19 @@ func (p *Provider) SearchForDefaultNamingContext(ctx context.Context) (string, e
 	}
 	defer conn.Close()
 
-	err = conn.Bind(p.c.BindUsername, p.c.BindPassword)
+	err = p.bindAsBindUser(conn, bindUsername, bindPassword)
 	if err != nil {
 		p.traceSearchBaseDiscoveryFailure(t, err)
-		return "", fmt.Errorf(`error binding as %q before querying for defaultNamingContext: %w`, p.c.BindUsername, err)
+		return "", fmt.Errorf(`error binding as %q before querying for defaultNamingContext: %w`, bindUsername, err)
 	}
 
 	searchResult, err := conn.Search(p.defaultNamingContextRequest())
 	if err != nil {
 		return "", fmt.Errorf(`error querying RootDSE for defaultNamingContext: %w`, err)
 	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
+		return "", fmt.Errorf(`error querying RootDSE for defaultNamingContext: %w`, err)
+	}
 
 	if len(searchResult.Entries) != 1 {
 		return "", fmt.Errorf(`error querying RootDSE for defaultNamingContext: expected to find 1 entry but found %d`, len(searchResult.Entries))
@@ -546,16 +2170,28 @@ func (p *Provider) SearchForDefaultNamingContext(ctx context.Context) (string, e
 	return searchBase, nil
 }
 
-func (p *Provider) searchAndBindUser(conn Conn, username string, grantedScopes []string, bindFunc func(conn Conn, foundUserDN string) error) (*authenticators.Response, error) {
+func (p *Provider) searchUser(conn Conn, username string) (*ldap.SearchResult, error) {
 	searchResult, err := conn.Search(p.userSearchRequest(username))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		// The filter matched more entries than the size limit of the search, so the username is ambiguous. This is
+		// the same as when more than one entry is returned, regardless of how many entries came with the error.
+		return nil, fmt.Errorf(`searching for user %q resulted in more search results than the size limit, but expected 1 result`, username)
+	}
 	if err != nil {
 		plog.All(`error searching for user`,
 			"upstreamName", p.GetName(),
 			"username", username,
 			"err", err,
 		)
+		return nil, fmt.Errorf(`error searching for user: %w`, classifySearchError(err))
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
 		return nil, fmt.Errorf(`error searching for user: %w`, err)
 	}
+	return searchResult, nil
+}
+
+func (p *Provider) searchAndBindUser(conn Conn, timer *debugTimer, username string, searchResult *ldap.SearchResult, grantedScopes []string, bindFunc func(conn Conn, foundUserDN, bindName string) error, rebindAsBindUser func(conn Conn) error, usernameFromWhoAmI bool) (*authenticators.Response, error) {
 	if len(searchResult.Entries) == 0 {
 		if plog.Enabled(plog.LevelAll) {
 			plog.All("error finding user: user not found (if this username is valid, please check the user search configuration)",
@@ -568,6 +2204,14 @@ func (p *Provider) searchAndBindUser(conn Conn, username string, grantedScopes [
 		return nil, nil
 	}
 
+	if len(searchResult.Entries) > 1 && p.c.UserSearch.AmbiguousDNlessResultsAsNotFound && !anyEntryHasDN(searchResult.Entries) {
+		// These results do not identify any user, so the username might still be someone's mistakenly entered
+		// password, and it should not be logged, just like when no user was found.
+		plog.Debug("error finding user: user search returned multiple results without DNs, treating it as user not found",
+			"upstreamName", p.GetName(), "numberOfResults", len(searchResult.Entries))
+		return nil, nil
+	}
+
 	// At this point, we have matched at least one entry, so we can be confident that the username is not actually
 	// someone's password mistakenly entered into the username field, so we can log it without concern.
 	if len(searchResult.Entries) > 1 {
@@ -577,48 +2221,100 @@ func (p *Provider) searchAndBindUser(conn Conn, username string, grantedScopes [
 	}
 	userEntry := searchResult.Entries[0]
 	if len(userEntry.DN) == 0 {
-		return nil, fmt.Errorf(`searching for user %q resulted in search result without DN`, username)
-	}
-
-	mappedUsername, err := p.getSearchResultAttributeValue(p.c.UserSearch.UsernameAttribute, userEntry, username)
-	if err != nil {
-		return nil, err
+		return nil, p.userEntryWithoutDNError(username,
+			fmt.Errorf(`searching for user %q resulted in search result without DN`, username))
 	}
 
-	// We would like to support binary typed attributes for UIDs, so always read them as binary and encode them,
-	// even when the attribute may not be binary.
-	mappedUID, err := p.getSearchResultAttributeRawValueEncoded(p.c.UserSearch.UIDAttribute, userEntry, username)
-	if err != nil {
-		return nil, err
+	var mappedUsername, mappedUID string
+	var mappedRefreshAttributes map[string]string
+	var err error
+	if !p.c.UserSearch.ReadUserEntryAfterBind {
+		mappedUsername, mappedUID, err = p.mapUserEntry(userEntry, username)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var mappedGroupNames []string
-	if slices.Contains(grantedScopes, oidcapi.ScopeGroups) {
-		mappedGroupNames, err = p.searchGroupsForUserDN(conn, userEntry.DN)
+	searchGroups := slices.Contains(grantedScopes, oidcapi.ScopeGroups)
+	if searchGroups && !p.c.GroupSearch.SearchAfterUserBind {
+		mappedGroupNames, err = p.searchGroupsForUser(conn, username, userEntry.DN)
 		if err != nil {
 			return nil, err
 		}
+		timer.record("group-search")
 	}
 
-	mappedRefreshAttributes := make(map[string]string)
-	for k := range p.c.RefreshAttributeChecks {
-		mappedVal, err := p.getSearchResultAttributeRawValueEncoded(k, userEntry, username)
+	if !p.c.UserSearch.ReadUserEntryAfterBind {
+		mappedRefreshAttributes, err = p.mapRefreshAttributes(userEntry, username)
 		if err != nil {
 			return nil, err
 		}
-		mappedRefreshAttributes[k] = mappedVal
 	}
 
 	// Caution: Note that any other LDAP commands after this bind will be run as this user instead of as the configured BindUsername!
-	err = bindFunc(conn, userEntry.DN)
+	bindName, err := p.getUserBindName(userEntry, username)
+	if err != nil {
+		return nil, err
+	}
+	err = bindFunc(conn, userEntry.DN, bindName)
 	if err != nil {
+		// A failed bind leaves the connection anonymous rather than bound as the bind user (RFC 4511 section 4.2.1),
+		// so nothing else may run on it and the groups are not searched. The caller closes it.
 		plog.DebugErr("error binding for user (if this is not the expected dn for this username, please check the user search configuration)",
-			err, "upstreamName", p.GetName(), "username", username, "dn", userEntry.DN)
+			err, "upstreamName", p.GetName(), "username", username, "dn", userEntry.DN, "bindName", bindName)
 		ldapErr := &ldap.Error{}
+		bindErr := fmt.Errorf(`error binding for user %q using provided password against DN %q: %w`, username, userEntry.DN, err)
 		if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials {
+			// Active Directory says why it refused the bind, so tell the user when their account is the problem.
+			if reason, ok := ADBindFailureReasonOf(err); ok && reason.isAccountProblem() {
+				return nil, &ADBindError{Reason: reason, Err: bindErr}
+			}
 			return nil, nil
 		}
-		return nil, fmt.Errorf(`error binding for user %q using provided password against DN %q: %w`, username, userEntry.DN, err)
+		return nil, bindErr
+	}
+	timer.record("user-bind")
+
+	// The connection is now bound as the user, so the operations which are meant to run as the user must use
+	// userConn, which refuses to run any other operation with the user's permissions.
+	userConn := &userBoundConn{conn: conn, userDN: userEntry.DN}
+
+	if p.c.UserSearch.ReadUserEntryAfterBind {
+		userEntry, err = p.readUserEntryAsUser(userConn, username, userEntry.DN)
+		if err != nil {
+			return nil, err
+		}
+		timer.record("read-user-entry")
+		mappedUsername, mappedUID, err = p.mapUserEntry(userEntry, username)
+		if err != nil {
+			return nil, err
+		}
+		mappedRefreshAttributes, err = p.mapRefreshAttributes(userEntry, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if usernameFromWhoAmI {
+		mappedUsername, err = p.getWhoAmIUsername(userConn, username, mappedUsername)
+		if err != nil {
+			return nil, err
+		}
+		timer.record("whoami")
+	}
+
+	// Any operations after this point must not run as the user, so they must first call rebindAsBindUser.
+	if searchGroups && p.c.GroupSearch.SearchAfterUserBind {
+		if err := rebindAsBindUser(conn); err != nil {
+			return nil, err
+		}
+		timer.record("rebind")
+		mappedGroupNames, err = p.searchGroupsForUser(conn, username, userEntry.DN)
+		if err != nil {
+			return nil, err
+		}
+		timer.record("group-search")
 	}
 
 	if len(mappedUsername) == 0 || len(mappedUID) == 0 {
@@ -639,6 +2335,92 @@ func (p *Provider) searchAndBindUser(conn Conn, username string, grantedScopes [
 	return response, nil
 }
 
+func anyEntryHasDN(entries []*ldap.Entry) bool {
+	for _, entry := range entries {
+		if len(entry.DN) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mapUserEntry returns the mapped username and UID of the user's entry.
+func (p *Provider) mapUserEntry(userEntry *ldap.Entry, username string) (string, string, error) {
+	mappedUsername, err := p.getMappedUsername(userEntry, username)
+	if err != nil {
+		return "", "", err
+	}
+
+	mappedUID, err := p.getMappedUID(userEntry, username)
+	if err != nil {
+		return "", "", err
+	}
+	return mappedUsername, mappedUID, nil
+}
+
+// mapRefreshAttributes returns the values of the RefreshAttributeChecks attributes of the user's entry.
+func (p *Provider) mapRefreshAttributes(userEntry *ldap.Entry, username string) (map[string]string, error) {
+	mappedRefreshAttributes := make(map[string]string)
+	for k := range p.c.RefreshAttributeChecks {
+		mappedVal, err := p.getSearchResultAttributeRawValueEncoded(k, userEntry, username, false)
+		if err != nil {
+			return nil, err
+		}
+		mappedRefreshAttributes[k] = mappedVal
+	}
+	return mappedRefreshAttributes, nil
+}
+
+// readUserEntryAsUser reads the user's entry using a connection which is bound as the user.
+func (p *Provider) readUserEntryAsUser(userConn *userBoundConn, username, userDN string) (*ldap.Entry, error) {
+	searchResult, err := userConn.Search(p.refreshUserSearchRequest(userDN))
+	if err != nil {
+		return nil, fmt.Errorf(`error reading the entry of user %q as the user: %w`, username, classifySearchError(err))
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
+		return nil, fmt.Errorf(`error reading the entry of user %q as the user: %w`, username, err)
+	}
+	if len(searchResult.Entries) != 1 {
+		return nil, fmt.Errorf(`reading the entry of user %q as the user resulted in %d search results, but expected 1 result`,
+			username, len(searchResult.Entries))
+	}
+	userEntry := searchResult.Entries[0]
+	if !strings.EqualFold(userEntry.DN, userDN) {
+		return nil, fmt.Errorf(`reading the entry of user %q as the user resulted in an entry with DN %q, but expected DN %q`,
+			username, userEntry.DN, userDN)
+	}
+	return userEntry, nil
+}
+
+func (p *Provider) userSearchBaseRequest() *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       p.c.UserSearch.Base,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{"1.1"}, // the special attribute name which requests that no attributes are returned
+		Controls:     nil,             // don't need paging because we set the SizeLimit so small
+	}
+}
+
+func (p *Provider) bindUserSearchRequest(bindUsername string) *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       p.c.BindUserSearch.Base,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		// The bind username may come from a Secret rather than from the config, so escape it like end user input.
+		Filter:     interpolateSearchFilter(p.c.BindUserSearch.Filter, p.escapeForSearchFilter(bindUsername)),
+		Attributes: []string{"1.1"}, // the special attribute name which requests that no attributes are returned
+		Controls:   nil,             // don't need paging because we set the SizeLimit so small
+	}
+}
+
 func (p *Provider) defaultNamingContextRequest() *ldap.SearchRequest {
 	return &ldap.SearchRequest{
 		BaseDN:       "",
@@ -655,7 +2437,7 @@ func (p *Provider) defaultNamingContextRequest() *ldap.SearchRequest {
 
 func (p *Provider) userSearchRequest(username string) *ldap.SearchRequest {
 	// See https://ldap.com/the-ldap-search-operation for general documentation of LDAP search options.
-	return &ldap.SearchRequest{
+	request := &ldap.SearchRequest{
 		BaseDN:       p.c.UserSearch.Base,
 		Scope:        ldap.ScopeWholeSubtree,
 		DerefAliases: ldap.NeverDerefAliases,
@@ -666,6 +2448,25 @@ func (p *Provider) userSearchRequest(username string) *ldap.SearchRequest {
 		Attributes:   p.userSearchRequestedAttributes(),
 		Controls:     nil, // this could be used to enable paging, but we're already limiting the result max size
 	}
+	if p.c.UserSearchRequestMutator != nil {
+		p.c.UserSearchRequestMutator(request)
+	}
+	return request
+}
+
+func (p *Provider) listUsersRequest(safeValue string, limit int) *ldap.SearchRequest {
+	// See https://ldap.com/the-ldap-search-operation for general documentation of LDAP search options.
+	return &ldap.SearchRequest{
+		BaseDN:       p.c.UserSearch.Base,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    limit,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       p.userSearchFilterForSafeValue(safeValue),
+		Attributes:   p.userSearchRequestedAttributes(),
+		Controls:     nil, // nil because ldap.SearchWithPaging() will set the appropriate controls for us
+	}
 }
 
 func (p *Provider) groupSearchRequest(userDN string) *ldap.SearchRequest {
@@ -703,9 +2504,18 @@ func (p *Provider) userSearchRequestedAttributes() []string {
 	if p.c.UserSearch.UsernameAttribute != distinguishedNameAttributeName {
 		attributes = append(attributes, p.c.UserSearch.UsernameAttribute)
 	}
-	if p.c.UserSearch.UIDAttribute != distinguishedNameAttributeName {
+	if len(p.c.UserSearch.UIDAttributeTemplate) > 0 {
+		for _, attributeName := range p.c.UserSearch.uidAttributeTemplateAttributes() {
+			if attributeName != distinguishedNameAttributeName {
+				attributes = append(attributes, attributeName)
+			}
+		}
+	} else if p.c.UserSearch.UIDAttribute != distinguishedNameAttributeName {
 		attributes = append(attributes, p.c.UserSearch.UIDAttribute)
 	}
+	if len(p.c.UserSearch.BindDNAttribute) > 0 && p.c.UserSearch.BindDNAttribute != distinguishedNameAttributeName {
+		attributes = append(attributes, p.c.UserSearch.BindDNAttribute)
+	}
 	for k := range p.c.RefreshAttributeChecks {
 		attributes = append(attributes, k)
 	}
@@ -713,22 +2523,66 @@ func (p *Provider) userSearchRequestedAttributes() []string {
 }
 
 func (p *Provider) groupSearchRequestedAttributes() []string {
-	switch p.c.GroupSearch.GroupNameAttribute {
-	case "":
-		return []string{}
-	case distinguishedNameAttributeName:
-		return []string{}
-	default:
+	attributes := []string{}
+	for _, attributeName := range p.groupNameAttributes() {
+		if attributeName != distinguishedNameAttributeName {
+			attributes = append(attributes, attributeName)
+		}
+	}
+	return attributes
+}
+
+// groupNameAttributes returns the attributes from which group names may be retrieved, in order of preference.
+func (p *Provider) groupNameAttributes() []string {
+	if len(p.c.GroupSearch.GroupNameAttributes) > 0 {
+		return p.c.GroupSearch.GroupNameAttributes
+	}
+	if len(p.c.GroupSearch.GroupNameAttribute) > 0 {
 		return []string{p.c.GroupSearch.GroupNameAttribute}
 	}
+	return []string{distinguishedNameAttributeName}
+}
+
+// firstPresentAttributeName returns the first of the attributeNames for which the entry has a non-empty value, or
+// the first of the attributeNames when the entry has none of them, so that the caller reports it as missing.
+func firstPresentAttributeName(attributeNames []string, entry *ldap.Entry) string {
+	for _, attributeName := range attributeNames {
+		if hasNonEmptyRawAttributeValue(attributeName, entry) {
+			return attributeName
+		}
+	}
+	return attributeNames[0]
 }
 
+// userSearchFilter returns the user search filter for the given username. The username is always confined to the
+// value of each filter item in which it is interpolated, whatever characters it contains, because it is escaped
+// and because the structure of the filter is decided by the config alone.
 func (p *Provider) userSearchFilter(username string) string {
 	// The username is end user input, so it should be escaped before being included in a search to prevent
 	// query injection.
-	safeUsername := p.escapeForSearchFilter(username)
+	return p.userSearchFilterForSafeValue(p.escapeForSearchFilter(username))
+}
+
+// userSearchFilterForSafeValue interpolates the given value into the user search filter. The caller is responsible
+// for escaping any end user input in the value.
+func (p *Provider) userSearchFilterForSafeValue(safeUsername string) string {
 	if len(p.c.UserSearch.Filter) == 0 {
-		return fmt.Sprintf("(%s=%s)", p.c.UserSearch.UsernameAttribute, safeUsername)
+		if len(p.c.UserSearch.UsernameSearchAttributes) == 0 {
+			return fmt.Sprintf("(%s=%s)", p.c.UserSearch.UsernameAttribute, safeUsername)
+		}
+		if len(p.c.UserSearch.UsernameSearchAttributes) == 1 {
+			return fmt.Sprintf("(%s=%s)", p.c.UserSearch.UsernameSearchAttributes[0], safeUsername)
+		}
+		var filter strings.Builder
+		filter.WriteString("(|")
+		for _, attributeName := range p.c.UserSearch.UsernameSearchAttributes {
+			filter.WriteString(fmt.Sprintf("(%s=%s)", attributeName, safeUsername))
+		}
+		filter.WriteString(")")
+		return filter.String()
+	}
+	if p.c.UserSearch.RawFilter {
+		return strings.ReplaceAll(p.c.UserSearch.Filter, searchFilterInterpolationLocationMarker, safeUsername)
 	}
 	return interpolateSearchFilter(p.c.UserSearch.Filter, safeUsername)
 }
@@ -745,19 +2599,170 @@ func (p *Provider) groupSearchFilter(userDN string) string {
 }
 
 func interpolateSearchFilter(filterFormat, valueToInterpolateIntoFilter string) string {
-	filter := strings.ReplaceAll(filterFormat, searchFilterInterpolationLocationMarker, valueToInterpolateIntoFilter)
-	if strings.HasPrefix(filter, "(") && strings.HasSuffix(filter, ")") {
-		return filter
+	// Decide whether to wrap the filter in parens before interpolating, so the value cannot influence the decision.
+	if !strings.HasPrefix(filterFormat, "(") || !strings.HasSuffix(filterFormat, ")") {
+		filterFormat = "(" + filterFormat + ")"
 	}
-	return "(" + filter + ")"
+	return strings.ReplaceAll(filterFormat, searchFilterInterpolationLocationMarker, valueToInterpolateIntoFilter)
 }
 
 func (p *Provider) escapeForSearchFilter(s string) string {
 	return ldap.EscapeFilter(s)
 }
 
+// userEntryWithoutDNError returns the error for a user entry without a DN, which is more specific than the given
+// error when the DN is also the username, since dn-based configs are common.
+func (p *Provider) userEntryWithoutDNError(username string, err error) error {
+	if p.c.UserSearch.UsernameAttribute == distinguishedNameAttributeName {
+		return fmt.Errorf(`username attribute "dn" resolved to an empty DN for user %q`, username)
+	}
+	return err
+}
+
+// getMappedUsername returns the username of the user, read from the UsernameAttribute.
+func (p *Provider) getMappedUsername(entry *ldap.Entry, username string) (string, error) {
+	if p.skipsEmptyAttributeValue(p.c.UserSearch.UsernameAttribute, entry) {
+		plog.Debug("user search result has an empty value for the username attribute, so falling back to using the DN as the username",
+			"upstreamName", p.GetName(), "usernameAttribute", p.c.UserSearch.UsernameAttribute, "dn", entry.DN)
+		return entry.DN, nil
+	}
+	mappedUsername, err := p.getSearchResultAttributeValue(p.c.UserSearch.UsernameAttribute, entry, username, p.c.TrimAttributeWhitespace)
+	if err != nil {
+		return "", err
+	}
+	mappedUsername = p.stripUsernameDomainSuffix(mappedUsername)
+	if len(mappedUsername) == 0 {
+		return "", fmt.Errorf(`found empty value for attribute %q after removing its domain suffix while searching for user %q, but expected value to be non-empty`,
+			p.c.UserSearch.UsernameAttribute, username)
+	}
+	return mappedUsername, nil
+}
+
+// stripUsernameDomainSuffix removes everything from the last "@" of the username when UsernameStripDomainSuffix
+// is configured.
+func (p *Provider) stripUsernameDomainSuffix(mappedUsername string) string {
+	if !p.c.UserSearch.UsernameStripDomainSuffix {
+		return mappedUsername
+	}
+	if i := strings.LastIndex(mappedUsername, "@"); i >= 0 {
+		return mappedUsername[:i]
+	}
+	return mappedUsername
+}
+
+// getWhoAmIUsername returns the username from the authorization identity of the user to whom the conn is bound,
+// or returns the fallbackUsername when the LDAP server does not support the "Who am I?" operation.
+func (p *Provider) getWhoAmIUsername(conn Conn, username, fallbackUsername string) (string, error) {
+	result, err := conn.WhoAmI(nil)
+	if err != nil {
+		ldapErr := &ldap.Error{}
+		if errors.As(err, &ldapErr) &&
+			(ldapErr.ResultCode == ldap.LDAPResultProtocolError || ldapErr.ResultCode == ldap.LDAPResultUnwillingToPerform) {
+			plog.Debug(`LDAP server does not support the "Who am I?" operation, so using the username attribute instead`,
+				"upstreamName", p.GetName(), "resultCode", ldapErr.ResultCode)
+			return fallbackUsername, nil
+		}
+		return "", fmt.Errorf(`error getting the authorization identity of user %q: %w`, username, err)
+	}
+
+	var authzID string
+	if result != nil {
+		authzID = result.AuthzID
+	}
+	var whoAmIUsername string
+	switch {
+	case authzID == "":
+		plog.Debug(`LDAP server returned an empty authorization identity, so using the username attribute instead`,
+			"upstreamName", p.GetName())
+		return fallbackUsername, nil
+	case strings.HasPrefix(authzID, "u:"):
+		whoAmIUsername = strings.TrimPrefix(authzID, "u:")
+	case strings.HasPrefix(authzID, "dn:"):
+		whoAmIUsername = strings.TrimPrefix(authzID, "dn:")
+	default:
+		return "", fmt.Errorf(`found unsupported authorization identity %q for user %q, but expected "u:" or "dn:" prefix`, authzID, username)
+	}
+
+	whoAmIUsername = p.stripUsernameDomainSuffix(whoAmIUsername)
+	if len(whoAmIUsername) == 0 {
+		return "", fmt.Errorf(`found empty username in authorization identity %q for user %q, but expected username to be non-empty`, authzID, username)
+	}
+	return whoAmIUsername, nil
+}
+
+// getMappedUID returns the encoded unique ID of the user, read from either the UIDAttribute or the UIDAttributeTemplate.
+func (p *Provider) getMappedUID(entry *ldap.Entry, username string) (string, error) {
+	if len(p.c.UserSearch.UIDAttributeTemplate) == 0 {
+		uidAttribute := p.c.UserSearch.UIDAttribute
+		if (p.c.UserSearch.UIDFallbackToDN && !hasNonEmptyRawAttributeValue(uidAttribute, entry)) ||
+			p.skipsEmptyAttributeValue(uidAttribute, entry) {
+			plog.Debug("user search result has no value for the UID attribute, so falling back to using the DN as the UID",
+				"upstreamName", p.GetName(), "uidAttribute", uidAttribute, "dn", entry.DN)
+			uidAttribute = distinguishedNameAttributeName
+		}
+		// We would like to support binary typed attributes for UIDs, so always read them as binary and encode them,
+		// even when the attribute may not be binary.
+		return p.getSearchResultAttributeRawValueEncoded(uidAttribute, entry, username, p.c.TrimUIDAttributeWhitespace)
+	}
+
+	// Replace all placeholders in a single pass, so that attribute values which happen to look like placeholders
+	// are never interpolated themselves.
+	var err error
+	uid := uidAttributeTemplatePlaceholder.ReplaceAllStringFunc(p.c.UserSearch.UIDAttributeTemplate, func(placeholder string) string {
+		if err != nil {
+			return ""
+		}
+		attributeName := uidAttributeTemplatePlaceholder.FindStringSubmatch(placeholder)[1]
+		var value string
+		value, err = p.getSearchResultAttributeValue(attributeName, entry, username, p.c.TrimUIDAttributeWhitespace)
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(uid)), nil
+}
+
+// hasNonEmptyRawAttributeValue returns true when the entry has at least one non-empty value for the attribute.
+func hasNonEmptyRawAttributeValue(attributeName string, entry *ldap.Entry) bool {
+	if attributeName == distinguishedNameAttributeName {
+		return len(entry.DN) > 0
+	}
+	for _, value := range entry.GetRawAttributeValues(attributeName) {
+		if len(value) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// skipsEmptyAttributeValue returns true when the EmptyValuePolicy is EmptyValueSkipToFallback and the entry has
+// exactly one value for the attribute, which is empty.
+func (p *Provider) skipsEmptyAttributeValue(attributeName string, entry *ldap.Entry) bool {
+	if p.c.UserSearch.EmptyValuePolicy != EmptyValueSkipToFallback || attributeName == distinguishedNameAttributeName {
+		return false
+	}
+	values := entry.GetRawAttributeValues(attributeName)
+	return len(values) == 1 && len(values[0]) == 0
+}
+
+// uidAttributeTemplateAttributes returns the unique names of the attributes referenced by the UIDAttributeTemplate,
+// in the order of their first reference.
+func (s UserSearchConfig) uidAttributeTemplateAttributes() []string {
+	var attributeNames []string
+	seen := sets.NewString()
+	for _, match := range uidAttributeTemplatePlaceholder.FindAllStringSubmatch(s.UIDAttributeTemplate, -1) {
+		if !seen.Has(match[1]) {
+			seen.Insert(match[1])
+			attributeNames = append(attributeNames, match[1])
+		}
+	}
+	return attributeNames
+}
+
 // Returns the (potentially) binary data of the attribute's value, base64 URL encoded.
-func (p *Provider) getSearchResultAttributeRawValueEncoded(attributeName string, entry *ldap.Entry, username string) (string, error) {
+func (p *Provider) getSearchResultAttributeRawValueEncoded(attributeName string, entry *ldap.Entry, username string, trimWhitespace bool) (string, error) {
 	if attributeName == distinguishedNameAttributeName {
 		return base64.RawURLEncoding.EncodeToString([]byte(entry.DN)), nil
 	}
@@ -771,6 +2776,9 @@ func (p *Provider) getSearchResultAttributeRawValueEncoded(attributeName string,
 	}
 
 	attributeValue := attributeValues[0]
+	if trimWhitespace {
+		attributeValue = bytes.TrimSpace(attributeValue)
+	}
 	if len(attributeValue) == 0 {
 		return "", fmt.Errorf(`found empty value for attribute %q while searching for user %q, but expected value to be non-empty`,
 			attributeName, username,
@@ -784,7 +2792,17 @@ func (p *Provider) getSearchResultAttributeRawValueEncoded(attributeName string,
 	return base64.RawURLEncoding.EncodeToString(attributeValue), nil
 }
 
-func (p *Provider) getSearchResultAttributeValue(attributeName string, entry *ldap.Entry, username string) (string, error) {
+// getUserBindName returns the name to use for the user's bind, which is the value of the BindDNAttribute, or the DN.
+func (p *Provider) getUserBindName(entry *ldap.Entry, username string) (string, error) {
+	if len(p.c.UserSearch.BindDNAttribute) == 0 {
+		return entry.DN, nil
+	}
+	return p.getSearchResultAttributeValue(p.c.UserSearch.BindDNAttribute, entry, username, false)
+}
+
+// getSearchResultAttributeValue returns the only value of the attribute, optionally without leading and trailing
+// whitespace.
+func (p *Provider) getSearchResultAttributeValue(attributeName string, entry *ldap.Entry, username string, trimWhitespace bool) (string, error) {
 	if attributeName == distinguishedNameAttributeName {
 		return entry.DN, nil
 	}
@@ -798,6 +2816,9 @@ func (p *Provider) getSearchResultAttributeValue(attributeName string, entry *ld
 	}
 
 	attributeValue := attributeValues[0]
+	if trimWhitespace {
+		attributeValue = strings.TrimSpace(attributeValue)
+	}
 	if len(attributeValue) == 0 {
 		return "", fmt.Errorf(`found empty value for attribute %q while searching for user %q, but expected value to be non-empty`,
 			attributeName, username,
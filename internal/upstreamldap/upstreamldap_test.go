@@ -9,15 +9,21 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	ber "github.com/go-asn1-ber/asn1-ber"
 	"github.com/go-ldap/ldap/v3"
 	"github.com/golang/mock/gomock"
+	fuzz "github.com/google/gofuzz"
 	"github.com/stretchr/testify/require"
 	"k8s.io/apiserver/pkg/authentication/user"
 
@@ -26,6 +32,7 @@ import (
 	"go.pinniped.dev/internal/crypto/ptls"
 	"go.pinniped.dev/internal/endpointaddr"
 	"go.pinniped.dev/internal/mocks/mockldapconn"
+	"go.pinniped.dev/internal/oidc/downstreamsession"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/internal/testutil/tlsserver"
@@ -267,6 +274,29 @@ func TestEndUserAuthentication(t *testing.T) {
 				}
 			}),
 		},
+		{
+			name:     "when the user search request has a mutator func",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearchRequestMutator = func(r *ldap.SearchRequest) {
+					r.Controls = append(r.Controls, ldap.NewControlString("1.2.840.113556.1.4.841", true, ""))
+				}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Controls = []ldap.Control{ldap.NewControlString("1.2.840.113556.1.4.841", true, "")}
+				})).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
 		{
 			name:     "when the group search base is empty then skip the group search entirely",
 			username: testUpstreamUsername,
@@ -372,6 +402,72 @@ func TestEndUserAuthentication(t *testing.T) {
 				info.UID = base64.RawURLEncoding.EncodeToString([]byte(testUserSearchResultDNValue))
 			}),
 		},
+		{
+			name:     "when the UIDAttributeTemplate is used instead of the UIDAttribute",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UIDAttribute = ""
+				p.UserSearch.UIDAttributeTemplate = "{sAMAccountName}@{domain}/{dn}/{sAMAccountName}"
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Attributes = []string{testUserSearchUsernameAttribute, "sAMAccountName", "domain"}
+				})).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+								ldap.NewEntryAttribute("sAMAccountName", []string{"some-account-{domain}"}),
+								ldap.NewEntryAttribute("domain", []string{"example.com"}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				// Values which look like placeholders are not interpolated again.
+				info.UID = base64.RawURLEncoding.EncodeToString([]byte(
+					"some-account-{domain}@example.com/" + testUserSearchResultDNValue + "/some-account-{domain}",
+				))
+			}),
+		},
+		{
+			name:     "when an attribute referenced by the UIDAttributeTemplate is missing",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UIDAttribute = ""
+				p.UserSearch.UIDAttributeTemplate = "{sAMAccountName}@{domain}"
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Attributes = []string{testUserSearchUsernameAttribute, "sAMAccountName", "domain"}
+				})).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+								ldap.NewEntryAttribute("sAMAccountName", []string{"some-account"}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`found 0 values for attribute "domain" while searching for user "%s", but expected 1 result`, testUpstreamUsername),
+		},
 		{
 			name:     "when the GroupNameAttribute is empty then it defaults to dn",
 			username: testUpstreamUsername,
@@ -458,6 +554,85 @@ func TestEndUserAuthentication(t *testing.T) {
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
+		{
+			name:     "when there are GroupNameAttributes, each group name comes from the first attribute which the group has",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.GroupNameAttribute = ""
+				p.GroupSearch.GroupNameAttributes = []string{"cn", "name"}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Attributes = []string{"cn", "name"}
+				}), expectedGroupSearchPageSize).
+					Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{
+							{
+								DN: testGroupSearchResultDNValue1,
+								Attributes: []*ldap.EntryAttribute{
+									ldap.NewEntryAttribute("cn", []string{testGroupSearchResultGroupNameAttributeValue1}),
+									ldap.NewEntryAttribute("name", []string{"not-used-because-cn-comes-first"}),
+								},
+							},
+							{
+								DN: testGroupSearchResultDNValue2,
+								Attributes: []*ldap.EntryAttribute{
+									ldap.NewEntryAttribute("name", []string{testGroupSearchResultGroupNameAttributeValue2}),
+								},
+							},
+							{
+								DN: "cn=some-other-group,ou=groups,dc=pinniped,dc=dev",
+								Attributes: []*ldap.EntryAttribute{
+									ldap.NewEntryAttribute("cn", []string{""}), // empty, so name is used instead
+									ldap.NewEntryAttribute("name", []string{testGroupSearchResultGroupNameAttributeValue1}),
+								},
+							},
+						},
+						Referrals: []string{}, // note that we are not following referrals at this time
+						Controls:  []ldap.Control{},
+					}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil), // the duplicate group name is only included once
+		},
+		{
+			name:     "when there are GroupNameAttributes and a group has none of them",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.GroupNameAttribute = ""
+				p.GroupSearch.GroupNameAttributes = []string{"cn", "name"}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Attributes = []string{"cn", "name"}
+				}), expectedGroupSearchPageSize).
+					Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{
+							{
+								DN: testGroupSearchResultDNValue1,
+								Attributes: []*ldap.EntryAttribute{
+									ldap.NewEntryAttribute("displayName", []string{testGroupSearchResultGroupNameAttributeValue1}),
+								},
+							},
+						},
+						Referrals: []string{}, // note that we are not following referrals at this time
+						Controls:  []ldap.Control{},
+					}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(
+				`error searching for group memberships for user with DN "%s": found 0 values for attribute "cn" while searching for user "%s", but expected 1 result`,
+				testUserSearchResultDNValue, testUserSearchResultDNValue),
+		},
 		{
 			name:     "when user search Filter is blank it derives a search filter from the UsernameAttribute",
 			username: testUpstreamUsername,
@@ -479,6 +654,67 @@ func TestEndUserAuthentication(t *testing.T) {
 			},
 			wantAuthResponse: expectedAuthResponse(nil),
 		},
+		{
+			name:     "when user search Filter is blank and there are multiple UsernameSearchAttributes it derives an OR search filter",
+			username: `a&b|c(d)e\f*g`,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = ""
+				p.UserSearch.UsernameSearchAttributes = []string{"sAMAccountName", "userPrincipalName"}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Filter = fmt.Sprintf("(|(sAMAccountName=%s)(userPrincipalName=%s))", `a&b|c\28d\29e\5cf\2ag`, `a&b|c\28d\29e\5cf\2ag`)
+				})).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			// The username is still mapped from the UsernameAttribute.
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when user search Filter is blank and there is one UsernameSearchAttribute it derives a search filter from it",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = ""
+				p.UserSearch.UsernameAttribute = "dn"
+				p.UserSearch.UsernameSearchAttributes = []string{"sAMAccountName"}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Filter = "(sAMAccountName=" + testUpstreamUsername + ")"
+					r.Attributes = []string{testUserSearchUIDAttribute}
+				})).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.Name = testUserSearchResultDNValue
+			}),
+		},
+		{
+			name:     "when the UsernameSearchAttributes contain dn",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = ""
+				p.UserSearch.UsernameSearchAttributes = []string{"sAMAccountName", "dn"}
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch UsernameSearchAttributes must not contain "dn"`,
+		},
 		{
 			name:     "when group search Filter is blank it uses a default search filter of member={}",
 			username: testUpstreamUsername,
@@ -721,6 +957,72 @@ func TestEndUserAuthentication(t *testing.T) {
 			dialError:      errors.New("some dial error"),
 			wantError:      fmt.Sprintf(`error dialing host "%s": some dial error`, testHost),
 		},
+		{
+			name:     "when the user search filter is raw then it is used verbatim without being wrapped by parenthesis",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = " (|(a={})(b={})) "
+				p.UserSearch.RawFilter = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Filter = fmt.Sprintf(" (|(a=%s)(b=%s)) ", testUpstreamUsername, testUpstreamUsername)
+				})).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when the user search filter is raw then the username is still escaped",
+			username: testUserDNWithSpecialChars,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = "uid={}"
+				p.UserSearch.RawFilter = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Filter = "uid=" + testUserDNWithSpecialCharsEscaped
+				})).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when the user search filter is raw and does not contain the placeholder",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = "(objectClass=person)"
+				p.UserSearch.RawFilter = true
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch Filter must contain "{}" when UserSearch RawFilter is true`,
+		},
+		{
+			name:     "when the user search filter is raw and empty",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Filter = ""
+				p.UserSearch.RawFilter = true
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch Filter must contain "{}" when UserSearch RawFilter is true`,
+		},
 		{
 			name:     "when the UsernameAttribute is dn and there is not a user search filter provided",
 			username: testUpstreamUsername,
@@ -732,6 +1034,40 @@ func TestEndUserAuthentication(t *testing.T) {
 			wantToSkipDial: true,
 			wantError:      `must specify UserSearch Filter when UserSearch UsernameAttribute is "dn"`,
 		},
+		{
+			name:     "when the UIDAttributeTemplate does not reference any attributes",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UIDAttributeTemplate = "some-constant-{}"
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch UIDAttributeTemplate "some-constant-{}" must reference at least one attribute using "{attributeName}"`,
+		},
+		{
+			name:     "when non-DN attributes are required but the username and UID are both taken from the DN",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameAttribute = "dn"
+				p.UserSearch.UIDAttribute = "dn"
+				p.UserSearch.RequireNonDNAttribute = true
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch RequireNonDNAttribute is true, but both the username and the UID are taken from "dn"`,
+		},
+		{
+			name:     "when non-DN attributes are required but the UID template only references the DN",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameAttribute = "dn"
+				p.UserSearch.UIDAttributeTemplate = "{dn}"
+				p.UserSearch.RequireNonDNAttribute = true
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch RequireNonDNAttribute is true, but both the username and the UID are taken from "dn"`,
+		},
 		{
 			name:           "when binding as the bind user returns an error",
 			username:       testUpstreamUsername,
@@ -755,6 +1091,191 @@ func TestEndUserAuthentication(t *testing.T) {
 			},
 			wantError: `error searching for user: some user search error`,
 		},
+		{
+			name:     "when searching for the user returns a network error and retrying on stale connections is enabled",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(2)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when searching for the user returns a network error twice and retrying on stale connections is enabled",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(2)
+				conn.EXPECT().Close().Times(2)
+			},
+			wantError: `error searching for user: LDAP Result Code 200 "Network Error": some network error`,
+		},
+		{
+			name:           "when searching for the user returns a network error and retrying on stale connections is not enabled",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error searching for user: LDAP Result Code 200 "Network Error": some network error`,
+		},
+		{
+			name:     "when searching for the user returns an error which is not a network error and retrying on stale connections is enabled",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, ldap.NewError(ldap.LDAPResultBusy, errors.New("some busy error"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error searching for user: LDAP Result Code 51 "Busy": some busy error`,
+		},
+		{
+			name:     "when binding as the bind user returns a network error and retrying on stale connections is enabled",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error binding as "%s" before user search: LDAP Result Code 200 "Network Error": some network error`, testBindUsername),
+		},
+		{
+			name:           "when searching for the user returns a referral",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).
+					Return(nil, ldap.NewError(ldap.LDAPResultReferral, errors.New("some referral"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error searching for user: the LDAP server returned a referral, which is not followed; ` +
+				`please check that the search base DN belongs to the naming context of the configured host ` +
+				`(e.g. use a Global Catalog host for cross-domain Active Directory searches): ` +
+				`LDAP Result Code 10 "Referral": some referral`,
+		},
+		{
+			name:           "when searching for the user's groups returns a referral",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(nil, ldap.NewError(ldap.LDAPResultReferral, errors.New("some referral"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for group memberships for user with DN "%s": `+
+				`the LDAP server returned a referral, which is not followed; `+
+				`please check that the search base DN belongs to the naming context of the configured host `+
+				`(e.g. use a Global Catalog host for cross-domain Active Directory searches): `+
+				`LDAP Result Code 10 "Referral": some referral`, testUserSearchResultDNValue),
+		},
+		{
+			name:     "when searching for the user returns an entry which is larger than the configured maximum size",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.MaxEntrySizeBytes = 100
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for user: the LDAP server returned an entry with DN "%s" `+
+				`whose attributes are 110 bytes, which exceeds the maximum of 100 bytes`, testUserSearchResultDNValue),
+		},
+		{
+			name:           "when searching for the user's groups returns an entry which is larger than the default maximum size",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{
+							{
+								DN: testGroupSearchResultDNValue1,
+								Attributes: []*ldap.EntryAttribute{
+									{Name: testGroupSearchGroupNameAttribute, ByteValues: [][]byte{make([]byte, 1024*1024)}},
+								},
+							},
+						},
+					}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for group memberships for user with DN "%s": `+
+				`the LDAP server returned an entry with DN "%s" whose attributes are 1048610 bytes, which exceeds the maximum of 1048576 bytes`,
+				testUserSearchResultDNValue, testGroupSearchResultDNValue1),
+		},
+		{
+			name:     "when searching for the user returns an entry which has more attributes than the configured maximum",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.MaxEntryAttributes = 1
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for user: the LDAP server returned an entry with DN "%s" `+
+				`which has 2 attributes, which exceeds the maximum of 1 attributes`, testUserSearchResultDNValue),
+		},
+		{
+			name:           "when searching for the user's groups returns an entry which has more attributes than the default maximum",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				attributes := []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+				}
+				for i := 0; i < 100; i++ {
+					attributes = append(attributes, ldap.NewEntryAttribute(fmt.Sprintf("operationalAttribute%d", i), []string{"some-value"}))
+				}
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{{DN: testGroupSearchResultDNValue1, Attributes: attributes}},
+					}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`error searching for group memberships for user with DN "%s": `+
+				`the LDAP server returned an entry with DN "%s" which has 101 attributes, which exceeds the maximum of 100 attributes`,
+				testUserSearchResultDNValue, testGroupSearchResultDNValue1),
+		},
 		{
 			name:           "when searching for the user's groups returns an error",
 			username:       testUpstreamUsername,
@@ -769,6 +1290,110 @@ func TestEndUserAuthentication(t *testing.T) {
 			},
 			wantError: fmt.Sprintf(`error searching for group memberships for user with DN "%s": some group search error`, testUserSearchResultDNValue),
 		},
+		{
+			name:     "when a group allowlist is configured",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.GroupAllowlist = []string{testGroupSearchResultGroupNameAttributeValue2, "some-other-group"}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				r.User.(*user.DefaultInfo).Groups = []string{testGroupSearchResultGroupNameAttributeValue2}
+			}),
+		},
+		{
+			name:     "when a group allowlist is configured and none of the user's groups are allowed",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.GroupAllowlist = []string{"some-other-group"}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				r.User.(*user.DefaultInfo).Groups = []string{}
+			}),
+		},
+		{
+			name:     "when the user has more groups than the configured maximum",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.MaxGroups = 1
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().Search(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Controls = []ldap.Control{ldap.NewControlPaging(expectedGroupSearchPageSize)}
+				})).Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				r.User.(*user.DefaultInfo).Groups = []string{testGroupSearchResultGroupNameAttributeValue1}
+			}),
+		},
+		{
+			name:     "when searching for the user's groups returns an error and group search is configured to fail open",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.FailOpen = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(nil, errors.New("some group search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				r.User.(*user.DefaultInfo).Groups = []string{}
+			}),
+		},
+		{
+			name:     "when searching for the user's groups returns an error and group search is configured to fail open, but the user's bind fails",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.FailOpen = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(nil, errors.New("some group search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).
+					Return(ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))).Times(1)
+			},
+			wantUnauthenticated:        true,
+			skipDryRunAuthenticateUser: true,
+		},
 		{
 			name:           "when searching for the user returns no results",
 			username:       testUpstreamUsername,
@@ -816,6 +1441,26 @@ func TestEndUserAuthentication(t *testing.T) {
 			},
 			wantError: fmt.Sprintf(`searching for user "%s" resulted in search result without DN`, testUpstreamUsername),
 		},
+		{
+			name:     "when searching for the user returns a user without a DN and the DN is the username",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameAttribute = "dn"
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.Attributes = []string{testUserSearchUIDAttribute}
+				})).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{DN: ""},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`username attribute "dn" resolved to an empty DN for user "%s"`, testUpstreamUsername),
+		},
 		{
 			name:           "when searching for the user's groups returns a group without a DN",
 			username:       testUpstreamUsername,
@@ -1026,10 +1671,12 @@ func TestEndUserAuthentication(t *testing.T) {
 				testUserSearchResultDNValue, testGroupSearchGroupNameAttribute, testUserSearchResultDNValue),
 		},
 		{
-			name:           "when searching for the user returns a user without an expected UID attribute",
-			username:       testUpstreamUsername,
-			password:       testUpstreamPassword,
-			providerConfig: providerConfig(nil),
+			name:     "when searching for the user returns a user without the UID attribute and UIDFallbackToDN is enabled",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UIDFallbackToDN = true
+			}),
 			searchMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
 				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
@@ -1042,15 +1689,25 @@ func TestEndUserAuthentication(t *testing.T) {
 						},
 					},
 				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantError: fmt.Sprintf(`found 0 values for attribute "%s" while searching for user "%s", but expected 1 result`, testUserSearchUIDAttribute, testUpstreamUsername),
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.UID = base64.RawURLEncoding.EncodeToString([]byte(testUserSearchResultDNValue))
+			}),
 		},
 		{
-			name:           "when searching for the user returns a user with too many values for the expected UID attribute",
-			username:       testUpstreamUsername,
-			password:       testUpstreamPassword,
-			providerConfig: providerConfig(nil),
+			name:     "when searching for the user returns a user with an empty UID attribute and UIDFallbackToDN is enabled",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UIDFallbackToDN = true
+			}),
 			searchMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
 				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
@@ -1059,7 +1716,110 @@ func TestEndUserAuthentication(t *testing.T) {
 							DN: testUserSearchResultDNValue,
 							Attributes: []*ldap.EntryAttribute{
 								ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
-								ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{
+								ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{""}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.UID = base64.RawURLEncoding.EncodeToString([]byte(testUserSearchResultDNValue))
+			}),
+		},
+		{
+			name:     "when searching for the user returns a user with empty username and UID attributes and the empty value policy is to skip to the fallback",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.EmptyValuePolicy = EmptyValueSkipToFallback
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{""}),
+								ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{""}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.Name = testUserSearchResultDNValue
+				info.UID = base64.RawURLEncoding.EncodeToString([]byte(testUserSearchResultDNValue))
+			}),
+		},
+		{
+			name:     "when UIDFallbackToDN is enabled but the UID attribute is present then it is used",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UIDFallbackToDN = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:           "when searching for the user returns a user without an expected UID attribute",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`found 0 values for attribute "%s" while searching for user "%s", but expected 1 result`, testUserSearchUIDAttribute, testUpstreamUsername),
+		},
+		{
+			name:           "when searching for the user returns a user with too many values for the expected UID attribute",
+			username:       testUpstreamUsername,
+			password:       testUpstreamPassword,
+			providerConfig: providerConfig(nil),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+								ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{
 									testUserSearchResultUIDAttributeValue,
 									"unexpected-additional-value",
 								}),
@@ -1151,6 +1911,184 @@ func TestEndUserAuthentication(t *testing.T) {
 				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Return(err).Times(1)
 			},
 		},
+		{
+			name:     "when the username comes from a u: authorization identity",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{AuthzID: "u:some-canonical-username"}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				r.User.(*user.DefaultInfo).Name = "some-canonical-username"
+			}),
+			skipDryRunAuthenticateUser: true, // DryRunAuthenticateUser() uses the username attribute instead
+		},
+		{
+			name:     "when the username comes from a dn: authorization identity with its domain suffix stripped",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+				p.UserSearch.UsernameStripDomainSuffix = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{AuthzID: "dn:cn=some-canonical-username@example.com"}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				r.User.(*user.DefaultInfo).Name = "cn=some-canonical-username"
+			}),
+			skipDryRunAuthenticateUser: true, // DryRunAuthenticateUser() uses the username attribute instead
+		},
+		{
+			name:     "when the LDAP server does not support the who am I operation",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().WhoAmI(nil).Return(nil, ldap.NewError(ldap.LDAPResultProtocolError, errors.New("some whoami error"))).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when the who am I operation returns an empty authorization identity",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{AuthzID: ""}, nil).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(nil),
+		},
+		{
+			name:     "when the who am I operation returns an unsupported authorization identity",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{AuthzID: "some-authzid"}, nil).Times(1)
+			},
+			wantError:                  fmt.Sprintf(`found unsupported authorization identity "some-authzid" for user "%s", but expected "u:" or "dn:" prefix`, testUpstreamUsername),
+			skipDryRunAuthenticateUser: true, // DryRunAuthenticateUser() uses the username attribute instead
+		},
+		{
+			name:     "when the who am I operation fails",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().WhoAmI(nil).Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(1)
+			},
+			wantError:                  fmt.Sprintf(`error getting the authorization identity of user "%s": LDAP Result Code 200 "Network Error": some network error`, testUpstreamUsername),
+			skipDryRunAuthenticateUser: true, // DryRunAuthenticateUser() uses the username attribute instead
+		},
+		{
+			name:     "when there is an identity transform",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.IdentityTransform = func(r *authenticators.Response) error {
+					info := r.User.(*user.DefaultInfo)
+					info.Name = "some-prefix:" + info.Name
+					info.Groups = append(info.Groups[1:], "some-synthetic-group")
+					return nil
+				}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantAuthResponse: expectedAuthResponse(func(r *authenticators.Response) {
+				info := r.User.(*user.DefaultInfo)
+				info.Name = "some-prefix:" + testUserSearchResultUsernameAttributeValue
+				info.Groups = []string{testGroupSearchResultGroupNameAttributeValue2, "some-synthetic-group"}
+			}),
+		},
+		{
+			name:     "when the identity transform returns an error",
+			username: testUpstreamUsername,
+			password: testUpstreamPassword,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.IdentityTransform = func(r *authenticators.Response) error {
+					return errors.New("some transform error")
+				}
+			}),
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(exampleUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).
+					Return(exampleGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			bindEndUserMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			},
+			wantError: fmt.Sprintf(`error transforming identity of user "%s": some transform error`, testUpstreamUsername),
+		},
 		{
 			name:                "when no username is specified",
 			username:            "",
@@ -1243,108 +2181,25 @@ func TestEndUserAuthentication(t *testing.T) {
 	}
 }
 
-func TestUpstreamRefresh(t *testing.T) {
-	pwdLastSetAttribute := "pwdLastSet"
-
-	expectedUserSearch := func(editFunc func(r *ldap.SearchRequest)) *ldap.SearchRequest {
-		request := &ldap.SearchRequest{
-			BaseDN:       testUserSearchResultDNValue,
-			Scope:        ldap.ScopeBaseObject,
-			DerefAliases: ldap.NeverDerefAliases,
-			SizeLimit:    2,
-			TimeLimit:    90,
-			TypesOnly:    false,
-			Filter:       "(objectClass=*)",
-			Attributes:   []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute, pwdLastSetAttribute},
-			Controls:     nil, // don't need paging because we set the SizeLimit so small
-		}
-		if editFunc != nil {
-			editFunc(request)
-		}
-		return request
-	}
-
-	expectedGroupSearch := func(editFunc func(r *ldap.SearchRequest)) *ldap.SearchRequest {
-		request := &ldap.SearchRequest{
-			BaseDN:       testGroupSearchBase,
-			Scope:        ldap.ScopeWholeSubtree,
-			DerefAliases: ldap.NeverDerefAliases,
-			SizeLimit:    0, // unlimited size because we will search with paging
-			TimeLimit:    90,
-			TypesOnly:    false,
-			Filter:       testGroupSearchFilterInterpolated,
-			Attributes:   []string{testGroupSearchGroupNameAttribute},
-			Controls:     nil, // nil because ldap.SearchWithPaging() will set the appropriate controls for us
-		}
-		if editFunc != nil {
-			editFunc(request)
-		}
-		return request
-	}
-
-	happyPathUserSearchResult := &ldap.SearchResult{
-		Entries: []*ldap.Entry{
-			{
-				DN: testUserSearchResultDNValue,
-				Attributes: []*ldap.EntryAttribute{
-					{
-						Name:   testUserSearchUsernameAttribute,
-						Values: []string{testUserSearchResultUsernameAttributeValue},
-					},
-					{
-						Name:       testUserSearchUIDAttribute,
-						ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-					},
-					{
-						Name:       pwdLastSetAttribute,
-						Values:     []string{"132801740800000000"},
-						ByteValues: [][]byte{[]byte("132801740800000000")},
-					},
-				},
-			},
-		},
-	}
-
-	happyPathGroupSearchResult := &ldap.SearchResult{
-		Entries: []*ldap.Entry{
-			{
-				DN: testGroupSearchResultDNValue1,
-				Attributes: []*ldap.EntryAttribute{
-					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
-				},
-			},
-			{
-				DN: testGroupSearchResultDNValue2,
-				Attributes: []*ldap.EntryAttribute{
-					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue2}),
-				},
-			},
-		},
-		Referrals: []string{}, // note that we are not following referrals at this time
-		Controls:  []ldap.Control{},
-	}
-
+func TestDryRunResolveGroups(t *testing.T) {
 	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
 		config := &ProviderConfig{
 			Name:               "some-provider-name",
 			Host:               testHost,
-			CABundle:           nil, // this field is only used by the production dialer, which is replaced by a mock for this test
 			ConnectionProtocol: TLS,
 			BindUsername:       testBindUsername,
 			BindPassword:       testBindPassword,
 			UserSearch: UserSearchConfig{
 				Base:              testUserSearchBase,
-				UIDAttribute:      testUserSearchUIDAttribute,
+				Filter:            testUserSearchFilter,
 				UsernameAttribute: testUserSearchUsernameAttribute,
+				UIDAttribute:      testUserSearchUIDAttribute,
 			},
 			GroupSearch: GroupSearchConfig{
 				Base:               testGroupSearchBase,
 				Filter:             testGroupSearchFilter,
 				GroupNameAttribute: testGroupSearchGroupNameAttribute,
 			},
-			RefreshAttributeChecks: map[string]func(*ldap.Entry, provider.RefreshAttributes) error{
-				pwdLastSetAttribute: AttributeUnchangedSinceLogin(pwdLastSetAttribute),
-			},
 		}
 		if editFunc != nil {
 			editFunc(config)
@@ -1352,526 +2207,3227 @@ func TestUpstreamRefresh(t *testing.T) {
 		return config
 	}
 
+	expectedUserSearch := &ldap.SearchRequest{
+		BaseDN:       testUserSearchBase,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       testUserSearchFilterInterpolated,
+		Attributes:   []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute},
+	}
+
+	expectedGroupSearch := &ldap.SearchRequest{
+		BaseDN:       testGroupSearchBase,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    0,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       testGroupSearchFilterInterpolated,
+		Attributes:   []string{testGroupSearchGroupNameAttribute},
+	}
+
+	// The user entry has no username or UID attributes, which does not matter when only resolving groups.
+	userSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue}},
+	}
+
+	groupSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testGroupSearchResultDNValue1,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+				},
+			},
+			{
+				DN: testGroupSearchResultDNValue2,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue2}),
+				},
+			},
+		},
+	}
+
 	tests := []struct {
 		name           string
+		username       string
 		providerConfig *ProviderConfig
-		grantedScopes  []string
 		setupMocks     func(conn *mockldapconn.MockConn)
-		refreshUserDN  string
-		dialError      error
-		wantErr        string
+		wantToSkipDial bool
 		wantGroups     []string
+		wantError      string
+		wantNotFound   bool
 	}{
 		{
-			name: "happy path without group search where searching the dn returns a single entry",
-			providerConfig: providerConfig(func(p *ProviderConfig) {
-				p.GroupSearch = GroupSearchConfig{}
-			}),
-			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
-				conn.EXPECT().Close().Times(1)
-			},
-			wantGroups: []string{},
-		},
-		{
-			name:           "happy path where group search returns groups",
+			name:           "happy path",
+			username:       testUpstreamUsername,
 			providerConfig: providerConfig(nil),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
-				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(groupSearchResult, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
 			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
 		},
 		{
-			name:           "happy path when the user DN has special LDAP search filter characters then they must be properly escaped in the custom group search filter",
-			providerConfig: providerConfig(nil),
-			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
-					r.BaseDN = testUserDNWithSpecialChars
-				})).
-					Return(&ldap.SearchResult{
-						Entries: []*ldap.Entry{
-							{
-								DN: testUserDNWithSpecialChars,
-								Attributes: []*ldap.EntryAttribute{
-									{
-										Name:   testUserSearchUsernameAttribute,
-										Values: []string{testUserSearchResultUsernameAttributeValue},
-									},
-									{
-										Name:       testUserSearchUIDAttribute,
-										ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-									},
-									{
-										Name:       pwdLastSetAttribute,
-										Values:     []string{"132801740800000000"},
-										ByteValues: [][]byte{[]byte("132801740800000000")},
-									},
-								},
-							},
-						},
-					}, nil).Times(1)
-				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
-					r.Filter = fmt.Sprintf("(some-group-filter=%s-and-more-filter=%s)", testUserDNWithSpecialCharsEscaped, testUserDNWithSpecialCharsEscaped)
-				}), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
-				conn.EXPECT().Close().Times(1)
-			},
-			refreshUserDN: testUserDNWithSpecialChars,
-			wantGroups:    []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
-		},
-		{
-			name: "when the user DN has special LDAP search filter characters then they must be properly escaped in the default group search filter",
+			name:     "when group search is not configured",
+			username: testUpstreamUsername,
 			providerConfig: providerConfig(func(p *ProviderConfig) {
-				p.GroupSearch.Filter = ""
+				p.GroupSearch = GroupSearchConfig{}
 			}),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
-					r.BaseDN = testUserDNWithSpecialChars
-				})).
-					Return(&ldap.SearchResult{
-						Entries: []*ldap.Entry{
-							{
-								DN: testUserDNWithSpecialChars,
-								Attributes: []*ldap.EntryAttribute{
-									{
-										Name:   testUserSearchUsernameAttribute,
-										Values: []string{testUserSearchResultUsernameAttributeValue},
-									},
-									{
-										Name:       testUserSearchUIDAttribute,
-										ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-									},
-									{
-										Name:       pwdLastSetAttribute,
-										Values:     []string{"132801740800000000"},
-										ByteValues: [][]byte{[]byte("132801740800000000")},
-									},
-								},
-							},
-						},
-					}, nil).Times(1)
-				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
-					r.Filter = fmt.Sprintf("(member=%s)", testUserDNWithSpecialCharsEscaped)
-				}), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
-				conn.EXPECT().Close().Times(1)
-			},
-			refreshUserDN: testUserDNWithSpecialChars,
-			wantGroups:    []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
-		},
-		{
-			name:           "happy path where group search returns no groups",
-			providerConfig: providerConfig(nil),
-			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
-				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(&ldap.SearchResult{
-					Entries:   []*ldap.Entry{},
-					Referrals: []string{}, // note that we are not following referrals at this time
-					Controls:  []ldap.Control{},
-				}, nil).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(userSearchResult, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
 			wantGroups: []string{},
 		},
 		{
-			name: "happy path where group search is configured but skipGroupRefresh is set",
+			name:     "when the group search fails, even when configured to fail open",
+			username: testUpstreamUsername,
 			providerConfig: providerConfig(func(p *ProviderConfig) {
-				p.GroupSearch.SkipGroupRefresh = true
+				p.GroupSearch.FailOpen = true
 			}),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1) // note that group search is not expected
+				conn.EXPECT().Search(expectedUserSearch).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(nil, errors.New("some group search error")).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantGroups: nil, // do not update groups
+			wantError: fmt.Sprintf(`error searching for group memberships for user with DN "%s": some group search error`, testUserSearchResultDNValue),
 		},
 		{
-			name:           "happy path where group search is configured but groups scope isn't included",
+			name:           "when the user is not found",
+			username:       testUpstreamUsername,
 			providerConfig: providerConfig(nil),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().Search(expectedUserSearch).Return(&ldap.SearchResult{}, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			grantedScopes: []string{},
-			wantGroups:    nil,
-		},
-		{
-			name:           "error where dial fails",
-			providerConfig: providerConfig(nil),
-			dialError:      errors.New("some dial error"),
-			wantErr:        "error dialing host \"ldap.example.com:8443\": some dial error",
+			wantError:    fmt.Sprintf(`user not found: "%s"`, testUpstreamUsername),
+			wantNotFound: true,
 		},
 		{
-			name:           "error binding",
+			name:           "when the username is empty",
+			username:       "",
 			providerConfig: providerConfig(nil),
-			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
-				conn.EXPECT().Close().Times(1)
-			},
-			wantErr: "error binding as \"cn=some-bind-username,dc=pinniped,dc=dev\" before user search: some bind error",
+			wantToSkipDial: true,
+			wantError:      "user not found: empty username",
+			wantNotFound:   true,
 		},
 		{
-			name:           "search result returns no entries",
+			name:           "when more than one user is found",
+			username:       testUpstreamUsername,
 			providerConfig: providerConfig(nil),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{},
+				conn.EXPECT().Search(expectedUserSearch).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue}, {DN: "some-other-dn"}},
 				}, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "searching for user \"some-upstream-user-dn\" resulted in 0 search results, but expected 1 result",
+			wantError: fmt.Sprintf(`searching for user "%s" resulted in 2 search results, but expected 1 result`, testUpstreamUsername),
 		},
 		{
-			name:           "error searching",
+			name:           "when binding as the bind user fails",
+			username:       testUpstreamUsername,
 			providerConfig: providerConfig(nil),
 			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, errors.New("some search error"))
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "error searching for user \"some-upstream-user-dn\": some search error",
+			wantError: fmt.Sprintf(`error binding as "%s" before user search: some bind error`, testBindUsername),
 		},
-		{
-			name:           "search result returns more than one entry",
-			providerConfig: providerConfig(nil),
-			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN:         testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{},
-						},
-						{
-							DN:         "doesn't-matter",
-							Attributes: []*ldap.EntryAttribute{},
-						},
-					},
-				}, nil).Times(1)
-				conn.EXPECT().Close().Times(1)
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			dialWasAttempted := false
+			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				dialWasAttempted = true
+				return conn, nil
+			})
+
+			groups, err := New(*tt.providerConfig).DryRunResolveGroups(context.Background(), tt.username)
+			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.Equal(t, tt.wantNotFound, errors.Is(err, ErrUserNotFound))
+				require.Nil(t, groups)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantGroups, groups)
+		})
+	}
+}
+
+func TestTestGroupSearch(t *testing.T) {
+	// TestGroupSearch parses the user DN before it dials, so this must be a real DN.
+	const userDN = "cn=some-user,dc=pinniped,dc=dev"
+
+	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
+		config := &ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch: UserSearchConfig{
+				Base:              testUserSearchBase,
+				Filter:            testUserSearchFilter,
+				UsernameAttribute: testUserSearchUsernameAttribute,
+				UIDAttribute:      testUserSearchUIDAttribute,
+			},
+			GroupSearch: GroupSearchConfig{
+				Base:               testGroupSearchBase,
+				Filter:             testGroupSearchFilter,
+				GroupNameAttribute: testGroupSearchGroupNameAttribute,
+			},
+		}
+		if editFunc != nil {
+			editFunc(config)
+		}
+		return config
+	}
+
+	expectedGroupSearch := &ldap.SearchRequest{
+		BaseDN:       testGroupSearchBase,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    0,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       fmt.Sprintf("(some-group-filter=%s-and-more-filter=%s)", userDN, userDN),
+		Attributes:   []string{testGroupSearchGroupNameAttribute},
+	}
+
+	groupSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testGroupSearchResultDNValue1,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+				},
 			},
-			wantErr: "searching for user \"some-upstream-user-dn\" resulted in 2 search results, but expected 1 result",
 		},
+	}
+
+	tests := []struct {
+		name           string
+		userDN         string
+		providerConfig *ProviderConfig
+		setupMocks     func(conn *mockldapconn.MockConn)
+		wantToSkipDial bool
+		wantGroups     []string
+		wantError      string
+		wantErrorKind  ConnectionErrorKind
+	}{
 		{
-			name:           "search result has wrong uid",
+			name:           "happy path, which does not search for the user",
+			userDN:         userDN,
 			providerConfig: providerConfig(nil),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{testUserSearchResultUsernameAttributeValue},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{[]byte("wrong-uid")},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(groupSearchResult, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "searching for user \"some-upstream-user-dn\" produced a different subject than the previous value. expected: \"ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=c29tZS11cHN0cmVhbS11aWQtdmFsdWU\", actual: \"ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=d3JvbmctdWlk\"",
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1},
 		},
 		{
-			name:           "search result has wrong username",
+			name:   "when group search is not configured",
+			userDN: userDN,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch = GroupSearchConfig{}
+			}),
+			wantToSkipDial: true,
+			wantError:      "cannot test the group search because the GroupSearch Base is not configured",
+		},
+		{
+			name:           "when the user DN is empty",
+			userDN:         "",
+			providerConfig: providerConfig(nil),
+			wantToSkipDial: true,
+			wantError:      "cannot test the group search because the user DN is empty",
+		},
+		{
+			name:           "when the user DN is not a DN",
+			userDN:         "some-username",
 			providerConfig: providerConfig(nil),
+			wantToSkipDial: true,
+			wantError:      `cannot test the group search because "some-username" is not a valid DN: DN ended with incomplete type, value pair`,
+		},
+		{
+			name:   "when the group search fails, even when configured to fail open",
+			userDN: userDN,
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.FailOpen = true
+			}),
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{"wrong-username"},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch, expectedGroupSearchPageSize).Return(nil, errors.New("some group search error")).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "searching for user \"some-upstream-user-dn\" returned a different username than the previous value. expected: \"some-upstream-username-value\", actual: \"wrong-username\"",
+			wantError: fmt.Sprintf(`error searching for group memberships for user with DN "%s": some group search error`, userDN),
 		},
 		{
-			name:           "search result has no dn",
+			name:           "when binding as the bind user fails",
+			userDN:         userDN,
 			providerConfig: providerConfig(nil),
 			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{testUserSearchResultUsernameAttributeValue},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "searching for user with original DN \"some-upstream-user-dn\" resulted in search result without DN",
+			wantError:     fmt.Sprintf(`error binding as "%s": some bind error`, testBindUsername),
+			wantErrorKind: BindFailed,
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			dialWasAttempted := false
+			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				dialWasAttempted = true
+				return conn, nil
+			})
+
+			groups, err := New(*tt.providerConfig).TestGroupSearch(context.Background(), tt.userDN)
+			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				if tt.wantErrorKind != "" {
+					connectionErr := &ConnectionError{}
+					require.ErrorAs(t, err, &connectionErr)
+					require.Equal(t, tt.wantErrorKind, connectionErr.Kind)
+				}
+				require.Nil(t, groups)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantGroups, groups)
+		})
+	}
+}
+
+func TestEndUserAuthenticationDebugTimings(t *testing.T) {
+	userSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+				},
+			},
 		},
+	}
+
+	tests := []struct {
+		name          string
+		debugTimings  bool
+		grantedScopes []string
+		editConfig    func(p *ProviderConfig)
+		setupMocks    func(conn *mockldapconn.MockConn)
+		wantSteps     []string
+	}{
 		{
-			name:           "search result has 0 values for username attribute",
-			providerConfig: providerConfig(nil),
+			name: "not enabled",
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "found 0 values for attribute \"some-upstream-username-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
 		},
 		{
-			name:           "search result has more than one value for username attribute",
-			providerConfig: providerConfig(nil),
+			name:         "without the groups scope, so there is no group search",
+			debugTimings: true,
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{testUserSearchResultUsernameAttributeValue, "something-else"},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "found 2 values for attribute \"some-upstream-username-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+			wantSteps: []string{"dial", "bind", "search", "user-bind"},
 		},
 		{
-			name:           "search result has 0 values for uid attribute",
-			providerConfig: providerConfig(nil),
+			name:          "with a group search",
+			debugTimings:  true,
+			grantedScopes: []string{"groups"},
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{testUserSearchResultUsernameAttributeValue},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(gomock.Any(), gomock.Any()).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "found 0 values for attribute \"some-upstream-uid-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+			wantSteps: []string{"dial", "bind", "search", "group-search", "user-bind"},
 		},
 		{
-			name:           "search result has 2 values for uid attribute",
-			providerConfig: providerConfig(nil),
+			name:          "with a group search after the user bind",
+			debugTimings:  true,
+			grantedScopes: []string{"groups"},
+			editConfig: func(p *ProviderConfig) {
+				p.GroupSearch.SearchAfterUserBind = true
+			},
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{testUserSearchResultUsernameAttributeValue},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue), []byte("other-uid-value")},
-								},
-							},
-						},
-					},
-				}, nil).Times(1)
+				conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1)
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(gomock.Any(), gomock.Any()).Return(&ldap.SearchResult{}, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
-			wantErr: "found 2 values for attribute \"some-upstream-uid-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+			wantSteps: []string{"dial", "bind", "search", "user-bind", "rebind", "group-search"},
 		},
 		{
-			name:           "search result has a changed pwdLastSet value",
-			providerConfig: providerConfig(nil),
+			name:         "with a retry on a stale connection",
+			debugTimings: true,
+			editConfig: func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			},
 			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
-					Entries: []*ldap.Entry{
-						{
-							DN: testUserSearchResultDNValue,
-							Attributes: []*ldap.EntryAttribute{
-								{
-									Name:   testUserSearchUsernameAttribute,
-									Values: []string{testUserSearchResultUsernameAttributeValue},
-								},
-								{
-									Name:       testUserSearchUIDAttribute,
-									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
-								},
-								{
-									Name:       pwdLastSetAttribute,
-									ByteValues: [][]byte{[]byte("132801740800000001")},
-								},
-							},
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+				gomock.InOrder(
+					conn.EXPECT().Search(gomock.Any()).
+						Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(1),
+					conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1),
+				)
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().Close().Times(2)
+			},
+			wantSteps: []string{"dial", "bind", "search", "retry-dial", "retry-bind", "retry-search", "user-bind"},
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			tt.setupMocks(conn)
+
+			config := ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				GroupSearch: GroupSearchConfig{
+					Base:               testGroupSearchBase,
+					Filter:             testGroupSearchFilter,
+					GroupNameAttribute: testGroupSearchGroupNameAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+				DebugTimings: tt.debugTimings,
+			}
+			if tt.editConfig != nil {
+				tt.editConfig(&config)
+			}
+			ldapProvider := New(config)
+
+			grantedScopes := tt.grantedScopes
+			if grantedScopes == nil {
+				grantedScopes = []string{}
+			}
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, grantedScopes)
+			require.NoError(t, err)
+			require.True(t, authenticated)
+
+			extra := authResponse.User.GetExtra()
+			if !tt.debugTimings {
+				require.Empty(t, extra)
+				return
+			}
+			require.Len(t, extra, 1)
+			timings := extra[DebugTimingsExtraKey]
+			require.Len(t, timings, len(tt.wantSteps))
+			for i, step := range tt.wantSteps {
+				require.Regexp(t, `^`+step+`=\S+s$`, timings[i])
+			}
+		})
+	}
+}
+
+func TestEndUserAuthenticationAuditBindDN(t *testing.T) {
+	for _, auditBindDN := range []bool{false, true} {
+		auditBindDN := auditBindDN
+		t.Run(fmt.Sprintf("AuditBindDN=%t", auditBindDN), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).Return(&ldap.SearchResult{
+				Entries: []*ldap.Entry{
+					{
+						DN: testUserSearchResultDNValue,
+						Attributes: []*ldap.EntryAttribute{
+							ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+							ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
 						},
 					},
-				}, nil).Times(1)
-				conn.EXPECT().Close().Times(1)
+				},
+			}, nil).Times(1)
+			conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+				AuditBindDN: auditBindDN,
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+			require.NoError(t, err)
+			require.True(t, authenticated)
+
+			// The DN never changes the user's name or UID.
+			require.Equal(t, testUserSearchResultUsernameAttributeValue, authResponse.User.GetName())
+			require.Equal(t, base64.RawURLEncoding.EncodeToString([]byte(testUserSearchResultUIDAttributeValue)), authResponse.User.GetUID())
+
+			extra := authResponse.User.GetExtra()
+			if !auditBindDN {
+				require.Empty(t, extra)
+				return
+			}
+			require.Equal(t, map[string][]string{AuditBindDNExtraKey: {testUserSearchResultDNValue}}, extra)
+		})
+	}
+}
+
+func TestEndUserAuthenticationUserNotFoundDelay(t *testing.T) {
+	foundUser := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+				},
 			},
-			wantErr: "validation for attribute \"pwdLastSet\" failed during upstream refresh: value for attribute \"pwdLastSet\" has changed since initial value at login",
 		},
+	}
+
+	tests := []struct {
+		name              string
+		userNotFoundDelay time.Duration
+		ctxTimeout        time.Duration
+		searchResult      *ldap.SearchResult
+		wantMinDuration   time.Duration
+		wantMaxDuration   time.Duration
+	}{
 		{
-			name:           "group search returns an error",
-			providerConfig: providerConfig(nil),
-			setupMocks: func(conn *mockldapconn.MockConn) {
-				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
-				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
-				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(nil, errors.New("some search error")).Times(1)
-				conn.EXPECT().Close().Times(1)
-			},
-			wantErr: "error searching for group memberships for user with DN \"some-upstream-user-dn\": some search error",
+			name:            "no delay by default",
+			searchResult:    &ldap.SearchResult{},
+			wantMaxDuration: 5 * time.Second,
+		},
+		{
+			name:              "delays when the user is not found",
+			userNotFoundDelay: 200 * time.Millisecond,
+			searchResult:      &ldap.SearchResult{},
+			wantMinDuration:   200 * time.Millisecond,
+			wantMaxDuration:   5 * time.Second,
+		},
+		{
+			name:              "delay ends early when the context is done",
+			userNotFoundDelay: time.Hour,
+			ctxTimeout:        100 * time.Millisecond,
+			searchResult:      &ldap.SearchResult{},
+			wantMinDuration:   100 * time.Millisecond,
+			wantMaxDuration:   5 * time.Second,
+		},
+		{
+			name:              "does not delay when the user is found but the bind fails",
+			userNotFoundDelay: time.Hour,
+			searchResult:      foundUser,
+			wantMaxDuration:   5 * time.Second,
 		},
 	}
-
-	for _, tt := range tests {
-		tt := tt
+	for _, test := range tests {
+		tt := test
 		t.Run(tt.name, func(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			t.Cleanup(ctrl.Finish)
 
 			conn := mockldapconn.NewMockConn(ctrl)
-			if tt.setupMocks != nil {
-				tt.setupMocks(conn)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).Return(tt.searchResult, nil).Times(1)
+			if len(tt.searchResult.Entries) > 0 {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).
+					Return(ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))).Times(1)
 			}
+			conn.EXPECT().Close().Times(1)
 
-			dialWasAttempted := false
-			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
-				dialWasAttempted = true
-				require.Equal(t, tt.providerConfig.Host, addr.Endpoint())
-				if tt.dialError != nil {
-					return nil, tt.dialError
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+				UserNotFoundDelay: tt.userNotFoundDelay,
+			})
+
+			ctx := context.Background()
+			if tt.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctxTimeout)
+				t.Cleanup(cancel)
+			}
+
+			start := time.Now()
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(ctx, testUpstreamUsername, testUpstreamPassword, []string{})
+			duration := time.Since(start)
+
+			require.NoError(t, err)
+			require.False(t, authenticated)
+			require.Nil(t, authResponse)
+			require.GreaterOrEqual(t, duration, tt.wantMinDuration)
+			require.Less(t, duration, tt.wantMaxDuration)
+		})
+	}
+}
+
+func TestEndUserAuthenticationSearchGroupsAfterUserBind(t *testing.T) {
+	userSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name                  string
+		userBindErr           error
+		rebindErr             error
+		wantAuthenticated     bool
+		wantGroupSearch       bool
+		wantError             string
+		wantBoundAsAfterLogin string
+	}{
+		{
+			name:                  "groups are searched as the bind user after the user's bind",
+			wantAuthenticated:     true,
+			wantGroupSearch:       true,
+			wantBoundAsAfterLogin: testBindUsername,
+		},
+		{
+			name:                  "groups are not searched when the user's bind fails",
+			userBindErr:           ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error")),
+			wantBoundAsAfterLogin: "",
+		},
+		{
+			name:                  "binding as the bind user again fails",
+			rebindErr:             ldap.NewError(ldap.LDAPResultUnavailable, errors.New("some rebind error")),
+			wantError:             fmt.Sprintf(`error binding as %q again after binding as the user: LDAP Result Code 52 "Unavailable": some rebind error`, testBindUsername),
+			wantBoundAsAfterLogin: "",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			// Track which identity the connection is bound as, like the LDAP server would. A failed bind leaves the
+			// connection anonymous (RFC 4511 section 4.2.1), which is represented by the empty string.
+			boundAs := ""
+			bindAs := func(err error) func(username, password string) error {
+				return func(username, password string) error {
+					boundAs = ""
+					if err == nil {
+						boundAs = username
+					}
+					return err
 				}
+			}
 
-				return conn, nil
+			conn := mockldapconn.NewMockConn(ctrl)
+			calls := []*gomock.Call{
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).DoAndReturn(bindAs(nil)),
+				conn.EXPECT().Search(gomock.Any()).DoAndReturn(func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+					require.Equal(t, testBindUsername, boundAs)
+					return userSearchResult, nil
+				}),
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).DoAndReturn(bindAs(tt.userBindErr)),
+			}
+			if tt.userBindErr == nil {
+				calls = append(calls, conn.EXPECT().Bind(testBindUsername, testBindPassword).DoAndReturn(bindAs(tt.rebindErr)))
+			}
+			if tt.wantGroupSearch {
+				calls = append(calls, conn.EXPECT().SearchWithPaging(gomock.Any(), defaultPageSize).
+					DoAndReturn(func(*ldap.SearchRequest, uint32) (*ldap.SearchResult, error) {
+						require.Equal(t, testBindUsername, boundAs, "groups must be searched as the bind user")
+						return &ldap.SearchResult{Entries: []*ldap.Entry{{DN: testGroupSearchResultDNValue1}}}, nil
+					}))
+			}
+			calls = append(calls, conn.EXPECT().Close())
+			gomock.InOrder(calls...)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				GroupSearch: GroupSearchConfig{
+					Base:                testGroupSearchBase,
+					Filter:              testGroupSearchFilter,
+					GroupNameAttribute:  "dn",
+					SearchAfterUserBind: true,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
 			})
 
-			if tt.refreshUserDN == "" {
-				tt.refreshUserDN = testUserSearchResultDNValue // default for all tests
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{"groups"})
+			require.Equal(t, tt.wantBoundAsAfterLogin, boundAs)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAuthenticated, authenticated)
+			if !tt.wantAuthenticated {
+				require.Nil(t, authResponse)
+				return
 			}
+			require.Equal(t, []string{testGroupSearchResultDNValue1}, authResponse.User.GetGroups())
+		})
+	}
+}
 
-			if tt.grantedScopes == nil {
-				tt.grantedScopes = []string{"groups"}
+func TestEndUserAuthenticationBindDNAttribute(t *testing.T) {
+	const bindDNAttribute = "userPrincipalName"
+
+	tests := []struct {
+		name            string
+		bindDNAttribute string
+		bindAttribute   *ldap.EntryAttribute
+		wantAttributes  []string
+		wantBindName    string
+		wantError       string
+	}{
+		{
+			name:           "binds using the DN by default",
+			wantAttributes: []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute},
+			wantBindName:   testUserSearchResultDNValue,
+		},
+		{
+			name:            "binds using the DN when the attribute is dn",
+			bindDNAttribute: "dn",
+			wantAttributes:  []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute},
+			wantBindName:    testUserSearchResultDNValue,
+		},
+		{
+			name:            "binds using the value of the attribute",
+			bindDNAttribute: bindDNAttribute,
+			bindAttribute:   ldap.NewEntryAttribute(bindDNAttribute, []string{"some-user@example.com"}),
+			wantAttributes:  []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute, bindDNAttribute},
+			wantBindName:    "some-user@example.com",
+		},
+		{
+			name:            "when the entry has no value for the attribute",
+			bindDNAttribute: bindDNAttribute,
+			wantAttributes:  []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute, bindDNAttribute},
+			wantError:       fmt.Sprintf(`found 0 values for attribute "userPrincipalName" while searching for user %q, but expected 1 result`, testUpstreamUsername),
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			attributes := []*ldap.EntryAttribute{
+				ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+				ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
 			}
-			initialPwdLastSetEncoded := base64.RawURLEncoding.EncodeToString([]byte("132801740800000000"))
-			ldapProvider := New(*tt.providerConfig)
-			subject := "ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=c29tZS11cHN0cmVhbS11aWQtdmFsdWU"
-			groups, err := ldapProvider.PerformRefresh(context.Background(), provider.RefreshAttributes{
-				Username:             testUserSearchResultUsernameAttributeValue,
-				Subject:              subject,
-				DN:                   tt.refreshUserDN,
-				AdditionalAttributes: map[string]string{pwdLastSetAttribute: initialPwdLastSetEncoded},
-				GrantedScopes:        tt.grantedScopes,
+			if tt.bindAttribute != nil {
+				attributes = append(attributes, tt.bindAttribute)
+			}
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).DoAndReturn(func(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+				require.Equal(t, tt.wantAttributes, searchRequest.Attributes)
+				return &ldap.SearchResult{Entries: []*ldap.Entry{{DN: testUserSearchResultDNValue, Attributes: attributes}}}, nil
+			}).Times(1)
+			if tt.wantBindName != "" {
+				conn.EXPECT().Bind(tt.wantBindName, testUpstreamPassword).Times(1)
+			}
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+					BindDNAttribute:   tt.bindDNAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
 			})
-			if tt.wantErr != "" {
-				require.Error(t, err)
-				require.Equal(t, tt.wantErr, err.Error())
-			} else {
-				require.NoError(t, err)
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.False(t, authenticated)
+				return
 			}
-			require.Equal(t, true, dialWasAttempted)
-			require.Equal(t, tt.wantGroups, groups)
+			require.NoError(t, err)
+			require.True(t, authenticated)
+			// The response always has the DN, regardless of the name used for the bind.
+			require.Equal(t, testUserSearchResultDNValue, authResponse.DN)
+		})
+	}
+}
+
+func TestEndUserAuthenticationSizeLimitExceeded(t *testing.T) {
+	userEntry := func(dn string) *ldap.Entry {
+		return &ldap.Entry{
+			DN: dn,
+			Attributes: []*ldap.EntryAttribute{
+				ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+				ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+			},
+		}
+	}
+	sizeLimitExceeded := ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("some size limit error"))
+	wantTooManyResults := fmt.Sprintf(`searching for user %q resulted in more search results than the size limit, but expected 1 result`, testUpstreamUsername)
+
+	tests := []struct {
+		name         string
+		searchResult *ldap.SearchResult
+		searchErr    error
+		wantError    string
+	}{
+		{
+			name:         "size limit exceeded with partial results",
+			searchResult: &ldap.SearchResult{Entries: []*ldap.Entry{userEntry("some-user-dn1"), userEntry("some-user-dn2")}},
+			searchErr:    sizeLimitExceeded,
+			wantError:    wantTooManyResults,
+		},
+		{
+			name:         "size limit exceeded with only one partial result",
+			searchResult: &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(testUserSearchResultDNValue)}},
+			searchErr:    sizeLimitExceeded,
+			wantError:    wantTooManyResults,
+		},
+		{
+			name:      "size limit exceeded without any results",
+			searchErr: sizeLimitExceeded,
+			wantError: wantTooManyResults,
+		},
+		{
+			name:      "other search errors are unchanged",
+			searchErr: ldap.NewError(ldap.LDAPResultBusy, errors.New("some search error")),
+			wantError: `error searching for user: LDAP Result Code 51 "Busy": some search error`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).Return(tt.searchResult, tt.searchErr).Times(1)
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+			require.EqualError(t, err, tt.wantError)
+			require.False(t, authenticated)
+			require.Nil(t, authResponse)
+		})
+	}
+}
+
+func TestEndUserAuthenticationAmbiguousDNlessResults(t *testing.T) {
+	userEntry := func(dn string) *ldap.Entry {
+		return &ldap.Entry{
+			DN: dn,
+			Attributes: []*ldap.EntryAttribute{
+				ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+				ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+			},
+		}
+	}
+
+	tests := []struct {
+		name                             string
+		ambiguousDNlessResultsAsNotFound bool
+		searchResult                     *ldap.SearchResult
+		wantError                        string
+	}{
+		{
+			name:         "multiple results without DNs are an error by default",
+			searchResult: &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(""), userEntry("")}},
+			wantError:    fmt.Sprintf(`searching for user %q resulted in 2 search results, but expected 1 result`, testUpstreamUsername),
+		},
+		{
+			name:                             "multiple results without DNs are not found when configured",
+			ambiguousDNlessResultsAsNotFound: true,
+			searchResult:                     &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(""), userEntry("")}},
+		},
+		{
+			name:                             "multiple results are still an error when configured and any of them has a DN",
+			ambiguousDNlessResultsAsNotFound: true,
+			searchResult:                     &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(""), userEntry(testUserSearchResultDNValue)}},
+			wantError:                        fmt.Sprintf(`searching for user %q resulted in 2 search results, but expected 1 result`, testUpstreamUsername),
+		},
+		{
+			name:                             "a single result without a DN is still an error when configured",
+			ambiguousDNlessResultsAsNotFound: true,
+			searchResult:                     &ldap.SearchResult{Entries: []*ldap.Entry{userEntry("")}},
+			wantError:                        fmt.Sprintf(`searching for user %q resulted in search result without DN`, testUpstreamUsername),
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).Return(tt.searchResult, nil).Times(1)
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:                             testUserSearchBase,
+					Filter:                           testUserSearchFilter,
+					UsernameAttribute:                testUserSearchUsernameAttribute,
+					UIDAttribute:                     testUserSearchUIDAttribute,
+					AmbiguousDNlessResultsAsNotFound: tt.ambiguousDNlessResultsAsNotFound,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.False(t, authenticated)
+			require.Nil(t, authResponse)
+		})
+	}
+}
+
+func TestEndUserAuthenticationTrimAttributeWhitespace(t *testing.T) {
+	const (
+		usernameValue = " some-username\r\n"
+		uidValue      = "some-uid\n"
+		groupValue    = "some-group\t"
+	)
+
+	tests := []struct {
+		name                       string
+		trimAttributeWhitespace    bool
+		trimUIDAttributeWhitespace bool
+		usernameValue              string
+		wantUsername               string
+		wantUID                    string
+		wantGroups                 []string
+		wantError                  string
+	}{
+		{
+			name:          "values are not trimmed by default",
+			usernameValue: usernameValue,
+			wantUsername:  usernameValue,
+			wantUID:       base64.RawURLEncoding.EncodeToString([]byte(uidValue)),
+			wantGroups:    []string{groupValue},
+		},
+		{
+			name:                    "usernames and group names are trimmed, but not the UID",
+			trimAttributeWhitespace: true,
+			usernameValue:           usernameValue,
+			wantUsername:            "some-username",
+			wantUID:                 base64.RawURLEncoding.EncodeToString([]byte(uidValue)),
+			wantGroups:              []string{"some-group"},
+		},
+		{
+			name:                       "the UID is trimmed when opted in",
+			trimAttributeWhitespace:    true,
+			trimUIDAttributeWhitespace: true,
+			usernameValue:              usernameValue,
+			wantUsername:               "some-username",
+			wantUID:                    base64.RawURLEncoding.EncodeToString([]byte("some-uid")),
+			wantGroups:                 []string{"some-group"},
+		},
+		{
+			name:                    "a username which is only whitespace is empty after trimming",
+			trimAttributeWhitespace: true,
+			usernameValue:           " \r\n",
+			wantError: fmt.Sprintf(`found empty value for attribute %q while searching for user %q, but expected value to be non-empty`,
+				testUserSearchUsernameAttribute, testUpstreamUsername),
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+			conn.EXPECT().Search(gomock.Any()).Return(&ldap.SearchResult{Entries: []*ldap.Entry{{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{tt.usernameValue}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{uidValue}),
+				},
+			}}}, nil).Times(1)
+			if tt.wantError == "" {
+				conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(gomock.Any(), gomock.Any()).Return(&ldap.SearchResult{Entries: []*ldap.Entry{{
+					DN: testGroupSearchResultDNValue1,
+					Attributes: []*ldap.EntryAttribute{
+						ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{groupValue}),
+					},
+				}}}, nil).Times(1)
+			}
+			conn.EXPECT().Close().Times(1)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				GroupSearch: GroupSearchConfig{
+					Base:               testGroupSearchBase,
+					Filter:             testGroupSearchFilter,
+					GroupNameAttribute: testGroupSearchGroupNameAttribute,
+				},
+				TrimAttributeWhitespace:    tt.trimAttributeWhitespace,
+				TrimUIDAttributeWhitespace: tt.trimUIDAttributeWhitespace,
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{"groups"})
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.False(t, authenticated)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, authenticated)
+			require.Equal(t, tt.wantUsername, authResponse.User.GetName())
+			require.Equal(t, tt.wantUID, authResponse.User.GetUID())
+			require.Equal(t, tt.wantGroups, authResponse.User.GetGroups())
+		})
+	}
+}
+
+func TestEndUserAuthenticationBindUserSearch(t *testing.T) {
+	const (
+		bindUsername = "svc-pinniped(*)"
+		bindUserDN   = "cn=svc-pinniped,ou=service-accounts,dc=pinniped,dc=dev"
+	)
+	expectedBindUserSearch := &ldap.SearchRequest{
+		BaseDN:       "ou=service-accounts,dc=pinniped,dc=dev",
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       `(&(objectClass=account)(uid=svc-pinniped\28\2a\29))`,
+		Attributes:   []string{"1.1"},
+		Controls:     nil,
+	}
+	userSearchResult := &ldap.SearchResult{Entries: []*ldap.Entry{{
+		DN: testUserSearchResultDNValue,
+		Attributes: []*ldap.EntryAttribute{
+			ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+			ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+		},
+	}}}
+	groupSearchResult := &ldap.SearchResult{Entries: []*ldap.Entry{{
+		DN: testGroupSearchResultDNValue1,
+		Attributes: []*ldap.EntryAttribute{
+			ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+		},
+	}}}
+
+	tests := []struct {
+		name        string
+		searchMocks func(conn *mockldapconn.MockConn)
+		wantGroups  []string
+		wantError   string
+	}{
+		{
+			name: "binds as the DN which was found by the bind user search, also when binding again after the user bind",
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				gomock.InOrder(
+					conn.EXPECT().Search(expectedBindUserSearch).
+						Return(&ldap.SearchResult{Entries: []*ldap.Entry{{DN: bindUserDN}}}, nil).Times(1),
+					conn.EXPECT().Bind(bindUserDN, testBindPassword).Times(1),
+					conn.EXPECT().Search(gomock.Any()).Return(userSearchResult, nil).Times(1),
+					conn.EXPECT().Bind(testUserSearchResultDNValue, testUpstreamPassword).Times(1),
+					conn.EXPECT().Bind(bindUserDN, testBindPassword).Times(1),
+					conn.EXPECT().SearchWithPaging(gomock.Any(), gomock.Any()).Return(groupSearchResult, nil).Times(1),
+					conn.EXPECT().Close().Times(1),
+				)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1},
+		},
+		{
+			name: "the bind user search does not find the bind user",
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedBindUserSearch).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error binding as "svc-pinniped(*)" before user search: searching for the bind user resulted in 0 search results, but expected 1 result`,
+		},
+		{
+			name: "the bind user search finds more than one entry",
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedBindUserSearch).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{{DN: bindUserDN}, {DN: "cn=other"}}}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error binding as "svc-pinniped(*)" before user search: searching for the bind user resulted in 2 search results, but expected 1 result`,
+		},
+		{
+			name: "the bind user search exceeds the size limit",
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedBindUserSearch).
+					Return(nil, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("some size limit error"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error binding as "svc-pinniped(*)" before user search: searching for the bind user resulted in more search results than the size limit, but expected 1 result`,
+		},
+		{
+			name: "the bind user search fails",
+			searchMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Search(expectedBindUserSearch).
+					Return(nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("anonymous search not allowed"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: `error binding as "svc-pinniped(*)" before user search: error searching for the bind user: LDAP Result Code 50 "Insufficient Access Rights": anonymous search not allowed`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			tt.searchMocks(conn)
+
+			ldapProvider := New(ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       bindUsername,
+				BindPassword:       testBindPassword,
+				BindUserSearch: BindUserSearchConfig{
+					Base:   "ou=service-accounts,dc=pinniped,dc=dev",
+					Filter: "&(objectClass=account)(uid={})",
+				},
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				GroupSearch: GroupSearchConfig{
+					Base:                testGroupSearchBase,
+					Filter:              testGroupSearchFilter,
+					GroupNameAttribute:  testGroupSearchGroupNameAttribute,
+					SearchAfterUserBind: true,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			})
+
+			authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{"groups"})
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.False(t, authenticated)
+				require.Nil(t, authResponse)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, authenticated)
+			require.Equal(t, testUserSearchResultDNValue, authResponse.DN)
+			require.Equal(t, tt.wantGroups, authResponse.User.GetGroups())
+		})
+	}
+}
+
+func TestUpstreamRefresh(t *testing.T) {
+	pwdLastSetAttribute := "pwdLastSet"
+
+	expectedUserSearch := func(editFunc func(r *ldap.SearchRequest)) *ldap.SearchRequest {
+		request := &ldap.SearchRequest{
+			BaseDN:       testUserSearchResultDNValue,
+			Scope:        ldap.ScopeBaseObject,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    2,
+			TimeLimit:    90,
+			TypesOnly:    false,
+			Filter:       "(objectClass=*)",
+			Attributes:   []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute, pwdLastSetAttribute},
+			Controls:     nil, // don't need paging because we set the SizeLimit so small
+		}
+		if editFunc != nil {
+			editFunc(request)
+		}
+		return request
+	}
+
+	expectedGroupSearch := func(editFunc func(r *ldap.SearchRequest)) *ldap.SearchRequest {
+		request := &ldap.SearchRequest{
+			BaseDN:       testGroupSearchBase,
+			Scope:        ldap.ScopeWholeSubtree,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    0, // unlimited size because we will search with paging
+			TimeLimit:    90,
+			TypesOnly:    false,
+			Filter:       testGroupSearchFilterInterpolated,
+			Attributes:   []string{testGroupSearchGroupNameAttribute},
+			Controls:     nil, // nil because ldap.SearchWithPaging() will set the appropriate controls for us
+		}
+		if editFunc != nil {
+			editFunc(request)
+		}
+		return request
+	}
+
+	happyPathUserSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					{
+						Name:   testUserSearchUsernameAttribute,
+						Values: []string{testUserSearchResultUsernameAttributeValue},
+					},
+					{
+						Name:       testUserSearchUIDAttribute,
+						ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+					},
+					{
+						Name:       pwdLastSetAttribute,
+						Values:     []string{"132801740800000000"},
+						ByteValues: [][]byte{[]byte("132801740800000000")},
+					},
+				},
+			},
+		},
+	}
+
+	happyPathGroupSearchResult := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			{
+				DN: testGroupSearchResultDNValue1,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+				},
+			},
+			{
+				DN: testGroupSearchResultDNValue2,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue2}),
+				},
+			},
+		},
+		Referrals: []string{}, // note that we are not following referrals at this time
+		Controls:  []ldap.Control{},
+	}
+
+	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
+		config := &ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			CABundle:           nil, // this field is only used by the production dialer, which is replaced by a mock for this test
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch: UserSearchConfig{
+				Base:              testUserSearchBase,
+				UIDAttribute:      testUserSearchUIDAttribute,
+				UsernameAttribute: testUserSearchUsernameAttribute,
+			},
+			GroupSearch: GroupSearchConfig{
+				Base:               testGroupSearchBase,
+				Filter:             testGroupSearchFilter,
+				GroupNameAttribute: testGroupSearchGroupNameAttribute,
+			},
+			RefreshAttributeChecks: map[string]func(*ldap.Entry, provider.RefreshAttributes) error{
+				pwdLastSetAttribute: AttributeUnchangedSinceLogin(pwdLastSetAttribute),
+			},
+		}
+		if editFunc != nil {
+			editFunc(config)
+		}
+		return config
+	}
+
+	tests := []struct {
+		name           string
+		providerConfig *ProviderConfig
+		grantedScopes  []string
+		setupMocks     func(conn *mockldapconn.MockConn)
+		refreshUserDN  string
+		previousGroups []string
+		dialError      error
+		wantErr        string
+		wantGroups     []string
+	}{
+		{
+			name: "happy path without group search where searching the dn returns a single entry",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch = GroupSearchConfig{}
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{},
+		},
+		{
+			name:           "happy path where group search returns groups",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name: "happy path where the username comes from the who am I operation, so it is not compared",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameFromWhoAmI = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{"some-username-which-differs-from-the-who-am-i-username"},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+								},
+								{
+									Name:       pwdLastSetAttribute,
+									Values:     []string{"132801740800000000"},
+									ByteValues: [][]byte{[]byte("132801740800000000")},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name: "happy path where group search returns groups and a group allowlist is configured",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.GroupAllowlist = []string{testGroupSearchResultGroupNameAttributeValue1}
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1},
+		},
+		{
+			name:           "happy path when the user DN has special LDAP search filter characters then they must be properly escaped in the custom group search filter",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.BaseDN = testUserDNWithSpecialChars
+				})).
+					Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{
+							{
+								DN: testUserDNWithSpecialChars,
+								Attributes: []*ldap.EntryAttribute{
+									{
+										Name:   testUserSearchUsernameAttribute,
+										Values: []string{testUserSearchResultUsernameAttributeValue},
+									},
+									{
+										Name:       testUserSearchUIDAttribute,
+										ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+									},
+									{
+										Name:       pwdLastSetAttribute,
+										Values:     []string{"132801740800000000"},
+										ByteValues: [][]byte{[]byte("132801740800000000")},
+									},
+								},
+							},
+						},
+					}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Filter = fmt.Sprintf("(some-group-filter=%s-and-more-filter=%s)", testUserDNWithSpecialCharsEscaped, testUserDNWithSpecialCharsEscaped)
+				}), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			refreshUserDN: testUserDNWithSpecialChars,
+			wantGroups:    []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name: "when the user DN has special LDAP search filter characters then they must be properly escaped in the default group search filter",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.Filter = ""
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(func(r *ldap.SearchRequest) {
+					r.BaseDN = testUserDNWithSpecialChars
+				})).
+					Return(&ldap.SearchResult{
+						Entries: []*ldap.Entry{
+							{
+								DN: testUserDNWithSpecialChars,
+								Attributes: []*ldap.EntryAttribute{
+									{
+										Name:   testUserSearchUsernameAttribute,
+										Values: []string{testUserSearchResultUsernameAttributeValue},
+									},
+									{
+										Name:       testUserSearchUIDAttribute,
+										ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+									},
+									{
+										Name:       pwdLastSetAttribute,
+										Values:     []string{"132801740800000000"},
+										ByteValues: [][]byte{[]byte("132801740800000000")},
+									},
+								},
+							},
+						},
+					}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(func(r *ldap.SearchRequest) {
+					r.Filter = fmt.Sprintf("(member=%s)", testUserDNWithSpecialCharsEscaped)
+				}), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			refreshUserDN: testUserDNWithSpecialChars,
+			wantGroups:    []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name:           "happy path where group search returns no groups",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(&ldap.SearchResult{
+					Entries:   []*ldap.Entry{},
+					Referrals: []string{}, // note that we are not following referrals at this time
+					Controls:  []ldap.Control{},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: []string{},
+		},
+		{
+			name: "happy path where group search is configured but skipGroupRefresh is set",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.SkipGroupRefresh = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1) // note that group search is not expected
+				conn.EXPECT().Close().Times(1)
+			},
+			wantGroups: nil, // do not update groups
+		},
+		{
+			name:           "happy path where group search is configured but groups scope isn't included",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			grantedScopes: []string{},
+			wantGroups:    nil,
+		},
+		{
+			name:           "error where dial fails",
+			providerConfig: providerConfig(nil),
+			dialError:      errors.New("some dial error"),
+			wantErr:        "error dialing host \"ldap.example.com:8443\": some dial error",
+		},
+		{
+			name:           "error binding",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "error binding as \"cn=some-bind-username,dc=pinniped,dc=dev\" before user search: some bind error",
+		},
+		{
+			name:           "search result returns no entries",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "searching for user \"some-upstream-user-dn\" resulted in 0 search results, but expected 1 result",
+		},
+		{
+			name:           "error searching",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, errors.New("some search error"))
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "error searching for user \"some-upstream-user-dn\": some search error",
+		},
+		{
+			name: "network error searching, retried on a new connection",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(happyPathGroupSearchResult, nil).Times(1)
+				conn.EXPECT().Close().Times(2)
+			},
+			wantGroups: []string{testGroupSearchResultGroupNameAttributeValue1, testGroupSearchResultGroupNameAttributeValue2},
+		},
+		{
+			name: "network error searching twice",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.RetryOnStaleConnection = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(nil, ldap.NewError(ldap.ErrorNetwork, errors.New("some network error"))).Times(2)
+				conn.EXPECT().Close().Times(2)
+			},
+			wantErr: "error searching for user \"some-upstream-user-dn\": LDAP Result Code 200 \"Network Error\": some network error",
+		},
+		{
+			name:           "search result returns more than one entry",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN:         testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{},
+						},
+						{
+							DN:         "doesn't-matter",
+							Attributes: []*ldap.EntryAttribute{},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "searching for user \"some-upstream-user-dn\" resulted in 2 search results, but expected 1 result",
+		},
+		{
+			name:           "search result has wrong uid",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{testUserSearchResultUsernameAttributeValue},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte("wrong-uid")},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "searching for user \"some-upstream-user-dn\" produced a different subject than the previous value. expected: \"ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=c29tZS11cHN0cmVhbS11aWQtdmFsdWU\", actual: \"ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=d3JvbmctdWlk\"",
+		},
+		{
+			name:           "search result has wrong username",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{"wrong-username"},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "searching for user \"some-upstream-user-dn\" returned a different username than the previous value. expected: \"some-upstream-username-value\", actual: \"wrong-username\"",
+		},
+		{
+			name:           "search result has no dn",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{testUserSearchResultUsernameAttributeValue},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "searching for user with original DN \"some-upstream-user-dn\" resulted in search result without DN",
+		},
+		{
+			name:           "search result has 0 values for username attribute",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "found 0 values for attribute \"some-upstream-username-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+		},
+		{
+			name:           "search result has more than one value for username attribute",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{testUserSearchResultUsernameAttributeValue, "something-else"},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "found 2 values for attribute \"some-upstream-username-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+		},
+		{
+			name:           "search result has 0 values for uid attribute",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{testUserSearchResultUsernameAttributeValue},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "found 0 values for attribute \"some-upstream-uid-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+		},
+		{
+			name:           "search result has 2 values for uid attribute",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{testUserSearchResultUsernameAttributeValue},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue), []byte("other-uid-value")},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "found 2 values for attribute \"some-upstream-uid-attribute\" while searching for user \"some-upstream-user-dn\", but expected 1 result",
+		},
+		{
+			name:           "search result has a changed pwdLastSet value",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{
+						{
+							DN: testUserSearchResultDNValue,
+							Attributes: []*ldap.EntryAttribute{
+								{
+									Name:   testUserSearchUsernameAttribute,
+									Values: []string{testUserSearchResultUsernameAttributeValue},
+								},
+								{
+									Name:       testUserSearchUIDAttribute,
+									ByteValues: [][]byte{[]byte(testUserSearchResultUIDAttributeValue)},
+								},
+								{
+									Name:       pwdLastSetAttribute,
+									ByteValues: [][]byte{[]byte("132801740800000001")},
+								},
+							},
+						},
+					},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "validation for attribute \"pwdLastSet\" failed during upstream refresh: value for attribute \"pwdLastSet\" has changed since initial value at login",
+		},
+		{
+			name:           "group search returns an error",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(nil, errors.New("some search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantErr: "error searching for group memberships for user with DN \"some-upstream-user-dn\": some search error",
+		},
+		{
+			name: "group search returns an error and group search is configured to fail open",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.FailOpen = true
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedUserSearch(nil)).Return(happyPathUserSearchResult, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedGroupSearch(nil), expectedGroupSearchPageSize).Return(nil, errors.New("some search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			previousGroups: []string{"some-previous-group"},
+			wantGroups:     []string{"some-previous-group"}, // keep the previous groups
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			dialWasAttempted := false
+			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				dialWasAttempted = true
+				require.Equal(t, tt.providerConfig.Host, addr.Endpoint())
+				if tt.dialError != nil {
+					return nil, tt.dialError
+				}
+
+				return conn, nil
+			})
+
+			if tt.refreshUserDN == "" {
+				tt.refreshUserDN = testUserSearchResultDNValue // default for all tests
+			}
+
+			if tt.grantedScopes == nil {
+				tt.grantedScopes = []string{"groups"}
+			}
+			initialPwdLastSetEncoded := base64.RawURLEncoding.EncodeToString([]byte("132801740800000000"))
+			ldapProvider := New(*tt.providerConfig)
+			subject := "ldaps://ldap.example.com:8443?base=some-upstream-user-base-dn&sub=c29tZS11cHN0cmVhbS11aWQtdmFsdWU"
+			groups, err := ldapProvider.PerformRefresh(context.Background(), provider.RefreshAttributes{
+				Username:             testUserSearchResultUsernameAttributeValue,
+				Subject:              subject,
+				DN:                   tt.refreshUserDN,
+				AdditionalAttributes: map[string]string{pwdLastSetAttribute: initialPwdLastSetEncoded},
+				GrantedScopes:        tt.grantedScopes,
+				Groups:               tt.previousGroups,
+			})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Equal(t, tt.wantErr, err.Error())
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, true, dialWasAttempted)
+			require.Equal(t, tt.wantGroups, groups)
+		})
+	}
+}
+
+func TestTestConnection(t *testing.T) {
+	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
+		config := &ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			CABundle:           nil, // this field is only used by the production dialer, which is replaced by a mock for this test
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch:         UserSearchConfig{}, // not used by TestConnection
+		}
+		if editFunc != nil {
+			editFunc(config)
+		}
+		return config
+	}
+
+	tests := []struct {
+		name           string
+		providerConfig *ProviderConfig
+		setupMocks     func(conn *mockldapconn.MockConn)
+		dialError      error
+		wantError      string
+		wantErrorKind  ConnectionErrorKind
+		wantToSkipDial bool
+	}{
+		{
+			name:           "happy path",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:           "when dial fails",
+			providerConfig: providerConfig(nil),
+			dialError:      errors.New("some dial error"),
+			wantError:      fmt.Sprintf(`error dialing host "%s": some dial error`, testHost),
+			wantErrorKind:  DialFailed,
+		},
+		{
+			name:           "when binding as the bind user returns an error",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError:     fmt.Sprintf(`error binding as "%s": some bind error`, testBindUsername),
+			wantErrorKind: BindFailed,
+		},
+		{
+			name: "when the bind credentials come from a func",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.BindCredentialsFunc = func(ctx context.Context) (string, string, error) {
+					return "some-rotated-bind-username", "some-rotated-bind-password", nil
+				}
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind("some-rotated-bind-username", "some-rotated-bind-password").Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name: "when binding with the bind credentials from a func returns an error",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.BindCredentialsFunc = func(ctx context.Context) (string, string, error) {
+					return "some-rotated-bind-username", "some-rotated-bind-password", nil
+				}
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind("some-rotated-bind-username", "some-rotated-bind-password").Return(errors.New("some bind error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError:     `error binding as "some-rotated-bind-username": some bind error`,
+			wantErrorKind: BindFailed,
+		},
+		{
+			name: "when the bind credentials func returns an error",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.BindCredentialsFunc = func(ctx context.Context) (string, string, error) {
+					return "", "", errors.New("some secret error")
+				}
+			}),
+			wantToSkipDial: true,
+			wantError:      `error getting bind credentials: some secret error`,
+			wantErrorKind:  BindFailed,
+		},
+		{
+			name: "when the CA bundle is invalid",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.CABundle = []byte("not a ca bundle")
+			}),
+			wantToSkipDial: true,
+			wantError:      `could not parse CA bundle`,
+			wantErrorKind:  ConfigInvalid,
+		},
+		{
+			name: "when the config is invalid",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				// This particular combination of options is not allowed.
+				p.UserSearch.UsernameAttribute = "dn"
+				p.UserSearch.Filter = ""
+			}),
+			wantToSkipDial: true,
+			wantError:      `must specify UserSearch Filter when UserSearch UsernameAttribute is "dn"`,
+			wantErrorKind:  ConfigInvalid,
+		},
+		{
+			name: "when the empty value policy is invalid",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.EmptyValuePolicy = "SomethingElse"
+			}),
+			wantToSkipDial: true,
+			wantError:      `UserSearch EmptyValuePolicy must be "Error" or "SkipToFallback", but was "SomethingElse"`,
+			wantErrorKind:  ConfigInvalid,
+		},
+		{
+			name: "when both group name attribute options are set",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.GroupSearch.GroupNameAttribute = "cn"
+				p.GroupSearch.GroupNameAttributes = []string{"cn", "name"}
+			}),
+			wantToSkipDial: true,
+			wantError:      `at most one of GroupSearch GroupNameAttribute and GroupNameAttributes may be set`,
+			wantErrorKind:  ConfigInvalid,
+		},
+		{
+			name: "when the TLS verification mode is invalid",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.TLSVerificationMode = "None"
+			}),
+			wantToSkipDial: true,
+			wantError:      `TLSVerificationMode must be "Full", "CAOnly", or "InsecureSkipVerify", but was "None"`,
+			wantErrorKind:  ConfigInvalid,
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			dialWasAttempted := false
+			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				dialWasAttempted = true
+				require.Equal(t, tt.providerConfig.Host, addr.Endpoint())
+				if tt.dialError != nil {
+					return nil, tt.dialError
+				}
+				return conn, nil
+			})
+
+			provider := New(*tt.providerConfig)
+			err := provider.TestConnection(context.Background())
+
+			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
+
+			switch {
+			case tt.wantError != "":
+				require.EqualError(t, err, tt.wantError)
+				kind, ok := ConnectionErrorKindOf(err)
+				require.True(t, ok)
+				require.Equal(t, tt.wantErrorKind, kind)
+			default:
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTestConnectionValidatesUserSearchBase(t *testing.T) {
+	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
+		config := &ProviderConfig{
+			Name:                                  "some-provider-name",
+			Host:                                  testHost,
+			ConnectionProtocol:                    TLS,
+			BindUsername:                          testBindUsername,
+			BindPassword:                          testBindPassword,
+			UserSearch:                            UserSearchConfig{Base: testUserSearchBase},
+			TestConnectionValidatesUserSearchBase: true,
+		}
+		if editFunc != nil {
+			editFunc(config)
+		}
+		return config
+	}
+
+	expectedBaseSearch := &ldap.SearchRequest{
+		BaseDN:       testUserSearchBase,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    2,
+		TimeLimit:    90,
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{"1.1"},
+		Controls:     nil,
+	}
+
+	tests := []struct {
+		name           string
+		providerConfig *ProviderConfig
+		setupMocks     func(conn *mockldapconn.MockConn)
+		wantError      string
+	}{
+		{
+			name:           "happy path",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedBaseSearch).Return(&ldap.SearchResult{
+					Entries: []*ldap.Entry{{DN: testUserSearchBase}},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name: "when not configured to validate the user search base",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.TestConnectionValidatesUserSearchBase = false
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name: "when the user search base is empty",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.Base = ""
+			}),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:           "when the search for the user search base returns an error",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedBaseSearch).
+					Return(nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("some search error"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`user search base not found or not accessible: "%s": LDAP Result Code 32 "No Such Object": some search error`, testUserSearchBase),
+		},
+		{
+			name:           "when the search for the user search base finds no entries",
+			providerConfig: providerConfig(nil),
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedBaseSearch).Return(&ldap.SearchResult{}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`user search base not found or not accessible: "%s": expected to find 1 entry but found 0`, testUserSearchBase),
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			tt.setupMocks(conn)
+
+			providerConfig := *tt.providerConfig
+			providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				return conn, nil
+			})
+
+			err := New(providerConfig).TestConnection(context.Background())
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.ErrorIs(t, err, ErrUserSearchBaseNotAccessible)
+				kind, ok := ConnectionErrorKindOf(err)
+				require.True(t, ok)
+				require.Equal(t, SearchBaseNotFound, kind)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSearchWithPagingUpTo(t *testing.T) {
+	page := func(cookie string, dns ...string) *ldap.SearchResult {
+		result := &ldap.SearchResult{}
+		for _, dn := range dns {
+			result.Entries = append(result.Entries, &ldap.Entry{DN: dn})
+		}
+		if cookie != "-" { // "-" means that the server ignored the paging control
+			pagingControl := ldap.NewControlPaging(0)
+			pagingControl.SetCookie([]byte(cookie))
+			result.Controls = []ldap.Control{pagingControl}
+		}
+		return result
+	}
+
+	tests := []struct {
+		name          string
+		maxEntries    int
+		pages         []*ldap.SearchResult
+		searchErr     error
+		wantCookies   []string
+		wantDNs       []string
+		wantTruncated bool
+		wantErr       string
+	}{
+		{
+			name:        "reads all pages",
+			maxEntries:  10,
+			pages:       []*ldap.SearchResult{page("cookie1", "a", "b"), page("cookie2", "c"), page("", "d")},
+			wantCookies: []string{"", "cookie1", "cookie2"},
+			wantDNs:     []string{"a", "b", "c", "d"},
+		},
+		{
+			name:          "stops reading pages when the maximum is reached",
+			maxEntries:    3,
+			pages:         []*ldap.SearchResult{page("cookie1", "a", "b"), page("cookie2", "c", "d")},
+			wantCookies:   []string{"", "cookie1"},
+			wantDNs:       []string{"a", "b", "c"},
+			wantTruncated: true,
+		},
+		{
+			name:          "stops reading pages when the maximum is reached exactly and there are more pages",
+			maxEntries:    2,
+			pages:         []*ldap.SearchResult{page("cookie1", "a", "b")},
+			wantCookies:   []string{""},
+			wantDNs:       []string{"a", "b"},
+			wantTruncated: true,
+		},
+		{
+			name:        "the maximum is reached exactly on the last page",
+			maxEntries:  2,
+			pages:       []*ldap.SearchResult{page("", "a", "b")},
+			wantCookies: []string{""},
+			wantDNs:     []string{"a", "b"},
+		},
+		{
+			name:        "server ignores the paging control",
+			maxEntries:  10,
+			pages:       []*ldap.SearchResult{page("-", "a", "b")},
+			wantCookies: []string{""},
+			wantDNs:     []string{"a", "b"},
+		},
+		{
+			name:        "server returns the same cookie twice",
+			maxEntries:  10,
+			pages:       []*ldap.SearchResult{page("cookie1", "a"), page("cookie1", "b")},
+			wantCookies: []string{"", "cookie1"},
+			wantErr:     "the LDAP server returned the same paging cookie twice",
+		},
+		{
+			name:        "search returns an error",
+			maxEntries:  10,
+			searchErr:   errors.New("some search error"),
+			wantCookies: []string{""},
+			wantErr:     "some search error",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			var gotCookies []string
+			conn.EXPECT().Search(gomock.Any()).DoAndReturn(func(r *ldap.SearchRequest) (*ldap.SearchResult, error) {
+				pagingControl, ok := ldap.FindControl(r.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+				require.True(t, ok)
+				require.Equal(t, uint32(42), pagingControl.PagingSize)
+				gotCookies = append(gotCookies, string(pagingControl.Cookie))
+				if tt.searchErr != nil {
+					return nil, tt.searchErr
+				}
+				return tt.pages[len(gotCookies)-1], nil
+			}).Times(len(tt.wantCookies))
+
+			result, truncated, err := searchWithPagingUpTo(conn, &ldap.SearchRequest{}, 42, tt.maxEntries)
+			require.Equal(t, tt.wantCookies, gotCookies)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, result)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantTruncated, truncated)
+			gotDNs := []string{}
+			for _, entry := range result.Entries {
+				gotDNs = append(gotDNs, entry.DN)
+			}
+			require.Equal(t, tt.wantDNs, gotDNs)
+		})
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	c := ProviderConfig{
+		Name:         "original-provider-name",
+		Host:         testHost,
+		CABundle:     []byte("some-ca-bundle"),
+		BindUsername: testBindUsername,
+		BindPassword: testBindPassword,
+		UserSearch: UserSearchConfig{
+			Base:              testUserSearchBase,
+			Filter:            testUserSearchFilter,
+			UsernameAttribute: testUserSearchUsernameAttribute,
+			UIDAttribute:      testUserSearchUIDAttribute,
+		},
+	}
+	p := New(c)
+	require.Equal(t, c, p.c)
+	require.Equal(t, c, p.GetConfig())
+
+	// The original config can be changed without impacting the provider, since the provider made a copy of the config.
+	c.Name = "changed-name"
+	require.Equal(t, "original-provider-name", p.c.Name)
+
+	// The return value of GetConfig can be modified without impacting the provider, since it is a copy of the config.
+	returnedConfig := p.GetConfig()
+	returnedConfig.Name = "changed-name"
+	require.Equal(t, "original-provider-name", p.c.Name)
+}
+
+func TestGetURL(t *testing.T) {
+	require.Equal(t,
+		"ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev",
+		New(ProviderConfig{
+			Host:       "ldap.example.com:1234",
+			UserSearch: UserSearchConfig{Base: "ou=users,dc=pinniped,dc=dev"},
+		}).GetURL().String())
+
+	require.Equal(t,
+		"ldaps://ldap.example.com?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev",
+		New(ProviderConfig{
+			Host:       "ldap.example.com",
+			UserSearch: UserSearchConfig{Base: "ou=users,dc=pinniped,dc=dev"},
+		}).GetURL().String())
+
+	for _, host := range []string{"ldaps://ldap.example.com:1234/", "ldap://ldap.example.com:1234", "LDAPS://ldap.example.com:1234"} {
+		require.Equal(t,
+			"ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev",
+			New(ProviderConfig{
+				Host:       host,
+				UserSearch: UserSearchConfig{Base: "ou=users,dc=pinniped,dc=dev"},
+			}).GetURL().String(), host)
+	}
+}
+
+func TestUserIdentifier(t *testing.T) {
+	tests := []struct {
+		name      string
+		host      string
+		connProto LDAPConnectionProtocol
+		want      string
+	}{
+		{
+			name: "host with port",
+			host: "ldap.example.com:1234",
+			want: "ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev&sub=some%2Fuid%3D",
+		},
+		{
+			name: "host without port",
+			host: "ldap.example.com",
+			want: "ldaps://ldap.example.com?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev&sub=some%2Fuid%3D",
+		},
+		{
+			name: "ldaps URL host",
+			host: "ldaps://ldap.example.com:1234/",
+			want: "ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev&sub=some%2Fuid%3D",
+		},
+		{
+			name:      "StartTLS",
+			host:      "ldap.example.com:1234",
+			connProto: StartTLS,
+			want:      "ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev&sub=some%2Fuid%3D",
+		},
+		{
+			name: "ldap URL host, which uses StartTLS",
+			host: "ldap://ldap.example.com:1234",
+			want: "ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev&sub=some%2Fuid%3D",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(ProviderConfig{
+				Host:               tt.host,
+				ConnectionProtocol: tt.connProto,
+				UserSearch:         UserSearchConfig{Base: "ou=users,dc=pinniped,dc=dev"},
+			})
+			require.Equal(t, tt.want, p.UserIdentifier("some/uid="))
+			// It must agree with the subject of the downstream ID tokens.
+			require.Equal(t, downstreamsession.DownstreamLDAPSubject("some/uid=", *p.GetURL()), p.UserIdentifier("some/uid="))
+		})
+	}
+}
+
+func TestHostAndConnectionProtocol(t *testing.T) {
+	tests := []struct {
+		name             string
+		host             string
+		connProto        LDAPConnectionProtocol
+		wantHost         string
+		wantConnProtocol LDAPConnectionProtocol
+		wantError        string
+	}{
+		{
+			name:             "bare host uses the configured connection protocol",
+			host:             "ldap.example.com:1234",
+			connProto:        StartTLS,
+			wantHost:         "ldap.example.com:1234",
+			wantConnProtocol: StartTLS,
+		},
+		{
+			name:             "ldaps URL",
+			host:             "ldaps://ldap.example.com:636/",
+			connProto:        StartTLS,
+			wantHost:         "ldap.example.com:636",
+			wantConnProtocol: TLS,
+		},
+		{
+			name:             "ldap URL without port",
+			host:             "ldap://ldap.example.com",
+			connProto:        TLS,
+			wantHost:         "ldap.example.com",
+			wantConnProtocol: StartTLS,
+		},
+		{
+			name:             "ldap URL with IPv6 address",
+			host:             "ldap://[::1]:389/",
+			wantHost:         "[::1]:389",
+			wantConnProtocol: StartTLS,
+		},
+		{
+			name:      "unsupported scheme",
+			host:      "ldapi://ldap.example.com",
+			wantError: `LDAP URL host has unsupported scheme "ldapi", must be "ldaps" or "ldap"`,
+		},
+		{
+			name:      "URL with a path",
+			host:      "ldaps://ldap.example.com/dc=pinniped,dc=dev",
+			wantError: `LDAP URL host must not have a user, path, query, or fragment`,
+		},
+		{
+			name:      "URL with a query",
+			host:      "ldaps://ldap.example.com/?sub",
+			wantError: `LDAP URL host must not have a user, path, query, or fragment`,
+		},
+		{
+			name:      "URL without a host",
+			host:      "ldaps:///",
+			wantError: `LDAP URL host must have a hostname`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			host, connProtocol, err := New(ProviderConfig{Host: tt.host, ConnectionProtocol: tt.connProto}).hostAndConnectionProtocol()
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantHost, host)
+			require.Equal(t, tt.wantConnProtocol, connProtocol)
+		})
+	}
+}
+
+// Testing of host parsing, TLS negotiation, and CA bundle, etc. for the production code's dialer.
+func TestRealTLSDialing(t *testing.T) {
+	testServer := tlsserver.TLSTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		func(server *httptest.Server) {
+			tlsserver.RecordTLSHello(server)
+			recordFunc := server.TLS.GetConfigForClient
+			server.TLS.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+				_, _ = recordFunc(info)
+				r, err := http.NewRequestWithContext(info.Context(), http.MethodGet, "/this-is-ldap", nil)
+				require.NoError(t, err)
+				tlsserver.AssertTLS(t, r, ptls.DefaultLDAP)
+				return nil, nil
+			}
+		})
+	parsedURL, err := url.Parse(testServer.URL)
+	require.NoError(t, err)
+	testServerHostAndPort := parsedURL.Host
+	testServerCABundle := tlsserver.TLSTestServerCA(testServer)
+
+	caForTestServerWithBadCertName, err := certauthority.New("Test CA", time.Hour)
+	require.NoError(t, err)
+	wrongIP := net.ParseIP("10.2.3.4")
+	cert, err := caForTestServerWithBadCertName.IssueServerCert([]string{"wrong-dns-name"}, []net.IP{wrongIP}, time.Hour)
+	require.NoError(t, err)
+	testServerWithBadCertNameAddr := testutil.TLSTestServerWithCert(t, func(w http.ResponseWriter, r *http.Request) {}, cert)
+
+	unusedPortGrabbingListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	recentlyClaimedHostAndPort := unusedPortGrabbingListener.Addr().String()
+	require.NoError(t, unusedPortGrabbingListener.Close())
+
+	alreadyCancelledContext, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc() // cancel it immediately
+
+	// A server which responds with plaintext, like an LDAP server's non-TLS port would.
+	plaintextListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = plaintextListener.Close() })
+	go func() {
+		for {
+			c, err := plaintextListener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte("this is not TLS"))
+			_ = c.Close()
+		}
+	}()
+	plaintextHostAndPort := plaintextListener.Addr().String()
+
+	tests := []struct {
+		name             string
+		host             string
+		connProto        LDAPConnectionProtocol
+		caBundle         []byte
+		verificationMode TLSVerificationMode
+		context          context.Context
+		wantError        string
+	}{
+		{
+			name:      "happy path",
+			host:      testServerHostAndPort,
+			caBundle:  testServerCABundle,
+			connProto: TLS,
+			context:   context.Background(),
+		},
+		{
+			name:      "happy path with an ldaps URL host, which overrides the connection protocol",
+			host:      "ldaps://" + testServerHostAndPort + "/",
+			caBundle:  testServerCABundle,
+			connProto: StartTLS,
+			context:   context.Background(),
+		},
+		{
+			name:      "unsupported LDAP URL scheme",
+			host:      "http://" + testServerHostAndPort,
+			caBundle:  testServerCABundle,
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": LDAP URL host has unsupported scheme "http", must be "ldaps" or "ldap"`,
+		},
+		{
+			name:      "server cert name does not match the address to which the client connected",
+			host:      testServerWithBadCertNameAddr,
+			caBundle:  caForTestServerWithBadCertName.Bundle(),
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": x509: certificate is valid for 10.2.3.4, not 127.0.0.1`,
+		},
+		{
+			name:             "server cert name does not match the address to which the client connected, when only the CA is verified",
+			host:             testServerWithBadCertNameAddr,
+			caBundle:         caForTestServerWithBadCertName.Bundle(),
+			verificationMode: TLSVerificationCAOnly,
+			connProto:        TLS,
+			context:          context.Background(),
+		},
+		{
+			name:             "server cert is not from the trusted CA, when only the CA is verified",
+			host:             testServerWithBadCertNameAddr,
+			caBundle:         testServerCABundle,
+			verificationMode: TLSVerificationCAOnly,
+			connProto:        TLS,
+			context:          context.Background(),
+			wantError:        fmt.Sprintf(`LDAP Result Code 200 "Network Error": %s`, testutil.X509UntrustedCertError("Test CA")),
+		},
+		{
+			name:             "server cert is not from a trusted CA, when verification is skipped",
+			host:             testServerWithBadCertNameAddr,
+			caBundle:         nil,
+			verificationMode: TLSVerificationInsecureSkipVerify,
+			connProto:        TLS,
+			context:          context.Background(),
+		},
+		{
+			name:      "server does not respond with TLS",
+			host:      plaintextHostAndPort,
+			caBundle:  testServerCABundle,
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": the LDAP server did not respond with TLS; ` +
+				`please check that the port of the configured host is correct for the connection protocol ` +
+				`(e.g. use ldaps with port 636, or use StartTLS with port 389): tls: first record does not look like a TLS handshake`,
+		},
+		{
+			name:      "invalid CA bundle with TLS",
+			host:      testServerHostAndPort,
+			caBundle:  []byte("not a ca bundle"),
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": could not parse CA bundle`,
+		},
+		{
+			name:      "invalid CA bundle with StartTLS",
+			host:      testServerHostAndPort,
+			caBundle:  []byte("not a ca bundle"),
+			connProto: StartTLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": could not parse CA bundle`,
+		},
+		{
+			name:      "invalid host with TLS",
+			host:      "this:is:not:a:valid:hostname",
+			caBundle:  testServerCABundle,
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": host "this:is:not:a:valid:hostname" is not a valid hostname or IP address`,
+		},
+		{
+			name:      "invalid host with StartTLS",
+			host:      "this:is:not:a:valid:hostname",
+			caBundle:  testServerCABundle,
+			connProto: StartTLS,
+			context:   context.Background(),
+			wantError: `LDAP Result Code 200 "Network Error": host "this:is:not:a:valid:hostname" is not a valid hostname or IP address`,
+		},
+		{
+			name:      "missing CA bundle when it is required because the host is not using a trusted CA",
+			host:      testServerHostAndPort,
+			caBundle:  nil,
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": %s`, testutil.X509UntrustedCertError("Acme Co")),
+		},
+		{
+			name: "cannot connect to host",
+			// This is assuming that this port was not reclaimed by another app since the test setup ran. Seems safe enough.
+			host:      recentlyClaimedHostAndPort,
+			caBundle:  testServerCABundle,
+			connProto: TLS,
+			context:   context.Background(),
+			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": dial tcp %s: connect: connection refused`, recentlyClaimedHostAndPort),
+		},
+		{
+			name:      "pays attention to the passed context",
+			host:      testServerHostAndPort,
+			caBundle:  testServerCABundle,
+			connProto: TLS,
+			context:   alreadyCancelledContext,
+			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": dial tcp %s: operation was canceled`, testServerHostAndPort),
+		},
+		{
+			name:      "unsupported connection protocol",
+			host:      testServerHostAndPort,
+			caBundle:  testServerCABundle,
+			connProto: "bad usage of this type",
+			context:   alreadyCancelledContext,
+			wantError: `LDAP Result Code 200 "Network Error": did not specify valid ConnectionProtocol`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			provider := New(ProviderConfig{
+				Host:                tt.host,
+				CABundle:            tt.caBundle,
+				TLSVerificationMode: tt.verificationMode,
+				ConnectionProtocol:  tt.connProto,
+				Dialer:              nil, // this test is for the default (production) TLS dialer
+			})
+			conn, err := provider.dial(tt.context)
+			if conn != nil {
+				defer conn.Close()
+			}
+			if tt.wantError != "" {
+				require.Nil(t, conn)
+				require.EqualError(t, err, tt.wantError)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, conn)
+
+				// Should be an instance of the real production LDAP client type.
+				// Can't test its methods here because we are not dialed to a real LDAP server.
+				require.IsType(t, &maxMessageSizeLDAPConn{}, conn)
+
+				// Indirectly checking that the Dialer method constructed the ldap.Conn with isTLS set to true,
+				// since this is always the correct behavior unless/until we want to support StartTLS.
+				err := conn.(*maxMessageSizeLDAPConn).StartTLS(ptls.DefaultLDAP(nil))
+				require.EqualError(t, err, `LDAP Result Code 200 "Network Error": ldap: already encrypted`)
+			}
+		})
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// A server which accepts TCP connections but never answers the TLS handshake, like a black-holed server would.
+	blackHoleListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = blackHoleListener.Close() })
+	go func() {
+		var accepted []net.Conn // keep the connections open without ever answering them
+		defer func() {
+			for _, c := range accepted {
+				_ = c.Close()
+			}
+		}()
+		for {
+			c, err := blackHoleListener.Accept()
+			if err != nil {
+				return
+			}
+			accepted = append(accepted, c)
+		}
+	}()
+
+	tests := []struct {
+		name               string
+		defaultDialTimeout time.Duration
+		contextTimeout     time.Duration
+	}{
+		{
+			name:               "the default dial timeout applies when the context has no deadline",
+			defaultDialTimeout: 100 * time.Millisecond,
+		},
+		{
+			name:               "the context's deadline applies when it is earlier than the default dial timeout",
+			defaultDialTimeout: time.Hour,
+			contextTimeout:     100 * time.Millisecond,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.contextTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.contextTimeout)
+				t.Cleanup(cancel)
+			}
+
+			provider := New(ProviderConfig{
+				Host:               blackHoleListener.Addr().String(),
+				ConnectionProtocol: TLS,
+				DefaultDialTimeout: tt.defaultDialTimeout,
+			})
+
+			start := time.Now()
+			conn, err := provider.dial(ctx)
+			require.Nil(t, conn)
+			require.EqualError(t, err, `LDAP Result Code 200 "Network Error": context deadline exceeded`)
+			require.Less(t, time.Since(start), 10*time.Second)
+		})
+	}
+}
+
+func TestDialTimeoutDefault(t *testing.T) {
+	require.Equal(t, time.Minute, New(ProviderConfig{}).dialTimeout())
+	require.Equal(t, time.Second, New(ProviderConfig{DefaultDialTimeout: time.Second}).dialTimeout())
+}
+
+func TestTLSConfigIsCopiedForEachDial(t *testing.T) {
+	p := New(ProviderConfig{CABundle: tlsserver.TLSTestServerCA(tlsserver.TLSTestServer(t, http.NotFoundHandler(), nil))})
+
+	tlsConfig1, err := p.tlsConfig(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig1.RootCAs)
+	tlsConfig1.ServerName = "some-server-name"
+
+	tlsConfig2, err := p.tlsConfig(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, tlsConfig2.ServerName)
+	require.NotSame(t, tlsConfig1, tlsConfig2)
+	require.Same(t, tlsConfig1.RootCAs, tlsConfig2.RootCAs) // the CA bundle was only parsed once
+}
+
+func TestDynamicCABundle(t *testing.T) {
+	testServer := tlsserver.TLSTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+	parsedURL, err := url.Parse(testServer.URL)
+	require.NoError(t, err)
+	testServerHostAndPort := parsedURL.Host
+	testServerCABundle := tlsserver.TLSTestServerCA(testServer)
+
+	caBundlePath := filepath.Join(t.TempDir(), "ca.crt")
+	writeCABundle := func(caBundle []byte) {
+		require.NoError(t, os.WriteFile(caBundlePath, caBundle, 0600))
+	}
+
+	t.Run("CABundlePath is read for each dial", func(t *testing.T) {
+		p := New(ProviderConfig{Host: testServerHostAndPort, ConnectionProtocol: TLS, CABundlePath: caBundlePath})
+		require.NoError(t, p.validateConfig())
+
+		writeCABundle(testServerCABundle)
+		conn, err := p.dial(context.Background())
+		require.NoError(t, err)
+		conn.Close()
+
+		writeCABundle([]byte("not a ca bundle"))
+		conn, err = p.dial(context.Background())
+		require.Nil(t, conn)
+		require.EqualError(t, err, `LDAP Result Code 200 "Network Error": could not parse CA bundle`)
+
+		require.NoError(t, os.Remove(caBundlePath))
+		conn, err = p.dial(context.Background())
+		require.Nil(t, conn)
+		require.EqualError(t, err, fmt.Sprintf(`LDAP Result Code 200 "Network Error": could not read CA bundle file %q: open %s: no such file or directory`, caBundlePath, caBundlePath))
+	})
+
+	t.Run("CABundleFunc is called for each dial", func(t *testing.T) {
+		caBundle := testServerCABundle
+		var loadErr error
+		var gotCtx context.Context
+		ctx := context.WithValue(context.Background(), struct{ name string }{"some-key"}, "some-value")
+		p := New(ProviderConfig{
+			Host:               testServerHostAndPort,
+			ConnectionProtocol: TLS,
+			CABundleFunc: func(ctx context.Context) ([]byte, error) {
+				gotCtx = ctx
+				return caBundle, loadErr
+			},
+		})
+		require.NoError(t, p.validateConfig())
+
+		tlsConfig, err := p.tlsConfig(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, tlsConfig.RootCAs)
+		require.Equal(t, ctx, gotCtx)
+
+		conn, err := p.dial(context.Background())
+		require.NoError(t, err)
+		conn.Close()
+
+		loadErr = errors.New("some load error")
+		conn, err = p.dial(context.Background())
+		require.Nil(t, conn)
+		require.EqualError(t, err, `LDAP Result Code 200 "Network Error": could not load CA bundle: some load error`)
+
+		loadErr = nil
+		caBundle = []byte("not a ca bundle")
+		conn, err = p.dial(context.Background())
+		require.Nil(t, conn)
+		require.EqualError(t, err, `LDAP Result Code 200 "Network Error": could not parse CA bundle`)
+	})
+
+	t.Run("more than one source of CA bundle", func(t *testing.T) {
+		loadCABundle := func(ctx context.Context) ([]byte, error) { return testServerCABundle, nil }
+		for _, config := range []ProviderConfig{
+			{CABundle: testServerCABundle, CABundlePath: caBundlePath},
+			{CABundle: testServerCABundle, CABundleFunc: loadCABundle},
+			{CABundlePath: caBundlePath, CABundleFunc: loadCABundle},
+		} {
+			config.Host = testServerHostAndPort
+			config.ConnectionProtocol = TLS
+			p := New(config)
+			wantErr := "at most one of CABundle, CABundlePath, and CABundleFunc may be set"
+			require.EqualError(t, p.validateConfig(), wantErr)
+			conn, err := p.dial(context.Background())
+			require.Nil(t, conn)
+			require.EqualError(t, err, `LDAP Result Code 200 "Network Error": `+wantErr)
+		}
+	})
+}
+
+func TestAttributeUnchangedSinceLogin(t *testing.T) {
+	initialVal := "some-attribute-value"
+	changedVal := "some-different-attribute-value"
+	attributeName := "some-attribute-name"
+	tests := []struct {
+		name       string
+		entry      *ldap.Entry
+		wantResult bool
+		wantErr    string
+	}{
+		{
+			name: "happy path where value has not changed since login",
+			entry: &ldap.Entry{
+				DN: "some-dn",
+				Attributes: []*ldap.EntryAttribute{
+					{
+						Name:       attributeName,
+						Values:     []string{initialVal},
+						ByteValues: [][]byte{[]byte(initialVal)},
+					},
+				},
+			},
+		},
+		{
+			name: "password has been reset since login",
+			entry: &ldap.Entry{
+				DN: "some-dn",
+				Attributes: []*ldap.EntryAttribute{
+					{
+						Name:       attributeName,
+						Values:     []string{changedVal},
+						ByteValues: [][]byte{[]byte(changedVal)},
+					},
+				},
+			},
+			wantErr: "value for attribute \"some-attribute-name\" has changed since initial value at login",
+		},
+		{
+			name: "no value for attribute attribute",
+			entry: &ldap.Entry{
+				DN:         "some-dn",
+				Attributes: []*ldap.EntryAttribute{},
+			},
+			wantErr: "expected to find 1 value for \"some-attribute-name\" attribute, but found 0",
+		},
+		{
+			name: "too many values for attribute",
+			entry: &ldap.Entry{
+				DN: "some-dn",
+				Attributes: []*ldap.EntryAttribute{
+					{
+						Name:       attributeName,
+						ByteValues: [][]byte{[]byte("val1"), []byte("val2")},
+					},
+				},
+			},
+			wantErr: "expected to find 1 value for \"some-attribute-name\" attribute, but found 2",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			initialValRawEncoded := base64.RawURLEncoding.EncodeToString([]byte(initialVal))
+			err := AttributeUnchangedSinceLogin(attributeName)(tt.entry, provider.RefreshAttributes{AdditionalAttributes: map[string]string{attributeName: initialValRawEncoded}})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Equal(t, tt.wantErr, err.Error())
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	newProvider := func(dialer LDAPDialerFunc) *Provider {
+		return New(ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch: UserSearchConfig{
+				Base:              testUserSearchBase,
+				Filter:            testUserSearchFilter,
+				UsernameAttribute: testUserSearchUsernameAttribute,
+				UIDAttribute:      testUserSearchUIDAttribute,
+			},
+			Dialer: dialer,
+		})
+	}
+
+	t.Run("operations fail after shutdown, and shutdown is idempotent", func(t *testing.T) {
+		ldapProvider := newProvider(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			t.Fatal("should not dial after shutdown")
+			return nil, nil
+		})
+
+		require.NoError(t, ldapProvider.Shutdown(context.Background()))
+		require.NoError(t, ldapProvider.Shutdown(context.Background()))
+
+		authResponse, authenticated, err := ldapProvider.AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{})
+		require.ErrorIs(t, err, ErrProviderClosed)
+		require.EqualError(t, err, "LDAP provider closed")
+		require.False(t, authenticated)
+		require.Nil(t, authResponse)
+
+		_, _, err = ldapProvider.DryRunAuthenticateUser(context.Background(), testUpstreamUsername, []string{})
+		require.ErrorIs(t, err, ErrProviderClosed)
+
+		_, err = ldapProvider.PerformRefresh(context.Background(), provider.RefreshAttributes{})
+		require.ErrorIs(t, err, ErrProviderClosed)
+
+		require.ErrorIs(t, ldapProvider.TestConnection(context.Background()), ErrProviderClosed)
+
+		_, err = ldapProvider.SearchForDefaultNamingContext(context.Background())
+		require.ErrorIs(t, err, ErrProviderClosed)
+	})
+
+	t.Run("shutdown waits for in-flight operations until the context is done", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		conn := mockldapconn.NewMockConn(ctrl)
+		conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+		conn.EXPECT().Close().Times(1)
+
+		dialStarted := make(chan struct{})
+		finishDial := make(chan struct{})
+		ldapProvider := newProvider(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			close(dialStarted)
+			<-finishDial
+			return conn, nil
 		})
-	}
+
+		testConnectionErr := make(chan error)
+		go func() {
+			testConnectionErr <- ldapProvider.TestConnection(context.Background())
+		}()
+		<-dialStarted
+
+		// The in-flight operation is blocked, so shutdown gives up when its context is done.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := ldapProvider.Shutdown(ctx)
+		require.EqualError(t, err, `error waiting for in-flight operations of LDAP provider "some-provider-name" to finish: context deadline exceeded`)
+
+		// New operations are rejected even though shutdown did not finish waiting.
+		require.ErrorIs(t, ldapProvider.HealthCheck(context.Background()), ErrProviderClosed)
+
+		// Once the in-flight operation finishes, shutdown finishes too.
+		close(finishDial)
+		require.NoError(t, <-testConnectionErr)
+		require.NoError(t, ldapProvider.Shutdown(context.Background()))
+	})
 }
 
-func TestTestConnection(t *testing.T) {
-	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
-		config := &ProviderConfig{
-			Name:               "some-provider-name",
-			Host:               testHost,
-			CABundle:           nil, // this field is only used by the production dialer, which is replaced by a mock for this test
-			ConnectionProtocol: TLS,
-			BindUsername:       testBindUsername,
-			BindPassword:       testBindPassword,
-			UserSearch:         UserSearchConfig{}, // not used by TestConnection
+func TestMaxConcurrentConnections(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	conn := mockldapconn.NewMockConn(ctrl)
+	conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(2)
+	conn.EXPECT().Close().Times(2)
+
+	dialStarted := make(chan struct{}, 2)
+	finishDial := make(chan struct{})
+	ldapProvider := New(ProviderConfig{
+		Name:                     "some-provider-name",
+		Host:                     testHost,
+		ConnectionProtocol:       TLS,
+		BindUsername:             testBindUsername,
+		BindPassword:             testBindPassword,
+		MaxConcurrentConnections: 1,
+		Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			dialStarted <- struct{}{}
+			<-finishDial
+			return conn, nil
+		}),
+	})
+
+	testConnectionErr := make(chan error)
+	go func() {
+		testConnectionErr <- ldapProvider.TestConnection(context.Background())
+	}()
+	<-dialStarted
+
+	// The only connection is in use, so another operation waits until its context is done, without dialing.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ldapProvider.TestConnection(ctx)
+	require.EqualError(t, err, `error waiting for one of the 1 concurrent connections of LDAP provider "some-provider-name": context deadline exceeded`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// A waiting operation proceeds once the first operation finishes.
+	secondTestConnectionErr := make(chan error)
+	go func() {
+		secondTestConnectionErr <- ldapProvider.TestConnection(context.Background())
+	}()
+	close(finishDial)
+	require.NoError(t, <-testConnectionErr)
+	require.NoError(t, <-secondTestConnectionErr)
+	require.Len(t, dialStarted, 1)
+
+	// Operations which gave up waiting do not count as in-flight for shutdown.
+	require.NoError(t, ldapProvider.Shutdown(context.Background()))
+}
+
+func TestListUsers(t *testing.T) {
+	providerConfig := &ProviderConfig{
+		Name:               "some-provider-name",
+		Host:               testHost,
+		ConnectionProtocol: TLS,
+		BindUsername:       testBindUsername,
+		BindPassword:       testBindPassword,
+		UserSearch: UserSearchConfig{
+			Base:              testUserSearchBase,
+			Filter:            testUserSearchFilter,
+			UsernameAttribute: testUserSearchUsernameAttribute,
+			UIDAttribute:      testUserSearchUIDAttribute,
+		},
+	}
+
+	expectedSearch := func(filter string, limit int) *ldap.SearchRequest {
+		return &ldap.SearchRequest{
+			BaseDN:       testUserSearchBase,
+			Scope:        ldap.ScopeWholeSubtree,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    limit,
+			TimeLimit:    90,
+			TypesOnly:    false,
+			Filter:       filter,
+			Attributes:   []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute},
+			Controls:     nil,
 		}
-		if editFunc != nil {
-			editFunc(config)
+	}
+
+	userEntry := func(i int) *ldap.Entry {
+		return &ldap.Entry{
+			DN: fmt.Sprintf("some-user-dn-%d", i),
+			Attributes: []*ldap.EntryAttribute{
+				ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{fmt.Sprintf("some-username-%d", i)}),
+				ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{fmt.Sprintf("some-uid-%d", i)}),
+			},
+		}
+	}
+
+	userSummary := func(i int) UserSummary {
+		return UserSummary{
+			Username: fmt.Sprintf("some-username-%d", i),
+			UID:      base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("some-uid-%d", i))),
+			DN:       fmt.Sprintf("some-user-dn-%d", i),
 		}
-		return config
 	}
 
 	tests := []struct {
 		name           string
-		providerConfig *ProviderConfig
+		username       string
+		limit          int
 		setupMocks     func(conn *mockldapconn.MockConn)
-		dialError      error
-		wantError      string
 		wantToSkipDial bool
+		wantUsers      []UserSummary
+		wantError      string
 	}{
 		{
-			name:           "happy path",
-			providerConfig: providerConfig(nil),
+			name:  "empty value matches all users",
+			limit: 10,
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedSearch("(some-user-filter=*-and-more-filter=*)", 10), uint32(10)).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{userEntry(1), userEntry(2)}}, nil).Times(1)
 				conn.EXPECT().Close().Times(1)
 			},
+			wantUsers: []UserSummary{userSummary(1), userSummary(2)},
 		},
 		{
-			name:           "when dial fails",
-			providerConfig: providerConfig(nil),
-			dialError:      errors.New("some dial error"),
-			wantError:      fmt.Sprintf(`error dialing host "%s": some dial error`, testHost),
+			name:     "value is escaped",
+			username: `a*b`,
+			limit:    1000,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedSearch(`(some-user-filter=a\2ab-and-more-filter=a\2ab)`, 1000), expectedGroupSearchPageSize).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{}}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUsers: []UserSummary{},
 		},
 		{
-			name:           "when binding as the bind user returns an error",
-			providerConfig: providerConfig(nil),
+			name:  "size limit exceeded returns the partial results up to the limit",
+			limit: 2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedSearch("(some-user-filter=*-and-more-filter=*)", 2), uint32(2)).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{userEntry(1), userEntry(2), userEntry(3)}},
+						ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUsers: []UserSummary{userSummary(1), userSummary(2)},
+		},
+		{
+			name:  "search error",
+			limit: 2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(gomock.Any(), gomock.Any()).Return(nil, errors.New("some search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: "error searching for users: some search error",
+		},
+		{
+			name:  "bind error",
+			limit: 2,
 			setupMocks: func(conn *mockldapconn.MockConn) {
 				conn.EXPECT().Bind(testBindUsername, testBindPassword).Return(errors.New("some bind error")).Times(1)
 				conn.EXPECT().Close().Times(1)
@@ -1879,14 +5435,21 @@ func TestTestConnection(t *testing.T) {
 			wantError: fmt.Sprintf(`error binding as "%s": some bind error`, testBindUsername),
 		},
 		{
-			name: "when the config is invalid",
-			providerConfig: providerConfig(func(p *ProviderConfig) {
-				// This particular combination of options is not allowed.
-				p.UserSearch.UsernameAttribute = "dn"
-				p.UserSearch.Filter = ""
-			}),
+			name:  "entry is missing the username attribute",
+			limit: 2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(gomock.Any(), gomock.Any()).
+					Return(&ldap.SearchResult{Entries: []*ldap.Entry{{DN: "some-user-dn"}}}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`found 0 values for attribute "%s" while searching for user "some-user-dn", but expected 1 result`, testUserSearchUsernameAttribute),
+		},
+		{
+			name:           "invalid limit",
+			limit:          0,
 			wantToSkipDial: true,
-			wantError:      `must specify UserSearch Filter when UserSearch UsernameAttribute is "dn"`,
+			wantError:      "limit must be positive, but was 0",
 		},
 	}
 
@@ -1902,37 +5465,33 @@ func TestTestConnection(t *testing.T) {
 			}
 
 			dialWasAttempted := false
-			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+			config := *providerConfig
+			config.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
 				dialWasAttempted = true
-				require.Equal(t, tt.providerConfig.Host, addr.Endpoint())
-				if tt.dialError != nil {
-					return nil, tt.dialError
-				}
 				return conn, nil
 			})
 
-			provider := New(*tt.providerConfig)
-			err := provider.TestConnection(context.Background())
+			users, err := New(config).ListUsers(context.Background(), tt.username, tt.limit)
 
 			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
-
-			switch {
-			case tt.wantError != "":
+			if tt.wantError != "" {
 				require.EqualError(t, err, tt.wantError)
-			default:
-				require.NoError(t, err)
+				require.Nil(t, users)
+				return
 			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantUsers, users)
 		})
 	}
 }
 
-func TestGetConfig(t *testing.T) {
-	c := ProviderConfig{
-		Name:         "original-provider-name",
-		Host:         testHost,
-		CABundle:     []byte("some-ca-bundle"),
-		BindUsername: testBindUsername,
-		BindPassword: testBindPassword,
+func TestStreamUsers(t *testing.T) {
+	providerConfig := &ProviderConfig{
+		Name:               "some-provider-name",
+		Host:               testHost,
+		ConnectionProtocol: TLS,
+		BindUsername:       testBindUsername,
+		BindPassword:       testBindPassword,
 		UserSearch: UserSearchConfig{
 			Base:              testUserSearchBase,
 			Filter:            testUserSearchFilter,
@@ -1940,262 +5499,557 @@ func TestGetConfig(t *testing.T) {
 			UIDAttribute:      testUserSearchUIDAttribute,
 		},
 	}
-	p := New(c)
-	require.Equal(t, c, p.c)
-	require.Equal(t, c, p.GetConfig())
-
-	// The original config can be changed without impacting the provider, since the provider made a copy of the config.
-	c.Name = "changed-name"
-	require.Equal(t, "original-provider-name", p.c.Name)
-
-	// The return value of GetConfig can be modified without impacting the provider, since it is a copy of the config.
-	returnedConfig := p.GetConfig()
-	returnedConfig.Name = "changed-name"
-	require.Equal(t, "original-provider-name", p.c.Name)
-}
-
-func TestGetURL(t *testing.T) {
-	require.Equal(t,
-		"ldaps://ldap.example.com:1234?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev",
-		New(ProviderConfig{
-			Host:       "ldap.example.com:1234",
-			UserSearch: UserSearchConfig{Base: "ou=users,dc=pinniped,dc=dev"},
-		}).GetURL().String())
-
-	require.Equal(t,
-		"ldaps://ldap.example.com?base=ou%3Dusers%2Cdc%3Dpinniped%2Cdc%3Ddev",
-		New(ProviderConfig{
-			Host:       "ldap.example.com",
-			UserSearch: UserSearchConfig{Base: "ou=users,dc=pinniped,dc=dev"},
-		}).GetURL().String())
-}
 
-// Testing of host parsing, TLS negotiation, and CA bundle, etc. for the production code's dialer.
-func TestRealTLSDialing(t *testing.T) {
-	testServer := tlsserver.TLSTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
-		func(server *httptest.Server) {
-			tlsserver.RecordTLSHello(server)
-			recordFunc := server.TLS.GetConfigForClient
-			server.TLS.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
-				_, _ = recordFunc(info)
-				r, err := http.NewRequestWithContext(info.Context(), http.MethodGet, "/this-is-ldap", nil)
-				require.NoError(t, err)
-				tlsserver.AssertTLS(t, r, ptls.DefaultLDAP)
-				return nil, nil
-			}
-		})
-	parsedURL, err := url.Parse(testServer.URL)
-	require.NoError(t, err)
-	testServerHostAndPort := parsedURL.Host
-	testServerCABundle := tlsserver.TLSTestServerCA(testServer)
+	userEntry := func(i int) *ldap.Entry {
+		return &ldap.Entry{
+			DN: fmt.Sprintf("some-user-dn-%d", i),
+			Attributes: []*ldap.EntryAttribute{
+				ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{fmt.Sprintf("some-username-%d", i)}),
+				ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{fmt.Sprintf("some-uid-%d", i)}),
+			},
+		}
+	}
 
-	caForTestServerWithBadCertName, err := certauthority.New("Test CA", time.Hour)
-	require.NoError(t, err)
-	wrongIP := net.ParseIP("10.2.3.4")
-	cert, err := caForTestServerWithBadCertName.IssueServerCert([]string{"wrong-dns-name"}, []net.IP{wrongIP}, time.Hour)
-	require.NoError(t, err)
-	testServerWithBadCertNameAddr := testutil.TLSTestServerWithCert(t, func(w http.ResponseWriter, r *http.Request) {}, cert)
+	pagingControl := func(cookie string) []ldap.Control {
+		control := ldap.NewControlPaging(0)
+		control.SetCookie([]byte(cookie))
+		return []ldap.Control{control}
+	}
 
-	unusedPortGrabbingListener, err := net.Listen("tcp", "127.0.0.1:0")
-	require.NoError(t, err)
-	recentlyClaimedHostAndPort := unusedPortGrabbingListener.Addr().String()
-	require.NoError(t, unusedPortGrabbingListener.Close())
+	// expectPage expects a search for the page with the given cookie, and returns the given page.
+	expectPage := func(conn *mockldapconn.MockConn, wantCookie string, page *ldap.SearchResult) *gomock.Call {
+		return conn.EXPECT().Search(gomock.Any()).DoAndReturn(func(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+			require.Equal(t, testUserSearchBase, request.BaseDN)
+			require.Equal(t, "(some-user-filter=*-and-more-filter=*)", request.Filter)
+			require.Zero(t, request.SizeLimit)
+			control := ldap.FindControl(request.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+			require.Equal(t, expectedGroupSearchPageSize, control.PagingSize)
+			require.Equal(t, wantCookie, string(control.Cookie))
+			return page, nil
+		}).Times(1)
+	}
 
-	alreadyCancelledContext, cancelFunc := context.WithCancel(context.Background())
-	cancelFunc() // cancel it immediately
+	stopErr := errors.New("stop here")
 
 	tests := []struct {
-		name      string
-		host      string
-		connProto LDAPConnectionProtocol
-		caBundle  []byte
-		context   context.Context
-		wantError string
+		name          string
+		setupMocks    func(conn *mockldapconn.MockConn)
+		stopAfter     int
+		wantUsernames []string
+		wantError     string
 	}{
 		{
-			name:      "happy path",
-			host:      testServerHostAndPort,
-			caBundle:  testServerCABundle,
-			connProto: TLS,
-			context:   context.Background(),
-		},
-		{
-			name:      "server cert name does not match the address to which the client connected",
-			host:      testServerWithBadCertNameAddr,
-			caBundle:  caForTestServerWithBadCertName.Bundle(),
-			connProto: TLS,
-			context:   context.Background(),
-			wantError: `LDAP Result Code 200 "Network Error": x509: certificate is valid for 10.2.3.4, not 127.0.0.1`,
-		},
-		{
-			name:      "invalid CA bundle with TLS",
-			host:      testServerHostAndPort,
-			caBundle:  []byte("not a ca bundle"),
-			connProto: TLS,
-			context:   context.Background(),
-			wantError: `LDAP Result Code 200 "Network Error": could not parse CA bundle`,
-		},
-		{
-			name:      "invalid CA bundle with StartTLS",
-			host:      testServerHostAndPort,
-			caBundle:  []byte("not a ca bundle"),
-			connProto: StartTLS,
-			context:   context.Background(),
-			wantError: `LDAP Result Code 200 "Network Error": could not parse CA bundle`,
-		},
-		{
-			name:      "invalid host with TLS",
-			host:      "this:is:not:a:valid:hostname",
-			caBundle:  testServerCABundle,
-			connProto: TLS,
-			context:   context.Background(),
-			wantError: `LDAP Result Code 200 "Network Error": host "this:is:not:a:valid:hostname" is not a valid hostname or IP address`,
+			name: "calls the func for each user of each page",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				gomock.InOrder(
+					expectPage(conn, "", &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(1), userEntry(2)}, Controls: pagingControl("cookie-1")}),
+					expectPage(conn, "cookie-1", &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(3)}, Controls: pagingControl("")}),
+				)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUsernames: []string{"some-username-1", "some-username-2", "some-username-3"},
 		},
 		{
-			name:      "invalid host with StartTLS",
-			host:      "this:is:not:a:valid:hostname",
-			caBundle:  testServerCABundle,
-			connProto: StartTLS,
-			context:   context.Background(),
-			wantError: `LDAP Result Code 200 "Network Error": host "this:is:not:a:valid:hostname" is not a valid hostname or IP address`,
+			name: "server which does not support paging returns all users in one page",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				expectPage(conn, "", &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(1), userEntry(2)}})
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUsernames: []string{"some-username-1", "some-username-2"},
 		},
 		{
-			name:      "missing CA bundle when it is required because the host is not using a trusted CA",
-			host:      testServerHostAndPort,
-			caBundle:  nil,
-			connProto: TLS,
-			context:   context.Background(),
-			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": %s`, testutil.X509UntrustedCertError("Acme Co")),
+			name:      "stops without asking for more pages when the func returns an error",
+			stopAfter: 2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				expectPage(conn, "", &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(1), userEntry(2), userEntry(3)}, Controls: pagingControl("cookie-1")})
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUsernames: []string{"some-username-1", "some-username-2"},
+			wantError:     "stop here",
 		},
 		{
-			name: "cannot connect to host",
-			// This is assuming that this port was not reclaimed by another app since the test setup ran. Seems safe enough.
-			host:      recentlyClaimedHostAndPort,
-			caBundle:  testServerCABundle,
-			connProto: TLS,
-			context:   context.Background(),
-			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": dial tcp %s: connect: connection refused`, recentlyClaimedHostAndPort),
+			name: "server returns the same cookie twice",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				gomock.InOrder(
+					expectPage(conn, "", &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(1)}, Controls: pagingControl("cookie-1")}),
+					expectPage(conn, "cookie-1", &ldap.SearchResult{Entries: []*ldap.Entry{userEntry(2)}, Controls: pagingControl("cookie-1")}),
+				)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantUsernames: []string{"some-username-1", "some-username-2"},
+			wantError:     "error searching for users: the LDAP server returned the same paging cookie twice",
 		},
 		{
-			name:      "pays attention to the passed context",
-			host:      testServerHostAndPort,
-			caBundle:  testServerCABundle,
-			connProto: TLS,
-			context:   alreadyCancelledContext,
-			wantError: fmt.Sprintf(`LDAP Result Code 200 "Network Error": dial tcp %s: operation was canceled`, testServerHostAndPort),
+			name: "search error",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(gomock.Any()).Return(nil, errors.New("some search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: "error searching for users: some search error",
 		},
 		{
-			name:      "unsupported connection protocol",
-			host:      testServerHostAndPort,
-			caBundle:  testServerCABundle,
-			connProto: "bad usage of this type",
-			context:   alreadyCancelledContext,
-			wantError: `LDAP Result Code 200 "Network Error": did not specify valid ConnectionProtocol`,
+			name: "entry is missing the username attribute",
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				expectPage(conn, "", &ldap.SearchResult{Entries: []*ldap.Entry{{DN: "some-user-dn"}}})
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: fmt.Sprintf(`found 0 values for attribute "%s" while searching for user "some-user-dn", but expected 1 result`, testUserSearchUsernameAttribute),
 		},
 	}
+
 	for _, test := range tests {
 		tt := test
 		t.Run(tt.name, func(t *testing.T) {
-			provider := New(ProviderConfig{
-				Host:               tt.host,
-				CABundle:           tt.caBundle,
-				ConnectionProtocol: tt.connProto,
-				Dialer:             nil, // this test is for the default (production) TLS dialer
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			tt.setupMocks(conn)
+
+			config := *providerConfig
+			config.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				return conn, nil
 			})
-			conn, err := provider.dial(tt.context)
-			if conn != nil {
-				defer conn.Close()
-			}
-			if tt.wantError != "" {
-				require.Nil(t, conn)
-				require.EqualError(t, err, tt.wantError)
-			} else {
-				require.NoError(t, err)
-				require.NotNil(t, conn)
 
-				// Should be an instance of the real production LDAP client type.
-				// Can't test its methods here because we are not dialed to a real LDAP server.
-				require.IsType(t, &ldap.Conn{}, conn)
+			var usernames []string
+			err := New(config).StreamUsers(context.Background(), "", func(summary UserSummary) error {
+				usernames = append(usernames, summary.Username)
+				if len(usernames) == tt.stopAfter {
+					return stopErr
+				}
+				return nil
+			})
 
-				// Indirectly checking that the Dialer method constructed the ldap.Conn with isTLS set to true,
-				// since this is always the correct behavior unless/until we want to support StartTLS.
-				err := conn.(*ldap.Conn).StartTLS(ptls.DefaultLDAP(nil))
-				require.EqualError(t, err, `LDAP Result Code 200 "Network Error": ldap: already encrypted`)
+			require.Equal(t, tt.wantUsernames, usernames)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				return
 			}
+			require.NoError(t, err)
 		})
 	}
 }
 
-func TestAttributeUnchangedSinceLogin(t *testing.T) {
-	initialVal := "some-attribute-value"
-	changedVal := "some-different-attribute-value"
-	attributeName := "some-attribute-name"
+func TestClassifySearchError(t *testing.T) {
+	referralErr := ldap.NewError(ldap.LDAPResultReferral, errors.New("some referral"))
+	classified := classifySearchError(fmt.Errorf("wrapped: %w", referralErr))
+	var referralError *ReferralError
+	require.ErrorAs(t, classified, &referralError)
+	require.ErrorIs(t, classified, referralErr)
+
+	otherErr := ldap.NewError(ldap.LDAPResultBusy, errors.New("some busy error"))
+	require.Equal(t, otherErr, classifySearchError(otherErr))
+}
+
+func TestClassifyTLSHandshakeError(t *testing.T) {
+	recordHeaderErr := tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}
+	classified := classifyTLSHandshakeError(fmt.Errorf("wrapped: %w", recordHeaderErr))
+	var notTLSError *NotTLSError
+	require.ErrorAs(t, classified, &notTLSError)
+	require.ErrorIs(t, classified, recordHeaderErr)
+
+	otherErr := errors.New("some handshake error")
+	require.Equal(t, otherErr, classifyTLSHandshakeError(otherErr))
+}
+
+func TestGetMappedUsername(t *testing.T) {
 	tests := []struct {
-		name       string
-		entry      *ldap.Entry
-		wantResult bool
-		wantErr    string
+		name              string
+		usernameAttribute string
+		stripDomainSuffix bool
+		emptyValuePolicy  EmptyValuePolicy
+		entry             *ldap.Entry
+		wantUsername      string
+		wantError         string
 	}{
 		{
-			name: "happy path where value has not changed since login",
+			name:              "dn",
+			usernameAttribute: "dn",
+			entry:             &ldap.Entry{DN: testUserSearchResultDNValue},
+			wantUsername:      testUserSearchResultDNValue,
+		},
+		{
+			name:              "other attribute",
+			usernameAttribute: testUserSearchUsernameAttribute,
 			entry: &ldap.Entry{
-				DN: "some-dn",
+				DN: "",
 				Attributes: []*ldap.EntryAttribute{
-					{
-						Name:       attributeName,
-						Values:     []string{initialVal},
-						ByteValues: [][]byte{[]byte(initialVal)},
-					},
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
 				},
 			},
+			wantUsername: testUserSearchResultUsernameAttributeValue,
 		},
 		{
-			name: "password has been reset since login",
+			name:              "other attribute which is empty",
+			usernameAttribute: testUserSearchUsernameAttribute,
 			entry: &ldap.Entry{
-				DN: "some-dn",
+				DN: testUserSearchResultDNValue,
 				Attributes: []*ldap.EntryAttribute{
-					{
-						Name:       attributeName,
-						Values:     []string{changedVal},
-						ByteValues: [][]byte{[]byte(changedVal)},
-					},
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{""}),
 				},
 			},
-			wantErr: "value for attribute \"some-attribute-name\" has changed since initial value at login",
+			wantError: fmt.Sprintf(`found empty value for attribute "%s" while searching for user "%s", but expected value to be non-empty`,
+				testUserSearchUsernameAttribute, testUpstreamUsername),
 		},
 		{
-			name: "no value for attribute attribute",
+			name:              "other attribute with its domain suffix stripped",
+			usernameAttribute: "userPrincipalName",
+			stripDomainSuffix: true,
 			entry: &ldap.Entry{
-				DN:         "some-dn",
-				Attributes: []*ldap.EntryAttribute{},
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute("userPrincipalName", []string{"pinny@some.domain@example.com"}),
+				},
 			},
-			wantErr: "expected to find 1 value for \"some-attribute-name\" attribute, but found 0",
+			wantUsername: "pinny@some.domain",
 		},
 		{
-			name: "too many values for attribute",
+			name:              "other attribute without a domain suffix to strip",
+			usernameAttribute: testUserSearchUsernameAttribute,
+			stripDomainSuffix: true,
 			entry: &ldap.Entry{
-				DN: "some-dn",
+				DN: testUserSearchResultDNValue,
 				Attributes: []*ldap.EntryAttribute{
-					{
-						Name:       attributeName,
-						ByteValues: [][]byte{[]byte("val1"), []byte("val2")},
-					},
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
 				},
 			},
-			wantErr: "expected to find 1 value for \"some-attribute-name\" attribute, but found 2",
+			wantUsername: testUserSearchResultUsernameAttributeValue,
+		},
+		{
+			name:              "other attribute which is empty after stripping its domain suffix",
+			usernameAttribute: "userPrincipalName",
+			stripDomainSuffix: true,
+			entry: &ldap.Entry{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute("userPrincipalName", []string{"@example.com"}),
+				},
+			},
+			wantError: fmt.Sprintf(`found empty value for attribute "userPrincipalName" after removing its domain suffix while searching for user "%s", but expected value to be non-empty`,
+				testUpstreamUsername),
+		},
+		{
+			name:              "other attribute which is empty with the empty value policy to skip to the fallback",
+			usernameAttribute: testUserSearchUsernameAttribute,
+			stripDomainSuffix: true,
+			emptyValuePolicy:  EmptyValueSkipToFallback,
+			entry: &ldap.Entry{
+				DN: "cn=some-user@example.com,dc=example,dc=com",
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{""}),
+				},
+			},
+			wantUsername: "cn=some-user@example.com,dc=example,dc=com",
+		},
+		{
+			name:              "other attribute which is missing with the empty value policy to skip to the fallback",
+			usernameAttribute: testUserSearchUsernameAttribute,
+			emptyValuePolicy:  EmptyValueSkipToFallback,
+			entry:             &ldap.Entry{DN: testUserSearchResultDNValue},
+			wantError: fmt.Sprintf(`found 0 values for attribute "%s" while searching for user "%s", but expected 1 result`,
+				testUserSearchUsernameAttribute, testUpstreamUsername),
+		},
+		{
+			name:              "other attribute which is empty with the empty value policy to error",
+			usernameAttribute: testUserSearchUsernameAttribute,
+			emptyValuePolicy:  EmptyValueError,
+			entry: &ldap.Entry{
+				DN: testUserSearchResultDNValue,
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{""}),
+				},
+			},
+			wantError: fmt.Sprintf(`found empty value for attribute "%s" while searching for user "%s", but expected value to be non-empty`,
+				testUserSearchUsernameAttribute, testUpstreamUsername),
 		},
 	}
 	for _, test := range tests {
 		tt := test
 		t.Run(tt.name, func(t *testing.T) {
-			initialValRawEncoded := base64.RawURLEncoding.EncodeToString([]byte(initialVal))
-			err := AttributeUnchangedSinceLogin(attributeName)(tt.entry, provider.RefreshAttributes{AdditionalAttributes: map[string]string{attributeName: initialValRawEncoded}})
-			if tt.wantErr != "" {
-				require.Error(t, err)
-				require.Equal(t, tt.wantErr, err.Error())
+			p := New(ProviderConfig{UserSearch: UserSearchConfig{
+				UsernameAttribute:         tt.usernameAttribute,
+				UsernameStripDomainSuffix: tt.stripDomainSuffix,
+				EmptyValuePolicy:          tt.emptyValuePolicy,
+			}})
+			username, err := p.getMappedUsername(tt.entry, testUpstreamUsername)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantUsername, username)
+		})
+	}
+}
+
+func TestUserSearchFilterConfinesUsername(t *testing.T) {
+	const marker = "pinniped-username-marker"
+
+	// filterShape describes the structure of the compiled filter, replacing the values which are equal to the
+	// username with "{}".
+	var filterShape func(packet *ber.Packet, username string) string
+	filterShape = func(packet *ber.Packet, username string) string {
+		if packet.Tag == ldap.FilterEqualityMatch {
+			require.Len(t, packet.Children, 2)
+			value := packet.Children[1].Data.String()
+			if value == username {
+				value = "{}"
+			}
+			return fmt.Sprintf("(%s=%q)", packet.Children[0].Data.String(), value)
+		}
+		var shape strings.Builder
+		shape.WriteString(fmt.Sprintf("%d[", packet.Tag))
+		for _, child := range packet.Children {
+			shape.WriteString(filterShape(child, username))
+		}
+		shape.WriteString("]")
+		return shape.String()
+	}
+
+	usernames := []string{
+		")", "(", "*", `\`, "\x00", "a\x00b", `\2a`, `\28\29`, "{}", "{}{}", "()()", "))))((((",
+		"*)(uid=*", "admin)(&", "*)(|(objectClass=*", "x)(!(uid=x", "ünïcødé", "ÿĀ",
+	}
+	// deterministic fuzzing of usernames
+	f := fuzz.New().RandSource(rand.NewSource(1)).NilChance(0)
+	for i := 0; i < 1000; i++ {
+		var username string
+		f.Fuzz(&username)
+		if len(username) > 0 {
+			usernames = append(usernames, username)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		userSearch UserSearchConfig
+	}{
+		{
+			name:       "default filter",
+			userSearch: UserSearchConfig{UsernameAttribute: "uid"},
+		},
+		{
+			name:       "default filter with several username search attributes",
+			userSearch: UserSearchConfig{UsernameAttribute: "uid", UsernameSearchAttributes: []string{"uid", "mail"}},
+		},
+		{
+			name:       "filter without parens",
+			userSearch: UserSearchConfig{Filter: "uid={}"},
+		},
+		{
+			name:       "nested filter",
+			userSearch: UserSearchConfig{Filter: "(&(objectClass=person)(uid={}))"},
+		},
+		{
+			name:       "nested filter without outer parens with several placeholders",
+			userSearch: UserSearchConfig{Filter: "&(objectClass=person)(|(uid={})(mail={}))"},
+		},
+		{
+			name:       "deeply nested filter",
+			userSearch: UserSearchConfig{Filter: "(&(objectClass=person)(!(uid={}))(|(mail={})(cn={})))"},
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(ProviderConfig{UserSearch: tt.userSearch})
+
+			markerPacket, err := ldap.CompileFilter(p.userSearchFilter(marker))
+			require.NoError(t, err)
+			wantShape := filterShape(markerPacket, marker)
+			require.Contains(t, wantShape, `"{}"`)
+
+			for _, username := range usernames {
+				filter := p.userSearchFilter(username)
+				packet, err := ldap.CompileFilter(filter)
+				require.NoError(t, err, "username %q resulted in filter %q", username, filter)
+				require.Equal(t, wantShape, filterShape(packet, username), "username %q resulted in filter %q", username, filter)
+			}
+		})
+	}
+}
+
+func TestProviderConfigValidate(t *testing.T) {
+	validConfig := func(editFunc func(c *ProviderConfig)) ProviderConfig {
+		config := ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch: UserSearchConfig{
+				Base:              testUserSearchBase,
+				Filter:            testUserSearchFilter,
+				UsernameAttribute: testUserSearchUsernameAttribute,
+				UIDAttribute:      testUserSearchUIDAttribute,
+			},
+			GroupSearch: GroupSearchConfig{
+				Base:               testGroupSearchBase,
+				Filter:             testGroupSearchFilter,
+				GroupNameAttribute: testGroupSearchGroupNameAttribute,
+			},
+		}
+		if editFunc != nil {
+			editFunc(&config)
+		}
+		return config
+	}
+
+	tests := []struct {
+		name      string
+		config    ProviderConfig
+		wantError string
+	}{
+		{
+			name:   "valid config",
+			config: validConfig(nil),
+		},
+		{
+			name: "valid config with a CA bundle which is read for each connection",
+			config: validConfig(func(c *ProviderConfig) {
+				c.CABundleFunc = func(ctx context.Context) ([]byte, error) { return nil, errors.New("never called") }
+			}),
+		},
+		{
+			name: "invalid TLSVerificationMode",
+			config: validConfig(func(c *ProviderConfig) {
+				c.TLSVerificationMode = "None"
+			}),
+			wantError: `TLSVerificationMode must be "Full", "CAOnly", or "InsecureSkipVerify", but was "None"`,
+		},
+		{
+			name: "more than one CA bundle",
+			config: validConfig(func(c *ProviderConfig) {
+				c.CABundle = []byte("some-ca-bundle")
+				c.CABundlePath = "some-ca-bundle-path"
+			}),
+			wantError: "at most one of CABundle, CABundlePath, and CABundleFunc may be set",
+		},
+		{
+			name: "invalid CA bundle",
+			config: validConfig(func(c *ProviderConfig) {
+				c.CABundle = []byte("not a PEM-encoded certificate")
+			}),
+			wantError: "could not parse CA bundle",
+		},
+		{
+			name: "valid LocalAddr",
+			config: validConfig(func(c *ProviderConfig) {
+				c.LocalAddr = "fd00::1"
+			}),
+		},
+		{
+			name: "invalid LocalAddr",
+			config: validConfig(func(c *ProviderConfig) {
+				c.LocalAddr = "10.0.0.1:389"
+			}),
+			wantError: `LocalAddr "10.0.0.1:389" must be an IP address`,
+		},
+		{
+			name: "dn as the username attribute without a filter",
+			config: validConfig(func(c *ProviderConfig) {
+				c.UserSearch.UsernameAttribute = "dn"
+				c.UserSearch.Filter = ""
+			}),
+			wantError: `must specify UserSearch Filter when UserSearch UsernameAttribute is "dn"`,
+		},
+		{
+			name: "both group name attribute settings",
+			config: validConfig(func(c *ProviderConfig) {
+				c.GroupSearch.GroupNameAttributes = []string{"cn"}
+			}),
+			wantError: `at most one of GroupSearch GroupNameAttribute and GroupNameAttributes may be set`,
+		},
+		{
+			name: "valid bind user search",
+			config: validConfig(func(c *ProviderConfig) {
+				c.BindUserSearch = BindUserSearchConfig{Base: "ou=service-accounts,dc=pinniped,dc=dev", Filter: "uid={}"}
+			}),
+		},
+		{
+			name: "bind user search without a base",
+			config: validConfig(func(c *ProviderConfig) {
+				c.BindUserSearch = BindUserSearchConfig{Filter: "uid={}"}
+			}),
+			wantError: `must specify BindUserSearch Base when BindUserSearch Filter is set`,
+		},
+		{
+			name: "bind user search filter without the bind username",
+			config: validConfig(func(c *ProviderConfig) {
+				c.BindUserSearch = BindUserSearchConfig{Base: "ou=service-accounts,dc=pinniped,dc=dev", Filter: "uid=svc-pinniped"}
+			}),
+			wantError: `BindUserSearch Filter must contain "{}"`,
+		},
+		{
+			name: "UID template without attributes",
+			config: validConfig(func(c *ProviderConfig) {
+				c.UserSearch.UIDAttributeTemplate = "some-template"
+			}),
+			wantError: `UserSearch UIDAttributeTemplate "some-template" must reference at least one attribute using "{attributeName}"`,
+		},
+		{
+			name: "only dn is mapped when a non-DN attribute is required",
+			config: validConfig(func(c *ProviderConfig) {
+				c.UserSearch.UsernameAttribute = "dn"
+				c.UserSearch.UIDAttribute = "dn"
+				c.UserSearch.RequireNonDNAttribute = true
+			}),
+			wantError: `UserSearch RequireNonDNAttribute is true, but both the username and the UID are taken from "dn"`,
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
 			} else {
 				require.NoError(t, err)
 			}
+
+			// The Provider uses the same rules, so that the CR validation and the runtime always agree.
+			providerErr := New(tt.config).validateConfig()
+			if tt.wantError != "" {
+				require.EqualError(t, providerErr, tt.wantError)
+			} else {
+				require.NoError(t, providerErr)
+			}
 		})
 	}
 }
+
+func TestDialFromLocalAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.RemoteAddr()
+		_ = c.Close()
+	}()
+	addr, err := endpointaddr.Parse(listener.Addr().String(), defaultLDAPPort)
+	require.NoError(t, err)
+
+	provider := New(ProviderConfig{LocalAddr: "127.0.0.1"})
+	c, err := provider.dialTCP(context.Background(), addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	require.Equal(t, "127.0.0.1", c.LocalAddr().(*net.TCPAddr).IP.String())
+	require.Equal(t, "127.0.0.1", (<-accepted).(*net.TCPAddr).IP.String())
+
+	provider = New(ProviderConfig{LocalAddr: "not-an-ip-address"})
+	_, err = provider.dialTCP(context.Background(), addr)
+	require.EqualError(t, err, `LocalAddr "not-an-ip-address" must be an IP address`)
+	_, err = provider.dialTLS(context.Background(), addr)
+	require.EqualError(t, err, `LDAP Result Code 200 "Network Error": LocalAddr "not-an-ip-address" must be an IP address`)
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// userBoundConn is a Conn which is bound as an end user. It only allows the operations which are meant to run as
+// the end user, i.e. the "Who am I?" operation and reading the end user's own entry. Other operations fail without
+// reaching the LDAP server, so that an operation which is meant to run as the bind user, e.g. a group search, can
+// never run with the end user's permissions by mistake. Such operations must use the underlying Conn after binding
+// it as the bind user again.
+//
+// It does not embed the Conn on purpose, so that every operation has to be allowed here explicitly.
+type userBoundConn struct {
+	conn   Conn
+	userDN string
+}
+
+var _ Conn = &userBoundConn{}
+
+func (c *userBoundConn) Bind(username, _ string) error {
+	return c.refuse(fmt.Sprintf("bind as %q", username))
+}
+
+func (c *userBoundConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	// Reading the user's own entry is the only search which is meant to run as the user.
+	if searchRequest.Scope != ldap.ScopeBaseObject || !strings.EqualFold(searchRequest.BaseDN, c.userDN) {
+		return nil, c.refuse(fmt.Sprintf("search of base DN %q", searchRequest.BaseDN))
+	}
+	return c.conn.Search(searchRequest)
+}
+
+func (c *userBoundConn) SearchWithPaging(searchRequest *ldap.SearchRequest, _ uint32) (*ldap.SearchResult, error) {
+	return nil, c.refuse(fmt.Sprintf("paged search of base DN %q", searchRequest.BaseDN))
+}
+
+func (c *userBoundConn) WhoAmI(controls []ldap.Control) (*ldap.WhoAmIResult, error) {
+	return c.conn.WhoAmI(controls)
+}
+
+func (c *userBoundConn) Close() {
+	c.conn.Close()
+}
+
+func (c *userBoundConn) refuse(operation string) error {
+	return fmt.Errorf("refusing to run %s on a connection which is bound as the user with DN %q, "+
+		"because it must run as the bind user", operation, c.userDN)
+}
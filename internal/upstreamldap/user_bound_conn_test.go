@@ -0,0 +1,187 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestUserBoundConn(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	ownEntryRequest := &ldap.SearchRequest{BaseDN: "CN=Some User,DC=pinniped,DC=dev", Scope: ldap.ScopeBaseObject}
+	conn := mockldapconn.NewMockConn(ctrl)
+	conn.EXPECT().Search(ownEntryRequest).Return(&ldap.SearchResult{}, nil).Times(1)
+	conn.EXPECT().WhoAmI(nil).Return(&ldap.WhoAmIResult{AuthzID: "u:some-user"}, nil).Times(1)
+	conn.EXPECT().Close().Times(1)
+
+	userConn := &userBoundConn{conn: conn, userDN: "cn=some user,dc=pinniped,dc=dev"}
+
+	// The operations which are meant to run as the user reach the LDAP server.
+	_, err := userConn.Search(ownEntryRequest)
+	require.NoError(t, err)
+	_, err = userConn.WhoAmI(nil)
+	require.NoError(t, err)
+	userConn.Close()
+
+	// The others do not.
+	_, err = userConn.Search(&ldap.SearchRequest{BaseDN: "dc=pinniped,dc=dev", Scope: ldap.ScopeWholeSubtree})
+	require.EqualError(t, err, `refusing to run search of base DN "dc=pinniped,dc=dev" on a connection which is bound `+
+		`as the user with DN "cn=some user,dc=pinniped,dc=dev", because it must run as the bind user`)
+	_, err = userConn.Search(&ldap.SearchRequest{BaseDN: "cn=other user,dc=pinniped,dc=dev", Scope: ldap.ScopeBaseObject})
+	require.EqualError(t, err, `refusing to run search of base DN "cn=other user,dc=pinniped,dc=dev" on a connection which is bound `+
+		`as the user with DN "cn=some user,dc=pinniped,dc=dev", because it must run as the bind user`)
+	_, err = userConn.SearchWithPaging(&ldap.SearchRequest{BaseDN: "ou=groups,dc=pinniped,dc=dev"}, 250)
+	require.EqualError(t, err, `refusing to run paged search of base DN "ou=groups,dc=pinniped,dc=dev" on a connection which is bound `+
+		`as the user with DN "cn=some user,dc=pinniped,dc=dev", because it must run as the bind user`)
+	err = userConn.Bind(testBindUsername, testBindPassword)
+	require.EqualError(t, err, fmt.Sprintf(`refusing to run bind as %q on a connection which is bound `+
+		`as the user with DN "cn=some user,dc=pinniped,dc=dev", because it must run as the bind user`, testBindUsername))
+}
+
+// identityRecordingConn is a Conn which records each operation along with the identity which the connection was
+// bound as when the operation ran.
+type identityRecordingConn struct {
+	boundAs string
+	calls   []string
+}
+
+func (c *identityRecordingConn) Bind(username, _ string) error {
+	c.boundAs = username
+	c.calls = append(c.calls, "Bind as "+username)
+	return nil
+}
+
+func (c *identityRecordingConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.calls = append(c.calls, fmt.Sprintf("Search of %s as %s", searchRequest.BaseDN, c.boundAs))
+	return &ldap.SearchResult{Entries: []*ldap.Entry{{
+		DN: testUserSearchResultDNValue,
+		Attributes: []*ldap.EntryAttribute{
+			ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{testUserSearchResultUsernameAttributeValue}),
+			ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{testUserSearchResultUIDAttributeValue}),
+		},
+	}}}, nil
+}
+
+func (c *identityRecordingConn) SearchWithPaging(searchRequest *ldap.SearchRequest, _ uint32) (*ldap.SearchResult, error) {
+	c.calls = append(c.calls, fmt.Sprintf("SearchWithPaging of %s as %s", searchRequest.BaseDN, c.boundAs))
+	return &ldap.SearchResult{Entries: []*ldap.Entry{{
+		DN: testGroupSearchResultDNValue1,
+		Attributes: []*ldap.EntryAttribute{
+			ldap.NewEntryAttribute(testGroupSearchGroupNameAttribute, []string{testGroupSearchResultGroupNameAttributeValue1}),
+		},
+	}}}, nil
+}
+
+func (c *identityRecordingConn) WhoAmI(_ []ldap.Control) (*ldap.WhoAmIResult, error) {
+	c.calls = append(c.calls, "WhoAmI as "+c.boundAs)
+	return &ldap.WhoAmIResult{AuthzID: "u:some-whoami-username"}, nil
+}
+
+func (c *identityRecordingConn) Close() {
+	c.calls = append(c.calls, "Close")
+}
+
+func TestEndUserAuthenticationRunsOperationsAsTheExpectedIdentity(t *testing.T) {
+	var (
+		bindUserSearch  = fmt.Sprintf("Search of %s as %s", testUserSearchBase, testBindUsername)
+		bindAsBindUser  = "Bind as " + testBindUsername
+		bindAsUser      = "Bind as " + testUserSearchResultDNValue
+		readEntryAsUser = fmt.Sprintf("Search of %s as %s", testUserSearchResultDNValue, testUserSearchResultDNValue)
+		whoAmIAsUser    = "WhoAmI as " + testUserSearchResultDNValue
+		groupSearch     = fmt.Sprintf("SearchWithPaging of %s as %s", testGroupSearchBase, testBindUsername)
+	)
+
+	tests := []struct {
+		name         string
+		editConfig   func(c *ProviderConfig)
+		wantCalls    []string
+		wantUsername string
+	}{
+		{
+			name:         "the groups are searched before the user bind",
+			wantCalls:    []string{bindAsBindUser, bindUserSearch, groupSearch, bindAsUser, "Close"},
+			wantUsername: testUserSearchResultUsernameAttributeValue,
+		},
+		{
+			name: "the groups are searched after the user bind",
+			editConfig: func(c *ProviderConfig) {
+				c.GroupSearch.SearchAfterUserBind = true
+			},
+			wantCalls:    []string{bindAsBindUser, bindUserSearch, bindAsUser, bindAsBindUser, groupSearch, "Close"},
+			wantUsername: testUserSearchResultUsernameAttributeValue,
+		},
+		{
+			name: "the user's entry is read again and the Who am I? operation runs as the user",
+			editConfig: func(c *ProviderConfig) {
+				c.UserSearch.ReadUserEntryAfterBind = true
+				c.UserSearch.UsernameFromWhoAmI = true
+			},
+			wantCalls:    []string{bindAsBindUser, bindUserSearch, groupSearch, bindAsUser, readEntryAsUser, whoAmIAsUser, "Close"},
+			wantUsername: "some-whoami-username",
+		},
+		{
+			name: "the groups are searched as the bind user after the operations which run as the user",
+			editConfig: func(c *ProviderConfig) {
+				c.UserSearch.ReadUserEntryAfterBind = true
+				c.UserSearch.UsernameFromWhoAmI = true
+				c.GroupSearch.SearchAfterUserBind = true
+			},
+			wantCalls: []string{
+				bindAsBindUser, bindUserSearch,
+				bindAsUser, readEntryAsUser, whoAmIAsUser,
+				bindAsBindUser, groupSearch,
+				"Close",
+			},
+			wantUsername: "some-whoami-username",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &identityRecordingConn{}
+			config := ProviderConfig{
+				Name:               "some-provider-name",
+				Host:               testHost,
+				ConnectionProtocol: TLS,
+				BindUsername:       testBindUsername,
+				BindPassword:       testBindPassword,
+				UserSearch: UserSearchConfig{
+					Base:              testUserSearchBase,
+					Filter:            testUserSearchFilter,
+					UsernameAttribute: testUserSearchUsernameAttribute,
+					UIDAttribute:      testUserSearchUIDAttribute,
+				},
+				GroupSearch: GroupSearchConfig{
+					Base:               testGroupSearchBase,
+					Filter:             testGroupSearchFilter,
+					GroupNameAttribute: testGroupSearchGroupNameAttribute,
+				},
+				Dialer: LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+					return conn, nil
+				}),
+			}
+			if tt.editConfig != nil {
+				tt.editConfig(&config)
+			}
+
+			authResponse, authenticated, err := New(config).AuthenticateUser(context.Background(), testUpstreamUsername, testUpstreamPassword, []string{"groups"})
+			require.NoError(t, err)
+			require.True(t, authenticated)
+			require.Equal(t, tt.wantCalls, conn.calls)
+			require.Equal(t, tt.wantUsername, authResponse.User.GetName())
+			require.Equal(t, []string{testGroupSearchResultGroupNameAttributeValue1}, authResponse.User.GetGroups())
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+// defaultUserFacingMessage is used for errors which have no more specific user facing message.
+const defaultUserFacingMessage = "unexpected error during upstream authentication"
+
+// UserFacingMessages maps LDAP result codes, e.g. ldap.LDAPResultInvalidCredentials, to concise messages which may
+// be shown to end users instead of the raw errors, which may be confusing and may reveal details of the LDAP server.
+type UserFacingMessages map[uint16]string
+
+// DefaultUserFacingMessages are the messages used by UserFacingMessage. Callers which want other messages should use
+// a copy with their changes.
+var DefaultUserFacingMessages = UserFacingMessages{
+	ldap.LDAPResultInvalidCredentials:       "invalid username or password",
+	ldap.LDAPResultConstraintViolation:      "password policy not met",
+	ldap.LDAPResultInsufficientAccessRights: "the LDAP identity provider is misconfigured",
+	ldap.LDAPResultTimeLimitExceeded:        "the LDAP server took too long to respond, please try again later",
+	ldap.LDAPResultBusy:                     "the LDAP server is unavailable, please try again later",
+	ldap.LDAPResultUnavailable:              "the LDAP server is unavailable, please try again later",
+	ldap.LDAPResultUnwillingToPerform:       "the LDAP server refused the request",
+	ldap.ErrorNetwork:                       "the LDAP server could not be reached, please try again later",
+}
+
+// UserFacingMessage returns the message from DefaultUserFacingMessages which explains the error to end users.
+func UserFacingMessage(err error) string {
+	return DefaultUserFacingMessages.Message(err)
+}
+
+// UserFacingErrorMessage returns the message from DefaultUserFacingMessages which explains the error to end users.
+// Unlike UserFacingMessage, it explains the account problems which Active Directory refused logins for when the
+// UserFacingAccountStatus of the Provider's config is true.
+func (p *Provider) UserFacingErrorMessage(err error) string {
+	return DefaultUserFacingMessages.message(err, p.c.UserFacingAccountStatus)
+}
+
+// Message returns a concise message which explains the error, e.g. an error returned by AuthenticateUser, to end
+// users. Errors which were classified by the Provider get a message for their classification, and other errors
+// get the message for their LDAP result code, or else a generic message. The raw error is logged at debug level,
+// since it is not part of the message. Account problems which Active Directory refused logins for get the generic
+// message, so that the state of an account is not revealed to anyone who tries to log in as it.
+func (m UserFacingMessages) Message(err error) string {
+	return m.message(err, false)
+}
+
+func (m UserFacingMessages) message(err error, revealAccountStatus bool) string {
+	if err == nil {
+		return ""
+	}
+	plog.DebugErr("translating LDAP error into a user facing message", err)
+
+	if message, ok := classifiedUserFacingMessage(err, revealAccountStatus); ok {
+		return message
+	}
+	ldapErr := &ldap.Error{}
+	if errors.As(err, &ldapErr) {
+		if message, ok := m[ldapErr.ResultCode]; ok {
+			return message
+		}
+	}
+	return defaultUserFacingMessage
+}
+
+// classifiedUserFacingMessage returns the message for errors which were classified by the Provider.
+func classifiedUserFacingMessage(err error, revealAccountStatus bool) (string, bool) {
+	var notTLSErr *NotTLSError
+	var adBindErr *ADBindError
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		// Do not reveal whether the username exists.
+		return "invalid username or password", true
+	case errors.Is(err, ErrCircuitOpen):
+		return "the LDAP server is unavailable, please try again later", true
+	case errors.Is(err, ErrProviderClosed):
+		return "the LDAP identity provider is being reconfigured, please try again", true
+	case errors.As(err, &notTLSErr):
+		return "could not establish a secure connection to the LDAP server", true
+	case errors.As(err, &adBindErr):
+		if !revealAccountStatus {
+			return defaultUserFacingMessage, true
+		}
+		return adBindFailureUserFacingMessage(adBindErr.Reason), true
+	}
+
+	kind, ok := ConnectionErrorKindOf(err)
+	if !ok {
+		return "", false
+	}
+	switch kind {
+	case DialFailed:
+		return "the LDAP server could not be reached, please try again later", true
+	case TLSFailed:
+		return "could not establish a secure connection to the LDAP server", true
+	case ConfigInvalid, BindFailed, SearchBaseNotFound, SearchBaseNotReadable:
+		return "the LDAP identity provider is misconfigured", true
+	default:
+		return "", false
+	}
+}
+
+// adBindFailureUserFacingMessage returns the message for an account which Active Directory refused to let log in.
+func adBindFailureUserFacingMessage(reason ADBindFailureReason) string {
+	switch reason {
+	case ADBindFailureAccountLocked:
+		return "the account is locked, please contact your administrator"
+	case ADBindFailureAccountDisabled, ADBindFailureAccountExpired:
+		return "the account is disabled or expired, please contact your administrator"
+	case ADBindFailurePasswordExpired, ADBindFailurePasswordMustChange:
+		return "the password has expired and must be changed"
+	case ADBindFailureLogonRestricted:
+		return "the account is not allowed to log in at this time or from this location"
+	default:
+		return "invalid username or password"
+	}
+}
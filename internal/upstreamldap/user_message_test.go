@@ -0,0 +1,157 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserFacingMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantMessage string
+	}{
+		{
+			name:        "no error",
+			wantMessage: "",
+		},
+		{
+			name:        "invalid credentials",
+			err:         fmt.Errorf("some context: %w", ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))),
+			wantMessage: "invalid username or password",
+		},
+		{
+			name:        "constraint violation",
+			err:         ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("some bind error")),
+			wantMessage: "password policy not met",
+		},
+		{
+			name:        "network error",
+			err:         ldap.NewError(ldap.ErrorNetwork, errors.New("some network error")),
+			wantMessage: "the LDAP server could not be reached, please try again later",
+		},
+		{
+			name:        "unknown result code",
+			err:         ldap.NewError(ldap.LDAPResultOther, errors.New("some other error")),
+			wantMessage: "unexpected error during upstream authentication",
+		},
+		{
+			name:        "unclassified error",
+			err:         errors.New("some error"),
+			wantMessage: "unexpected error during upstream authentication",
+		},
+		{
+			name:        "user not found does not reveal that the username does not exist",
+			err:         fmt.Errorf("some context: %w", ErrUserNotFound),
+			wantMessage: "invalid username or password",
+		},
+		{
+			name:        "circuit open",
+			err:         ErrCircuitOpen,
+			wantMessage: "the LDAP server is unavailable, please try again later",
+		},
+		{
+			name:        "provider closed",
+			err:         ErrProviderClosed,
+			wantMessage: "the LDAP identity provider is being reconfigured, please try again",
+		},
+		{
+			name:        "not TLS",
+			err:         &NotTLSError{Err: errors.New("some TLS error")},
+			wantMessage: "could not establish a secure connection to the LDAP server",
+		},
+		{
+			name:        "dial failed",
+			err:         &ConnectionError{Kind: DialFailed, Err: ldap.NewError(ldap.ErrorNetwork, errors.New("some dial error"))},
+			wantMessage: "the LDAP server could not be reached, please try again later",
+		},
+		{
+			name:        "TLS failed",
+			err:         &ConnectionError{Kind: TLSFailed, Err: errors.New("some TLS error")},
+			wantMessage: "could not establish a secure connection to the LDAP server",
+		},
+		{
+			name:        "bind failed is classified before its result code",
+			err:         &ConnectionError{Kind: BindFailed, Err: ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))},
+			wantMessage: "the LDAP identity provider is misconfigured",
+		},
+		{
+			name:        "Active Directory account problems do not reveal the state of the account",
+			err:         &ADBindError{Reason: ADBindFailureAccountLocked, Err: ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))},
+			wantMessage: "unexpected error during upstream authentication",
+		},
+		{
+			name:        "search base not readable",
+			err:         &ConnectionError{Kind: SearchBaseNotReadable, Err: ErrUserSearchBaseNotReadable},
+			wantMessage: "the LDAP identity provider is misconfigured",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.wantMessage, UserFacingMessage(tt.err))
+		})
+	}
+}
+
+func TestProviderUserFacingErrorMessage(t *testing.T) {
+	accountLockedErr := &ADBindError{Reason: ADBindFailureAccountLocked, Err: ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))}
+	passwordExpiredErr := &ADBindError{Reason: ADBindFailurePasswordExpired, Err: ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("some bind error"))}
+	dialErr := &ConnectionError{Kind: DialFailed, Err: ldap.NewError(ldap.ErrorNetwork, errors.New("some dial error"))}
+
+	tests := []struct {
+		name                    string
+		userFacingAccountStatus bool
+		err                     error
+		wantMessage             string
+	}{
+		{
+			name:        "account problems get the generic message by default",
+			err:         accountLockedErr,
+			wantMessage: "unexpected error during upstream authentication",
+		},
+		{
+			name:                    "account is locked when configured to tell users about their account",
+			userFacingAccountStatus: true,
+			err:                     accountLockedErr,
+			wantMessage:             "the account is locked, please contact your administrator",
+		},
+		{
+			name:                    "password has expired when configured to tell users about their account",
+			userFacingAccountStatus: true,
+			err:                     passwordExpiredErr,
+			wantMessage:             "the password has expired and must be changed",
+		},
+		{
+			name:        "other errors get their messages by default",
+			err:         dialErr,
+			wantMessage: "the LDAP server could not be reached, please try again later",
+		},
+	}
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(ProviderConfig{UserFacingAccountStatus: tt.userFacingAccountStatus})
+			require.Equal(t, tt.wantMessage, p.UserFacingErrorMessage(tt.err))
+		})
+	}
+}
+
+func TestUserFacingMessagesOverrides(t *testing.T) {
+	messages := UserFacingMessages{}
+	for code, message := range DefaultUserFacingMessages {
+		messages[code] = message
+	}
+	messages[ldap.LDAPResultConstraintViolation] = "your password has expired, please change it"
+
+	err := ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("some bind error"))
+	require.Equal(t, "your password has expired, please change it", messages.Message(err))
+	require.Equal(t, "password policy not met", UserFacingMessage(err), "the defaults must not change")
+}
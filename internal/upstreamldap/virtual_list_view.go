@@ -0,0 +1,242 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"k8s.io/utils/trace"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// See https://datatracker.ietf.org/doc/html/rfc2891.
+	controlTypeServerSideSort = "1.2.840.113556.1.4.473"
+
+	// See https://datatracker.ietf.org/doc/html/draft-ietf-ldapext-ldapv3-vlv-09.
+	controlTypeVLVRequest  = "2.16.840.1.113730.3.4.9"
+	controlTypeVLVResponse = "2.16.840.1.113730.3.4.10"
+
+	// maxListUsersRangeCount is the maximum number of users returned by one call to ListUsersRange.
+	maxListUsersRangeCount = 250
+
+	// maxListUsersRangeFallbackEnd is the maximum end of the range when the LDAP server does not support virtual
+	// list views, since all users up to the end of the range must then be read.
+	maxListUsersRangeFallbackEnd = 1000
+)
+
+// errVLVNotSupported means that the LDAP server did not perform a virtual list view search.
+var errVLVNotSupported = errors.New("the LDAP server does not support virtual list views")
+
+// UserRange is a range of the users found by ListUsersRange.
+type UserRange struct {
+	// Users are the users in the range.
+	Users []UserSummary
+
+	// Total is the LDAP server's estimate of the number of matching users, or -1 when it is not known because the
+	// LDAP server does not support virtual list views.
+	Total int
+}
+
+// ListUsersRange is an admin-only operation like ListUsers, which returns at most count users starting at the
+// 1-based offset within all matching users, so that tooling can page through the users of a large directory without
+// reading all of them. It uses the virtual list view control, which requires sorting the users by their
+// UsernameAttribute. When the LDAP server does not support virtual list views, or when the UsernameAttribute is "dn",
+// it falls back to reading all users up to the end of the range using simple paging, in which case the users are in
+// the LDAP server's order and the end of the range (offset+count-1) must be at most 1000. The count must be at most
+// 250, to bound the load on the LDAP server.
+func (p *Provider) ListUsersRange(ctx context.Context, username string, offset, count int) (*UserRange, error) {
+	if err := p.beginOperation(ctx); err != nil {
+		return nil, err
+	}
+	defer p.endOperation()
+
+	t := trace.FromContext(ctx).Nest("slow ldap list users range attempt", trace.Field{Key: "providerName", Value: p.GetName()})
+	defer t.LogIfLong(500 * time.Millisecond) // to help users debug slow LDAP searches
+
+	if offset < 1 {
+		return nil, fmt.Errorf("offset must be at least 1, but was %d", offset)
+	}
+	if count < 1 || count > maxListUsersRangeCount {
+		return nil, fmt.Errorf("count must be between 1 and %d, but was %d", maxListUsersRangeCount, count)
+	}
+
+	conn, err := p.dialAndBind(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	safeValue := p.listUsersSafeValue(username)
+
+	// LDAP servers cannot sort by DN, which is required for virtual list views.
+	if p.c.UserSearch.UsernameAttribute != distinguishedNameAttributeName {
+		userRange, err := p.searchForUserRangeWithVLV(conn, safeValue, offset, count)
+		if !errors.Is(err, errVLVNotSupported) {
+			return userRange, err
+		}
+		plog.Debug("LDAP server does not support virtual list views, falling back to simple paging", "upstreamName", p.GetName())
+	}
+
+	end := offset + count - 1
+	if end > maxListUsersRangeFallbackEnd {
+		return nil, fmt.Errorf("%w, so the end of the range must be at most %d, but was %d", errVLVNotSupported, maxListUsersRangeFallbackEnd, end)
+	}
+	entries, err := p.pagedSearchForUsers(conn, safeValue, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) < offset {
+		entries = nil
+	} else {
+		entries = entries[offset-1:]
+	}
+	users, err := p.userSummaries(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &UserRange{Users: users, Total: -1}, nil
+}
+
+// searchForUserRangeWithVLV returns errVLVNotSupported when the LDAP server did not perform a virtual list view search.
+func (p *Provider) searchForUserRangeWithVLV(conn Conn, safeValue string, offset, count int) (*UserRange, error) {
+	request := p.listUsersRequest(safeValue, count)
+	request.Controls = []ldap.Control{
+		&controlServerSideSort{AttributeType: p.c.UserSearch.UsernameAttribute},
+		&controlVLVRequest{AfterCount: count - 1, Offset: offset},
+	}
+
+	searchResult, err := conn.Search(request)
+	if err != nil {
+		ldapErr := &ldap.Error{}
+		if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultUnavailableCriticalExtension {
+			return nil, errVLVNotSupported
+		}
+		return nil, fmt.Errorf(`error searching for users: %w`, err)
+	}
+
+	response, err := findVLVResponse(searchResult.Controls)
+	if err != nil {
+		return nil, fmt.Errorf(`error searching for users: %w`, err)
+	}
+	if response == nil {
+		// The LDAP server ignored the controls.
+		return nil, errVLVNotSupported
+	}
+	if response.Result != ldap.LDAPResultSuccess {
+		return nil, fmt.Errorf(`error searching for users: virtual list view failed with result code %d`, response.Result)
+	}
+	if err := p.checkSearchResultEntrySizes(searchResult); err != nil {
+		return nil, fmt.Errorf(`error searching for users: %w`, err)
+	}
+
+	entries := searchResult.Entries
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	users, err := p.userSummaries(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &UserRange{Users: users, Total: response.ContentCount}, nil
+}
+
+// controlServerSideSort is a critical server side sort request control which sorts by one attribute, since the
+// go-ldap library does not implement it.
+type controlServerSideSort struct {
+	AttributeType string
+}
+
+func (c *controlServerSideSort) GetControlType() string {
+	return controlTypeServerSideSort
+}
+
+func (c *controlServerSideSort) Encode() *ber.Packet {
+	sortKey := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKey")
+	sortKey.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, c.AttributeType, "attributeType"))
+	sortKeyList := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeyList")
+	sortKeyList.AppendChild(sortKey)
+	return encodeCriticalControl(controlTypeServerSideSort, sortKeyList)
+}
+
+func (c *controlServerSideSort) String() string {
+	return fmt.Sprintf("Control Type: Server Side Sort (%q)  Criticality: true  Attribute Type: %q", controlTypeServerSideSort, c.AttributeType)
+}
+
+// controlVLVRequest is a critical virtual list view request control which selects the target entry by its 1-based
+// offset, since the go-ldap library does not implement it.
+type controlVLVRequest struct {
+	AfterCount int
+	Offset     int
+}
+
+func (c *controlVLVRequest) GetControlType() string {
+	return controlTypeVLVRequest
+}
+
+func (c *controlVLVRequest) Encode() *ber.Packet {
+	byOffset := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "byOffset")
+	byOffset.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(c.Offset), "offset"))
+	// A contentCount of zero means that the client does not know the number of entries.
+	byOffset.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "contentCount"))
+	request := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewRequest")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "beforeCount"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(c.AfterCount), "afterCount"))
+	request.AppendChild(byOffset)
+	return encodeCriticalControl(controlTypeVLVRequest, request)
+}
+
+func (c *controlVLVRequest) String() string {
+	return fmt.Sprintf("Control Type: Virtual List View Request (%q)  Criticality: true  After Count: %d  Offset: %d", controlTypeVLVRequest, c.AfterCount, c.Offset)
+}
+
+func encodeCriticalControl(controlType string, value *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlType, "Control Type"))
+	packet.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	controlValue := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value")
+	controlValue.AppendChild(value)
+	packet.AppendChild(controlValue)
+	return packet
+}
+
+// vlvResponse is the decoded value of a virtual list view response control.
+type vlvResponse struct {
+	TargetPosition int
+	ContentCount   int
+	Result         uint16
+}
+
+// findVLVResponse returns nil when there is no virtual list view response control. Since the go-ldap library does not
+// implement this control, it decodes it as an ldap.ControlString holding the raw control value.
+func findVLVResponse(controls []ldap.Control) (*vlvResponse, error) {
+	control := ldap.FindControl(controls, controlTypeVLVResponse)
+	if control == nil {
+		return nil, nil
+	}
+	controlString, ok := control.(*ldap.ControlString)
+	if !ok {
+		return nil, fmt.Errorf("could not parse virtual list view response control of type %T", control)
+	}
+	packet, err := ber.DecodePacketErr([]byte(controlString.ControlValue))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse virtual list view response control: %w", err)
+	}
+	if len(packet.Children) < 3 {
+		return nil, fmt.Errorf("could not parse virtual list view response control: expected at least 3 values but found %d", len(packet.Children))
+	}
+	targetPosition, ok1 := packet.Children[0].Value.(int64)
+	contentCount, ok2 := packet.Children[1].Value.(int64)
+	result, ok3 := packet.Children[2].Value.(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("could not parse virtual list view response control: expected integer values")
+	}
+	return &vlvResponse{TargetPosition: int(targetPosition), ContentCount: int(contentCount), Result: uint16(result)}, nil
+}
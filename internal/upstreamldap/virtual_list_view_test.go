@@ -0,0 +1,359 @@
+// Copyright 2022 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package upstreamldap
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/endpointaddr"
+	"go.pinniped.dev/internal/mocks/mockldapconn"
+)
+
+func TestListUsersRange(t *testing.T) {
+	providerConfig := func(editFunc func(p *ProviderConfig)) *ProviderConfig {
+		config := &ProviderConfig{
+			Name:               "some-provider-name",
+			Host:               testHost,
+			ConnectionProtocol: TLS,
+			BindUsername:       testBindUsername,
+			BindPassword:       testBindPassword,
+			UserSearch: UserSearchConfig{
+				Base:              testUserSearchBase,
+				Filter:            testUserSearchFilter,
+				UsernameAttribute: testUserSearchUsernameAttribute,
+				UIDAttribute:      testUserSearchUIDAttribute,
+			},
+		}
+		if editFunc != nil {
+			editFunc(config)
+		}
+		return config
+	}
+
+	const allUsersFilter = "(some-user-filter=*-and-more-filter=*)"
+
+	expectedSearch := func(limit int, controls ...ldap.Control) *ldap.SearchRequest {
+		return &ldap.SearchRequest{
+			BaseDN:       testUserSearchBase,
+			Scope:        ldap.ScopeWholeSubtree,
+			DerefAliases: ldap.NeverDerefAliases,
+			SizeLimit:    limit,
+			TimeLimit:    90,
+			TypesOnly:    false,
+			Filter:       allUsersFilter,
+			Attributes:   []string{testUserSearchUsernameAttribute, testUserSearchUIDAttribute},
+			Controls:     controls,
+		}
+	}
+
+	expectedVLVSearch := func(offset, count int) *ldap.SearchRequest {
+		return expectedSearch(count,
+			&controlServerSideSort{AttributeType: testUserSearchUsernameAttribute},
+			&controlVLVRequest{AfterCount: count - 1, Offset: offset},
+		)
+	}
+
+	userEntries := func(from, to int) []*ldap.Entry {
+		entries := []*ldap.Entry{}
+		for i := from; i <= to; i++ {
+			entries = append(entries, &ldap.Entry{
+				DN: fmt.Sprintf("some-user-dn-%d", i),
+				Attributes: []*ldap.EntryAttribute{
+					ldap.NewEntryAttribute(testUserSearchUsernameAttribute, []string{fmt.Sprintf("some-username-%d", i)}),
+					ldap.NewEntryAttribute(testUserSearchUIDAttribute, []string{fmt.Sprintf("some-uid-%d", i)}),
+				},
+			})
+		}
+		return entries
+	}
+
+	userSummaries := func(from, to int) []UserSummary {
+		users := []UserSummary{}
+		for i := from; i <= to; i++ {
+			users = append(users, UserSummary{
+				Username: fmt.Sprintf("some-username-%d", i),
+				UID:      base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("some-uid-%d", i))),
+				DN:       fmt.Sprintf("some-user-dn-%d", i),
+			})
+		}
+		return users
+	}
+
+	tests := []struct {
+		name           string
+		providerConfig *ProviderConfig
+		offset         int
+		count          int
+		setupMocks     func(conn *mockldapconn.MockConn)
+		wantToSkipDial bool
+		wantRange      *UserRange
+		wantError      string
+	}{
+		{
+			name:           "virtual list view",
+			providerConfig: providerConfig(nil),
+			offset:         11,
+			count:          3,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(11, 3)).Return(&ldap.SearchResult{
+					Entries:  userEntries(11, 13),
+					Controls: []ldap.Control{vlvResponseControl(11, 42, ldap.LDAPResultSuccess)},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantRange: &UserRange{Users: userSummaries(11, 13), Total: 42},
+		},
+		{
+			name:           "virtual list view beyond the last user",
+			providerConfig: providerConfig(nil),
+			offset:         41,
+			count:          3,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(41, 3)).Return(&ldap.SearchResult{
+					Entries:  userEntries(41, 42),
+					Controls: []ldap.Control{vlvResponseControl(41, 42, ldap.LDAPResultSuccess)},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantRange: &UserRange{Users: userSummaries(41, 42), Total: 42},
+		},
+		{
+			name:           "virtual list view fails",
+			providerConfig: providerConfig(nil),
+			offset:         1,
+			count:          3,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(1, 3)).Return(&ldap.SearchResult{
+					Controls: []ldap.Control{vlvResponseControl(0, 0, 61)},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: "error searching for users: virtual list view failed with result code 61",
+		},
+		{
+			name:           "invalid virtual list view response control",
+			providerConfig: providerConfig(nil),
+			offset:         1,
+			count:          3,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(1, 3)).Return(&ldap.SearchResult{
+					Controls: []ldap.Control{ldap.NewControlString(controlTypeVLVResponse, false,
+						string(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewResponse").Bytes()))},
+				}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: "error searching for users: could not parse virtual list view response control: expected at least 3 values but found 0",
+		},
+		{
+			name:           "search error",
+			providerConfig: providerConfig(nil),
+			offset:         1,
+			count:          3,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(1, 3)).Return(nil, errors.New("some search error")).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: "error searching for users: some search error",
+		},
+		{
+			name:           "LDAP server does not support the critical controls, so falls back to simple paging",
+			providerConfig: providerConfig(nil),
+			offset:         3,
+			count:          2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(3, 2)).
+					Return(nil, ldap.NewError(ldap.LDAPResultUnavailableCriticalExtension, errors.New("critical extension is unavailable"))).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedSearch(4), uint32(4)).
+					Return(&ldap.SearchResult{Entries: userEntries(1, 4)}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantRange: &UserRange{Users: userSummaries(3, 4), Total: -1},
+		},
+		{
+			name:           "LDAP server ignores the controls, so falls back to simple paging",
+			providerConfig: providerConfig(nil),
+			offset:         3,
+			count:          2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(3, 2)).Return(&ldap.SearchResult{Entries: userEntries(1, 2)}, nil).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedSearch(4), uint32(4)).
+					Return(&ldap.SearchResult{Entries: userEntries(1, 3)}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantRange: &UserRange{Users: userSummaries(3, 3), Total: -1},
+		},
+		{
+			name:           "simple paging beyond the last user",
+			providerConfig: providerConfig(nil),
+			offset:         5,
+			count:          2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(5, 2)).
+					Return(nil, ldap.NewError(ldap.LDAPResultUnavailableCriticalExtension, errors.New("critical extension is unavailable"))).Times(1)
+				conn.EXPECT().SearchWithPaging(expectedSearch(6), uint32(6)).
+					Return(&ldap.SearchResult{Entries: userEntries(1, 3)}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantRange: &UserRange{Users: []UserSummary{}, Total: -1},
+		},
+		{
+			name:           "simple paging is bounded",
+			providerConfig: providerConfig(nil),
+			offset:         900,
+			count:          200,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().Search(expectedVLVSearch(900, 200)).
+					Return(nil, ldap.NewError(ldap.LDAPResultUnavailableCriticalExtension, errors.New("critical extension is unavailable"))).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantError: "the LDAP server does not support virtual list views, so the end of the range must be at most 1000, but was 1099",
+		},
+		{
+			name: "username attribute is dn, so uses simple paging",
+			providerConfig: providerConfig(func(p *ProviderConfig) {
+				p.UserSearch.UsernameAttribute = "dn"
+			}),
+			offset: 2,
+			count:  2,
+			setupMocks: func(conn *mockldapconn.MockConn) {
+				conn.EXPECT().Bind(testBindUsername, testBindPassword).Times(1)
+				conn.EXPECT().SearchWithPaging(gomock.Any(), uint32(3)).
+					Return(&ldap.SearchResult{Entries: userEntries(1, 3)}, nil).Times(1)
+				conn.EXPECT().Close().Times(1)
+			},
+			wantRange: &UserRange{
+				Users: []UserSummary{
+					{Username: "some-user-dn-2", UID: userSummaries(2, 2)[0].UID, DN: "some-user-dn-2"},
+					{Username: "some-user-dn-3", UID: userSummaries(3, 3)[0].UID, DN: "some-user-dn-3"},
+				},
+				Total: -1,
+			},
+		},
+		{
+			name:           "offset is not positive",
+			providerConfig: providerConfig(nil),
+			offset:         0,
+			count:          2,
+			wantToSkipDial: true,
+			wantError:      "offset must be at least 1, but was 0",
+		},
+		{
+			name:           "count is not positive",
+			providerConfig: providerConfig(nil),
+			offset:         1,
+			count:          0,
+			wantToSkipDial: true,
+			wantError:      "count must be between 1 and 250, but was 0",
+		},
+		{
+			name:           "count is too large",
+			providerConfig: providerConfig(nil),
+			offset:         1,
+			count:          251,
+			wantToSkipDial: true,
+			wantError:      "count must be between 1 and 250, but was 251",
+		},
+	}
+
+	for _, test := range tests {
+		tt := test
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			conn := mockldapconn.NewMockConn(ctrl)
+			if tt.setupMocks != nil {
+				tt.setupMocks(conn)
+			}
+
+			dialWasAttempted := false
+			tt.providerConfig.Dialer = LDAPDialerFunc(func(ctx context.Context, addr endpointaddr.HostPort) (Conn, error) {
+				dialWasAttempted = true
+				return conn, nil
+			})
+
+			userRange, err := New(*tt.providerConfig).ListUsersRange(context.Background(), "", tt.offset, tt.count)
+			require.Equal(t, !tt.wantToSkipDial, dialWasAttempted)
+			if tt.wantError != "" {
+				require.EqualError(t, err, tt.wantError)
+				require.Nil(t, userRange)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantRange, userRange)
+		})
+	}
+}
+
+func TestVirtualListViewControlEncoding(t *testing.T) {
+	decodeControl := func(control ldap.Control) (string, bool, *ber.Packet) {
+		packet, err := ber.DecodePacketErr(control.Encode().Bytes())
+		require.NoError(t, err)
+		require.Len(t, packet.Children, 3)
+		value, err := ber.DecodePacketErr(packet.Children[2].Data.Bytes())
+		require.NoError(t, err)
+		return packet.Children[0].Value.(string), packet.Children[1].Value.(bool), value
+	}
+
+	controlType, criticality, value := decodeControl(&controlServerSideSort{AttributeType: "some-attribute"})
+	require.Equal(t, "1.2.840.113556.1.4.473", controlType)
+	require.True(t, criticality)
+	require.Len(t, value.Children, 1)
+	require.Len(t, value.Children[0].Children, 1)
+	require.Equal(t, "some-attribute", value.Children[0].Children[0].Value)
+
+	controlType, criticality, value = decodeControl(&controlVLVRequest{AfterCount: 9, Offset: 21})
+	require.Equal(t, "2.16.840.1.113730.3.4.9", controlType)
+	require.True(t, criticality)
+	require.Len(t, value.Children, 3)
+	require.Equal(t, int64(0), value.Children[0].Value) // beforeCount
+	require.Equal(t, int64(9), value.Children[1].Value) // afterCount
+	byOffset := value.Children[2]
+	require.Equal(t, ber.ClassContext, byOffset.ClassType)
+	require.Equal(t, ber.Tag(0), byOffset.Tag)
+	require.Len(t, byOffset.Children, 2)
+	require.Equal(t, int64(21), byOffset.Children[0].Value) // offset
+	require.Equal(t, int64(0), byOffset.Children[1].Value)  // contentCount
+}
+
+func TestFindVLVResponse(t *testing.T) {
+	response, err := findVLVResponse([]ldap.Control{ldap.NewControlPaging(0), vlvResponseControl(3, 42, 0)})
+	require.NoError(t, err)
+	require.Equal(t, &vlvResponse{TargetPosition: 3, ContentCount: 42, Result: 0}, response)
+
+	response, err = findVLVResponse([]ldap.Control{ldap.NewControlPaging(0)})
+	require.NoError(t, err)
+	require.Nil(t, response)
+
+	_, err = findVLVResponse([]ldap.Control{ldap.NewControlString(controlTypeVLVResponse, false, "not ber")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not parse virtual list view response control")
+}
+
+// vlvResponseControl returns a virtual list view response control like the go-ldap library would decode it.
+func vlvResponseControl(targetPosition, contentCount, result int64) ldap.Control {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewResponse")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, targetPosition, "targetPosition"))
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, contentCount, "contentCount"))
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, result, "virtualListViewResult"))
+	return ldap.NewControlString(controlTypeVLVResponse, false, string(value.Bytes()))
+}